@@ -1,20 +1,51 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"image"
 	"image/color"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net"
+	"net/url"
 	"os"
-
-	_ "github.com/chai2010/webp"
-	_ "github.com/strukturag/libheif/go/heif"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chai2010/webp"
+	"github.com/strukturag/libheif/go/heif"
 )
 
 const (
@@ -23,6 +54,13 @@ const (
 	ExitFileNotFound    = 2
 	ExitInvalidFormat   = 3
 	ExitProcessingError = 4
+	ExitWarning         = 5
+)
+
+const (
+	ConfidenceAuthoritative = "authoritative"
+	ConfidenceHeuristic     = "heuristic"
+	ConfidenceDefault       = "default"
 )
 
 type ColorModel int
@@ -33,6 +71,7 @@ const (
 	ColorModelYCbCr
 	ColorModelGrayscale
 	ColorModelIndexed
+	ColorModelCMYK
 )
 
 func (cm ColorModel) String() string {
@@ -45,6 +84,8 @@ func (cm ColorModel) String() string {
 		return "Grayscale"
 	case ColorModelIndexed:
 		return "Indexed"
+	case ColorModelCMYK:
+		return "CMYK"
 	default:
 		return "Unknown"
 	}
@@ -63,6 +104,8 @@ const (
 	ColorSpaceBT709
 	ColorSpaceBT2020
 	ColorSpaceDisplayP3
+	ColorSpaceUntagged
+	ColorSpaceGray
 )
 
 func (cs ColorSpace) String() string {
@@ -77,6 +120,10 @@ func (cs ColorSpace) String() string {
 		return "BT.2020"
 	case ColorSpaceDisplayP3:
 		return "Display P3"
+	case ColorSpaceUntagged:
+		return "Untagged"
+	case ColorSpaceGray:
+		return "Gray"
 	default:
 		return "Unknown"
 	}
@@ -93,6 +140,7 @@ const (
 	HDRPQ
 	HDRHLG
 	HDRLimited
+	HDRLinear
 )
 
 func (h HDRType) String() string {
@@ -103,6 +151,8 @@ func (h HDRType) String() string {
 		return "HLG (ARIB STD-B67)"
 	case HDRLimited:
 		return "Limited"
+	case HDRLinear:
+		return "Linear (scene-referred)"
 	case HDRNone:
 		return "None"
 	default:
@@ -114,6 +164,22 @@ func (h HDRType) MarshalJSON() ([]byte, error) {
 	return json.Marshal(h.String())
 }
 
+func (h *HDRType) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	for _, candidate := range []HDRType{HDRNone, HDRPQ, HDRHLG, HDRLimited, HDRLinear} {
+		if candidate.String() == s {
+			*h = candidate
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown HDR type %q", s)
+}
+
 type ChromaSubsampling int
 
 const (
@@ -122,6 +188,8 @@ const (
 	ChromaSubsampling422
 	ChromaSubsampling420
 	ChromaSubsamplingUnknown
+	ChromaSubsampling411
+	ChromaSubsampling440
 )
 
 func (cs ChromaSubsampling) String() string {
@@ -132,6 +200,10 @@ func (cs ChromaSubsampling) String() string {
 		return "4:2:2"
 	case ChromaSubsampling420:
 		return "4:2:0"
+	case ChromaSubsampling411:
+		return "4:1:1"
+	case ChromaSubsampling440:
+		return "4:4:0"
 	case ChromaSubsamplingNA:
 		return "N/A"
 	default:
@@ -143,6 +215,22 @@ func (cs ChromaSubsampling) MarshalJSON() ([]byte, error) {
 	return json.Marshal(cs.String())
 }
 
+func (cs *ChromaSubsampling) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	for _, candidate := range []ChromaSubsampling{ChromaSubsamplingNA, ChromaSubsampling444, ChromaSubsampling422, ChromaSubsampling420, ChromaSubsampling411, ChromaSubsampling440, ChromaSubsamplingUnknown} {
+		if candidate.String() == s {
+			*cs = candidate
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown chroma subsampling %q", s)
+}
+
 type CompressionType int
 
 const (
@@ -150,6 +238,7 @@ const (
 	CompressionLossless
 	CompressionLossy
 	CompressionHybrid
+	CompressionNotApplicable
 )
 
 func (ct CompressionType) String() string {
@@ -160,6 +249,8 @@ func (ct CompressionType) String() string {
 		return "Lossy"
 	case CompressionHybrid:
 		return "Lossy/Lossless"
+	case CompressionNotApplicable:
+		return "N/A"
 	default:
 		return "Unknown"
 	}
@@ -170,55 +261,335 @@ func (ct CompressionType) MarshalJSON() ([]byte, error) {
 }
 
 type ImageInfo struct {
-	Format            string            `json:"format"`
-	Width             int               `json:"width"`
-	Height            int               `json:"height"`
-	ColorModel        ColorModel        `json:"color_model"`
-	ColorSpace        ColorSpace        `json:"color_space"`
-	BitDepth          int               `json:"bit_depth"`
-	HasAlpha          bool              `json:"has_alpha"`
-	HasICCProfile     bool              `json:"has_icc_profile"`
-	ICCProfileSize    int               `json:"icc_profile_size,omitempty"`
-	HDRType           HDRType           `json:"hdr_type"`
-	ChromaSubsampling ChromaSubsampling `json:"chroma_subsampling"`
-	CompressionType   CompressionType   `json:"compression_type"`
-	OriginalSize      int64             `json:"original_size_bytes"`
-	DecodedSize       int64             `json:"decoded_size_bytes"`
-	CompressionRatio  float64           `json:"compression_ratio"`
+	Filename               string            `json:"filename,omitempty"`
+	Format                 string            `json:"format"`
+	Width                  int               `json:"width"`
+	Height                 int               `json:"height"`
+	Megapixels             float64           `json:"megapixels"`
+	PixelAspectRatio       float64           `json:"pixel_aspect_ratio"`
+	DisplayWidth           int               `json:"display_width,omitempty"`
+	DisplayHeight          int               `json:"display_height,omitempty"`
+	ColorModel             ColorModel        `json:"color_model"`
+	ColorSpace             ColorSpace        `json:"color_space"`
+	CICP                   *CICPValues       `json:"cicp,omitempty"`
+	BitDepth               int               `json:"bit_depth"`
+	ChannelBitDepths       []int             `json:"channel_bit_depths,omitempty"`
+	UniformBitDepth        bool              `json:"uniform_bit_depth"`
+	BitsPerPixel           int               `json:"bits_per_pixel"`
+	BitsPerPixelStored     float64           `json:"bits_per_pixel_stored"`
+	ChannelCount           int               `json:"channel_count,omitempty"`
+	HasAlpha               bool              `json:"has_alpha"`
+	PremultipliedAlpha     bool              `json:"premultiplied_alpha,omitempty"`
+	HasGainMap             bool              `json:"has_gain_map,omitempty"`
+	WideGamut              bool              `json:"wide_gamut,omitempty"`
+	IsVector               bool              `json:"is_vector,omitempty"`
+	HasICCProfile          bool              `json:"has_icc_profile"`
+	ICCProfileSize         int               `json:"icc_profile_size,omitempty"`
+	HasXMP                 bool              `json:"has_xmp"`
+	XMPSize                int               `json:"xmp_size,omitempty"`
+	PaletteSize            int               `json:"palette_size,omitempty"`
+	EmbeddedThumbnailBytes int               `json:"embedded_thumbnail_bytes,omitempty"`
+	DPIX                   int               `json:"dpi_x,omitempty"`
+	DPIY                   int               `json:"dpi_y,omitempty"`
+	DensityUnit            string            `json:"density_unit,omitempty"`
+	RestartInterval        int               `json:"restart_interval,omitempty"`
+	HDRType                HDRType           `json:"hdr_type"`
+	ChromaSubsampling      ChromaSubsampling `json:"chroma_subsampling"`
+	CompressionType        CompressionType   `json:"compression_type"`
+	Codec                  string            `json:"codec,omitempty"`
+	FrameCount             int               `json:"frame_count,omitempty"`
+	LoopCount              *int              `json:"loop_count,omitempty"`
+	MipmapCount            int               `json:"mipmap_count,omitempty"`
+	Tiled                  bool              `json:"tiled,omitempty"`
+	TileCount              int               `json:"tile_count,omitempty"`
+	OriginalSize           int64             `json:"original_size_bytes"`
+	Truncated              bool              `json:"truncated,omitempty"`
+	MissingBytes           int64             `json:"missing_bytes,omitempty"`
+	TrailingBytes          int64             `json:"trailing_bytes,omitempty"`
+	EffectiveOriginalSize  int64             `json:"effective_original_size_bytes,omitempty"`
+	DecodedSize            int64             `json:"decoded_size_bytes"`
+	CompressionRatio       float64           `json:"compression_ratio"`
+	ContentHash            string            `json:"content_hash,omitempty"`
+	PerceptualHash         string            `json:"perceptual_hash,omitempty"`
+	EffectivelyGrayscale   bool              `json:"effectively_grayscale,omitempty"`
+	DistinctColors         int               `json:"distinct_colors,omitempty"`
+	DecodeDurationMs       float64           `json:"decode_duration_ms,omitempty"`
+	ReencodedFormat        string            `json:"reencoded_format,omitempty"`
+	ReencodedSize          int64             `json:"reencoded_size_bytes,omitempty"`
+	ProjectedSavings       float64           `json:"projected_savings,omitempty"`
+	GPUTextureBytes        int64             `json:"gpu_texture_bytes,omitempty"`
+	BudgetExceeded         bool              `json:"budget_exceeded,omitempty"`
+	Warning                string            `json:"warning,omitempty"`
+	Confidence             map[string]string `json:"confidence,omitempty"`
+	ScaledSizes            map[int]int64     `json:"scaled_sizes,omitempty"`
+	EmbeddedImages         []ImageInfo       `json:"embedded_images,omitempty"`
+	Explanation            []string          `json:"-"`
+}
+
+func init() {
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeUnsupported, decodeICOConfig)
+	image.RegisterFormat("exr", "\x76\x2f\x31\x01", decodeUnsupported, decodeEXRConfig)
+	image.RegisterFormat("hdr", "#?RADIANCE", decodeUnsupported, decodeRadianceConfig)
+	image.RegisterFormat("hdr", "#?RGBE", decodeUnsupported, decodeRadianceConfig)
+	image.RegisterFormat("heif", "????ftypmsf1", decodeUnsupported, decodeHEIFSequenceConfig)
+	image.RegisterFormat("avif", "????ftypavis", decodeUnsupported, decodeHEIFSequenceConfig)
+	image.RegisterFormat("dds", "DDS ", decodeUnsupported, decodeDDSConfig)
+	image.RegisterFormat("jp2", jp2Signature, decodeUnsupported, decodeJPEG2000Config)
+	image.RegisterFormat("jp2", j2kSignature, decodeUnsupported, decodeJPEG2000Config)
+	image.RegisterFormat("tiff", "II*\x00", decodeUnsupported, decodeTIFFConfig)
+	image.RegisterFormat("tiff", "MM\x00*", decodeUnsupported, decodeTIFFConfig)
+	image.RegisterFormat("svg", "<svg", decodeUnsupported, decodeSVGConfig)
+}
+
+var errDecodeUnsupported = errors.New("image: decoding is unsupported for this format")
+
+func decodeUnsupported(r io.Reader) (image.Image, error) {
+	return nil, errDecodeUnsupported
+}
+
+func measureDecodeTime(r io.Reader) (float64, error) {
+	start := time.Now()
+	if _, _, err := image.Decode(r); err != nil {
+		return 0, err
+	}
+	return float64(time.Since(start)) / float64(time.Millisecond), nil
+}
+
+const (
+	CompareToWebP = "webp"
+	CompareToAVIF = "avif"
+)
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func reencodeSize(r io.Reader, format string, quality int) (int64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+
+	switch format {
+	case CompareToWebP:
+		counter := &countingWriter{}
+		if err := webp.Encode(counter, img, &webp.Options{Quality: float32(quality)}); err != nil {
+			return 0, err
+		}
+		return counter.n, nil
+	case CompareToAVIF:
+		ctx, err := heif.EncodeFromImage(img, heif.CompressionAV1, quality, heif.LosslessModeDisabled, heif.LoggingLevelNone)
+		if err != nil {
+			return 0, err
+		}
+
+		tmp, err := os.CreateTemp("", "decoded-imagesize-*.avif")
+		if err != nil {
+			return 0, err
+		}
+		path := tmp.Name()
+		tmp.Close()
+		defer os.Remove(path)
+
+		if err := ctx.WriteToFile(path); err != nil {
+			return 0, err
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return stat.Size(), nil
+	default:
+		return 0, fmt.Errorf("unsupported re-encode format %q", format)
+	}
+}
+
+func applyReencode(info *ImageInfo, format string, size int64) {
+	info.ReencodedFormat = format
+	info.ReencodedSize = size
+	if info.OriginalSize > 0 {
+		info.ProjectedSavings = 1 - float64(size)/float64(info.OriginalSize)
+	}
 }
 
 func analyzeImage(filename string) (*ImageInfo, error) {
-	file, err := os.Open(filename)
+	input, _, err := openInput(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = file.Close() }()
+	defer func() { _ = input.Close() }()
+
+	return analyzeReader(input)
+}
+
+type memoryInput struct {
+	*bytes.Reader
+}
+
+func (memoryInput) Close() error {
+	return nil
+}
+
+func openInput(filename string) (io.ReadSeekCloser, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	config, format, err := image.DecodeConfig(file)
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, err
+	}
+	if stat.Mode().IsRegular() {
+		return file, stat.Size(), nil
+	}
+
+	data, err := io.ReadAll(file)
+	_ = file.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	return memoryInput{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+type sectionInput struct {
+	*io.SectionReader
+	closer io.Closer
+}
+
+func (s sectionInput) Close() error {
+	return s.closer.Close()
+}
+
+func openInputAt(filename string, offset int64) (io.ReadSeekCloser, int64, error) {
+	input, size, err := openInput(filename)
+	if err != nil || offset == 0 {
+		return input, size, err
+	}
+
+	readerAt, ok := input.(io.ReaderAt)
+	if !ok || offset < 0 || offset >= size {
+		_ = input.Close()
+		return nil, 0, fmt.Errorf("invalid offset %d for %d-byte input", offset, size)
+	}
+	return sectionInput{io.NewSectionReader(readerAt, offset, size-offset), input}, size - offset, nil
+}
+
+type customAnalyzer struct {
+	format  string
+	magic   []byte
+	analyze func(io.ReadSeeker, image.Config, *ImageInfo)
+}
+
+var customAnalyzers []customAnalyzer
+
+func RegisterAnalyzer(ext string, magic []byte, fn func(io.ReadSeeker, image.Config, *ImageInfo)) {
+	customAnalyzers = append(customAnalyzers, customAnalyzer{
+		format:  strings.ToLower(strings.TrimPrefix(ext, ".")),
+		magic:   magic,
+		analyze: fn,
+	})
+}
+
+func lookupAnalyzer(format string) (customAnalyzer, bool) {
+	for _, analyzer := range customAnalyzers {
+		if analyzer.format == format {
+			return analyzer, true
+		}
+	}
+	return customAnalyzer{}, false
+}
+
+func matchAnalyzer(r io.ReadSeeker) (customAnalyzer, bool) {
+	longest := 0
+	for _, analyzer := range customAnalyzers {
+		if len(analyzer.magic) > longest {
+			longest = len(analyzer.magic)
+		}
+	}
+	if longest == 0 {
+		return customAnalyzer{}, false
+	}
+
+	_, _ = r.Seek(0, 0)
+	header := make([]byte, longest)
+	n, _ := io.ReadFull(r, header)
+	header = header[:n]
+
+	for _, analyzer := range customAnalyzers {
+		if len(analyzer.magic) > 0 && bytes.HasPrefix(header, analyzer.magic) {
+			return analyzer, true
+		}
+	}
+	return customAnalyzer{}, false
+}
+
+func analyzeReader(r io.ReadSeeker) (*ImageInfo, error) {
+	config, format, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		if svgConfig, svgErr := sniffSVGConfig(r); svgErr == nil {
+			config, format, err = svgConfig, "svg", nil
+		} else if analyzer, ok := matchAnalyzer(r); ok {
+			info := &ImageInfo{Format: analyzer.format, PixelAspectRatio: 1, UniformBitDepth: true}
+			explain(info, "format %s from registered magic %q", analyzer.format, analyzer.magic)
+			_, _ = r.Seek(0, 0)
+			analyzer.analyze(r, image.Config{}, info)
+			return info, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	info := &ImageInfo{
-		Format: format,
-		Width:  config.Width,
-		Height: config.Height,
+		Format:           format,
+		Width:            config.Width,
+		Height:           config.Height,
+		PixelAspectRatio: 1,
+		UniformBitDepth:  true,
 	}
 
-	_, _ = file.Seek(0, 0)
+	explain(info, "format %s from magic bytes %q", format, readSignature(r, format))
+	explain(info, "dimensions %dx%d from the %s header", config.Width, config.Height, format)
+
+	_, _ = r.Seek(0, 0)
 
 	switch format {
 	case "png":
-		analyzePNG(file, config, info)
+		analyzePNG(r, config, info)
 	case "jpeg":
-		analyzeJPEG(file, config, info)
+		analyzeJPEG(r, config, info)
 	case "webp":
-		analyzeWebP(file, config, info)
-	case "heif":
-		analyzeHEIF(file, config, info)
-	case "avif":
-		analyzeAVIF(file, config, info)
+		analyzeWebP(r, config, info)
+	case "heif", "avif":
+		analyzeISOBMFF(r, config, info)
+	case "ico":
+		analyzeICO(r, config, info)
+	case "exr":
+		analyzeEXR(r, config, info)
+	case "hdr":
+		analyzeRadiance(r, config, info)
+	case "dds":
+		analyzeDDS(r, config, info)
+	case "jp2":
+		analyzeJPEG2000(r, config, info)
+	case "gif":
+		analyzeGIF(r, config, info)
+	case "tiff":
+		analyzeTIFF(r, config, info)
+	case "svg":
+		analyzeSVG(r, config, info)
 	default:
+		if analyzer, ok := lookupAnalyzer(format); ok {
+			analyzer.analyze(r, config, info)
+			break
+		}
 		info.ColorModel = ColorModelUnknown
 		info.ColorSpace = ColorSpaceUnknown
 		info.BitDepth = 8
@@ -227,6 +598,31 @@ func analyzeImage(filename string) (*ImageInfo, error) {
 	return info, nil
 }
 
+var signatureLengths = map[string]int{
+	"png":  8,
+	"jpeg": 3,
+	"webp": 12,
+	"heif": 12,
+	"avif": 12,
+	"hdr":  2,
+}
+
+func readSignature(r io.ReadSeeker, format string) []byte {
+	length, ok := signatureLengths[format]
+	if !ok {
+		length = 4
+	}
+
+	_, _ = r.Seek(0, 0)
+	signature := make([]byte, length)
+	n, _ := io.ReadFull(r, signature)
+	return signature[:n]
+}
+
+func explain(info *ImageInfo, format string, args ...interface{}) {
+	info.Explanation = append(info.Explanation, fmt.Sprintf(format, args...))
+}
+
 func mapStdColorModel(cm color.Model) (ColorModel, bool) {
 	switch cm {
 	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model:
@@ -246,27 +642,138 @@ func mapStdColorModel(cm color.Model) (ColorModel, bool) {
 	}
 }
 
+func isPremultipliedModel(cm color.Model) bool {
+	return cm == color.RGBAModel || cm == color.RGBA64Model
+}
+
+func imageTypeName(cm color.Model) string {
+	switch cm {
+	case color.RGBAModel:
+		return "image.RGBA"
+	case color.RGBA64Model:
+		return "image.RGBA64"
+	case color.NRGBAModel:
+		return "image.NRGBA"
+	case color.NRGBA64Model:
+		return "image.NRGBA64"
+	case color.GrayModel:
+		return "image.Gray"
+	case color.Gray16Model:
+		return "image.Gray16"
+	default:
+		return "image.Paletted"
+	}
+}
+
+func pngDecodedModel(chunks pngChunks, config color.Model) color.Model {
+	header := chunks.Header
+	trns := chunks.Transparency
+	deep := header.BitDepth == 16
+
+	switch header.ColorType {
+	case 0:
+		switch {
+		case trns && deep:
+			return color.NRGBA64Model
+		case trns:
+			return color.NRGBAModel
+		case deep:
+			return color.Gray16Model
+		default:
+			return color.GrayModel
+		}
+	case 2:
+		switch {
+		case trns && deep:
+			return color.NRGBA64Model
+		case trns:
+			return color.NRGBAModel
+		case deep:
+			return color.RGBA64Model
+		default:
+			return color.RGBAModel
+		}
+	case 4, 6:
+		if deep {
+			return color.NRGBA64Model
+		}
+		return color.NRGBAModel
+	default:
+		return config
+	}
+}
+
 func analyzePNG(r io.ReadSeeker, config image.Config, info *ImageInfo) {
 	info.ColorModel, info.HasAlpha = mapStdColorModel(config.ColorModel)
 	info.CompressionType = CompressionLossless
 	info.ChromaSubsampling = ChromaSubsamplingNA
 	info.HDRType = HDRNone
 
-	_, _ = r.Seek(0, 0)
-	info.BitDepth = detectPNGBitDepth(r)
+	chunks := scanPNGChunks(r)
+	decodedModel := pngDecodedModel(chunks, config.ColorModel)
+	info.PremultipliedAlpha = chunks.Transparency && isPremultipliedModel(decodedModel)
+
+	explain(info, "color model %s from PNG IHDR color type", info.ColorModel)
+	if chunks.Transparency {
+		if info.PremultipliedAlpha {
+			explain(info, "premultiplied alpha because the PNG decodes to %s", imageTypeName(decodedModel))
+		} else {
+			explain(info, "straight alpha because the PNG decodes to %s", imageTypeName(decodedModel))
+		}
+	}
+
+	info.BitDepth = chunks.BitDepth
+	setConfidence(info, "bit_depth", ConfidenceAuthoritative)
+	explain(info, "bit depth %d from PNG IHDR offset 24", info.BitDepth)
 
 	if info.BitDepth == 16 {
 		info.HDRType = HDRLimited
+		explain(info, "HDR type %s because the bit depth is 16", info.HDRType)
 	}
 
-	_, _ = r.Seek(0, 0)
-	iccProfile, colorSpace := detectPNGICCProfile(r)
-	if len(iccProfile) > 0 {
+	if len(chunks.ICCProfile) > 0 {
 		info.HasICCProfile = true
-		info.ICCProfileSize = len(iccProfile)
-		info.ColorSpace = parseColorSpace(colorSpace)
+		info.ICCProfileSize = len(chunks.ICCProfile)
+	}
+	info.ColorSpace = parseColorSpace(chunks.ColorSpace)
+	if info.ColorSpace == ColorSpaceUntagged {
+		setConfidence(info, "color_space", ConfidenceDefault)
 	} else {
-		info.ColorSpace = ColorSpaceSRGB
+		setConfidence(info, "color_space", ConfidenceHeuristic)
+	}
+	switch {
+	case info.HasICCProfile:
+		explain(info, "color space %s from iCCP substring match (%d-byte profile)", info.ColorSpace, info.ICCProfileSize)
+	case info.ColorSpace == ColorSpaceUntagged:
+		explain(info, "color space %s: no iCCP, sRGB or gAMA chunk", info.ColorSpace)
+	default:
+		explain(info, "color space %s from sRGB or gAMA chunk", info.ColorSpace)
+	}
+
+	info.PaletteSize = chunks.PaletteSize
+	if info.PaletteSize > 0 {
+		explain(info, "palette size %d from PLTE chunk", info.PaletteSize)
+	}
+
+	info.DPIX, info.DPIY, info.DensityUnit = chunks.DPIX, chunks.DPIY, chunks.DensityUnit
+	if info.DPIX > 0 {
+		explain(info, "density %dx%d %s from pHYs chunk", info.DPIX, info.DPIY, info.DensityUnit)
+	}
+
+	setXMP(info, chunks.XMP)
+	if info.HasXMP {
+		explain(info, "XMP packet (%d bytes) from iTXt chunk", info.XMPSize)
+	}
+
+	info.CICP = chunks.CICP
+	if info.CICP != nil {
+		explain(info, "CICP %d/%d/%d from cICP chunk", info.CICP.ColorPrimaries, info.CICP.TransferCharacteristics, info.CICP.MatrixCoefficients)
+	}
+
+	info.TrailingBytes = chunks.TrailingBytes
+	if info.TrailingBytes > 0 {
+		addWarning(info, fmt.Sprintf("%d bytes of trailing data after IEND", info.TrailingBytes))
+		explain(info, "%d trailing bytes after the IEND chunk", info.TrailingBytes)
 	}
 }
 
@@ -275,16 +782,23 @@ func analyzeJPEG(r io.ReadSeeker, config image.Config, info *ImageInfo) {
 	info.HasAlpha = false
 	info.HDRType = HDRNone
 
-	_, _ = r.Seek(0, 0)
-	if is12BitJPEG(r) {
-		info.BitDepth = 12
+	markers := scanJPEGMarkers(r)
+	marker, precision := markers.FrameMarker, markers.Precision
+	info.BitDepth = 8
+	setConfidence(info, "bit_depth", ConfidenceDefault)
+	if precision > 0 {
+		info.BitDepth = precision
+		setConfidence(info, "bit_depth", ConfidenceAuthoritative)
+		explain(info, "bit depth %d from SOF%d precision", info.BitDepth, marker-0xC0)
 	} else {
-		info.BitDepth = 8
+		explain(info, "bit depth 8 by default: no SOF marker found")
+	}
+	if marker == 0xC3 {
+		info.CompressionType = CompressionLossless
+		explain(info, "lossless compression from SOF3 marker")
 	}
 
-	_, _ = r.Seek(0, 0)
-	subsampling := detectJPEGSubsampling(r)
-	switch subsampling {
+	switch markers.Subsampling {
 	case "4:4:4":
 		info.ColorModel = ColorModelYCbCr
 		info.ChromaSubsampling = ChromaSubsampling444
@@ -294,6 +808,12 @@ func analyzeJPEG(r io.ReadSeeker, config image.Config, info *ImageInfo) {
 	case "4:2:0":
 		info.ColorModel = ColorModelYCbCr
 		info.ChromaSubsampling = ChromaSubsampling420
+	case "4:1:1":
+		info.ColorModel = ColorModelYCbCr
+		info.ChromaSubsampling = ChromaSubsampling411
+	case "4:4:0":
+		info.ColorModel = ColorModelYCbCr
+		info.ChromaSubsampling = ChromaSubsampling440
 	case "Grayscale":
 		info.ColorModel = ColorModelGrayscale
 		info.ChromaSubsampling = ChromaSubsamplingNA
@@ -301,15 +821,44 @@ func analyzeJPEG(r io.ReadSeeker, config image.Config, info *ImageInfo) {
 		info.ColorModel = ColorModelYCbCr
 		info.ChromaSubsampling = ChromaSubsamplingUnknown
 	}
+	if info.ChromaSubsampling == ChromaSubsamplingUnknown {
+		setConfidence(info, "chroma_subsampling", ConfidenceDefault)
+		explain(info, "chroma subsampling %s: sampling factors not recognized", info.ChromaSubsampling)
+	} else {
+		setConfidence(info, "chroma_subsampling", ConfidenceAuthoritative)
+		explain(info, "chroma subsampling %s from SOF component sampling factors", info.ChromaSubsampling)
+	}
 
-	_, _ = r.Seek(0, 0)
-	iccProfile, colorSpace := detectJPEGICCProfile(r)
-	if len(iccProfile) > 0 {
+	if len(markers.ICCProfile) > 0 {
 		info.HasICCProfile = true
-		info.ICCProfileSize = len(iccProfile)
-		info.ColorSpace = parseColorSpace(colorSpace)
+		info.ICCProfileSize = len(markers.ICCProfile)
+		info.ColorSpace = parseColorSpace(markers.ColorSpace)
+		setConfidence(info, "color_space", ConfidenceHeuristic)
+		explain(info, "color space %s from APP2 ICC_PROFILE substring match (%d-byte profile)", info.ColorSpace, info.ICCProfileSize)
 	} else {
 		info.ColorSpace = ColorSpaceSRGB
+		setConfidence(info, "color_space", ConfidenceDefault)
+		explain(info, "color space %s by default: no ICC profile", info.ColorSpace)
+	}
+
+	info.EmbeddedThumbnailBytes = markers.ThumbnailBytes
+	if info.EmbeddedThumbnailBytes > 0 {
+		explain(info, "embedded thumbnail (%d bytes) from APP1 Exif IFD1", info.EmbeddedThumbnailBytes)
+	}
+
+	info.RestartInterval = markers.RestartInterval
+	if info.RestartInterval > 0 {
+		explain(info, "restart interval %d from DRI marker", info.RestartInterval)
+	}
+
+	info.DPIX, info.DPIY, info.DensityUnit = markers.DPIX, markers.DPIY, markers.DensityUnit
+	if info.DPIX > 0 {
+		explain(info, "density %dx%d %s from JFIF/Exif header", info.DPIX, info.DPIY, info.DensityUnit)
+	}
+
+	setXMP(info, markers.XMP)
+	if info.HasXMP {
+		explain(info, "XMP packet (%d bytes) from APP1 segment", info.XMPSize)
 	}
 }
 
@@ -320,346 +869,4447 @@ func analyzeWebP(r io.ReadSeeker, config image.Config, info *ImageInfo) {
 	info.ColorModel, info.HasAlpha = mapStdColorModel(config.ColorModel)
 
 	_, _ = r.Seek(0, 0)
-	isLossless, chromaSub := detectWebPFormat(r)
-	if isLossless {
+	features := detectWebPFormat(r)
+	if features.Lossless {
 		info.CompressionType = CompressionLossless
 		info.ChromaSubsampling = ChromaSubsamplingNA
+		explain(info, "lossless compression from VP8L chunk")
 	} else {
 		info.CompressionType = CompressionLossy
-		info.ChromaSubsampling = chromaSub
+		info.ChromaSubsampling = features.ChromaSubsampling
+		explain(info, "lossy compression with %s chroma subsampling from VP8 chunk", info.ChromaSubsampling)
 	}
+	setConfidence(info, "bit_depth", ConfidenceAuthoritative)
+	setConfidence(info, "chroma_subsampling", ConfidenceAuthoritative)
 
-	info.ColorSpace = ColorSpaceSRGB
-}
+	if features.HasAlpha {
+		info.HasAlpha = true
+	}
 
-type heifMetadata struct {
-	ColorModel        ColorModel
-	HasAlpha          bool
-	BitDepth          int
-	ColorSpace        ColorSpace
-	ChromaSubsampling ChromaSubsampling
-	HDRType           HDRType
-}
+	if features.CanvasWidth > 0 && features.CanvasHeight > 0 {
+		info.Width = features.CanvasWidth
+		info.Height = features.CanvasHeight
+		explain(info, "canvas %dx%d from VP8X chunk", info.Width, info.Height)
+	}
 
-func parseHEIFMetadata(r io.ReadSeeker) heifMetadata {
-	meta := heifMetadata{
-		ColorModel:        ColorModelYCbCr,
-		HasAlpha:          false,
-		BitDepth:          8,
-		ColorSpace:        ColorSpaceBT709,
-		ChromaSubsampling: ChromaSubsampling420,
-		HDRType:           HDRNone,
+	if len(features.ICCProfile) > 0 {
+		info.HasICCProfile = true
+		info.ICCProfileSize = len(features.ICCProfile)
+		info.ColorSpace = parseColorSpace(detectColorSpaceFromICC(features.ICCProfile))
+		setConfidence(info, "color_space", ConfidenceHeuristic)
+		explain(info, "color space %s from ICCP substring match (%d-byte profile)", info.ColorSpace, info.ICCProfileSize)
+	} else {
+		info.ColorSpace = ColorSpaceSRGB
+		setConfidence(info, "color_space", ConfidenceDefault)
+		explain(info, "color space %s by default for WebP", info.ColorSpace)
 	}
 
+	setMissingBytes(info, detectWebPMissingBytes(r))
+}
+
+func detectWebPMissingBytes(r io.ReadSeeker) int64 {
 	_, _ = r.Seek(0, 0)
-	data := make([]byte, 16384)
-	n, _ := r.Read(data)
-	if n < 12 {
-		return meta
-	}
-	data = data[:n]
 
-	if string(data[4:8]) != "ftyp" {
-		return meta
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[0:4]) != "RIFF" {
+		return 0
 	}
 
-	offset := 0
-	for offset+8 < len(data) {
-		if offset+4 > len(data) {
-			break
-		}
+	fileSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
 
-		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
-		if boxSize == 0 || boxSize < 8 {
-			break
-		}
+	declared := int64(binary.LittleEndian.Uint32(header[4:8])) + 8
+	if declared > fileSize {
+		return declared - fileSize
+	}
+	return 0
+}
 
-		if offset+8 > len(data) {
-			break
-		}
+func setMissingBytes(info *ImageInfo, missing int64) {
+	info.Truncated = missing > 0
+	info.MissingBytes = missing
+	if info.Truncated {
+		addWarning(info, fmt.Sprintf("file is truncated (%d bytes missing)", missing))
+	}
+}
 
-		boxType := string(data[offset+4 : offset+8])
+type icoEntry struct {
+	Width      int
+	Height     int
+	ColorCount int
+	BitCount   int
+	Offset     int64
+}
 
-		if int(boxSize) > len(data)-offset {
-			boxSize = uint32(len(data) - offset)
-		}
+func parseICODirectory(r io.Reader) ([]icoEntry, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
 
-		boxData := data[offset+8 : offset+int(boxSize)]
+	if binary.LittleEndian.Uint16(header[0:2]) != 0 || binary.LittleEndian.Uint16(header[2:4]) != 1 {
+		return nil, errors.New("ico: invalid ICONDIR header")
+	}
 
-		switch boxType {
-		case "meta":
-			parseMetaBox(boxData, &meta)
+	count := int(binary.LittleEndian.Uint16(header[4:6]))
+	if count == 0 {
+		return nil, errors.New("ico: no embedded images")
+	}
 
-		case "pixi":
-			if len(boxData) >= 3 {
-				meta.BitDepth = int(boxData[2])
-			}
+	entries := make([]icoEntry, 0, count)
+	buf := make([]byte, 16)
+	for i := 0; i < count; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
 
-		case "colr":
-			if len(boxData) >= 4 {
-				colorType := string(boxData[0:4])
-				if colorType == "nclx" && len(boxData) >= 8 {
-					colorPrimaries := binary.BigEndian.Uint16(boxData[4:6])
-					transferChar := binary.BigEndian.Uint16(boxData[6:8])
-
-					switch colorPrimaries {
-					case 1:
-						meta.ColorSpace = ColorSpaceBT709
-					case 9:
-						meta.ColorSpace = ColorSpaceBT2020
-					case 12:
-						meta.ColorSpace = ColorSpaceDisplayP3
-					}
+		entry := icoEntry{
+			Width:      int(buf[0]),
+			Height:     int(buf[1]),
+			ColorCount: int(buf[2]),
+			BitCount:   int(binary.LittleEndian.Uint16(buf[6:8])),
+			Offset:     int64(binary.LittleEndian.Uint32(buf[12:16])),
+		}
+		if entry.Width == 0 {
+			entry.Width = 256
+		}
+		if entry.Height == 0 {
+			entry.Height = 256
+		}
+		entries = append(entries, entry)
+	}
 
-					switch transferChar {
-					case 16:
-						meta.HDRType = HDRPQ
-					case 18:
-						meta.HDRType = HDRHLG
-					}
-				}
-			}
+	return entries, nil
+}
 
-		case "auxC":
-			if bytes.Contains(boxData, []byte("urn:mpeg:mpegB:cicp:systems:auxiliary:alpha")) {
-				meta.HasAlpha = true
-			}
+func largestICOEntry(entries []icoEntry) icoEntry {
+	largest := entries[0]
+	for _, entry := range entries[1:] {
+		if entry.Width*entry.Height > largest.Width*largest.Height {
+			largest = entry
 		}
+	}
+	return largest
+}
 
-		offset += int(boxSize)
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	entries, err := parseICODirectory(r)
+	if err != nil {
+		return image.Config{}, err
 	}
 
-	return meta
+	largest := largestICOEntry(entries)
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      largest.Width,
+		Height:     largest.Height,
+	}, nil
 }
 
-func parseMetaBox(data []byte, meta *heifMetadata) {
-	offset := 4
+func analyzeICO(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.ColorModel = ColorModelRGB
+	info.HasAlpha = true
+	info.BitDepth = 8
+	info.ColorSpace = ColorSpaceSRGB
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRNone
+	info.CompressionType = CompressionLossless
 
-	for offset+8 < len(data) {
-		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
-		boxType := string(data[offset+4 : offset+8])
+	_, _ = r.Seek(0, 0)
+	entries, err := parseICODirectory(r)
+	if err != nil {
+		return
+	}
 
-		if boxSize < 8 || offset+int(boxSize) > len(data) {
+	for _, entry := range entries {
+		embedded := ImageInfo{
+			Format:            "ico",
+			Width:             entry.Width,
+			Height:            entry.Height,
+			ColorSpace:        ColorSpaceSRGB,
+			ChromaSubsampling: ChromaSubsamplingNA,
+			HDRType:           HDRNone,
+			CompressionType:   CompressionLossless,
+		}
+
+		switch {
+		case entry.BitCount == 32 || entry.BitCount == 0:
+			embedded.ColorModel = ColorModelRGB
+			embedded.BitDepth = 8
+			embedded.HasAlpha = true
+		case entry.BitCount == 24:
+			embedded.ColorModel = ColorModelRGB
+			embedded.BitDepth = 8
+		case entry.BitCount == 16:
+			embedded.ColorModel = ColorModelRGB
+			embedded.BitDepth = 5
+		default:
+			embedded.ColorModel = ColorModelIndexed
+			embedded.BitDepth = entry.BitCount
+		}
+
+		if header, ok := readICOPNGHeader(r, entry.Offset); ok {
+			embedded.Width = header.Width
+			embedded.Height = header.Height
+			embedded.BitDepth = header.BitDepth
+			embedded.ColorModel, embedded.HasAlpha = header.colorModel()
+		}
+
+		bytesPerPixel := calculateBytesPerPixel(&embedded)
+		embedded.BitsPerPixel = bytesPerPixel * 8
+		embedded.DecodedSize = int64(embedded.Width) * int64(embedded.Height) * int64(bytesPerPixel)
+		info.EmbeddedImages = append(info.EmbeddedImages, embedded)
+	}
+}
+
+func readICOPNGHeader(r io.ReadSeeker, offset int64) (pngHeader, bool) {
+	if _, err := r.Seek(offset, 0); err != nil {
+		return pngHeader{}, false
+	}
+
+	data := make([]byte, 8+8+13)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return pngHeader{}, false
+	}
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) || binary.BigEndian.Uint32(data[8:12]) != 13 || string(data[12:16]) != "IHDR" {
+		return pngHeader{}, false
+	}
+	return parsePNGHeader(data[16:])
+}
+
+const (
+	exrPixelUint  = 0
+	exrPixelHalf  = 1
+	exrPixelFloat = 2
+)
+
+type exrChannel struct {
+	Name      string
+	PixelType int
+}
+
+type exrHeader struct {
+	Width    int
+	Height   int
+	Channels []exrChannel
+}
+
+func readEXRString(r *bytes.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return sb.String(), nil
+		}
+		sb.WriteByte(b)
+	}
+}
+
+func parseEXRHeader(r io.Reader) (exrHeader, error) {
+	var header exrHeader
+
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return header, err
+	}
+
+	if !bytes.Equal(prefix[0:4], []byte{0x76, 0x2f, 0x31, 0x01}) {
+		return header, errors.New("exr: invalid magic number")
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return header, err
+	}
+
+	br := bytes.NewReader(data)
+	foundWindow := false
+	for {
+		name, err := readEXRString(br)
+		if err != nil {
+			return header, errors.New("exr: truncated header")
+		}
+		if name == "" {
 			break
 		}
 
-		switch boxType {
-		case "iprp":
-			parseIprpBox(data[offset+8:offset+int(boxSize)], meta)
+		if _, err := readEXRString(br); err != nil {
+			return header, errors.New("exr: truncated header")
 		}
 
-		offset += int(boxSize)
+		var size int32
+		if err := binary.Read(br, binary.LittleEndian, &size); err != nil || size < 0 || int(size) > br.Len() {
+			return header, errors.New("exr: truncated header")
+		}
+
+		value := make([]byte, size)
+		_, _ = br.Read(value)
+
+		switch name {
+		case "dataWindow":
+			if len(value) < 16 {
+				return header, errors.New("exr: invalid dataWindow")
+			}
+			xMin := int32(binary.LittleEndian.Uint32(value[0:4]))
+			yMin := int32(binary.LittleEndian.Uint32(value[4:8]))
+			xMax := int32(binary.LittleEndian.Uint32(value[8:12]))
+			yMax := int32(binary.LittleEndian.Uint32(value[12:16]))
+			header.Width = int(xMax) - int(xMin) + 1
+			header.Height = int(yMax) - int(yMin) + 1
+			foundWindow = true
+		case "channels":
+			header.Channels = parseEXRChannels(value)
+		}
 	}
+
+	if !foundWindow || header.Width <= 0 || header.Height <= 0 {
+		return header, errors.New("exr: missing or invalid dataWindow")
+	}
+
+	return header, nil
 }
 
-func parseIprpBox(data []byte, meta *heifMetadata) {
-	offset := 0
+func parseEXRChannels(value []byte) []exrChannel {
+	var channels []exrChannel
 
-	for offset+8 < len(data) {
-		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
-		boxType := string(data[offset+4 : offset+8])
+	br := bytes.NewReader(value)
+	for {
+		name, err := readEXRString(br)
+		if err != nil || name == "" {
+			break
+		}
 
-		if boxSize < 8 || offset+int(boxSize) > len(data) {
+		entry := make([]byte, 16)
+		if _, err := io.ReadFull(br, entry); err != nil {
 			break
 		}
 
-		boxData := data[offset+8 : offset+int(boxSize)]
+		channels = append(channels, exrChannel{
+			Name:      name,
+			PixelType: int(binary.LittleEndian.Uint32(entry[0:4])),
+		})
+	}
+
+	return channels
+}
+
+func exrPixelBits(pixelType int) int {
+	if pixelType == exrPixelHalf {
+		return 16
+	}
+	return 32
+}
+
+func decodeEXRConfig(r io.Reader) (image.Config, error) {
+	header, err := parseEXRHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return image.Config{
+		ColorModel: color.RGBA64Model,
+		Width:      header.Width,
+		Height:     header.Height,
+	}, nil
+}
+
+func analyzeEXR(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.ColorModel = ColorModelRGB
+	info.ColorSpace = ColorSpaceBT709
+	info.BitDepth = 16
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRLinear
+	info.CompressionType = CompressionLossless
+
+	_, _ = r.Seek(0, 0)
+	header, err := parseEXRHeader(r)
+	if err != nil || len(header.Channels) == 0 {
+		return
+	}
+
+	hasColor := false
+	maxBits := 0
+	info.ChannelBitDepths = make([]int, 0, len(header.Channels))
+	for _, ch := range header.Channels {
+		switch ch.Name {
+		case "A":
+			info.HasAlpha = true
+		case "R", "G", "B":
+			hasColor = true
+		}
+		bits := exrPixelBits(ch.PixelType)
+		info.ChannelBitDepths = append(info.ChannelBitDepths, bits)
+		maxBits = max(maxBits, bits)
+	}
+
+	if !hasColor {
+		info.ColorModel = ColorModelGrayscale
+	}
+	info.BitDepth = maxBits
+	info.UniformBitDepth = uniformBitDepth(info.ChannelBitDepths)
+	info.ChannelCount = len(header.Channels)
+	explain(info, "%d channels with bit depths %v from EXR channels attribute", info.ChannelCount, info.ChannelBitDepths)
+}
+
+func parseRadianceHeader(r io.Reader) (int, int, error) {
+	br := bufio.NewReader(io.LimitReader(r, 64*1024))
+
+	signature, err := br.ReadString('\n')
+	if err != nil {
+		return 0, 0, errors.New("hdr: truncated header")
+	}
+	signature = strings.TrimSpace(signature)
+	if signature != "#?RADIANCE" && signature != "#?RGBE" {
+		return 0, 0, errors.New("hdr: invalid signature")
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0, 0, errors.New("hdr: truncated header")
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		if format, ok := strings.CutPrefix(line, "FORMAT="); ok {
+			if format != "32-bit_rle_rgbe" && format != "32-bit_rle_xyze" {
+				return 0, 0, fmt.Errorf("hdr: unsupported format %q", format)
+			}
+		}
+	}
+
+	resolution, err := br.ReadString('\n')
+	if err != nil && resolution == "" {
+		return 0, 0, errors.New("hdr: missing resolution line")
+	}
+
+	fields := strings.Fields(resolution)
+	if len(fields) != 4 {
+		return 0, 0, errors.New("hdr: invalid resolution line")
+	}
+
+	first, err1 := strconv.Atoi(fields[1])
+	second, err2 := strconv.Atoi(fields[3])
+	if err1 != nil || err2 != nil || first <= 0 || second <= 0 {
+		return 0, 0, errors.New("hdr: invalid resolution line")
+	}
+
+	axis1 := strings.TrimLeft(fields[0], "+-")
+	axis2 := strings.TrimLeft(fields[2], "+-")
+	switch {
+	case axis1 == "Y" && axis2 == "X":
+		return second, first, nil
+	case axis1 == "X" && axis2 == "Y":
+		return first, second, nil
+	default:
+		return 0, 0, errors.New("hdr: invalid resolution line")
+	}
+}
+
+func decodeRadianceConfig(r io.Reader) (image.Config, error) {
+	width, height, err := parseRadianceHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return image.Config{
+		ColorModel: color.RGBA64Model,
+		Width:      width,
+		Height:     height,
+	}, nil
+}
+
+func analyzeRadiance(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.ColorModel = ColorModelRGB
+	info.ColorSpace = ColorSpaceBT709
+	info.BitDepth = 32
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRLinear
+	info.CompressionType = CompressionLossless
+}
+
+type ddsHeader struct {
+	Width       int
+	Height      int
+	MipmapCount int
+	PixelFlags  uint32
+	FourCC      string
+	RGBBitCount int
+	DXGIFormat  uint32
+}
+
+const (
+	ddsPixelAlpha  = 0x1
+	ddsPixelFourCC = 0x4
+)
 
+func parseDDSHeader(r io.Reader) (ddsHeader, error) {
+	buf := make([]byte, 148)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return ddsHeader{}, err
+	}
+	if n < 128 || string(buf[0:4]) != "DDS " {
+		return ddsHeader{}, errors.New("dds: invalid header")
+	}
+	if binary.LittleEndian.Uint32(buf[4:8]) != 124 {
+		return ddsHeader{}, errors.New("dds: unexpected header size")
+	}
+
+	header := ddsHeader{
+		Height:      int(binary.LittleEndian.Uint32(buf[12:16])),
+		Width:       int(binary.LittleEndian.Uint32(buf[16:20])),
+		MipmapCount: int(binary.LittleEndian.Uint32(buf[28:32])),
+		PixelFlags:  binary.LittleEndian.Uint32(buf[80:84]),
+		RGBBitCount: int(binary.LittleEndian.Uint32(buf[88:92])),
+	}
+	if header.PixelFlags&ddsPixelFourCC != 0 {
+		header.FourCC = string(buf[84:88])
+		if header.FourCC == "DX10" {
+			if n < 132 {
+				return ddsHeader{}, errors.New("dds: truncated DX10 header")
+			}
+			header.DXGIFormat = binary.LittleEndian.Uint32(buf[128:132])
+		}
+	}
+	return header, nil
+}
+
+func decodeDDSConfig(r io.Reader) (image.Config, error) {
+	header, err := parseDDSHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      header.Width,
+		Height:     header.Height,
+	}, nil
+}
+
+func ddsDXGIFormatName(format uint32) string {
+	switch format {
+	case 71, 72:
+		return "BC1"
+	case 74, 75:
+		return "BC2"
+	case 77, 78:
+		return "BC3"
+	case 80, 81:
+		return "BC4"
+	case 83, 84:
+		return "BC5"
+	case 95, 96:
+		return "BC6H"
+	case 98, 99:
+		return "BC7"
+	case 28, 29:
+		return "R8G8B8A8"
+	case 87, 91:
+		return "B8G8R8A8"
+	default:
+		return fmt.Sprintf("DXGI_%d", format)
+	}
+}
+
+func analyzeDDS(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.ColorModel = ColorModelRGB
+	info.ColorSpace = ColorSpaceSRGB
+	info.BitDepth = 8
+	info.ChannelCount = 4
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRNone
+	info.CompressionType = CompressionLossless
+
+	_, _ = r.Seek(0, 0)
+	header, err := parseDDSHeader(r)
+	if err != nil {
+		return
+	}
+
+	info.MipmapCount = max(header.MipmapCount, 1)
+	info.HasAlpha = header.PixelFlags&ddsPixelAlpha != 0
+
+	codec := header.FourCC
+	if codec == "DX10" {
+		codec = ddsDXGIFormatName(header.DXGIFormat)
+	}
+	switch codec {
+	case "":
+		info.Codec = fmt.Sprintf("uncompressed %d-bit", header.RGBBitCount)
+		explain(info, "uncompressed %d-bit pixels from DDS_PIXELFORMAT", header.RGBBitCount)
+		return
+	case "R8G8B8A8", "B8G8R8A8":
+		info.Codec = codec
+		info.HasAlpha = true
+		explain(info, "uncompressed %s pixels from DX10 header", codec)
+		return
+	case "DXT2", "DXT3", "DXT4", "DXT5", "BC2", "BC3", "BC7":
+		info.HasAlpha = true
+	case "BC6H":
+		info.BitDepth = 16
+		info.HDRType = HDRLinear
+	}
+
+	info.Codec = codec
+	info.CompressionType = CompressionLossy
+	explain(info, "block-compressed %s from DDS_PIXELFORMAT FourCC %q", codec, header.FourCC)
+}
+
+const (
+	jp2Signature = "\x00\x00\x00\x0cjP  \r\n\x87\n"
+	j2kSignature = "\xff\x4f\xff\x51"
+)
+
+type jpeg2000Header struct {
+	Width      int
+	Height     int
+	Components int
+	BitDepth   int
+	Container  bool
+	EnumCS     uint32
+	ICCProfile []byte
+}
+
+func parseJ2KCodestream(r io.Reader) (jpeg2000Header, error) {
+	buf := make([]byte, 42)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return jpeg2000Header{}, err
+	}
+	if string(buf[0:4]) != j2kSignature {
+		return jpeg2000Header{}, errors.New("jpeg2000: missing SOC/SIZ markers")
+	}
+
+	xSize := binary.BigEndian.Uint32(buf[8:12])
+	ySize := binary.BigEndian.Uint32(buf[12:16])
+	xOffset := binary.BigEndian.Uint32(buf[16:20])
+	yOffset := binary.BigEndian.Uint32(buf[20:24])
+	components := int(binary.BigEndian.Uint16(buf[40:42]))
+	if xOffset > xSize || yOffset > ySize || components == 0 {
+		return jpeg2000Header{}, errors.New("jpeg2000: invalid SIZ segment")
+	}
+
+	header := jpeg2000Header{
+		Width:      int(xSize - xOffset),
+		Height:     int(ySize - yOffset),
+		Components: components,
+	}
+
+	depths := make([]byte, 3*components)
+	if _, err := io.ReadFull(r, depths); err != nil {
+		return jpeg2000Header{}, err
+	}
+	for i := 0; i < components; i++ {
+		header.BitDepth = max(header.BitDepth, int(depths[3*i]&0x7F)+1)
+	}
+	return header, nil
+}
+
+func parseJP2Header(data []byte, header *jpeg2000Header) {
+	forEachHEIFBox(data, func(boxType string, payload []byte) {
 		switch boxType {
-		case "ipco":
-			parseIpcoBox(boxData, meta)
+		case "ihdr":
+			if len(payload) >= 11 {
+				header.Height = int(binary.BigEndian.Uint32(payload[0:4]))
+				header.Width = int(binary.BigEndian.Uint32(payload[4:8]))
+				header.Components = int(binary.BigEndian.Uint16(payload[8:10]))
+				if payload[10] != 0xFF {
+					header.BitDepth = int(payload[10]&0x7F) + 1
+				}
+			}
+		case "colr":
+			if len(payload) >= 7 && payload[0] == 1 {
+				header.EnumCS = binary.BigEndian.Uint32(payload[3:7])
+			} else if len(payload) > 3 && payload[0] == 2 {
+				header.ICCProfile = payload[3:]
+			}
+		case "bpcc":
+			for _, depth := range payload {
+				header.BitDepth = max(header.BitDepth, int(depth&0x7F)+1)
+			}
 		}
+	})
+}
 
-		offset += int(boxSize)
+func parseJPEG2000Header(r io.Reader) (jpeg2000Header, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(jp2Signature))
+	if err != nil && len(magic) < len(j2kSignature) {
+		return jpeg2000Header{}, err
+	}
+	if string(magic[:len(j2kSignature)]) == j2kSignature {
+		return parseJ2KCodestream(br)
+	}
+	if string(magic) != jp2Signature {
+		return jpeg2000Header{}, errors.New("jpeg2000: invalid signature")
+	}
+
+	header := jpeg2000Header{Container: true}
+	boxHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, boxHeader); err != nil {
+			return jpeg2000Header{}, errors.New("jpeg2000: no jp2h header box")
+		}
+		boxType := string(boxHeader[4:8])
+		boxSize := int64(binary.BigEndian.Uint32(boxHeader[0:4]))
+		headerSize := int64(8)
+		if boxSize == 1 {
+			if _, err := io.ReadFull(br, boxHeader); err != nil {
+				return jpeg2000Header{}, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(boxHeader))
+			headerSize = 16
+		}
+
+		switch {
+		case boxType == "jp2h":
+			if boxSize < headerSize || boxSize-headerSize > heifMaxBoxPayload {
+				return jpeg2000Header{}, errors.New("jpeg2000: invalid jp2h box size")
+			}
+			data := make([]byte, boxSize-headerSize)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return jpeg2000Header{}, err
+			}
+			parseJP2Header(data, &header)
+			if header.Width == 0 || header.Height == 0 || header.Components == 0 {
+				return jpeg2000Header{}, errors.New("jpeg2000: missing ihdr box")
+			}
+			return header, nil
+		case boxType == "jp2c":
+			codestream, err := parseJ2KCodestream(br)
+			if err != nil {
+				return jpeg2000Header{}, err
+			}
+			codestream.Container = true
+			return codestream, nil
+		case boxSize == 0 || boxSize < headerSize:
+			return jpeg2000Header{}, errors.New("jpeg2000: no jp2h header box")
+		}
+
+		if _, err := io.CopyN(io.Discard, br, boxSize-headerSize); err != nil {
+			return jpeg2000Header{}, err
+		}
 	}
 }
 
-func parseIpcoBox(data []byte, meta *heifMetadata) {
-	offset := 0
+func decodeJPEG2000Config(r io.Reader) (image.Config, error) {
+	header, err := parseJPEG2000Header(r)
+	if err != nil {
+		return image.Config{}, err
+	}
 
-	for offset+8 < len(data) {
-		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
-		boxType := string(data[offset+4 : offset+8])
+	return image.Config{
+		ColorModel: color.RGBA64Model,
+		Width:      header.Width,
+		Height:     header.Height,
+	}, nil
+}
+
+func analyzeJPEG2000(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.CompressionType = CompressionHybrid
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRNone
+	info.ColorSpace = ColorSpaceUntagged
+	info.Codec = "JPEG 2000"
+
+	_, _ = r.Seek(0, 0)
+	header, err := parseJPEG2000Header(r)
+	if err != nil {
+		return
+	}
+
+	info.ChannelCount = header.Components
+	info.BitDepth = max(header.BitDepth, 1)
+	info.HasAlpha = header.Components == 2 || header.Components >= 4
+	if header.Components <= 2 {
+		info.ColorModel = ColorModelGrayscale
+	} else {
+		info.ColorModel = ColorModelRGB
+	}
+	if info.BitDepth > 8 {
+		info.HDRType = HDRLimited
+	}
+
+	switch {
+	case len(header.ICCProfile) > 0:
+		info.HasICCProfile = true
+		info.ICCProfileSize = len(header.ICCProfile)
+		info.ColorSpace = parseColorSpace(detectColorSpaceFromICC(header.ICCProfile))
+	case header.EnumCS == 16 || header.EnumCS == 17:
+		info.ColorSpace = ColorSpaceSRGB
+	case header.EnumCS == 18:
+		info.ColorSpace = ColorSpaceSRGB
+		info.ColorModel = ColorModelYCbCr
+	}
+
+	if header.Container {
+		explain(info, "%dx%d, %d components at %d bits from jp2h ihdr box", info.Width, info.Height, header.Components, info.BitDepth)
+	} else {
+		explain(info, "%dx%d, %d components at %d bits from the SIZ marker segment", info.Width, info.Height, header.Components, info.BitDepth)
+	}
+}
+
+const (
+	tiffTagImageWidth      = 256
+	tiffTagImageLength     = 257
+	tiffTagBitsPerSample   = 258
+	tiffTagCompression     = 259
+	tiffTagPhotometric     = 262
+	tiffTagSamplesPerPixel = 277
+	tiffTagExtraSamples    = 338
+	tiffTagICCProfile      = 34675
+	tiffMaxIFDEntries      = 4096
+	tiffMaxValueBytes      = 16 << 20
+)
+
+type tiffEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+type tiffIFD struct {
+	Order   binary.ByteOrder
+	Entries map[uint16]tiffEntry
+}
+
+func readTIFFIFD(r io.Reader) (tiffIFD, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return tiffIFD{}, errors.New("tiff: truncated header")
+	}
+
+	ifd := tiffIFD{Entries: make(map[uint16]tiffEntry)}
+	switch string(header[0:2]) {
+	case "II":
+		ifd.Order = binary.LittleEndian
+	case "MM":
+		ifd.Order = binary.BigEndian
+	default:
+		return tiffIFD{}, errors.New("tiff: invalid byte order")
+	}
+	if ifd.Order.Uint16(header[2:4]) != 42 {
+		return tiffIFD{}, errors.New("tiff: invalid magic")
+	}
+
+	offset := ifd.Order.Uint32(header[4:8])
+	if offset < 8 {
+		return tiffIFD{}, errors.New("tiff: invalid IFD offset")
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(offset)-8); err != nil {
+		return tiffIFD{}, errors.New("tiff: IFD offset beyond end of file")
+	}
+
+	countBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, countBytes); err != nil {
+		return tiffIFD{}, errors.New("tiff: truncated IFD")
+	}
+	count := int(ifd.Order.Uint16(countBytes))
+	if count == 0 || count > tiffMaxIFDEntries {
+		return tiffIFD{}, fmt.Errorf("tiff: invalid IFD entry count %d", count)
+	}
+
+	entries := make([]byte, count*12)
+	if _, err := io.ReadFull(r, entries); err != nil {
+		return tiffIFD{}, errors.New("tiff: truncated IFD")
+	}
+	for i := 0; i < count; i++ {
+		entry := entries[i*12 : i*12+12]
+		ifd.Entries[ifd.Order.Uint16(entry[0:2])] = tiffEntry{
+			Type:  ifd.Order.Uint16(entry[2:4]),
+			Count: ifd.Order.Uint32(entry[4:8]),
+			Value: entry[8:12],
+		}
+	}
+
+	return ifd, nil
+}
+
+func tiffTypeSize(fieldType uint16) int {
+	switch fieldType {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9:
+		return 4
+	default:
+		return 0
+	}
+}
+
+func (ifd tiffIFD) raw(r io.ReadSeeker, tag uint16) []byte {
+	entry, ok := ifd.Entries[tag]
+	size := tiffTypeSize(entry.Type)
+	if !ok || size == 0 || entry.Count == 0 || int64(entry.Count)*int64(size) > tiffMaxValueBytes {
+		return nil
+	}
+
+	total := int(entry.Count) * size
+	if total <= 4 {
+		return entry.Value[:total]
+	}
+	if r == nil {
+		return nil
+	}
+	if _, err := r.Seek(int64(ifd.Order.Uint32(entry.Value)), io.SeekStart); err != nil {
+		return nil
+	}
+	data := make([]byte, total)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil
+	}
+	return data
+}
+
+func (ifd tiffIFD) values(r io.ReadSeeker, tag uint16) []int {
+	data := ifd.raw(r, tag)
+	if data == nil {
+		return nil
+	}
+
+	size := tiffTypeSize(ifd.Entries[tag].Type)
+	values := make([]int, len(data)/size)
+	for i := range values {
+		switch size {
+		case 1:
+			values[i] = int(data[i])
+		case 2:
+			values[i] = int(ifd.Order.Uint16(data[i*2:]))
+		case 4:
+			values[i] = int(ifd.Order.Uint32(data[i*4:]))
+		}
+	}
+	return values
+}
+
+func (ifd tiffIFD) value(tag uint16, fallback int) int {
+	if values := ifd.values(nil, tag); len(values) > 0 {
+		return values[0]
+	}
+	return fallback
+}
+
+func decodeTIFFConfig(r io.Reader) (image.Config, error) {
+	ifd, err := readTIFFIFD(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	width := ifd.value(tiffTagImageWidth, 0)
+	height := ifd.value(tiffTagImageLength, 0)
+	if width <= 0 || height <= 0 {
+		return image.Config{}, errors.New("tiff: missing image dimensions")
+	}
+
+	return image.Config{
+		ColorModel: color.RGBAModel,
+		Width:      width,
+		Height:     height,
+	}, nil
+}
+
+func analyzeTIFF(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.ColorModel = ColorModelRGB
+	info.ColorSpace = ColorSpaceUntagged
+	info.BitDepth = 8
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRNone
+	info.CompressionType = CompressionUnknown
+
+	_, _ = r.Seek(0, 0)
+	ifd, err := readTIFFIFD(r)
+	if err != nil {
+		return
+	}
+
+	switch ifd.value(tiffTagCompression, 1) {
+	case 1, 2, 3, 4, 5, 8, 32773, 32946:
+		info.CompressionType = CompressionLossless
+	case 6, 7:
+		info.CompressionType = CompressionLossy
+	}
+
+	photometric := ifd.value(tiffTagPhotometric, 2)
+	baseChannels := 3
+	switch photometric {
+	case 0, 1:
+		info.ColorModel = ColorModelGrayscale
+		baseChannels = 1
+	case 3:
+		info.ColorModel = ColorModelIndexed
+		baseChannels = 1
+	case 5:
+		info.ColorModel = ColorModelCMYK
+		baseChannels = 4
+	case 6:
+		info.ColorModel = ColorModelYCbCr
+		info.ChromaSubsampling = ChromaSubsamplingUnknown
+	}
+
+	samples := max(ifd.value(tiffTagSamplesPerPixel, 1), 1)
+	info.ChannelCount = samples
+
+	bits := ifd.values(r, tiffTagBitsPerSample)
+	if len(bits) == 0 {
+		bits = []int{1}
+	}
+	info.BitDepth = 0
+	for _, depth := range bits {
+		info.BitDepth = max(info.BitDepth, depth)
+	}
+	if len(bits) > 1 {
+		info.ChannelBitDepths = bits
+		info.UniformBitDepth = uniformBitDepth(bits)
+	}
+	if info.BitDepth > 8 && info.ColorModel != ColorModelIndexed {
+		info.HDRType = HDRLimited
+	}
+
+	extra := ifd.values(r, tiffTagExtraSamples)
+	for _, kind := range extra {
+		if kind == 1 || kind == 2 {
+			info.HasAlpha = true
+		}
+	}
+
+	if icc := ifd.raw(r, tiffTagICCProfile); len(icc) > 0 {
+		info.HasICCProfile = true
+		info.ICCProfileSize = len(icc)
+		info.ColorSpace = parseColorSpace(detectColorSpaceFromICC(icc))
+	}
+
+	explain(info, "%d samples per pixel at %d bits, photometric interpretation %d, from IFD0", samples, info.BitDepth, photometric)
+	if extraChannels := samples - baseChannels; extraChannels > 0 {
+		explain(info, "%d channels beyond %s, extra samples %v", extraChannels, info.ColorModel, extra)
+	}
+}
+
+func ddsMipChainSize(width, height, levels, bitsPerPixel int) int64 {
+	var size int64
+	for level := 0; level < levels; level++ {
+		size += pixelBytes(max(width>>level, 1), max(height>>level, 1), bitsPerPixel)
+		if width>>level <= 1 && height>>level <= 1 {
+			break
+		}
+	}
+	return size
+}
+
+func parseSVGLength(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"px", 1},
+		{"pt", 96.0 / 72},
+		{"pc", 16},
+		{"in", 96},
+		{"cm", 96 / 2.54},
+		{"mm", 96 / 25.4},
+	}
+
+	scale := 1.0
+	for _, unit := range units {
+		if trimmed, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, scale = trimmed, unit.scale
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number <= 0 {
+		return 0, false
+	}
+	return number * scale, true
+}
+
+func parseSVGDimensions(r io.Reader) (int, int, error) {
+	decoder := xml.NewDecoder(io.LimitReader(r, 1<<20))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0, image.ErrFormat
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "svg" {
+			return 0, 0, image.ErrFormat
+		}
+
+		var width, height float64
+		var haveWidth, haveHeight bool
+		var viewBox string
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width, haveWidth = parseSVGLength(attr.Value)
+			case "height":
+				height, haveHeight = parseSVGLength(attr.Value)
+			case "viewBox":
+				viewBox = attr.Value
+			}
+		}
+
+		if !haveWidth || !haveHeight {
+			fields := strings.FieldsFunc(viewBox, func(c rune) bool { return c == ' ' || c == ',' })
+			if len(fields) != 4 {
+				return 0, 0, errors.New("svg: no usable width/height or viewBox")
+			}
+			boxWidth, err1 := strconv.ParseFloat(fields[2], 64)
+			boxHeight, err2 := strconv.ParseFloat(fields[3], 64)
+			if err1 != nil || err2 != nil || boxWidth <= 0 || boxHeight <= 0 {
+				return 0, 0, errors.New("svg: invalid viewBox")
+			}
+			if !haveWidth {
+				width = boxWidth
+			}
+			if !haveHeight {
+				height = boxHeight
+			}
+		}
+
+		return int(math.Round(width)), int(math.Round(height)), nil
+	}
+}
+
+const svgSniffLength = 4096
+
+func sniffSVGConfig(r io.ReadSeeker) (image.Config, error) {
+	_, _ = r.Seek(0, 0)
+	prefix := make([]byte, svgSniffLength)
+	n, _ := io.ReadFull(r, prefix)
+	prefix = bytes.TrimLeft(bytes.TrimPrefix(prefix[:n], []byte("\xef\xbb\xbf")), " \t\r\n")
+	if !bytes.HasPrefix(prefix, []byte("<")) || !bytes.Contains(prefix, []byte("<svg")) {
+		return image.Config{}, image.ErrFormat
+	}
+
+	_, _ = r.Seek(0, 0)
+	return decodeSVGConfig(r)
+}
+
+func decodeSVGConfig(r io.Reader) (image.Config, error) {
+	width, height, err := parseSVGDimensions(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return image.Config{
+		ColorModel: color.RGBAModel,
+		Width:      width,
+		Height:     height,
+	}, nil
+}
+
+type gifMetadata struct {
+	FrameCount  int
+	LoopCount   *int
+	Transparent bool
+}
+
+func parseGIF(r io.Reader) (gifMetadata, error) {
+	var meta gifMetadata
+	br := bufio.NewReader(r)
+
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return meta, err
+	}
+	if string(header[0:3]) != "GIF" {
+		return meta, errors.New("gif: missing signature")
+	}
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << ((header[10] & 0x07) + 1)); err != nil {
+			return meta, err
+		}
+	}
+
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return meta, err
+		}
+
+		switch introducer {
+		case 0x21:
+			label, err := br.ReadByte()
+			if err != nil {
+				return meta, err
+			}
+			blocks, err := readGIFSubBlocks(br)
+			if err != nil {
+				return meta, err
+			}
+			switch {
+			case label == 0xF9 && len(blocks) > 0 && len(blocks[0]) >= 4:
+				if blocks[0][0]&0x01 != 0 {
+					meta.Transparent = true
+				}
+			case label == 0xFF && len(blocks) > 1 && (string(blocks[0]) == "NETSCAPE2.0" || string(blocks[0]) == "ANIMEXTS1.0"):
+				if len(blocks[1]) >= 3 && blocks[1][0] == 0x01 {
+					loops := int(binary.LittleEndian.Uint16(blocks[1][1:3]))
+					meta.LoopCount = &loops
+				}
+			}
+
+		case 0x2C:
+			meta.FrameCount++
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return meta, err
+			}
+			if descriptor[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << ((descriptor[8] & 0x07) + 1)); err != nil {
+					return meta, err
+				}
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return meta, err
+			}
+			if _, err := readGIFSubBlocks(br); err != nil {
+				return meta, err
+			}
+
+		case 0x3B:
+			return meta, nil
+
+		default:
+			return meta, fmt.Errorf("gif: unexpected block introducer 0x%02x", introducer)
+		}
+	}
+}
+
+func readGIFSubBlocks(br *bufio.Reader) ([][]byte, error) {
+	var blocks [][]byte
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return blocks, nil
+		}
+		if len(blocks) >= 2 {
+			if _, err := br.Discard(int(size)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		block := make([]byte, size)
+		if _, err := io.ReadFull(br, block); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func analyzeGIF(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.ColorModel = ColorModelIndexed
+	info.BitDepth = 8
+	info.ColorSpace = ColorSpaceSRGB
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRNone
+	info.CompressionType = CompressionLossless
+	if palette, ok := config.ColorModel.(color.Palette); ok {
+		info.PaletteSize = len(palette)
+	}
+
+	_, _ = r.Seek(0, 0)
+	meta, err := parseGIF(r)
+	if err != nil && meta.FrameCount == 0 {
+		return
+	}
+
+	info.HasAlpha = meta.Transparent
+	if meta.Transparent {
+		explain(info, "alpha from a graphic control extension with a transparent color index")
+	}
+	if meta.FrameCount > 1 {
+		info.FrameCount = meta.FrameCount
+		explain(info, "%d frames from image descriptors", meta.FrameCount)
+	}
+	if meta.LoopCount != nil {
+		info.LoopCount = meta.LoopCount
+		explain(info, "loop count %d from the NETSCAPE2.0 application extension (0 = infinite)", *meta.LoopCount)
+	}
+}
+
+func analyzeSVG(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.IsVector = true
+	info.ColorModel = ColorModelUnknown
+	info.ColorSpace = ColorSpaceUnknown
+	info.ChromaSubsampling = ChromaSubsamplingNA
+	info.HDRType = HDRNone
+	info.CompressionType = CompressionNotApplicable
+}
+
+type CICPValues struct {
+	ColorPrimaries          int  `json:"color_primaries"`
+	TransferCharacteristics int  `json:"transfer_characteristics"`
+	MatrixCoefficients      int  `json:"matrix_coefficients"`
+	FullRange               bool `json:"full_range"`
+}
+
+func parseNCLX(data []byte) *CICPValues {
+	if len(data) < 7 {
+		return nil
+	}
+	return &CICPValues{
+		ColorPrimaries:          int(binary.BigEndian.Uint16(data[0:2])),
+		TransferCharacteristics: int(binary.BigEndian.Uint16(data[2:4])),
+		MatrixCoefficients:      int(binary.BigEndian.Uint16(data[4:6])),
+		FullRange:               data[6]&0x80 != 0,
+	}
+}
+
+func applyNCLX(data []byte, meta *heifMetadata) {
+	meta.CICP = parseNCLX(data)
+	colorPrimaries := binary.BigEndian.Uint16(data[0:2])
+	transferChar := binary.BigEndian.Uint16(data[2:4])
+
+	switch colorPrimaries {
+	case 1:
+		meta.ColorSpace = ColorSpaceBT709
+	case 9:
+		meta.ColorSpace = ColorSpaceBT2020
+	case 12:
+		meta.ColorSpace = ColorSpaceDisplayP3
+	}
+	switch colorPrimaries {
+	case 1, 9, 12:
+		setHEIFConfidence(meta, "color_space", ConfidenceAuthoritative)
+	}
+
+	switch transferChar {
+	case 16:
+		meta.HDRType = HDRPQ
+	case 18:
+		meta.HDRType = HDRHLG
+	}
+	setHEIFConfidence(meta, "hdr_type", ConfidenceAuthoritative)
+}
+
+func applyColr(data []byte, meta *heifMetadata) {
+	if len(data) < 4 {
+		return
+	}
+	switch string(data[0:4]) {
+	case "nclx":
+		if len(data) >= 8 {
+			applyNCLX(data[4:], meta)
+		}
+	case "prof", "rICC":
+		if len(data) > 4 {
+			meta.ICCProfile = append([]byte(nil), data[4:]...)
+		}
+	}
+}
+
+func compatibleColorSpaces(a, b ColorSpace) bool {
+	if a == b {
+		return true
+	}
+	srgbPrimaries := func(cs ColorSpace) bool { return cs == ColorSpaceSRGB || cs == ColorSpaceBT709 }
+	return srgbPrimaries(a) && srgbPrimaries(b)
+}
+
+func resolveHEIFColorSpace(meta *heifMetadata) {
+	if len(meta.ICCProfile) == 0 {
+		return
+	}
+
+	iccSpace := parseColorSpace(detectColorSpaceFromICC(meta.ICCProfile))
+	if meta.Confidence["color_space"] != ConfidenceAuthoritative {
+		meta.ColorSpace = iccSpace
+		setHEIFConfidence(meta, "color_space", ConfidenceHeuristic)
+		return
+	}
+	if !compatibleColorSpaces(iccSpace, meta.ColorSpace) {
+		meta.ColorConflict = fmt.Sprintf("ICC profile (%s) conflicts with nclx (%s)", iccSpace, meta.ColorSpace)
+	}
+}
+
+func setHEIFConfidence(meta *heifMetadata, field, level string) {
+	if meta.Confidence == nil {
+		meta.Confidence = make(map[string]string)
+	}
+	meta.Confidence[field] = level
+}
+
+type heifMetadata struct {
+	ColorModel        ColorModel
+	HasAlpha          bool
+	HasGainMap        bool
+	BitDepth          int
+	ChannelBitDepths  []int
+	ColorSpace        ColorSpace
+	ColorConflict     string
+	ICCProfile        []byte
+	CICP              *CICPValues
+	ChromaSubsampling ChromaSubsampling
+	HDRType           HDRType
+	Width             int
+	Height            int
+	MajorBrand        string
+	CompatibleBrands  []string
+	Codec             string
+	PixelAspectRatio  float64
+	XMP               []byte
+	MissingBytes      int64
+	FrameCount        int
+	TileCount         int
+	Confidence        map[string]string
+	Boxes             []string
+
+	items heifItems
+}
+
+type heifItems struct {
+	primary    uint32
+	types      map[uint32]string
+	derived    map[uint32][]uint32
+	locations  map[uint32]heifItemLocation
+	properties map[uint32][]int
+	boxes      map[int]heifProperty
+	extents    map[int][2]int
+	mimeTypes  map[uint32]string
+	itemData   []byte
+}
+
+type heifProperty struct {
+	boxType string
+	data    []byte
+}
+
+type heifItemLocation struct {
+	constructionMethod int
+	offset             uint64
+	length             uint64
+}
+
+func parseHEIFMetadata(r io.ReadSeeker) heifMetadata {
+	meta := heifMetadata{
+		ColorModel:        ColorModelYCbCr,
+		HasAlpha:          false,
+		BitDepth:          8,
+		ColorSpace:        ColorSpaceBT709,
+		ChromaSubsampling: ChromaSubsampling420,
+		HDRType:           HDRNone,
+		PixelAspectRatio:  1,
+		Confidence: map[string]string{
+			"color_space":        ConfidenceDefault,
+			"bit_depth":          ConfidenceDefault,
+			"chroma_subsampling": ConfidenceDefault,
+			"hdr_type":           ConfidenceDefault,
+		},
+	}
+
+	fileSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil || fileSize < 12 {
+		return meta
+	}
+
+	var offset int64
+	for offset+8 < fileSize {
+		boxType, headerSize, boxSize, ok := readHEIFBoxHeader(r, offset, fileSize)
+		if !ok {
+			break
+		}
+
+		if offset == 0 && boxType != "ftyp" {
+			return meta
+		}
+
+		if boxSize > fileSize-offset {
+			meta.MissingBytes = boxSize - (fileSize - offset)
+			boxSize = fileSize - offset
+		}
+		meta.Boxes = append(meta.Boxes, boxType)
+
+		switch boxType {
+		case "ftyp", "meta", "moov", "pixi", "colr", "auxC":
+		default:
+			offset += boxSize
+			continue
+		}
+
+		payloadSize := boxSize - headerSize
+		if payloadSize > heifMaxBoxPayload {
+			offset += boxSize
+			continue
+		}
+
+		boxData := make([]byte, payloadSize)
+		if _, err := io.ReadFull(r, boxData); err != nil {
+			break
+		}
+
+		switch boxType {
+		case "ftyp":
+			if len(boxData) >= 8 {
+				meta.MajorBrand = string(boxData[0:4])
+				for i := 8; i+4 <= len(boxData); i += 4 {
+					meta.CompatibleBrands = append(meta.CompatibleBrands, string(boxData[i:i+4]))
+				}
+			}
+
+		case "meta":
+			parseMetaBox(boxData, &meta)
+
+		case "moov":
+			parseMoovBox(boxData, &meta)
+
+		case "pixi":
+			parsePixiBox(boxData, &meta)
+
+		case "colr":
+			applyColr(boxData, &meta)
+
+		case "auxC":
+			if bytes.Contains(boxData, []byte("urn:mpeg:mpegB:cicp:systems:auxiliary:alpha")) {
+				meta.HasAlpha = true
+			}
+			if bytes.Contains(boxData, []byte("urn:com:apple:photo:2020:aux:hdrgainmap")) {
+				meta.HasGainMap = true
+			}
+		}
+
+		offset += boxSize
+	}
+
+	resolveHEIFCanvas(r, &meta)
+	resolveHEIFColorSpace(&meta)
+	if meta.items.types[meta.items.primary] == "grid" {
+		meta.TileCount = len(meta.items.derived[meta.items.primary])
+	}
+	meta.Codec = resolveHEIFCodec(&meta)
+	meta.XMP = resolveHEIFXMP(r, &meta)
+
+	return meta
+}
+
+const heifMaxBoxPayload = 16 << 20
+
+func readHEIFBoxHeader(r io.ReadSeeker, offset, fileSize int64) (string, int64, int64, bool) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return "", 0, 0, false
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, 0, false
+	}
+
+	boxType := string(header[4:8])
+	headerSize := int64(8)
+	boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+
+	switch boxSize {
+	case 0:
+		boxSize = fileSize - offset
+	case 1:
+		if _, err := io.ReadFull(r, header); err != nil {
+			return "", 0, 0, false
+		}
+		largeSize := binary.BigEndian.Uint64(header)
+		if largeSize > uint64(1<<62) {
+			return "", 0, 0, false
+		}
+		boxSize = int64(largeSize)
+		headerSize = 16
+	}
+
+	if boxSize < headerSize {
+		return "", 0, 0, false
+	}
+
+	return boxType, headerSize, boxSize, true
+}
+
+func parseMetaBox(data []byte, meta *heifMetadata) {
+	offset := 4
+
+	for offset+8 < len(data) {
+		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
+		boxType := string(data[offset+4 : offset+8])
+
+		if boxSize < 8 || offset+int(boxSize) > len(data) {
+			break
+		}
+
+		boxData := data[offset+8 : offset+int(boxSize)]
+
+		switch boxType {
+		case "iprp":
+			parseIprpBox(boxData, meta)
+		case "pitm":
+			parsePitmBox(boxData, meta)
+		case "iinf":
+			parseIinfBox(boxData, meta)
+		case "iref":
+			parseIrefBox(boxData, meta)
+		case "iloc":
+			parseIlocBox(boxData, meta)
+		case "idat":
+			meta.items.itemData = boxData
+		}
+
+		offset += int(boxSize)
+	}
+
+	applyHEIFItemProperties(meta)
+}
+
+func parseIprpBox(data []byte, meta *heifMetadata) {
+	offset := 0
+
+	for offset+8 < len(data) {
+		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
+		boxType := string(data[offset+4 : offset+8])
+
+		if boxSize < 8 || offset+int(boxSize) > len(data) {
+			break
+		}
+
+		boxData := data[offset+8 : offset+int(boxSize)]
+
+		switch boxType {
+		case "ipco":
+			parseIpcoBox(boxData, meta)
+		case "ipma":
+			parseIpmaBox(boxData, meta)
+		}
+
+		offset += int(boxSize)
+	}
+}
+
+func parsePixiBox(data []byte, meta *heifMetadata) {
+	if len(data) < 6 {
+		return
+	}
+
+	numChannels := int(data[4])
+	if numChannels == 0 || len(data) < 5+numChannels {
+		return
+	}
+
+	meta.ChannelBitDepths = make([]int, numChannels)
+	meta.BitDepth = 0
+	for i := range meta.ChannelBitDepths {
+		depth := int(data[5+i])
+		meta.ChannelBitDepths[i] = depth
+		meta.BitDepth = max(meta.BitDepth, depth)
+	}
+	setHEIFConfidence(meta, "bit_depth", ConfidenceAuthoritative)
+}
+
+func parseIpcoBox(data []byte, meta *heifMetadata) {
+	offset := 0
+	index := 0
+
+	for offset+8 < len(data) {
+		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
+		boxType := string(data[offset+4 : offset+8])
+
+		if boxSize < 8 || offset+int(boxSize) > len(data) {
+			break
+		}
+
+		boxData := data[offset+8 : offset+int(boxSize)]
+		index++
+
+		switch boxType {
+		case "ispe":
+			if len(boxData) >= 12 {
+				if meta.items.extents == nil {
+					meta.items.extents = make(map[int][2]int)
+				}
+				meta.items.extents[index] = [2]int{
+					int(binary.BigEndian.Uint32(boxData[4:8])),
+					int(binary.BigEndian.Uint32(boxData[8:12])),
+				}
+			}
+
+		case "pixi", "colr", "pasp":
+			if meta.items.boxes == nil {
+				meta.items.boxes = make(map[int]heifProperty)
+			}
+			meta.items.boxes[index] = heifProperty{boxType: boxType, data: boxData}
+
+		case "auxC":
+			if bytes.Contains(boxData, []byte("urn:mpeg:mpegB:cicp:systems:auxiliary:alpha")) {
+				meta.HasAlpha = true
+			}
+			if bytes.Contains(boxData, []byte("urn:com:apple:photo:2020:aux:hdrgainmap")) {
+				meta.HasGainMap = true
+			}
+		}
+
+		offset += int(boxSize)
+	}
+}
+
+func applyHEIFItemProperties(meta *heifMetadata) {
+	if len(meta.items.boxes) == 0 {
+		return
+	}
+
+	indices := meta.items.properties[meta.items.primary]
+	if len(meta.items.properties) == 0 {
+		for index := range meta.items.boxes {
+			indices = append(indices, index)
+		}
+		sort.Ints(indices)
+	}
+
+	applied := make(map[string]bool)
+	for _, index := range indices {
+		if property, ok := meta.items.boxes[index]; ok {
+			applyHEIFProperty(property, meta)
+			applied[property.boxType] = true
+		}
+	}
+
+	if tiles := meta.items.derived[meta.items.primary]; len(tiles) > 0 {
+		for _, index := range meta.items.properties[tiles[0]] {
+			if property, ok := meta.items.boxes[index]; ok && !applied[property.boxType] {
+				applyHEIFProperty(property, meta)
+			}
+		}
+	}
+}
+
+func applyHEIFProperty(property heifProperty, meta *heifMetadata) {
+	switch property.boxType {
+	case "pixi":
+		parsePixiBox(property.data, meta)
+	case "colr":
+		applyColr(property.data, meta)
+	case "pasp":
+		if len(property.data) >= 8 {
+			hSpacing := binary.BigEndian.Uint32(property.data[0:4])
+			vSpacing := binary.BigEndian.Uint32(property.data[4:8])
+			if hSpacing > 0 && vSpacing > 0 {
+				meta.PixelAspectRatio = float64(hSpacing) / float64(vSpacing)
+			}
+		}
+	}
+}
+
+func parsePitmBox(data []byte, meta *heifMetadata) {
+	if len(data) < 6 {
+		return
+	}
+
+	if data[0] == 0 {
+		meta.items.primary = uint32(binary.BigEndian.Uint16(data[4:6]))
+	} else if len(data) >= 8 {
+		meta.items.primary = binary.BigEndian.Uint32(data[4:8])
+	}
+}
+
+func parseIinfBox(data []byte, meta *heifMetadata) {
+	offset := 6
+	if len(data) > 0 && data[0] != 0 {
+		offset = 8
+	}
+
+	for offset+8 < len(data) {
+		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
+		boxType := string(data[offset+4 : offset+8])
+
+		if boxSize < 8 || offset+int(boxSize) > len(data) {
+			break
+		}
+
+		boxData := data[offset+8 : offset+int(boxSize)]
+
+		if boxType == "infe" && len(boxData) >= 4 {
+			version := boxData[0]
+			var itemID uint32
+			var itemType string
+			var rest []byte
+
+			switch {
+			case version == 2 && len(boxData) >= 12:
+				itemID = uint32(binary.BigEndian.Uint16(boxData[4:6]))
+				itemType = string(boxData[8:12])
+				rest = boxData[12:]
+			case version >= 3 && len(boxData) >= 14:
+				itemID = binary.BigEndian.Uint32(boxData[4:8])
+				itemType = string(boxData[10:14])
+				rest = boxData[14:]
+			}
+
+			if itemType != "" {
+				if meta.items.types == nil {
+					meta.items.types = make(map[uint32]string)
+				}
+				meta.items.types[itemID] = itemType
+			}
+
+			if itemType == "mime" {
+				fields := bytes.SplitN(rest, []byte{0}, 3)
+				if len(fields) >= 2 {
+					if meta.items.mimeTypes == nil {
+						meta.items.mimeTypes = make(map[uint32]string)
+					}
+					meta.items.mimeTypes[itemID] = string(fields[1])
+				}
+			}
+		}
+
+		offset += int(boxSize)
+	}
+}
+
+func parseIrefBox(data []byte, meta *heifMetadata) {
+	if len(data) < 4 {
+		return
+	}
+
+	idSize := 2
+	if data[0] != 0 {
+		idSize = 4
+	}
+
+	readID := func(b []byte) uint32 {
+		if idSize == 2 {
+			return uint32(binary.BigEndian.Uint16(b))
+		}
+		return binary.BigEndian.Uint32(b)
+	}
+
+	offset := 4
+	for offset+8 < len(data) {
+		boxSize := binary.BigEndian.Uint32(data[offset : offset+4])
+		boxType := string(data[offset+4 : offset+8])
+
+		if boxSize < 8 || offset+int(boxSize) > len(data) {
+			break
+		}
+
+		boxData := data[offset+8 : offset+int(boxSize)]
+
+		if boxType == "dimg" && len(boxData) >= idSize+2 {
+			fromID := readID(boxData[0:idSize])
+			count := int(binary.BigEndian.Uint16(boxData[idSize : idSize+2]))
+
+			if meta.items.derived == nil {
+				meta.items.derived = make(map[uint32][]uint32)
+			}
+			pos := idSize + 2
+			for i := 0; i < count && pos+idSize <= len(boxData); i++ {
+				meta.items.derived[fromID] = append(meta.items.derived[fromID], readID(boxData[pos:pos+idSize]))
+				pos += idSize
+			}
+		}
+
+		offset += int(boxSize)
+	}
+}
+
+func parseIlocBox(data []byte, meta *heifMetadata) {
+	if len(data) < 8 {
+		return
+	}
+
+	version := data[0]
+	offsetSize := int(data[4] >> 4)
+	lengthSize := int(data[4] & 0x0F)
+	baseOffsetSize := int(data[5] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(data[5] & 0x0F)
+	}
+
+	pos := 6
+	readUint := func(size int) (uint64, bool) {
+		if pos+size > len(data) {
+			return 0, false
+		}
+		var value uint64
+		for i := 0; i < size; i++ {
+			value = value<<8 | uint64(data[pos+i])
+		}
+		pos += size
+		return value, true
+	}
+
+	itemCountSize := 2
+	if version == 2 {
+		itemCountSize = 4
+	}
+	itemCount, ok := readUint(itemCountSize)
+	if !ok {
+		return
+	}
+
+	for i := uint64(0); i < itemCount; i++ {
+		idSize := 2
+		if version == 2 {
+			idSize = 4
+		}
+		itemID, ok := readUint(idSize)
+		if !ok {
+			return
+		}
+
+		location := heifItemLocation{}
+		if version == 1 || version == 2 {
+			method, ok := readUint(2)
+			if !ok {
+				return
+			}
+			location.constructionMethod = int(method & 0x0F)
+		}
+
+		if _, ok := readUint(2); !ok {
+			return
+		}
+		baseOffset, ok := readUint(baseOffsetSize)
+		if !ok {
+			return
+		}
+		extentCount, ok := readUint(2)
+		if !ok {
+			return
+		}
+
+		for e := uint64(0); e < extentCount; e++ {
+			if _, ok := readUint(indexSize); !ok {
+				return
+			}
+			extentOffset, ok := readUint(offsetSize)
+			if !ok {
+				return
+			}
+			extentLength, ok := readUint(lengthSize)
+			if !ok {
+				return
+			}
+			if e == 0 {
+				location.offset = baseOffset + extentOffset
+				location.length = extentLength
+			}
+		}
+
+		if meta.items.locations == nil {
+			meta.items.locations = make(map[uint32]heifItemLocation)
+		}
+		meta.items.locations[uint32(itemID)] = location
+	}
+}
+
+func parseIpmaBox(data []byte, meta *heifMetadata) {
+	if len(data) < 8 {
+		return
+	}
+
+	version := data[0]
+	largeIndex := data[3]&1 != 0
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+
+	pos := 8
+	for i := 0; i < count; i++ {
+		var itemID uint32
+		if version < 1 {
+			if pos+2 > len(data) {
+				return
+			}
+			itemID = uint32(binary.BigEndian.Uint16(data[pos : pos+2]))
+			pos += 2
+		} else {
+			if pos+4 > len(data) {
+				return
+			}
+			itemID = binary.BigEndian.Uint32(data[pos : pos+4])
+			pos += 4
+		}
+
+		if pos >= len(data) {
+			return
+		}
+		associations := int(data[pos])
+		pos++
+
+		for a := 0; a < associations; a++ {
+			var index int
+			if largeIndex {
+				if pos+2 > len(data) {
+					return
+				}
+				index = int(binary.BigEndian.Uint16(data[pos:pos+2]) & 0x7FFF)
+				pos += 2
+			} else {
+				if pos >= len(data) {
+					return
+				}
+				index = int(data[pos] & 0x7F)
+				pos++
+			}
+
+			if meta.items.properties == nil {
+				meta.items.properties = make(map[uint32][]int)
+			}
+			meta.items.properties[itemID] = append(meta.items.properties[itemID], index)
+		}
+	}
+}
+
+func heifItemExtent(meta *heifMetadata, itemID uint32) (int, int, bool) {
+	for _, index := range meta.items.properties[itemID] {
+		if extent, ok := meta.items.extents[index]; ok {
+			return extent[0], extent[1], true
+		}
+	}
+	return 0, 0, false
+}
+
+func heifItemPayload(r io.ReadSeeker, meta *heifMetadata, itemID uint32) []byte {
+	location, ok := meta.items.locations[itemID]
+	if !ok {
+		return nil
+	}
+
+	switch location.constructionMethod {
+	case 0:
+		fileSize, err := r.Seek(0, io.SeekEnd)
+		if err != nil || location.offset > uint64(fileSize) {
+			return nil
+		}
+
+		length := location.length
+		if length == 0 {
+			length = uint64(fileSize) - location.offset
+		}
+		if location.offset+length > uint64(fileSize) || length > heifMaxBoxPayload {
+			return nil
+		}
+
+		if _, err := r.Seek(int64(location.offset), io.SeekStart); err != nil {
+			return nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+		return payload
+	case 1:
+		source := meta.items.itemData
+		length := location.length
+		if length == 0 && location.offset <= uint64(len(source)) {
+			length = uint64(len(source)) - location.offset
+		}
+		if location.offset+length > uint64(len(source)) {
+			return nil
+		}
+		return source[location.offset : location.offset+length]
+	default:
+		return nil
+	}
+}
+
+func parseImageGrid(data []byte) (rows, columns, width, height int, ok bool) {
+	if len(data) < 8 {
+		return 0, 0, 0, 0, false
+	}
+
+	rows = int(data[2]) + 1
+	columns = int(data[3]) + 1
+
+	if data[1]&1 == 0 {
+		width = int(binary.BigEndian.Uint16(data[4:6]))
+		height = int(binary.BigEndian.Uint16(data[6:8]))
+	} else {
+		if len(data) < 12 {
+			return 0, 0, 0, 0, false
+		}
+		width = int(binary.BigEndian.Uint32(data[4:8]))
+		height = int(binary.BigEndian.Uint32(data[8:12]))
+	}
+
+	return rows, columns, width, height, true
+}
+
+func resolveHEIFCanvas(r io.ReadSeeker, meta *heifMetadata) {
+	primary := meta.items.primary
+
+	if width, height, ok := heifItemExtent(meta, primary); ok {
+		meta.Width, meta.Height = width, height
+		return
+	}
+
+	if meta.items.types[primary] != "grid" {
+		return
+	}
+
+	tiles := meta.items.derived[primary]
+	rows, columns := 1, len(tiles)
+	if gridRows, gridColumns, width, height, ok := parseImageGrid(heifItemPayload(r, meta, primary)); ok {
+		if width > 0 && height > 0 {
+			meta.Width, meta.Height = width, height
+			return
+		}
+		rows, columns = gridRows, gridColumns
+	}
+
+	if len(tiles) > 0 {
+		if tileWidth, tileHeight, ok := heifItemExtent(meta, tiles[0]); ok {
+			meta.Width, meta.Height = columns*tileWidth, rows*tileHeight
+		}
+	}
+}
+
+func forEachHEIFBox(data []byte, fn func(boxType string, payload []byte)) {
+	offset := 0
+	for offset+8 <= len(data) {
+		boxSize := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		if boxSize < 8 || offset+boxSize > len(data) {
+			return
+		}
+		fn(string(data[offset+4:offset+8]), data[offset+8:offset+boxSize])
+		offset += boxSize
+	}
+}
+
+func parseMoovBox(data []byte, meta *heifMetadata) {
+	forEachHEIFBox(data, func(boxType string, trak []byte) {
+		if boxType != "trak" || meta.FrameCount > 0 {
+			return
+		}
+
+		var width, height, samples int
+		var handler string
+		forEachHEIFBox(trak, func(boxType string, payload []byte) {
+			switch boxType {
+			case "tkhd":
+				if len(payload) >= 84 {
+					width = int(binary.BigEndian.Uint32(payload[len(payload)-8:]) >> 16)
+					height = int(binary.BigEndian.Uint32(payload[len(payload)-4:]) >> 16)
+				}
+			case "mdia":
+				forEachHEIFBox(payload, func(boxType string, payload []byte) {
+					switch boxType {
+					case "hdlr":
+						if len(payload) >= 12 {
+							handler = string(payload[8:12])
+						}
+					case "minf":
+						forEachHEIFBox(payload, func(boxType string, payload []byte) {
+							if boxType != "stbl" {
+								return
+							}
+							forEachHEIFBox(payload, func(boxType string, payload []byte) {
+								if boxType == "stsz" && len(payload) >= 12 {
+									samples = int(binary.BigEndian.Uint32(payload[8:12]))
+								}
+							})
+						})
+					}
+				})
+			}
+		})
+
+		if handler != "pict" && handler != "vide" {
+			return
+		}
+		meta.FrameCount = samples
+		if meta.Width == 0 && meta.Height == 0 {
+			meta.Width, meta.Height = width, height
+		}
+	})
+}
+
+func decodeHEIFSequenceConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(io.LimitReader(r, heifMaxBoxPayload))
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	meta := parseHEIFMetadata(bytes.NewReader(data))
+	return image.Config{
+		ColorModel: color.YCbCrModel,
+		Width:      meta.Width,
+		Height:     meta.Height,
+	}, nil
+}
+
+func heifCodecName(code string) string {
+	switch code {
+	case "hvc1", "hev1", "heic", "heix", "heim", "heis", "hevc", "hevx":
+		return "HEVC"
+	case "av01", "avif", "avis":
+		return "AV1"
+	case "jpeg", "jpgs":
+		return "JPEG"
+	case "vvc1", "vvi1", "vvic":
+		return "VVC"
+	case "unci":
+		return "Uncompressed"
+	default:
+		return ""
+	}
+}
+
+func resolveHEIFXMP(r io.ReadSeeker, meta *heifMetadata) []byte {
+	var xmpID uint32
+	found := false
+	for id, mimeType := range meta.items.mimeTypes {
+		if mimeType == "application/rdf+xml" && (!found || id < xmpID) {
+			xmpID = id
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return heifItemPayload(r, meta, xmpID)
+}
+
+func resolveHEIFCodec(meta *heifMetadata) string {
+	primary := meta.items.primary
+	itemType := meta.items.types[primary]
+	if itemType == "grid" || itemType == "iovl" {
+		if tiles := meta.items.derived[primary]; len(tiles) > 0 {
+			itemType = meta.items.types[tiles[0]]
+		}
+	}
+	if codec := heifCodecName(itemType); codec != "" {
+		return codec
+	}
+
+	if codec := heifCodecName(meta.MajorBrand); codec != "" {
+		return codec
+	}
+	for _, brand := range meta.CompatibleBrands {
+		if codec := heifCodecName(brand); codec != "" {
+			return codec
+		}
+	}
+
+	return ""
+}
+
+func applyPixelAspectRatio(info *ImageInfo) {
+	if info.PixelAspectRatio <= 0 || info.PixelAspectRatio == 1 {
+		return
+	}
+
+	info.DisplayWidth = int(math.Round(float64(info.Width) * info.PixelAspectRatio))
+	info.DisplayHeight = info.Height
+}
+
+func analyzeISOBMFF(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+	info.CompressionType = CompressionHybrid
+
+	metadata := parseHEIFMetadata(r)
+
+	info.ColorModel = metadata.ColorModel
+	info.HasAlpha = metadata.HasAlpha
+	info.HasGainMap = metadata.HasGainMap
+	info.BitDepth = metadata.BitDepth
+	info.ChannelBitDepths = metadata.ChannelBitDepths
+	info.UniformBitDepth = uniformBitDepth(metadata.ChannelBitDepths)
+	info.ColorSpace = metadata.ColorSpace
+	info.WideGamut = isWideGamut(metadata.ColorSpace)
+	info.CICP = metadata.CICP
+	info.ChromaSubsampling = metadata.ChromaSubsampling
+	info.HDRType = metadata.HDRType
+	info.Codec = metadata.Codec
+	info.FrameCount = metadata.FrameCount
+	info.Tiled = metadata.TileCount > 0
+	info.TileCount = metadata.TileCount
+	info.PixelAspectRatio = metadata.PixelAspectRatio
+	info.Confidence = metadata.Confidence
+	info.HasICCProfile = len(metadata.ICCProfile) > 0
+	info.ICCProfileSize = len(metadata.ICCProfile)
+	setXMP(info, metadata.XMP)
+	setMissingBytes(info, metadata.MissingBytes)
+	if metadata.ColorConflict != "" {
+		addWarning(info, metadata.ColorConflict)
+	}
+
+	if metadata.Width > 0 && metadata.Height > 0 {
+		info.Width = metadata.Width
+		info.Height = metadata.Height
+	}
+
+	explainHEIF(info, &metadata)
+	applyPixelAspectRatio(info)
+}
+
+func isWideGamut(cs ColorSpace) bool {
+	return cs == ColorSpaceBT2020 || cs == ColorSpaceDisplayP3
+}
+
+func explainHEIF(info *ImageInfo, meta *heifMetadata) {
+	explain(info, "boxes found: %s", strings.Join(meta.Boxes, ", "))
+	if meta.MajorBrand != "" {
+		explain(info, "major brand %s (compatible: %s) from ftyp box", meta.MajorBrand, strings.Join(meta.CompatibleBrands, ", "))
+	}
+	if meta.Codec != "" {
+		explain(info, "codec %s from the primary item type", meta.Codec)
+	}
+	if meta.Width > 0 && meta.Height > 0 {
+		explain(info, "dimensions %dx%d from ispe property or grid", meta.Width, meta.Height)
+	}
+	if meta.TileCount > 0 {
+		explain(info, "%d tiles from the grid item's dimg references", meta.TileCount)
+	}
+
+	if meta.Confidence["bit_depth"] == ConfidenceAuthoritative {
+		explain(info, "bit depth %d from pixi property", info.BitDepth)
+	} else {
+		explain(info, "bit depth %d by default: no pixi property", info.BitDepth)
+	}
+	switch meta.Confidence["color_space"] {
+	case ConfidenceAuthoritative:
+		explain(info, "color space %s from colr nclx color primaries", info.ColorSpace)
+	case ConfidenceHeuristic:
+		explain(info, "color space %s from colr ICC profile substring match (%d-byte profile)", info.ColorSpace, len(meta.ICCProfile))
+	default:
+		explain(info, "color space %s by default: no recognized colr nclx box", info.ColorSpace)
+	}
+	if meta.ColorConflict != "" {
+		explain(info, "%s; the nclx value is reported", meta.ColorConflict)
+	}
+	if info.WideGamut {
+		explain(info, "wide gamut because the primaries are %s, independent of the transfer function", info.ColorSpace)
+	}
+	if meta.Confidence["hdr_type"] == ConfidenceAuthoritative {
+		explain(info, "HDR type %s from colr nclx transfer characteristics", info.HDRType)
+	}
+	explain(info, "chroma subsampling %s by default", info.ChromaSubsampling)
+
+	if info.HasAlpha {
+		explain(info, "alpha from auxC alpha auxiliary image")
+	}
+	if info.HasGainMap {
+		explain(info, "gain map from auxC hdrgainmap auxiliary image")
+	}
+	if info.FrameCount > 0 {
+		explain(info, "%d frames from moov sample sizes", info.FrameCount)
+	}
+}
+
+func uniformBitDepth(depths []int) bool {
+	for _, depth := range depths {
+		if depth != depths[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseColorSpace(cs string) ColorSpace {
+	switch cs {
+	case "sRGB", "sRGB (ICC)":
+		return ColorSpaceSRGB
+	case "Adobe RGB":
+		return ColorSpaceAdobeRGB
+	case "BT.709":
+		return ColorSpaceBT709
+	case "BT.2020":
+		return ColorSpaceBT2020
+	case "Display P3":
+		return ColorSpaceDisplayP3
+	case "Untagged":
+		return ColorSpaceUntagged
+	case "Gray":
+		return ColorSpaceGray
+	default:
+		return ColorSpaceSRGB
+	}
+}
+
+type webpMetadata struct {
+	Lossless          bool
+	ChromaSubsampling ChromaSubsampling
+	HasAlpha          bool
+	ICCProfile        []byte
+	CanvasWidth       int
+	CanvasHeight      int
+}
+
+func detectWebPFormat(r io.ReadSeeker) webpMetadata {
+	meta := webpMetadata{ChromaSubsampling: ChromaSubsamplingUnknown}
+
+	_, _ = r.Seek(0, 0)
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return meta
+	}
+
+	if string(header[0:4]) != "RIFF" {
+		return meta
+	}
+
+	if string(header[8:12]) != "WEBP" {
+		return meta
+	}
+
+	imageFound := false
+	chunkHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunkHeader[:4]); err != nil {
+			return meta
+		}
+		fourCC := string(chunkHeader[:4])
+
+		if !imageFound {
+			switch fourCC {
+			case "VP8L":
+				meta.Lossless = true
+				meta.ChromaSubsampling = ChromaSubsamplingNA
+				imageFound = true
+			case "VP8 ":
+				meta.ChromaSubsampling = ChromaSubsampling420
+				imageFound = true
+			}
+		}
+
+		if _, err := io.ReadFull(r, chunkHeader[4:8]); err != nil {
+			return meta
+		}
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+		padded := size + size&1
+
+		switch fourCC {
+		case "VP8X":
+			if size < 10 {
+				_, _ = r.Seek(padded, 1)
+				continue
+			}
+			vp8x := make([]byte, 10)
+			if _, err := io.ReadFull(r, vp8x); err != nil {
+				return meta
+			}
+			if vp8x[0]&0x10 != 0 {
+				meta.HasAlpha = true
+			}
+			meta.CanvasWidth = int(uint32(vp8x[4])|uint32(vp8x[5])<<8|uint32(vp8x[6])<<16) + 1
+			meta.CanvasHeight = int(uint32(vp8x[7])|uint32(vp8x[8])<<8|uint32(vp8x[9])<<16) + 1
+			_, _ = r.Seek(padded-10, 1)
+
+		case "VP8L":
+			vp8lHeader := make([]byte, 5)
+			if _, err := io.ReadFull(r, vp8lHeader); err != nil {
+				return meta
+			}
+			if vp8lHeader[0] == 0x2F && binary.LittleEndian.Uint32(vp8lHeader[1:5])&(1<<28) != 0 {
+				meta.HasAlpha = true
+			}
+			_, _ = r.Seek(padded-5, 1)
+
+		case "ALPH":
+			meta.HasAlpha = true
+			_, _ = r.Seek(padded, 1)
+
+		case "ICCP":
+			if size > heifMaxBoxPayload {
+				_, _ = r.Seek(padded, 1)
+				continue
+			}
+			iccData, err := io.ReadAll(io.LimitReader(r, size))
+			if err != nil || int64(len(iccData)) < size {
+				return meta
+			}
+			meta.ICCProfile = iccData
+			_, _ = r.Seek(padded-size, 1)
+
+		case "ANMF":
+			_, _ = r.Seek(16, 1)
+
+		default:
+			_, _ = r.Seek(padded, 1)
+		}
+	}
+}
+
+type sizeScope struct {
+	allImages bool
+	allFrames bool
+	mipmaps   bool
+}
+
+func analyzeFile(filename string, opts Options) (*ImageInfo, error) {
+	input, size, err := openInputAt(filename, opts.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = input.Close() }()
+
+	return analyzeInput(input, filename, size, opts)
+}
+
+func analyzeInput(r io.ReadSeeker, filename string, size int64, opts Options) (*ImageInfo, error) {
+	info, err := analyzeReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Filename = filename
+	applySizeEstimate(info, size, opts.Scales, opts.sizeScope(), opts.EstimateModel)
+	checkExtension(info, filename)
+	return info, nil
+}
+
+var extensionFormats = map[string]string{
+	".png":   "png",
+	".jpg":   "jpeg",
+	".jpeg":  "jpeg",
+	".jpe":   "jpeg",
+	".jfif":  "jpeg",
+	".jif":   "jpeg",
+	".webp":  "webp",
+	".heic":  "heif",
+	".heif":  "heif",
+	".heics": "heif",
+	".hif":   "heif",
+	".avif":  "avif",
+	".avifs": "avif",
+	".avis":  "avif",
+	".ico":   "ico",
+	".exr":   "exr",
+	".hdr":   "hdr",
+	".svg":   "svg",
+	".dds":   "dds",
+	".gif":   "gif",
+	".jp2":   "jp2",
+	".j2k":   "jp2",
+	".j2c":   "jp2",
+	".jpx":   "jp2",
+	".tif":   "tiff",
+	".tiff":  "tiff",
+}
+
+func checkExtension(info *ImageInfo, filename string) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	expected, ok := extensionFormats[ext]
+	if !ok || expected == info.Format {
+		return
+	}
+
+	source := "content"
+	if (expected == "heif" || expected == "avif") && (info.Format == "heif" || info.Format == "avif") {
+		source = "brand"
+	}
+	addWarning(info, fmt.Sprintf("extension %s but %s %s", ext, source, info.Format))
+}
+
+type Options struct {
+	JSONOutput            bool
+	CompactJSON           bool
+	Fields                []string
+	Quiet                 bool
+	UseColor              bool
+	Scales                []int
+	AllImages             bool
+	AllFrames             bool
+	Mipmaps               bool
+	CompressedArchiveSize bool
+	DecodeTime            bool
+	Strict                bool
+	HashAlgorithm         string
+	PerceptualHash        bool
+	DetectGrayscale       bool
+	CountColors           bool
+	Budgets               map[string]int64
+	Offset                int64
+	MinRatio              float64
+	MaxRatio              float64
+	EstimateModel         string
+	CompareTo             string
+	Quality               int
+	GPU                   bool
+	GPUMipmaps            bool
+	Raw                   *RawSpec
+	JSONArray             bool
+	ErrorsOnly            bool
+	CompactErrors         bool
+	Histogram             bool
+	Summary               bool
+	SummaryJSON           bool
+	Sidecar               bool
+	OutputDir             string
+	XMPWriter             io.Writer
+	FileTimeout           time.Duration
+	Retries               int
+	Sample                int
+	Seed                  int64
+	ExitOnWarning         bool
+	WarnAvgRatio          float64
+}
+
+func (o Options) sizeScope() sizeScope {
+	return sizeScope{allImages: o.AllImages, allFrames: o.AllFrames, mipmaps: o.Mipmaps}
+}
+
+func (o Options) showsRatio(ratio float64) bool {
+	return (o.MinRatio <= 0 || ratio >= o.MinRatio) && (o.MaxRatio <= 0 || ratio <= o.MaxRatio)
+}
+
+func estimateDecodedSize(filename string, opts Options) (*ImageInfo, error) {
+	info, err := analyzeDecodedSize(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := printResult(info, opts); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func analyzeDecodedSize(filename string, opts Options) (*ImageInfo, error) {
+	input, size, err := openInputAt(filename, opts.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = input.Close() }()
+
+	info, err := analyzeInput(input, filename, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyOptions(input, info, opts); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func printResult(info *ImageInfo, opts Options) error {
+	if !opts.showsRatio(info.CompressionRatio) {
+		return nil
+	}
+
+	if opts.JSONOutput {
+		return writeSelectedJSON(os.Stdout, info, opts.Fields, opts.CompactJSON)
+	}
+	if !opts.Quiet {
+		printImageInfo(info, opts.Scales, opts.UseColor)
+	}
+	return nil
+}
+
+func applyOptions(input io.ReadSeeker, info *ImageInfo, opts Options) error {
+	applyBudget(info, opts.Budgets)
+	applyGPUEstimate(info, opts)
+
+	if opts.DecodeTime || opts.Strict {
+		_, _ = input.Seek(0, io.SeekStart)
+		duration, err := measureDecodeTime(input)
+		if err != nil && !errors.Is(err, errDecodeUnsupported) {
+			return fmt.Errorf("decode: %w", err)
+		}
+		if opts.DecodeTime {
+			info.DecodeDurationMs = duration
+		}
+	}
+
+	var err error
+	if opts.HashAlgorithm != "" {
+		_, _ = input.Seek(0, io.SeekStart)
+		info.ContentHash, err = computeContentHash(input, opts.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.PerceptualHash {
+		_, _ = input.Seek(0, io.SeekStart)
+		info.PerceptualHash, err = computePerceptualHash(input)
+		if err != nil && !errors.Is(err, errDecodeUnsupported) {
+			return fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	if opts.DetectGrayscale && info.ColorModel != ColorModelGrayscale {
+		_, _ = input.Seek(0, io.SeekStart)
+		info.EffectivelyGrayscale, err = isEffectivelyGrayscale(input)
+		if err != nil && !errors.Is(err, errDecodeUnsupported) {
+			return fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	if opts.CountColors && info.ColorModel == ColorModelIndexed {
+		_, _ = input.Seek(0, io.SeekStart)
+		info.DistinctColors, err = countDistinctColors(input)
+		if err != nil && !errors.Is(err, errDecodeUnsupported) {
+			return fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	if opts.CompareTo != "" {
+		_, _ = input.Seek(0, io.SeekStart)
+		size, err := reencodeSize(input, opts.CompareTo, opts.Quality)
+		if err != nil && !errors.Is(err, errDecodeUnsupported) {
+			return fmt.Errorf("reencode: %w", err)
+		}
+		if err == nil {
+			applyReencode(info, opts.CompareTo, size)
+		}
+	}
+
+	return nil
+}
+
+const maxFrameSize = 256 << 20
+
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d-byte limit", length, maxFrameSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+func writeFrame(w io.Writer, payload []byte) error {
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func analyzePayload(payload []byte, opts Options) ([]byte, error) {
+	input := bytes.NewReader(payload)
+	info, err := analyzeInput(input, "", int64(len(payload)), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyOptions(input, info, opts); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeSelectedJSON(&buf, info, opts.Fields, true); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func serveConn(conn io.ReadWriter, opts Options) error {
+	for {
+		payload, err := readFrame(conn)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		response, err := analyzePayload(payload, opts)
+		if err != nil {
+			response, _ = json.Marshal(map[string]interface{}{
+				"error":     err.Error(),
+				"exit_code": categorizeError(err),
+			})
+		}
+		if err := writeFrame(conn, response); err != nil {
+			return err
+		}
+	}
+}
+
+func runServer(path string, opts Options) error {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer func() { _ = conn.Close() }()
+			if err := serveConn(conn, opts); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}()
+	}
+}
+
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("invalid hash algorithm %q (want md5, sha1 or sha256)", algorithm)
+	}
+}
+
+func computeContentHash(r io.Reader, algorithm string) (string, error) {
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func computePerceptualHash(r io.Reader) (string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+
+	const hashWidth, hashHeight = 9, 8
+	bounds := img.Bounds()
+	if bounds.Dx() <= 0 || bounds.Dy() <= 0 {
+		return "", errors.New("phash: empty image")
+	}
+
+	var luma [hashHeight][hashWidth]float64
+	for y := 0; y < hashHeight; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/hashHeight
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/hashHeight, y0+1)
+		for x := 0; x < hashWidth; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/hashWidth
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/hashWidth, x0+1)
+
+			var sum float64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sum += float64(color.GrayModel.Convert(img.At(sx, sy)).(color.Gray).Y)
+				}
+			}
+			luma[y][x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < hashHeight; y++ {
+		for x := 0; x < hashWidth-1; x++ {
+			hash <<= 1
+			if luma[y][x] < luma[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+func isEffectivelyGrayscale(r io.Reader) (bool, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return false, err
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			red, green, blue, _ := img.At(x, y).RGBA()
+			if red != green || green != blue {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func countDistinctColors(r io.Reader) (int, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+
+	bounds := img.Bounds()
+	if paletted, ok := img.(*image.Paletted); ok {
+		used := make([]bool, len(paletted.Palette))
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if index := int(paletted.ColorIndexAt(x, y)); index < len(used) {
+					used[index] = true
+				}
+			}
+		}
+
+		colors := make(map[color.RGBA64]struct{})
+		for index, inUse := range used {
+			if inUse {
+				colors[color.RGBA64Model.Convert(paletted.Palette[index]).(color.RGBA64)] = struct{}{}
+			}
+		}
+		return len(colors), nil
+	}
+
+	colors := make(map[color.RGBA64]struct{})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			colors[color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)] = struct{}{}
+		}
+	}
+	return len(colors), nil
+}
+
+func perceptualHashDistance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
+
+func uniqueDecodedSize(results []*ImageInfo) (int64, int) {
+	seen := make(map[string]bool)
+	var unique int64
+	duplicates := 0
+	for _, info := range results {
+		if info.ContentHash != "" {
+			if seen[info.ContentHash] {
+				duplicates++
+				continue
+			}
+			seen[info.ContentHash] = true
+		}
+		unique += info.DecodedSize
+	}
+	return unique, duplicates
+}
+
+type HistogramBucket struct {
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+type Histogram struct {
+	Megapixels []HistogramBucket `json:"megapixels"`
+	BitDepths  []HistogramBucket `json:"bit_depths"`
+	Formats    []HistogramBucket `json:"formats"`
+}
+
+var megapixelBuckets = []struct {
+	label string
+	limit float64
+}{
+	{"< 1 MP", 1},
+	{"1-4 MP", 4},
+	{"4-12 MP", 12},
+	{"12-24 MP", 24},
+	{"24-50 MP", 50},
+	{">= 50 MP", math.Inf(1)},
+}
+
+func buildHistogram(results []*ImageInfo) Histogram {
+	histogram := Histogram{Megapixels: make([]HistogramBucket, len(megapixelBuckets))}
+	for i, bucket := range megapixelBuckets {
+		histogram.Megapixels[i].Label = bucket.label
+	}
+
+	depths := make(map[int]int)
+	formats := make(map[string]int)
+	for _, info := range results {
+		for i, bucket := range megapixelBuckets {
+			if info.Megapixels < bucket.limit {
+				histogram.Megapixels[i].Count++
+				break
+			}
+		}
+		depths[info.BitDepth]++
+		formats[info.Format]++
+	}
+
+	depthKeys := make([]int, 0, len(depths))
+	for depth := range depths {
+		depthKeys = append(depthKeys, depth)
+	}
+	sort.Ints(depthKeys)
+	for _, depth := range depthKeys {
+		histogram.BitDepths = append(histogram.BitDepths, HistogramBucket{fmt.Sprintf("%d-bit", depth), depths[depth]})
+	}
+
+	formatKeys := make([]string, 0, len(formats))
+	for format := range formats {
+		formatKeys = append(formatKeys, format)
+	}
+	sort.Strings(formatKeys)
+	for _, format := range formatKeys {
+		histogram.Formats = append(histogram.Formats, HistogramBucket{format, formats[format]})
+	}
+
+	return histogram
+}
+
+func printHistogram(w io.Writer, histogram Histogram, total int) {
+	sections := []struct {
+		title   string
+		buckets []HistogramBucket
+	}{
+		{"Megapixels", histogram.Megapixels},
+		{"Bit depths", histogram.BitDepths},
+		{"Formats", histogram.Formats},
+	}
+
+	for i, section := range sections {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s:\n", section.title)
+		for _, bucket := range section.buckets {
+			bar := ""
+			if total > 0 {
+				bar = strings.Repeat("#", (bucket.Count*40+total-1)/total)
+			}
+			fmt.Fprintf(w, "  %-10s %6d %s\n", bucket.Label, bucket.Count, bar)
+		}
+	}
+}
+
+func printPerceptualHashGroups(results []*ImageInfo) {
+	groups := make(map[string][]string)
+	var order []string
+	for _, info := range results {
+		if info.PerceptualHash == "" {
+			continue
+		}
+		if _, seen := groups[info.PerceptualHash]; !seen {
+			order = append(order, info.PerceptualHash)
+		}
+		groups[info.PerceptualHash] = append(groups[info.PerceptualHash], info.Filename)
+	}
+
+	fmt.Println("\nPerceptual hash groups:")
+	printed := false
+	for _, hash := range order {
+		if len(groups[hash]) < 2 {
+			continue
+		}
+		fmt.Printf("  %s: %s\n", hash, strings.Join(groups[hash], ", "))
+		printed = true
+	}
+	if !printed {
+		fmt.Println("  (no visually identical images)")
+	}
+}
+
+func sidecarPath(filename, outputDir string) (string, error) {
+	if outputDir == "" {
+		return filename + ".json", nil
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(cwd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the current directory and cannot be mirrored into %s", filename, outputDir)
+	}
+	return filepath.Join(outputDir, rel) + ".json", nil
+}
+
+func writeSidecar(info *ImageInfo, compact bool, fields []string, outputDir string) error {
+	path, err := sidecarPath(info.Filename, outputDir)
+	if err != nil {
+		return fmt.Errorf("sidecar: %w", err)
+	}
+	if outputDir != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("sidecar: %w", err)
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("sidecar: %w", err)
+	}
+
+	if err := writeSelectedJSON(file, info, fields, compact); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("sidecar: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("sidecar: %w", err)
+	}
+	return nil
+}
+
+type selectedFields struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func (s selectedFields) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, key := range s.keys {
+		value, ok := s.values[key]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func jsonFieldNames() []string {
+	var names []string
+	infoType := reflect.TypeOf(ImageInfo{})
+	for i := 0; i < infoType.NumField(); i++ {
+		name, _, _ := strings.Cut(infoType.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func parseFields(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	known := make(map[string]bool)
+	for _, name := range jsonFieldNames() {
+		known[name] = true
+	}
+
+	var fields []string
+	for _, part := range strings.Split(value, ",") {
+		field := strings.TrimSpace(part)
+		if !known[field] {
+			return nil, fmt.Errorf("unknown field %q (valid fields: %s)", field, strings.Join(jsonFieldNames(), ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func selectFields(info *ImageInfo, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return info, nil
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return selectedFields{keys: fields, values: values}, nil
+}
+
+func writeSelectedJSON(w io.Writer, info *ImageInfo, fields []string, compact bool) error {
+	selected, err := selectFields(info, fields)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, selected, compact)
+}
+
+func writeJSON(w io.Writer, v interface{}, compact bool) error {
+	encoder := json.NewEncoder(w)
+	if !compact {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(v)
+}
+
+const (
+	EstimateModelGo    = "go"
+	EstimateModelRGBA  = "rgba"
+	EstimateModelTight = "tight"
+)
+
+func validEstimateModel(model string) bool {
+	switch model {
+	case "", EstimateModelGo, EstimateModelRGBA, EstimateModelTight:
+		return true
+	default:
+		return false
+	}
+}
+
+func modelBitsPerPixel(info *ImageInfo, model string) int {
+	switch model {
+	case EstimateModelRGBA:
+		return 32
+	case EstimateModelTight:
+		return tightBitsPerPixel(info)
+	default:
+		return calculateBytesPerPixel(info) * 8
+	}
+}
+
+func tightBitsPerPixel(info *ImageInfo) int {
+	depth := info.BitDepth
+	if depth <= 0 {
+		depth = 8
+	}
+
+	if info.ChannelCount > 0 {
+		return info.ChannelCount * depth
+	}
+
+	switch info.ColorModel {
+	case ColorModelGrayscale, ColorModelIndexed:
+		if info.HasAlpha {
+			return 2 * depth
+		}
+		return depth
+	case ColorModelRGB:
+		if info.HasAlpha {
+			return 4 * depth
+		}
+		return 3 * depth
+	case ColorModelYCbCr:
+		switch info.ChromaSubsampling {
+		case ChromaSubsampling420, ChromaSubsampling411:
+			return 3 * depth / 2
+		case ChromaSubsampling422, ChromaSubsampling440:
+			return 2 * depth
+		default:
+			return 3 * depth
+		}
+	default:
+		return 4 * depth
+	}
+}
+
+func pixelBytes(width, height, bitsPerPixel int) int64 {
+	return (int64(width)*int64(height)*int64(bitsPerPixel) + 7) / 8
+}
+
+func applySizeEstimate(info *ImageInfo, originalSize int64, scales []int, scope sizeScope, model string) {
+	bitsPerPixel := modelBitsPerPixel(info, model)
+	if info.IsVector {
+		bitsPerPixel = 0
+	}
+	decodedSize := pixelBytes(info.Width, info.Height, bitsPerPixel)
+	if scope.allImages && len(info.EmbeddedImages) > 0 {
+		decodedSize = 0
+		for i := range info.EmbeddedImages {
+			embedded := &info.EmbeddedImages[i]
+			if model == "" || model == EstimateModelGo {
+				decodedSize += embedded.DecodedSize
+			} else {
+				decodedSize += pixelBytes(embedded.Width, embedded.Height, modelBitsPerPixel(embedded, model))
+			}
+		}
+	}
+	if scope.mipmaps && info.MipmapCount > 1 {
+		decodedSize = ddsMipChainSize(info.Width, info.Height, info.MipmapCount, bitsPerPixel)
+	}
+	if scope.allFrames && info.FrameCount > 1 {
+		decodedSize *= int64(info.FrameCount)
+	}
+
+	if model == "" || model == EstimateModelGo {
+		explain(info, "decoded size %d bytes from %dx%d pixels at %d bytes per pixel", decodedSize, info.Width, info.Height, bitsPerPixel/8)
+	} else {
+		explain(info, "decoded size %d bytes from %dx%d pixels at %d bits per pixel (%s model)", decodedSize, info.Width, info.Height, bitsPerPixel, model)
+	}
+
+	info.OriginalSize = originalSize
+	if info.TrailingBytes > 0 && info.TrailingBytes < originalSize {
+		originalSize -= info.TrailingBytes
+		info.EffectiveOriginalSize = originalSize
+		explain(info, "effective original size %d bytes excluding trailing data", originalSize)
+	}
+	info.DecodedSize = decodedSize
+	info.BitsPerPixel = bitsPerPixel
+	info.Megapixels = float64(info.Width) * float64(info.Height) / 1e6
+	info.CompressionRatio = 0
+	if originalSize > 0 {
+		info.CompressionRatio = float64(decodedSize) / float64(originalSize)
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		addWarning(info, fmt.Sprintf("zero-dimension image (%dx%d)", info.Width, info.Height))
+	}
+	if pixels := int64(info.Width) * int64(info.Height); pixels > 0 && !info.IsVector {
+		info.BitsPerPixelStored = float64(originalSize*8) / float64(pixels)
+	}
+
+	if len(scales) > 0 {
+		info.ScaledSizes = make(map[int]int64, len(scales))
+		for _, width := range scales {
+			w, h := scaledDimensions(info.Width, info.Height, width)
+			info.ScaledSizes[width] = pixelBytes(w, h, bitsPerPixel)
+		}
+	}
+}
+
+func readBudgets(path string) (map[string]int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("budget: %w", err)
+	}
+
+	budgets := make(map[string]int64)
+	for i, record := range records {
+		format := strings.ToLower(strings.TrimSpace(record[0]))
+		limit, err := strconv.ParseInt(strings.TrimSpace(record[1]), 10, 64)
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("budget: invalid byte limit %q for %s on line %d", record[1], format, i+1)
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("budget: negative byte limit for %s on line %d", format, i+1)
+		}
+		budgets[format] = limit
+	}
+	return budgets, nil
+}
+
+func applyBudget(info *ImageInfo, budgets map[string]int64) {
+	limit, ok := budgets[info.Format]
+	if !ok || info.DecodedSize <= limit {
+		return
+	}
+	info.BudgetExceeded = true
+	addWarning(info, fmt.Sprintf("decoded size %d bytes exceeds the %s budget of %d bytes", info.DecodedSize, info.Format, limit))
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+func gpuTextureBytes(width, height, bitsPerPixel int, mipmaps bool) int64 {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	paddedWidth, paddedHeight := nextPowerOfTwo(width), nextPowerOfTwo(height)
+	if !mipmaps {
+		return pixelBytes(paddedWidth, paddedHeight, bitsPerPixel)
+	}
+
+	levels := 1
+	for size := max(paddedWidth, paddedHeight); size > 1; size >>= 1 {
+		levels++
+	}
+	return ddsMipChainSize(paddedWidth, paddedHeight, levels, bitsPerPixel)
+}
+
+func applyGPUEstimate(info *ImageInfo, opts Options) {
+	if !opts.GPU || info.IsVector {
+		return
+	}
+	info.GPUTextureBytes = gpuTextureBytes(info.Width, info.Height, info.BitsPerPixel, opts.GPUMipmaps)
+	explain(info, "GPU texture %d bytes after padding %dx%d to %dx%d", info.GPUTextureBytes, info.Width, info.Height, nextPowerOfTwo(info.Width), nextPowerOfTwo(info.Height))
+}
+
+func setConfidence(info *ImageInfo, field, level string) {
+	if info.Confidence == nil {
+		info.Confidence = make(map[string]string)
+	}
+	info.Confidence[field] = level
+}
+
+func addWarning(info *ImageInfo, message string) {
+	if info.Warning != "" {
+		info.Warning += "; "
+	}
+	info.Warning += message
+}
+
+type FieldDifference struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+func compareImageInfo(a, b *ImageInfo) []FieldDifference {
+	return []FieldDifference{
+		{"Format", a.Format, b.Format},
+		{"Dimensions", fmt.Sprintf("%dx%d", a.Width, a.Height), fmt.Sprintf("%dx%d", b.Width, b.Height)},
+		{"Color Model", a.ColorModel.String(), b.ColorModel.String()},
+		{"Color Space", a.ColorSpace.String(), b.ColorSpace.String()},
+		{"Bit Depth", strconv.Itoa(a.BitDepth), strconv.Itoa(b.BitDepth)},
+		{"Alpha Channel", strconv.FormatBool(a.HasAlpha), strconv.FormatBool(b.HasAlpha)},
+		{"HDR Support", a.HDRType.String(), b.HDRType.String()},
+		{"Chroma Subsampling", a.ChromaSubsampling.String(), b.ChromaSubsampling.String()},
+		{"Compression Type", a.CompressionType.String(), b.CompressionType.String()},
+		{"Original file size", strconv.FormatInt(a.OriginalSize, 10), strconv.FormatInt(b.OriginalSize, 10)},
+		{"Estimated decoded size", strconv.FormatInt(a.DecodedSize, 10), strconv.FormatInt(b.DecodedSize, 10)},
+		{"Compression ratio", fmt.Sprintf("%.1fx", a.CompressionRatio), fmt.Sprintf("%.1fx", b.CompressionRatio)},
+	}
+}
+
+func explainImage(filename string, opts Options, w io.Writer) (*ImageInfo, error) {
+	info, err := analyzeFile(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(w, "How %s was analyzed:\n", filename)
+	for i, step := range info.Explanation {
+		fmt.Fprintf(w, "  %d. %s\n", i+1, step)
+	}
+	if info.Warning != "" {
+		fmt.Fprintf(w, "  Warning: %s\n", info.Warning)
+	}
+	return info, nil
+}
+
+func diffImageInfo(a, b *ImageInfo) []FieldDifference {
+	differences := []FieldDifference{}
+	for _, field := range compareImageInfo(a, b) {
+		if field.A != field.B {
+			differences = append(differences, field)
+		}
+	}
+	return differences
+}
+
+func diffImages(fileA, fileB string, opts Options) ([]FieldDifference, error) {
+	a, err := analyzeFile(fileA, opts)
+	if err != nil {
+		return nil, &ProcessError{Filename: fileA, Err: err}
+	}
+	b, err := analyzeFile(fileB, opts)
+	if err != nil {
+		return nil, &ProcessError{Filename: fileB, Err: err}
+	}
+
+	differences := diffImageInfo(a, b)
+
+	if opts.JSONOutput {
+		err := writeJSON(os.Stdout, map[string]interface{}{
+			"a":           a,
+			"b":           b,
+			"differences": differences,
+		}, opts.CompactJSON)
+		if err != nil {
+			return nil, err
+		}
+		return differences, nil
+	}
+
+	fmt.Printf("  %-24s %-24s %s\n", "", fileA, fileB)
+	for _, field := range compareImageInfo(a, b) {
+		row := fmt.Sprintf("%-24s %-24s %s", field.Field+":", field.A, field.B)
+		if field.A != field.B {
+			fmt.Println(colorize(opts.UseColor, ansiRed, "* "+row))
+		} else {
+			fmt.Println("  " + row)
+		}
+	}
+
+	return differences, nil
+}
+
+type ProcessError struct {
+	Filename string
+	Err      error
+}
+
+func (e *ProcessError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Filename, e.Err)
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+func readManifest(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	var files []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+var (
+	htmlImagePattern     = regexp.MustCompile(`(?i)<img\b[^>]*?\bsrc\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	markdownImagePattern = regexp.MustCompile(`!\[[^\]]*\]\(\s*(?:<([^>]*)>|([^)\s]+))`)
+)
+
+func readDocumentImages(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, pattern := range []*regexp.Regexp{htmlImagePattern, markdownImagePattern} {
+		for _, match := range pattern.FindAllSubmatch(data, -1) {
+			for _, group := range match[1:] {
+				if len(group) > 0 {
+					refs = append(refs, string(group))
+					break
+				}
+			}
+		}
+	}
+
+	dir := filepath.Dir(path)
+	seen := make(map[string]bool)
+	var files []string
+	for _, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if i := strings.IndexAny(ref, "?#"); i >= 0 {
+			ref = ref[:i]
+		}
+		if ref == "" || strings.HasPrefix(ref, "//") || strings.Contains(ref, ":") {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(ref); err == nil {
+			ref = unescaped
+		}
+		filename := filepath.FromSlash(ref)
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		if !seen[filename] {
+			seen[filename] = true
+			files = append(files, filename)
+		}
+	}
+
+	return files, nil
+}
+
+func processFiles(files []string, process func(filename string) error) []*ProcessError {
+	var failures []*ProcessError
+	for _, filename := range files {
+		if err := process(filename); err != nil {
+			failures = append(failures, processErrors(filename, err)...)
+		}
+	}
+	return failures
+}
+
+func reportFailures(failures []*ProcessError, multiple bool, jsonOutput bool) {
+	for _, failure := range failures {
+		message := failure.Err.Error()
+		if multiple {
+			message = failure.Error()
+		}
+
+		if jsonOutput {
+			errJSON, _ := json.Marshal(map[string]interface{}{
+				"error":     message,
+				"exit_code": categorizeError(failure.Err),
+			})
+			fmt.Println(string(errJSON))
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", message)
+		}
+	}
+}
+
+type RunSummary struct {
+	Images           int                    `json:"images"`
+	Failures         int                    `json:"failures"`
+	TotalDecodedSize int64                  `json:"total_decoded_size_bytes"`
+	ByFormat         map[string]FormatStats `json:"by_format,omitempty"`
+	HDRCount         int                    `json:"hdr_count"`
+	SDRCount         int                    `json:"sdr_count"`
+	ByHDRType        map[string]int         `json:"by_hdr_type,omitempty"`
+	Histogram        *Histogram             `json:"histogram,omitempty"`
+	Sample           *SampleSummary         `json:"sample,omitempty"`
+}
+
+type FormatStats struct {
+	Count        int     `json:"count"`
+	OriginalSize int64   `json:"original_size_bytes"`
+	DecodedSize  int64   `json:"decoded_size_bytes"`
+	AverageRatio float64 `json:"average_ratio"`
+}
+
+type SampleSummary struct {
+	Seed                     int64 `json:"seed"`
+	SampledFiles             int   `json:"sampled_files"`
+	AnalyzedFiles            int   `json:"analyzed_files"`
+	FailedFiles              int   `json:"failed_files"`
+	TotalFiles               int   `json:"total_files"`
+	SampledOriginalSize      int64 `json:"sampled_original_size_bytes"`
+	SampledDecodedSize       int64 `json:"sampled_decoded_size_bytes"`
+	ExtrapolatedOriginalSize int64 `json:"extrapolated_original_size_bytes"`
+	ExtrapolatedDecodedSize  int64 `json:"extrapolated_decoded_size_bytes"`
+}
+
+func sampleFiles(files []string, n int, seed int64) []string {
+	if n <= 0 || n >= len(files) {
+		return files
+	}
+
+	picked := rand.New(rand.NewSource(seed)).Perm(len(files))[:n]
+	sort.Ints(picked)
+	sampled := make([]string, n)
+	for i, index := range picked {
+		sampled[i] = files[index]
+	}
+	return sampled
+}
+
+func summarizeSample(results []*ImageInfo, sampledFiles, analyzedFiles, totalFiles int, seed int64) SampleSummary {
+	summary := SampleSummary{
+		Seed:          seed,
+		SampledFiles:  sampledFiles,
+		AnalyzedFiles: analyzedFiles,
+		FailedFiles:   sampledFiles - analyzedFiles,
+		TotalFiles:    totalFiles,
+	}
+	for _, info := range results {
+		summary.SampledOriginalSize += info.OriginalSize
+		summary.SampledDecodedSize += info.DecodedSize
+	}
+	if analyzedFiles > 0 {
+		scale := float64(totalFiles) / float64(analyzedFiles)
+		summary.ExtrapolatedOriginalSize = int64(math.Round(float64(summary.SampledOriginalSize) * scale))
+		summary.ExtrapolatedDecodedSize = int64(math.Round(float64(summary.SampledDecodedSize) * scale))
+	}
+	return summary
+}
+
+func printSampleSummary(w io.Writer, summary SampleSummary) {
+	fmt.Fprintf(w, "Sampled %d of %d files (seed %d)\n", summary.SampledFiles, summary.TotalFiles, summary.Seed)
+	if summary.FailedFiles > 0 {
+		fmt.Fprintf(w, "Failed samples: %d (extrapolated from the %d analyzed files)\n", summary.FailedFiles, summary.AnalyzedFiles)
+	}
+	fmt.Fprintf(w, "Sampled original size: %d bytes (%.2f MB), extrapolated %d bytes (%.2f MB)\n",
+		summary.SampledOriginalSize, float64(summary.SampledOriginalSize)/(1024*1024),
+		summary.ExtrapolatedOriginalSize, float64(summary.ExtrapolatedOriginalSize)/(1024*1024))
+	fmt.Fprintf(w, "Sampled decoded size: %d bytes (%.2f MB), extrapolated %d bytes (%.2f MB)\n",
+		summary.SampledDecodedSize, float64(summary.SampledDecodedSize)/(1024*1024),
+		summary.ExtrapolatedDecodedSize, float64(summary.ExtrapolatedDecodedSize)/(1024*1024))
+}
+
+type jsonArrayWriter struct {
+	w       io.Writer
+	compact bool
+	count   int
+}
+
+func newJSONArrayWriter(w io.Writer, compact bool) (*jsonArrayWriter, error) {
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return nil, err
+	}
+	return &jsonArrayWriter{w: w, compact: compact}, nil
+}
+
+func (a *jsonArrayWriter) write(v interface{}) error {
+	var data []byte
+	var err error
+	if a.compact {
+		data, err = json.Marshal(v)
+	} else {
+		data, err = json.MarshalIndent(v, "  ", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	separator := "  "
+	if a.count > 0 {
+		separator = ",\n  "
+	}
+	a.count++
+	_, err = io.WriteString(a.w, separator+string(data))
+	return err
+}
+
+func (a *jsonArrayWriter) writeImage(info *ImageInfo, fields []string) error {
+	selected, err := selectFields(info, fields)
+	if err != nil {
+		return err
+	}
+	return a.write(selected)
+}
+
+func (a *jsonArrayWriter) writeFailure(failure *ProcessError, multiple bool) error {
+	message := failure.Err.Error()
+	if multiple {
+		message = failure.Error()
+	}
+	return a.write(map[string]interface{}{
+		"error":     message,
+		"exit_code": categorizeError(failure.Err),
+	})
+}
+
+func (a *jsonArrayWriter) close(summary RunSummary) error {
+	if err := a.write(map[string]RunSummary{"summary": summary}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(a.w, "\n]\n")
+	return err
+}
+
+func summarizeRun(results []*ImageInfo, failures int) RunSummary {
+	summary := RunSummary{Images: len(results), Failures: failures}
+	byFormat := make(map[string][]*ImageInfo)
+	for _, info := range results {
+		summary.TotalDecodedSize += info.DecodedSize
+		byFormat[info.Format] = append(byFormat[info.Format], info)
+		if info.HDRType == HDRNone {
+			summary.SDRCount++
+		} else {
+			summary.HDRCount++
+		}
+		if summary.ByHDRType == nil {
+			summary.ByHDRType = make(map[string]int)
+		}
+		summary.ByHDRType[info.HDRType.String()]++
+	}
+
+	if len(byFormat) > 0 {
+		summary.ByFormat = make(map[string]FormatStats, len(byFormat))
+	}
+	for format, infos := range byFormat {
+		stats := FormatStats{Count: len(infos)}
+		for _, info := range infos {
+			stats.OriginalSize += info.OriginalSize
+			stats.DecodedSize += info.DecodedSize
+		}
+		stats.AverageRatio, _ = averageCompressionRatio(infos)
+		summary.ByFormat[format] = stats
+	}
+	return summary
+}
+
+func printRunSummary(w io.Writer, summary RunSummary) {
+	fmt.Fprintf(w, "Images: %d, failures: %d\n", summary.Images, summary.Failures)
+	fmt.Fprintf(w, "Total decoded size: %d bytes (%.2f MB)\n", summary.TotalDecodedSize, float64(summary.TotalDecodedSize)/(1024*1024))
+	if len(summary.ByFormat) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "HDR: %d, SDR: %d\n", summary.HDRCount, summary.SDRCount)
+	hdrTypes := make([]string, 0, len(summary.ByHDRType))
+	for hdrType := range summary.ByHDRType {
+		hdrTypes = append(hdrTypes, hdrType)
+	}
+	sort.Strings(hdrTypes)
+	fmt.Fprintln(w, "By HDR type:")
+	for _, hdrType := range hdrTypes {
+		fmt.Fprintf(w, "  %-24s %6d\n", hdrType, summary.ByHDRType[hdrType])
+	}
+
+	formats := make([]string, 0, len(summary.ByFormat))
+	for format := range summary.ByFormat {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	fmt.Fprintln(w, "By format:")
+	for _, format := range formats {
+		stats := summary.ByFormat[format]
+		fmt.Fprintf(w, "  %-10s %6d images, original %.2f MB, decoded %.2f MB, average ratio %.1fx\n",
+			format, stats.Count, float64(stats.OriginalSize)/(1024*1024), float64(stats.DecodedSize)/(1024*1024), stats.AverageRatio)
+	}
+}
+
+const maxFailureExamples = 3
+
+type FailureGroup struct {
+	Message  string   `json:"error"`
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+	ExitCode int      `json:"exit_code"`
+}
+
+func groupFailures(failures []*ProcessError) []*FailureGroup {
+	var groups []*FailureGroup
+	byMessage := make(map[string]*FailureGroup)
+	for _, failure := range failures {
+		message := strings.ReplaceAll(failure.Err.Error(), failure.Filename, "<file>")
+		group, ok := byMessage[message]
+		if !ok {
+			group = &FailureGroup{Message: message, ExitCode: categorizeError(failure.Err)}
+			byMessage[message] = group
+			groups = append(groups, group)
+		}
+		group.Count++
+		if len(group.Examples) < maxFailureExamples {
+			group.Examples = append(group.Examples, failure.Filename)
+		}
+	}
+	return groups
+}
+
+func reportGroupedFailures(failures []*ProcessError, jsonOutput bool) {
+	for _, group := range groupFailures(failures) {
+		if jsonOutput {
+			errJSON, _ := json.Marshal(group)
+			fmt.Println(string(errJSON))
+			continue
+		}
+
+		examples := strings.Join(group.Examples, ", ")
+		if more := group.Count - len(group.Examples); more > 0 {
+			examples += fmt.Sprintf(" and %d more", more)
+		}
+		fmt.Fprintf(os.Stderr, "Error: %s (%d files, e.g. %s)\n", group.Message, group.Count, examples)
+	}
+}
+
+const retryBackoff = 100 * time.Millisecond
+
+func isTransientError(err error) bool {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr)
+}
+
+func withRetries(retries int, backoff time.Duration, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || !isTransientError(err) {
+			return err
+		}
+		time.Sleep(backoff * time.Duration(attempt+1))
+	}
+}
+
+type analysisResult struct {
+	infos []*ImageInfo
+	err   error
+}
+
+func withFileTimeout(timeout time.Duration, fn func() ([]*ImageInfo, error)) ([]*ImageInfo, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan analysisResult, 1)
+	go func() {
+		infos, err := fn()
+		done <- analysisResult{infos: infos, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.infos, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("analysis timed out after %s: %w", timeout, ctx.Err())
+	}
+}
+
+func isArchive(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".zip", ".tar":
+		return true
+	default:
+		return false
+	}
+}
+
+type archiveEntryErrors []*ProcessError
+
+func (e archiveEntryErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more archive errors)", e[0].Error(), len(e)-1)
+}
+
+func processErrors(filename string, err error) []*ProcessError {
+	var entries archiveEntryErrors
+	if errors.As(err, &entries) {
+		return entries
+	}
+	return []*ProcessError{{Filename: filename, Err: err}}
+}
+
+func estimateArchive(filename string, opts Options) ([]*ImageInfo, error) {
+	results, err := analyzeArchive(filename, opts)
+	if printErr := printArchiveResults(results, opts); printErr != nil {
+		return results, printErr
+	}
+	return results, err
+}
+
+func analyzeArchive(filename string, opts Options) ([]*ImageInfo, error) {
+	var results []*ImageInfo
+	var failed archiveEntryErrors
+
+	entryFailed := func(name string, err error) {
+		failed = append(failed, &ProcessError{Filename: filename + "!" + name, Err: err})
+	}
+
+	analyzeEntry := func(name string, data []byte, originalSize int64) error {
+		info, err := analyzeReader(bytes.NewReader(data))
+		if errors.Is(err, image.ErrFormat) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		info.Filename = name
+		applySizeEstimate(info, originalSize, opts.Scales, opts.sizeScope(), opts.EstimateModel)
+		checkExtension(info, name)
+		if err := applyOptions(bytes.NewReader(data), info, opts); err != nil {
+			return err
+		}
 
-		if boxSize < 8 || offset+int(boxSize) > len(data) {
-			break
+		results = append(results, info)
+		return nil
+	}
+
+	if strings.ToLower(filepath.Ext(filename)) == ".zip" {
+		archive, err := zip.OpenReader(filename)
+		if err != nil {
+			return nil, err
 		}
+		defer func() { _ = archive.Close() }()
 
-		boxData := data[offset+8 : offset+int(boxSize)]
+		for _, entry := range archive.File {
+			if entry.FileInfo().IsDir() {
+				continue
+			}
 
-		switch boxType {
-		case "pixi":
-			if len(boxData) >= 3 {
-				numChannels := int(boxData[1])
-				if numChannels > 0 && len(boxData) >= 2+numChannels {
-					meta.BitDepth = int(boxData[2])
-				}
+			rc, err := entry.Open()
+			if err != nil {
+				entryFailed(entry.Name, err)
+				continue
+			}
+			data, err := io.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				entryFailed(entry.Name, err)
+				continue
 			}
 
-		case "colr":
-			if len(boxData) >= 4 {
-				colorType := string(boxData[0:4])
-				if colorType == "nclx" && len(boxData) >= 8 {
-					colorPrimaries := binary.BigEndian.Uint16(boxData[4:6])
-					transferChar := binary.BigEndian.Uint16(boxData[6:8])
-
-					switch colorPrimaries {
-					case 1:
-						meta.ColorSpace = ColorSpaceBT709
-					case 9:
-						meta.ColorSpace = ColorSpaceBT2020
-					case 12:
-						meta.ColorSpace = ColorSpaceDisplayP3
-					}
+			originalSize := int64(entry.UncompressedSize64)
+			if opts.CompressedArchiveSize {
+				originalSize = int64(entry.CompressedSize64)
+			}
+			if err := analyzeEntry(entry.Name, data, originalSize); err != nil {
+				entryFailed(entry.Name, err)
+			}
+		}
+	} else {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = file.Close() }()
 
-					switch transferChar {
-					case 16:
-						meta.HDRType = HDRPQ
-					case 18:
-						meta.HDRType = HDRHLG
-					}
-				}
+		archive := tar.NewReader(file)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				failed = append(failed, &ProcessError{Filename: filename, Err: err})
+				break
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
 			}
 
-		case "auxC":
-			if bytes.Contains(boxData, []byte("urn:mpeg:mpegB:cicp:systems:auxiliary:alpha")) {
-				meta.HasAlpha = true
+			data, err := io.ReadAll(archive)
+			if err != nil {
+				entryFailed(header.Name, err)
+				continue
+			}
+			if err := analyzeEntry(header.Name, data, header.Size); err != nil {
+				entryFailed(header.Name, err)
 			}
 		}
+	}
 
-		offset += int(boxSize)
+	if len(failed) > 0 {
+		return results, failed
 	}
+	return results, nil
 }
 
-func analyzeHEIF(r io.ReadSeeker, config image.Config, info *ImageInfo) {
-	info.CompressionType = CompressionHybrid
+func printArchiveResults(results []*ImageInfo, opts Options) error {
+	if opts.JSONOutput && opts.CompactJSON {
+		for _, info := range results {
+			if !opts.showsRatio(info.CompressionRatio) {
+				continue
+			}
+			if err := writeSelectedJSON(os.Stdout, info, opts.Fields, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-	metadata := parseHEIFMetadata(r)
+	if opts.JSONOutput {
+		selected := make([]interface{}, 0, len(results))
+		for _, info := range results {
+			if !opts.showsRatio(info.CompressionRatio) {
+				continue
+			}
+			entry, err := selectFields(info, opts.Fields)
+			if err != nil {
+				return err
+			}
+			selected = append(selected, entry)
+		}
+		return writeJSON(os.Stdout, selected, false)
+	}
 
-	info.ColorModel = metadata.ColorModel
-	info.HasAlpha = metadata.HasAlpha
-	info.BitDepth = metadata.BitDepth
-	info.ColorSpace = metadata.ColorSpace
-	info.ChromaSubsampling = metadata.ChromaSubsampling
-	info.HDRType = metadata.HDRType
+	if opts.Quiet {
+		return nil
+	}
+
+	shown := 0
+	var totalDecodeMs float64
+	for _, info := range results {
+		totalDecodeMs += info.DecodeDurationMs
+		if !opts.showsRatio(info.CompressionRatio) {
+			continue
+		}
+		if shown > 0 {
+			fmt.Println()
+		}
+		printImageInfo(info, opts.Scales, opts.UseColor)
+		shown++
+	}
+	if opts.DecodeTime {
+		fmt.Printf("\nTotal decode time: %.2f ms\n", totalDecodeMs)
+	}
+	if opts.PerceptualHash {
+		printPerceptualHashGroups(results)
+	}
+	return nil
 }
 
-func analyzeAVIF(r io.ReadSeeker, config image.Config, info *ImageInfo) {
-	info.CompressionType = CompressionHybrid
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
 
-	metadata := parseHEIFMetadata(r)
+func colorize(enabled bool, code, text string) string {
+	if !enabled {
+		return text
+	}
+	return code + text + ansiReset
+}
 
-	info.ColorModel = metadata.ColorModel
-	info.HasAlpha = metadata.HasAlpha
-	info.BitDepth = metadata.BitDepth
-	info.ColorSpace = metadata.ColorSpace
-	info.ChromaSubsampling = metadata.ChromaSubsampling
-	info.HDRType = metadata.HDRType
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
 }
 
-func parseColorSpace(cs string) ColorSpace {
-	switch cs {
-	case "sRGB", "sRGB (ICC)":
-		return ColorSpaceSRGB
-	case "Adobe RGB":
-		return ColorSpaceAdobeRGB
-	case "BT.709":
-		return ColorSpaceBT709
-	case "BT.2020":
-		return ColorSpaceBT2020
-	case "Display P3":
-		return ColorSpaceDisplayP3
+func resolveColorMode(mode string, noColor bool, tty bool) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return !noColor && tty, nil
 	default:
-		return ColorSpaceSRGB
+		return false, fmt.Errorf("invalid color mode %q (want auto, always or never)", mode)
 	}
 }
 
-func detectWebPFormat(r io.ReadSeeker) (bool, ChromaSubsampling) {
-	_, _ = r.Seek(0, 0)
+func printImageInfo(info *ImageInfo, scales []int, useColor bool) {
+	label := func(name string) string {
+		return colorize(useColor, ansiBold, name+":")
+	}
 
-	header := make([]byte, 12)
-	if _, err := io.ReadFull(r, header); err != nil {
-		return false, ChromaSubsamplingUnknown
+	if info.Filename != "" {
+		fmt.Printf("%s %s\n", label("File"), info.Filename)
+	}
+	fmt.Printf("%s %s\n", label("Format"), info.Format)
+	fmt.Printf("%s %dx%d\n", label("Dimensions"), info.Width, info.Height)
+	if info.DisplayWidth > 0 && info.DisplayHeight > 0 {
+		fmt.Printf("%s %dx%d (pixel aspect ratio %.3g)\n", label("Display Dimensions"),
+			info.DisplayWidth, info.DisplayHeight, info.PixelAspectRatio)
+	}
+	fmt.Printf("%s %.2f\n", label("Megapixels"), info.Megapixels)
+	fmt.Printf("%s %s\n", label("Color Model"), info.ColorModel)
+	if info.HasICCProfile {
+		fmt.Printf("%s Present (%d bytes)\n", label("ICC Profile"), info.ICCProfileSize)
+	} else {
+		fmt.Printf("%s Not detected\n", label("ICC Profile"))
+	}
+	if info.HasXMP {
+		fmt.Printf("%s Present (%d bytes)\n", label("XMP Metadata"), info.XMPSize)
+	}
+	fmt.Printf("%s %s\n", label("Color Space"), info.ColorSpace)
+	if info.CICP != nil {
+		colorRange := "limited range"
+		if info.CICP.FullRange {
+			colorRange = "full range"
+		}
+		fmt.Printf("%s %d/%d/%d (%s)\n", label("CICP"), info.CICP.ColorPrimaries,
+			info.CICP.TransferCharacteristics, info.CICP.MatrixCoefficients, colorRange)
+	}
+	if info.EmbeddedThumbnailBytes > 0 {
+		fmt.Printf("%s %d bytes\n", label("Embedded Thumbnail"), info.EmbeddedThumbnailBytes)
+	}
+	fmt.Printf("%s %d\n", label("Bit Depth"), info.BitDepth)
+	if !info.UniformBitDepth && len(info.ChannelBitDepths) > 0 {
+		depths := make([]string, len(info.ChannelBitDepths))
+		for i, depth := range info.ChannelBitDepths {
+			depths[i] = strconv.Itoa(depth)
+		}
+		fmt.Printf("%s %s (mixed, sized at %d-bit)\n", label("Channel Bit Depths"), strings.Join(depths, "/"), info.BitDepth)
+	}
+	if info.PaletteSize > 0 {
+		fmt.Printf("%s %d entries\n", label("Palette Size"), info.PaletteSize)
+	}
+	if info.ChannelCount > 0 {
+		fmt.Printf("%s %d\n", label("Channels"), info.ChannelCount)
+	}
+	fmt.Printf("%s %d\n", label("Bits Per Pixel"), info.BitsPerPixel)
+	fmt.Printf("%s %v\n", label("Alpha Channel"), info.HasAlpha)
+	if info.PremultipliedAlpha {
+		fmt.Printf("%s yes\n", label("Premultiplied Alpha"))
+	}
+	if info.HasGainMap {
+		fmt.Printf("%s Present (HDR rendering)\n", label("Gain Map"))
+	}
+	fmt.Printf("%s %s\n", label("Chroma Subsampling"), info.ChromaSubsampling)
+	fmt.Printf("%s %s\n", label("HDR Support"), info.HDRType)
+	if info.WideGamut {
+		fmt.Printf("%s yes (%s primaries)\n", label("Wide Gamut"), info.ColorSpace)
+	}
+	fmt.Printf("%s %s\n", label("Compression Type"), info.CompressionType)
+	if info.Codec != "" {
+		fmt.Printf("%s %s\n", label("Codec"), info.Codec)
+	}
+	if info.LoopCount != nil {
+		if *info.LoopCount == 0 {
+			fmt.Printf("%s infinite\n", label("Loop count"))
+		} else {
+			fmt.Printf("%s %d\n", label("Loop count"), *info.LoopCount)
+		}
+	}
+	if info.FrameCount > 0 {
+		fmt.Printf("%s %d\n", label("Frames"), info.FrameCount)
+	}
+	if info.MipmapCount > 0 {
+		fmt.Printf("%s %d\n", label("Mipmaps"), info.MipmapCount)
+	}
+	if info.Tiled {
+		fmt.Printf("%s %d (grid)\n", label("Tiles"), info.TileCount)
+	}
+	if info.RestartInterval > 0 {
+		fmt.Printf("%s %d MCUs\n", label("Restart Interval"), info.RestartInterval)
+	}
+	if info.DPIX > 0 && info.DPIY > 0 {
+		fmt.Printf("%s %dx%d DPI (declared as %s)\n", label("Resolution"), info.DPIX, info.DPIY, info.DensityUnit)
+	} else if info.DensityUnit != "" {
+		fmt.Printf("%s %s\n", label("Resolution"), info.DensityUnit)
+	}
+	fmt.Printf("%s %d bytes (%.2f MB)\n", label("Original file size"),
+		info.OriginalSize, float64(info.OriginalSize)/(1024*1024))
+	if info.Truncated {
+		fmt.Printf("%s yes (%d bytes missing)\n", label("Truncated"), info.MissingBytes)
+	}
+	if info.TrailingBytes > 0 {
+		fmt.Printf("%s %d bytes after IEND (effective size %d bytes)\n", label("Trailing data"), info.TrailingBytes, info.EffectiveOriginalSize)
+	}
+	if info.IsVector {
+		fmt.Printf("%s N/A (vector)\n", label("Estimated decoded size"))
+	} else {
+		fmt.Printf("%s %d bytes (%.2f MB)\n", label("Estimated decoded size"),
+			info.DecodedSize, float64(info.DecodedSize)/(1024*1024))
+	}
+	if info.GPUTextureBytes > 0 {
+		fmt.Printf("%s %d bytes (%.2f MB)\n", label("GPU texture size"),
+			info.GPUTextureBytes, float64(info.GPUTextureBytes)/(1024*1024))
+	}
+	if len(info.EmbeddedImages) > 0 {
+		fmt.Printf("%s %d\n", label("Embedded images"), len(info.EmbeddedImages))
+		for _, embedded := range info.EmbeddedImages {
+			fmt.Printf("  %dx%d %s, %d-bit: %d bytes\n",
+				embedded.Width, embedded.Height, embedded.ColorModel, embedded.BitDepth, embedded.DecodedSize)
+		}
 	}
 
-	if string(header[0:4]) != "RIFF" {
-		return false, ChromaSubsamplingUnknown
+	ratio := fmt.Sprintf("%.1fx", info.CompressionRatio)
+	if info.CompressionRatio >= 10 {
+		ratio = colorize(useColor, ansiGreen, ratio)
+	}
+	fmt.Printf("%s %s\n", label("Compression ratio"), ratio)
+	fmt.Printf("%s %.2f\n", label("Stored bits per pixel"), info.BitsPerPixelStored)
+	if info.DecodeDurationMs > 0 {
+		fmt.Printf("%s %.2f ms\n", label("Decode time"), info.DecodeDurationMs)
+	}
+	if info.ReencodedSize > 0 {
+		fmt.Printf("%s %d bytes (%.1f%% smaller)\n", label("Re-encoded as "+info.ReencodedFormat), info.ReencodedSize, info.ProjectedSavings*100)
+	}
+	if info.ContentHash != "" {
+		fmt.Printf("%s %s\n", label("Content hash"), info.ContentHash)
+	}
+	if info.PerceptualHash != "" {
+		fmt.Printf("%s %s\n", label("Perceptual hash"), info.PerceptualHash)
+	}
+	if info.EffectivelyGrayscale {
+		fmt.Printf("%s yes (stored as %s)\n", label("Effectively grayscale"), info.ColorModel)
+	}
+	if info.DistinctColors > 0 {
+		fmt.Printf("%s %d\n", label("Distinct colors"), info.DistinctColors)
+	}
+	if info.Warning != "" {
+		fmt.Printf("%s %s\n", label("Warning"), colorize(useColor, ansiYellow, info.Warning))
 	}
 
-	if string(header[8:12]) != "WEBP" {
-		return false, ChromaSubsamplingUnknown
+	for _, width := range scales {
+		w, h := scaledDimensions(info.Width, info.Height, width)
+		fmt.Printf("%s %d bytes (%.2f MB)\n", label(fmt.Sprintf("Scaled to %dx%d", w, h)),
+			info.ScaledSizes[width], float64(info.ScaledSizes[width])/(1024*1024))
+	}
+}
+
+func scaledDimensions(width, height, targetWidth int) (int, int) {
+	if width <= 0 || targetWidth >= width {
+		return width, height
+	}
+
+	scaledHeight := int((int64(height)*int64(targetWidth) + int64(width)/2) / int64(width))
+	if scaledHeight < 1 {
+		scaledHeight = 1
+	}
+	return targetWidth, scaledHeight
+}
+
+func parseScales(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var scales []int
+	for _, part := range strings.Split(value, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("invalid scale width %q", part)
+		}
+		scales = append(scales, width)
+	}
+	return scales, nil
+}
+
+type RawSpec struct {
+	Width      int
+	Height     int
+	ColorModel ColorModel
+	HasAlpha   bool
+	BitDepth   int
+}
+
+func parseRawSpec(value string) (*RawSpec, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid raw spec %q (want WxH:MODEL:DEPTH)", value)
 	}
 
-	chunkHeader := make([]byte, 4)
-	if _, err := io.ReadFull(r, chunkHeader); err != nil {
-		return false, ChromaSubsamplingUnknown
+	dims := strings.SplitN(strings.ToLower(parts[0]), "x", 2)
+	if len(dims) != 2 {
+		return nil, fmt.Errorf("invalid raw dimensions %q", parts[0])
+	}
+	width, errW := strconv.Atoi(dims[0])
+	height, errH := strconv.Atoi(dims[1])
+	if errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid raw dimensions %q", parts[0])
 	}
 
-	fourCC := string(chunkHeader)
-	switch fourCC {
-	case "VP8L":
-		return true, ChromaSubsamplingNA
-	case "VP8 ":
-		return false, ChromaSubsampling420
+	spec := &RawSpec{Width: width, Height: height}
+	switch strings.ToUpper(parts[1]) {
+	case "RGB":
+		spec.ColorModel = ColorModelRGB
+	case "RGBA":
+		spec.ColorModel = ColorModelRGB
+		spec.HasAlpha = true
+	case "GRAY":
+		spec.ColorModel = ColorModelGrayscale
+	case "GRAYA":
+		spec.ColorModel = ColorModelGrayscale
+		spec.HasAlpha = true
 	default:
-		return false, ChromaSubsamplingUnknown
+		return nil, fmt.Errorf("invalid raw color model %q (want RGB, RGBA, GRAY or GRAYA)", parts[1])
+	}
+
+	depth, err := strconv.Atoi(parts[2])
+	if err != nil || (depth != 8 && depth != 16 && depth != 32) {
+		return nil, fmt.Errorf("invalid raw bit depth %q (want 8, 16 or 32)", parts[2])
 	}
+	spec.BitDepth = depth
+
+	return spec, nil
 }
 
-func estimateDecodedSize(filename string, jsonOutput bool) (*ImageInfo, error) {
-	info, err := analyzeImage(filename)
+func analyzeRaw(filename string, spec *RawSpec, scales []int) (*ImageInfo, error) {
+	input, size, err := openInput(filename)
 	if err != nil {
 		return nil, err
 	}
+	_ = input.Close()
 
-	fileInfo, err := os.Stat(filename)
-	if err != nil {
-		return nil, err
+	info := &ImageInfo{
+		Filename:          filename,
+		Format:            "raw",
+		Width:             spec.Width,
+		Height:            spec.Height,
+		PixelAspectRatio:  1,
+		ColorModel:        spec.ColorModel,
+		ColorSpace:        ColorSpaceUntagged,
+		BitDepth:          spec.BitDepth,
+		UniformBitDepth:   true,
+		HasAlpha:          spec.HasAlpha,
+		ChromaSubsampling: ChromaSubsamplingNA,
+		CompressionType:   CompressionNotApplicable,
 	}
-	originalSize := fileInfo.Size()
+	applySizeEstimate(info, size, scales, sizeScope{}, "")
+	info.CompressionRatio = 1.0
 
-	bytesPerPixel := calculateBytesPerPixel(info)
-	decodedSize := int64(info.Width) * int64(info.Height) * int64(bytesPerPixel)
+	if info.OriginalSize != info.DecodedSize {
+		addWarning(info, fmt.Sprintf("file is %d bytes but %dx%d %s at %d-bit needs %d bytes",
+			info.OriginalSize, spec.Width, spec.Height, rawModelName(spec), spec.BitDepth, info.DecodedSize))
+	}
 
-	info.OriginalSize = originalSize
-	info.DecodedSize = decodedSize
-	info.CompressionRatio = float64(decodedSize) / float64(originalSize)
+	return info, nil
+}
 
-	if jsonOutput {
-		encoder := json.NewEncoder(os.Stdout)
-		encoder.SetIndent("", "  ")
-		if err := encoder.Encode(info); err != nil {
-			return nil, err
-		}
-	} else {
-		fmt.Printf("Format: %s\n", info.Format)
-		fmt.Printf("Dimensions: %dx%d\n", info.Width, info.Height)
-		fmt.Printf("Color Model: %s\n", info.ColorModel)
-		if info.HasICCProfile {
-			fmt.Printf("ICC Profile: Present (%d bytes)\n", info.ICCProfileSize)
-		} else {
-			fmt.Printf("ICC Profile: Not detected\n")
-		}
-		fmt.Printf("Color Space: %s\n", info.ColorSpace)
-		fmt.Printf("Bit Depth: %d\n", info.BitDepth)
-		fmt.Printf("Alpha Channel: %v\n", info.HasAlpha)
-		fmt.Printf("Chroma Subsampling: %s\n", info.ChromaSubsampling)
-		fmt.Printf("HDR Support: %s\n", info.HDRType)
-		fmt.Printf("Compression Type: %s\n", info.CompressionType)
-		fmt.Printf("Original file size: %d bytes (%.2f MB)\n",
-			originalSize, float64(originalSize)/(1024*1024))
-		fmt.Printf("Estimated decoded size: %d bytes (%.2f MB)\n",
-			decodedSize, float64(decodedSize)/(1024*1024))
-		fmt.Printf("Compression ratio: %.1fx\n",
-			float64(decodedSize)/float64(originalSize))
+func rawModelName(spec *RawSpec) string {
+	name := "RGB"
+	if spec.ColorModel == ColorModelGrayscale {
+		name = "GRAY"
+	}
+	if spec.HasAlpha {
+		name += "A"
 	}
+	return name
+}
+
+func estimateRawSize(filename string, spec *RawSpec, opts Options) (*ImageInfo, error) {
+	info, err := analyzeRawSize(filename, spec, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := printResult(info, opts); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
 
+func analyzeRawSize(filename string, spec *RawSpec, opts Options) (*ImageInfo, error) {
+	info, err := analyzeRaw(filename, spec, opts.Scales)
+	if err != nil {
+		return nil, err
+	}
+	applyBudget(info, opts.Budgets)
+	applyGPUEstimate(info, opts)
 	return info, nil
 }
 
 func calculateBytesPerPixel(info *ImageInfo) int {
 	bytesPerChannel := (info.BitDepth + 7) / 8
 
+	if info.ChannelCount > 0 {
+		return info.ChannelCount * bytesPerChannel
+	}
+
 	switch info.ColorModel {
 	case ColorModelGrayscale:
 		if info.HasAlpha {
@@ -680,301 +5330,1086 @@ func calculateBytesPerPixel(info *ImageInfo) int {
 	}
 }
 
-func detectPNGICCProfile(r io.ReadSeeker) ([]byte, string) {
+type pngChunks struct {
+	Header        pngHeader
+	BitDepth      int
+	Transparency  bool
+	PaletteSize   int
+	DPIX          int
+	DPIY          int
+	DensityUnit   string
+	ICCProfile    []byte
+	ColorSpace    string
+	XMP           []byte
+	CICP          *CICPValues
+	TrailingBytes int64
+}
+
+func scanPNGChunks(r io.ReadSeeker) pngChunks {
+	chunks := pngChunks{BitDepth: 8, ColorSpace: "Untagged"}
 	_, _ = r.Seek(8, 0)
 
+	seenIDAT := false
+	xmpDone := false
 	buf := make([]byte, 8)
 	for {
 		if _, err := io.ReadFull(r, buf); err != nil {
-			return nil, "sRGB"
+			return chunks
 		}
 
-		length := binary.BigEndian.Uint32(buf[:4])
+		length := int64(binary.BigEndian.Uint32(buf[:4]))
 		chunkType := string(buf[4:8])
 
-		if chunkType == "iCCP" {
-			iccData := make([]byte, length)
-			if _, err := io.ReadFull(r, iccData); err != nil {
-				return nil, "sRGB"
-			}
-			return iccData, detectColorSpaceFromICC(iccData)
-		}
+		switch {
+		case chunkType == "IEND":
+			end, err := r.Seek(length+4, 1)
+			if err != nil {
+				return chunks
+			}
+			if fileSize, err := r.Seek(0, io.SeekEnd); err == nil && fileSize > end {
+				chunks.TrailingBytes = fileSize - end
+			}
+			return chunks
+		case chunkType == "IDAT":
+			seenIDAT = true
+		case chunkType == "tRNS" && !seenIDAT:
+			chunks.Transparency = true
+		case chunkType == "sRGB" && chunks.ICCProfile == nil:
+			chunks.ColorSpace = "sRGB"
+		case chunkType == "PLTE" && !seenIDAT:
+			if length > 0 && length%3 == 0 && length <= 256*3 {
+				chunks.PaletteSize = int(length / 3)
+			}
+		}
+
+		var wanted bool
+		switch chunkType {
+		case "IHDR":
+			wanted = length == 13
+		case "pHYs":
+			wanted = length == 9 && !seenIDAT
+		case "cICP":
+			wanted = length == 4 && !seenIDAT
+		case "gAMA":
+			wanted = length == 4 && chunks.ICCProfile == nil
+		case "iCCP":
+			wanted = chunks.ICCProfile == nil && length <= heifMaxBoxPayload
+		case "iTXt":
+			wanted = !xmpDone && length >= int64(len(pngXMPKeyword))+5 && length <= maxXMPSize
+		}
+		if !wanted {
+			_, _ = r.Seek(length+4, 1)
+			continue
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return chunks
+		}
+		_, _ = r.Seek(4, 1)
+
+		switch chunkType {
+		case "IHDR":
+			chunks.BitDepth = int(data[8])
+			if header, ok := parsePNGHeader(data); ok {
+				chunks.Header = header
+				chunks.Transparency = chunks.Transparency || header.ColorType == 4 || header.ColorType == 6
+			}
+		case "pHYs":
+			x := binary.BigEndian.Uint32(data[0:4])
+			y := binary.BigEndian.Uint32(data[4:8])
+			if data[8] == 1 {
+				chunks.DPIX, chunks.DPIY, chunks.DensityUnit = int(math.Round(float64(x)*0.0254)), int(math.Round(float64(y)*0.0254)), "ppm"
+			} else {
+				chunks.DPIX, chunks.DPIY, chunks.DensityUnit = 0, 0, fmt.Sprintf("aspect ratio %d:%d", x, y)
+			}
+		case "cICP":
+			chunks.CICP = &CICPValues{
+				ColorPrimaries:          int(data[0]),
+				TransferCharacteristics: int(data[1]),
+				MatrixCoefficients:      int(data[2]),
+				FullRange:               data[3] == 1,
+			}
+		case "gAMA":
+			if isSRGBGamma(binary.BigEndian.Uint32(data)) {
+				chunks.ColorSpace = "sRGB"
+			}
+		case "iCCP":
+			chunks.ICCProfile = data
+			chunks.ColorSpace = detectColorSpaceFromICC(data)
+		case "iTXt":
+			if string(data[:len(pngXMPKeyword)+1]) == pngXMPKeyword+"\x00" {
+				xmpDone = true
+				chunks.XMP = parsePNGXMPText(data[len(pngXMPKeyword)+1:])
+			}
+		}
+	}
+}
+
+func parsePNGXMPText(rest []byte) []byte {
+	compressed := rest[0] == 1
+	fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+	if len(fields) != 3 {
+		return nil
+	}
+	text := fields[2]
+
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(text))
+		if err != nil {
+			return nil
+		}
+		text, err = io.ReadAll(io.LimitReader(zr, maxXMPSize))
+		if err != nil {
+			return nil
+		}
+	}
+	return text
+}
+
+const (
+	jpegXMPHeader = "http://ns.adobe.com/xap/1.0/\x00"
+	pngXMPKeyword = "XML:com.adobe.xmp"
+	maxXMPSize    = 16 << 20
+)
+
+func setXMP(info *ImageInfo, xmp []byte) {
+	info.HasXMP = len(xmp) > 0
+	info.XMPSize = len(xmp)
+}
+
+func readXMP(r io.ReadSeeker) []byte {
+	magic := make([]byte, 8)
+	n, _ := io.ReadFull(r, magic)
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xFF, 0xD8}):
+		return scanJPEGMarkers(r).XMP
+	case bytes.HasPrefix(magic, []byte("\x89PNG\r\n\x1a\n")):
+		return scanPNGChunks(r).XMP
+	case len(magic) == 8 && string(magic[4:8]) == "ftyp":
+		_, _ = r.Seek(0, 0)
+		return parseHEIFMetadata(r).XMP
+	default:
+		return nil
+	}
+}
+
+func extractXMP(filename string, w io.Writer) error {
+	if stat, err := os.Stat(filename); err != nil || !stat.Mode().IsRegular() {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	xmp := readXMP(file)
+	if len(xmp) == 0 {
+		return nil
+	}
+	_, err = w.Write(append(xmp, '\n'))
+	return err
+}
+
+func isSRGBGamma(gamma uint32) bool {
+	const srgbGamma = 45455
+	return gamma >= srgbGamma-100 && gamma <= srgbGamma+100
+}
+
+func parseExifThumbnailLength(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd0 := int(order.Uint32(tiff[4:8]))
+	if ifd0+2 > len(tiff) {
+		return 0
+	}
+
+	entries := int(order.Uint16(tiff[ifd0 : ifd0+2]))
+	nextOffset := ifd0 + 2 + entries*12
+	if nextOffset+4 > len(tiff) {
+		return 0
+	}
+
+	ifd1 := int(order.Uint32(tiff[nextOffset : nextOffset+4]))
+	if ifd1 == 0 || ifd1+2 > len(tiff) {
+		return 0
+	}
+
+	entries = int(order.Uint16(tiff[ifd1 : ifd1+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd1 + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		tag := order.Uint16(tiff[entry : entry+2])
+		if tag == 0x0202 {
+			return int(order.Uint32(tiff[entry+8 : entry+12]))
+		}
+	}
+
+	return 0
+}
+
+func detectColorSpaceFromICC(iccData []byte) string {
+	if len(iccData) < 128 {
+		return "sRGB"
+	}
+
+	if string(iccData[16:20]) == "GRAY" {
+		return "Gray"
+	}
+	if bytes.Contains(iccData, []byte("Display P3")) || bytes.Contains(iccData, []byte("P3")) {
+		return "Display P3"
+	}
+	if bytes.Contains(iccData, []byte("BT.2020")) || bytes.Contains(iccData, []byte("Rec. 2020")) {
+		return "BT.2020"
+	}
+	if bytes.Contains(iccData, []byte("BT.709")) || bytes.Contains(iccData, []byte("Rec. 709")) {
+		return "BT.709"
+	}
+	if bytes.Contains(iccData, []byte("Adobe RGB")) {
+		return "Adobe RGB"
+	}
+
+	return "sRGB (ICC)"
+}
 
-		if chunkType == "IEND" {
-			break
-		}
+func chromaNotation(yH, yV, cbH, cbV, crH, crV uint8) string {
+	custom := fmt.Sprintf("Custom (%dx%d:%dx%d:%dx%d)", yH, yV, cbH, cbV, crH, crV)
+	if cbH != crH || cbV != crV || cbH == 0 || cbV == 0 || yH%cbH != 0 || yV%cbV != 0 {
+		return custom
+	}
 
-		_, _ = r.Seek(int64(length+4), 1)
+	switch [2]uint8{yH / cbH, yV / cbV} {
+	case [2]uint8{1, 1}:
+		return "4:4:4"
+	case [2]uint8{2, 1}:
+		return "4:2:2"
+	case [2]uint8{2, 2}:
+		return "4:2:0"
+	case [2]uint8{4, 1}:
+		return "4:1:1"
+	case [2]uint8{1, 2}:
+		return "4:4:0"
+	default:
+		return custom
 	}
+}
 
-	return nil, "sRGB"
+type jpegMarkers struct {
+	FrameMarker     byte
+	Precision       int
+	Subsampling     string
+	ICCProfile      []byte
+	ColorSpace      string
+	ThumbnailBytes  int
+	RestartInterval int
+	DPIX            int
+	DPIY            int
+	DensityUnit     string
+	XMP             []byte
 }
 
-func detectJPEGICCProfile(r io.ReadSeeker) ([]byte, string) {
+func scanJPEGMarkers(r io.ReadSeeker) jpegMarkers {
+	markers := jpegMarkers{Subsampling: "Unknown", ColorSpace: "sRGB"}
 	_, _ = r.Seek(0, 0)
 
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(r, buf); err != nil {
-		return nil, "sRGB"
+		return markers
 	}
 
 	if buf[0] != 0xFF || buf[1] != 0xD8 {
-		return nil, "sRGB"
+		return markers
 	}
 
 	for {
 		if _, err := io.ReadFull(r, buf); err != nil {
-			return nil, "sRGB"
+			return markers
 		}
 
 		if buf[0] != 0xFF {
-			return nil, "sRGB"
+			return markers
 		}
 
 		marker := buf[1]
 
-		if marker == 0xD9 {
-			break
+		if marker == 0xD9 || marker == 0xDA {
+			return markers
 		}
 
 		if _, err := io.ReadFull(r, buf); err != nil {
-			return nil, "sRGB"
+			return markers
 		}
 
 		length := int(binary.BigEndian.Uint16(buf)) - 2
+		if length < 0 {
+			return markers
+		}
 
-		if marker == 0xE2 {
-			data := make([]byte, length)
-			if _, err := io.ReadFull(r, data); err != nil {
-				return nil, "sRGB"
-			}
+		frame := isJPEGFrameMarker(marker) && markers.FrameMarker == 0
+		if frame {
+			markers.FrameMarker = marker
+		}
 
-			if len(data) > 12 && string(data[:12]) == "ICC_PROFILE\x00" {
-				return data[14:], detectColorSpaceFromICC(data[14:])
-			}
-		} else {
+		wanted := frame ||
+			(marker == 0xE0 && markers.DensityUnit == "") ||
+			(marker == 0xE1 && (markers.ThumbnailBytes == 0 || markers.XMP == nil)) ||
+			(marker == 0xE2 && markers.ICCProfile == nil) ||
+			(marker == 0xDD && markers.RestartInterval == 0)
+		if !wanted {
 			_, _ = r.Seek(int64(length), 1)
+			continue
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return markers
+		}
+
+		switch {
+		case frame:
+			if len(data) >= 1 {
+				markers.Precision = int(data[0])
+			}
+			if marker <= 0xC3 {
+				markers.Subsampling = jpegFrameSubsampling(data)
+			}
+		case marker == 0xE0:
+			markers.DPIX, markers.DPIY, markers.DensityUnit = parseJFIFDensity(data)
+		case marker == 0xE1:
+			if len(data) > 6 && string(data[:6]) == "Exif\x00\x00" && markers.ThumbnailBytes == 0 {
+				markers.ThumbnailBytes = parseExifThumbnailLength(data[6:])
+			}
+			if len(data) > len(jpegXMPHeader) && string(data[:len(jpegXMPHeader)]) == jpegXMPHeader && markers.XMP == nil {
+				markers.XMP = data[len(jpegXMPHeader):]
+			}
+		case marker == 0xE2:
+			if len(data) >= 14 && string(data[:12]) == "ICC_PROFILE\x00" {
+				markers.ICCProfile = data[14:]
+				markers.ColorSpace = detectColorSpaceFromICC(markers.ICCProfile)
+			}
+		case marker == 0xDD:
+			if len(data) >= 2 {
+				markers.RestartInterval = int(binary.BigEndian.Uint16(data))
+			}
 		}
 	}
+}
+
+func jpegFrameSubsampling(sofData []byte) string {
+	if len(sofData) < 6 {
+		return "Unknown"
+	}
+
+	numComponents := sofData[5]
+	if numComponents < 3 {
+		return "Grayscale"
+	}
+
+	if len(sofData) < 6+int(numComponents)*3 {
+		return "Unknown"
+	}
+
+	yH, yV := sofData[7]>>4, sofData[7]&0x0F
+	cbH, cbV := sofData[10]>>4, sofData[10]&0x0F
+	crH, crV := sofData[13]>>4, sofData[13]&0x0F
 
-	return nil, "sRGB"
+	return chromaNotation(yH, yV, cbH, cbV, crH, crV)
 }
 
-func detectColorSpaceFromICC(iccData []byte) string {
-	if len(iccData) < 128 {
-		return "sRGB"
+func parseJFIFDensity(app0 []byte) (int, int, string) {
+	if len(app0) < 12 || string(app0[0:5]) != "JFIF\x00" {
+		return 0, 0, ""
 	}
 
-	if bytes.Contains(iccData, []byte("Display P3")) || bytes.Contains(iccData, []byte("P3")) {
-		return "Display P3"
+	x := int(binary.BigEndian.Uint16(app0[8:10]))
+	y := int(binary.BigEndian.Uint16(app0[10:12]))
+	switch app0[7] {
+	case 1:
+		return x, y, "dpi"
+	case 2:
+		return int(math.Round(float64(x) * 2.54)), int(math.Round(float64(y) * 2.54)), "dpcm"
+	default:
+		return 0, 0, fmt.Sprintf("aspect ratio %d:%d", x, y)
 	}
-	if bytes.Contains(iccData, []byte("BT.2020")) || bytes.Contains(iccData, []byte("Rec. 2020")) {
-		return "BT.2020"
+}
+
+func isJPEGFrameMarker(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+type pngHeader struct {
+	Width     int
+	Height    int
+	BitDepth  int
+	ColorType int
+}
+
+func parsePNGHeader(ihdr []byte) (pngHeader, bool) {
+	if len(ihdr) < 13 {
+		return pngHeader{}, false
 	}
-	if bytes.Contains(iccData, []byte("BT.709")) || bytes.Contains(iccData, []byte("Rec. 709")) {
-		return "BT.709"
+
+	header := pngHeader{
+		Width:     int(binary.BigEndian.Uint32(ihdr[0:4])),
+		Height:    int(binary.BigEndian.Uint32(ihdr[4:8])),
+		BitDepth:  int(ihdr[8]),
+		ColorType: int(ihdr[9]),
 	}
-	if bytes.Contains(iccData, []byte("Adobe RGB")) {
-		return "Adobe RGB"
+	if header.Width <= 0 || header.Height <= 0 {
+		return pngHeader{}, false
 	}
+	return header, true
+}
 
-	return "sRGB (ICC)"
+func (h pngHeader) colorModel() (ColorModel, bool) {
+	switch h.ColorType {
+	case 0:
+		return ColorModelGrayscale, false
+	case 3:
+		return ColorModelIndexed, false
+	case 4:
+		return ColorModelGrayscale, true
+	case 6:
+		return ColorModelRGB, true
+	default:
+		return ColorModelRGB, false
+	}
 }
 
-func detectJPEGSubsampling(r io.ReadSeeker) string {
-	_, _ = r.Seek(0, 0)
+func main() {
+	jsonOutput := flag.Bool("json", false, "Output in JSON format")
+	jsonCompact := flag.Bool("json-compact", false, "Output single-line JSON, one object per image (implies -json)")
+	jsonArray := flag.Bool("json-array", false, "Stream all results as one JSON array, ending with a summary object")
+	scalesFlag := flag.String("scales", "", "Comma-separated target widths to estimate downscaled sizes for")
+	allImages := flag.Bool("all-images", false, "Sum the decoded size of every image embedded in multi-image files (ICO)")
+	gpu := flag.Bool("gpu", false, "Report the GPU texture memory with dimensions padded to powers of two")
+	gpuMipmaps := flag.Bool("gpu-mipmaps", false, "Include a full mipmap chain in the GPU texture memory (implies -gpu)")
+	mipmaps := flag.Bool("mipmaps", false, "Include the full mipmap chain of DDS textures in the decoded size")
+	allFrames := flag.Bool("all-frames", false, "Multiply the decoded size by the frame count of image sequences (.heics, .avis, .avifs)")
+	colorMode := flag.String("color", "auto", "Colorize human-readable output: auto, always or never")
+	quiet := flag.Bool("quiet", false, "Print nothing on success; only errors are reported")
+	compactErrors := flag.Bool("compact-errors", false, "Group failures by error message and print each group once with a count and example files")
+	errorsOnly := flag.Bool("errors-only", false, "Report only files that failed (human or JSON); successes and summaries are suppressed")
+	decodeTime := flag.Bool("decode-time", false, "Fully decode each image and report how long decoding took")
+	strict := flag.Bool("strict", false, "Fully decode each image and fail if the pixel data is corrupt")
+	serverSocket := flag.String("server", "", "Serve length-prefixed analysis requests on this Unix socket")
+	fromDoc := flag.String("from-doc", "", "Analyze the local images referenced by this HTML or Markdown file")
+	fromFile := flag.String("from-file", "", "Read newline-separated image paths to analyze from this file")
+	diff := flag.Bool("diff", false, "Compare the analyses of exactly two images side by side")
+	explainFlag := flag.Bool("explain", false, "Print a step-by-step trace of how each value was derived for a single image")
+	fileTimeout := flag.Duration("file-timeout", 0, "Give up on a file whose analysis takes longer than this (e.g. 10s); 0 disables the limit")
+	sample := flag.Int("sample", 0, "Analyze only a random sample of N files and extrapolate the totals to all files")
+	seed := flag.Int64("seed", 0, "Random seed for -sample (default: time-based, printed with the summary)")
+	retries := flag.Int("retries", 0, "Retry each file up to N times on transient I/O errors")
+	hashAlgorithm := flag.String("hash", "", "Include a content hash of each file: md5, sha1 or sha256")
+	perceptualHash := flag.Bool("phash", false, "Fully decode each image and report a perceptual (difference) hash")
+	countColors := flag.Bool("count-colors", false, "Fully decode indexed images and count the distinct colors actually used")
+	detectGrayscale := flag.Bool("detect-grayscale", false, "Fully decode color images and report whether every pixel is gray (R==G==B)")
+	budgetFile := flag.String("budget", "", "CSV of format,max_decoded_bytes; images over their format's budget get a warning")
+	fieldsFlag := flag.String("fields", "", "Comma-separated JSON field names to include in the output (e.g. filename,width,height)")
+	outputDir := flag.String("output-dir", "", "Write sidecar JSON files into this directory, mirroring the inputs' paths relative to the current directory (implies -sidecar)")
+	sidecar := flag.Bool("sidecar", false, "Also write each image's JSON to <image>.json next to the file")
+	warnAvgRatio := flag.Float64("warn-avg-ratio", 0, "Exit with code 5 if the average compression ratio of all analyzed images is below this value")
+	exitOnWarning := flag.Bool("exit-on-warning", false, "Exit with code 5 if any analyzed image carries a warning")
+	extractXMPPath := flag.String("extract-xmp", "", "Write each image's raw XMP packet to this file (\"-\" for stderr)")
+	histogram := flag.Bool("histogram", false, "After the run, print histograms of megapixels, bit depths and formats to stderr")
+	runSummary := flag.Bool("summary", false, "After the run, print totals and per-format and HDR/SDR breakdowns to stderr")
+	summaryJSON := flag.Bool("summary-json", false, "Print only the run summary as JSON to stdout, without per-image results")
+	minRatio := flag.Float64("min-ratio", 0, "Only list images whose compression ratio is at least this value")
+	maxRatio := flag.Float64("max-ratio", 0, "Only list images whose compression ratio is at most this value")
+	offset := flag.Int64("offset", 0, "Start reading each image at this byte offset (e.g. for images embedded in atlases)")
+	rawFlag := flag.String("raw", "", "Treat inputs as headerless pixel buffers described as WxH:MODEL:DEPTH (e.g. 1920x1080:RGB:8)")
+	estimateModel := flag.String("estimate-model", EstimateModelGo, "Bytes-per-pixel model for the decoded size: go, rgba or tight")
+	compareTo := flag.String("compare-to", "", "Re-encode each image as webp or avif and report the size and projected savings")
+	quality := flag.Int("quality", 80, "Encoder quality (0-100) used by -compare-to")
+	archiveSize := flag.String("archive-size", "uncompressed", "Original size used for archive entries: uncompressed or compressed")
+	cpuProfile := flag.String("cpuprofile", "", "Write a CPU profile to this file")
+	memProfile := flag.String("memprofile", "", "Write a heap profile to this file on exit")
+	flag.Parse()
 
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return "Unknown"
+	stopProfiling, err := startProfiling(*cpuProfile, *memProfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(ExitUsageError)
+	}
+	defer stopProfiling()
+	exit := func(code int) {
+		stopProfiling()
+		os.Exit(code)
 	}
 
-	if buf[0] != 0xFF || buf[1] != 0xD8 {
-		return "Unknown"
+	if *jsonCompact {
+		*jsonOutput = true
+	}
+	if *outputDir != "" {
+		*sidecar = true
+	}
+	if *gpuMipmaps {
+		*gpu = true
+	}
+	if *sample > 0 {
+		seedSet := false
+		flag.Visit(func(f *flag.Flag) {
+			seedSet = seedSet || f.Name == "seed"
+		})
+		if !seedSet {
+			*seed = time.Now().UnixNano()
+		}
 	}
 
-	for {
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return "Unknown"
+	_, noColor := os.LookupEnv("NO_COLOR")
+	useColor, err := resolveColorMode(*colorMode, noColor, isTerminal(os.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(ExitUsageError)
+	}
+
+	scales, err := parseScales(*scalesFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(ExitUsageError)
+	}
+
+	fields, err := parseFields(*fieldsFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(ExitUsageError)
+	}
+
+	var budgets map[string]int64
+	if *budgetFile != "" {
+		budgets, err = readBudgets(*budgetFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(ExitUsageError)
 		}
+	}
 
-		if buf[0] != 0xFF {
-			return "Unknown"
+	if *hashAlgorithm != "" {
+		if _, err := newHasher(*hashAlgorithm); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(ExitUsageError)
 		}
+	}
 
-		marker := buf[1]
+	if *offset < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid offset %d (must be 0 or more)\n", *offset)
+		exit(ExitUsageError)
+	}
 
-		if marker == 0xC0 || marker == 0xC1 || marker == 0xC2 {
-			if _, err := io.ReadFull(r, buf); err != nil {
-				return "Unknown"
-			}
+	if *warnAvgRatio < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid average ratio threshold %g (must be 0 or more)\n", *warnAvgRatio)
+		exit(ExitUsageError)
+	}
 
-			length := int(binary.BigEndian.Uint16(buf))
-			sofData := make([]byte, length-2)
-			if _, err := io.ReadFull(r, sofData); err != nil {
-				return "Unknown"
-			}
+	if *sample < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid sample size %d (must be 0 or more)\n", *sample)
+		exit(ExitUsageError)
+	}
 
-			if len(sofData) < 6 {
-				return "Unknown"
-			}
+	if *retries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid retry count %d (must be 0 or more)\n", *retries)
+		exit(ExitUsageError)
+	}
 
-			numComponents := sofData[5]
-			if numComponents < 3 {
-				return "Grayscale"
-			}
+	if !validEstimateModel(*estimateModel) {
+		fmt.Fprintf(os.Stderr, "Error: invalid estimate model %q (want go, rgba or tight)\n", *estimateModel)
+		exit(ExitUsageError)
+	}
 
-			if len(sofData) < 6+int(numComponents)*3 {
-				return "Unknown"
-			}
+	if *compareTo != "" && *compareTo != CompareToWebP && *compareTo != CompareToAVIF {
+		fmt.Fprintf(os.Stderr, "Error: invalid compare-to format %q (want webp or avif)\n", *compareTo)
+		exit(ExitUsageError)
+	}
 
-			ySample := sofData[7]
-			cbSample := sofData[10]
+	if *quality < 0 || *quality > 100 {
+		fmt.Fprintf(os.Stderr, "Error: invalid quality %d (must be between 0 and 100)\n", *quality)
+		exit(ExitUsageError)
+	}
 
-			yH := (ySample >> 4) & 0x0F
-			yV := ySample & 0x0F
-			cbH := (cbSample >> 4) & 0x0F
-			cbV := cbSample & 0x0F
+	if *archiveSize != "uncompressed" && *archiveSize != "compressed" {
+		fmt.Fprintf(os.Stderr, "Error: invalid archive size mode %q (want uncompressed or compressed)\n", *archiveSize)
+		exit(ExitUsageError)
+	}
 
-			if yH == 1 && yV == 1 && cbH == 1 && cbV == 1 {
-				return "4:4:4"
-			} else if yH == 2 && yV == 1 && cbH == 1 && cbV == 1 {
-				return "4:2:2"
-			} else if yH == 2 && yV == 2 && cbH == 1 && cbV == 1 {
-				return "4:2:0"
-			}
+	var rawSpec *RawSpec
+	if *rawFlag != "" {
+		rawSpec, err = parseRawSpec(*rawFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(ExitUsageError)
+		}
+	}
 
-			return fmt.Sprintf("Custom (%dx%d:%dx%d)", yH, yV, cbH, cbV)
+	var xmpWriter io.Writer
+	switch *extractXMPPath {
+	case "":
+	case "-":
+		xmpWriter = os.Stderr
+	default:
+		xmpFile, err := os.Create(*extractXMPPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(categorizeError(err))
 		}
+		defer xmpFile.Close()
+		xmpWriter = xmpFile
+	}
 
-		if marker == 0xD9 {
-			break
+	files := flag.Args()
+	if *fromFile != "" {
+		manifest, err := readManifest(*fromFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(categorizeError(err))
+		}
+		files = append(files, manifest...)
+	}
+	if *fromDoc != "" {
+		referenced, err := readDocumentImages(*fromDoc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(categorizeError(err))
 		}
+		files = append(files, referenced...)
+	}
 
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return "Unknown"
+	if len(files) < 1 && *serverSocket == "" {
+		fmt.Println("Usage: decoded-imagesize [-server <socket>] [-json] [-json-compact] [-json-array] [-scales <widths>] [-all-images] [-all-frames] [-mipmaps] [-color <mode>] [-archive-size <mode>] [-estimate-model <model>] [-compare-to <webp|avif>] [-quality <n>] [-gpu] [-gpu-mipmaps] [-decode-time] [-strict] [-quiet] [-errors-only] [-compact-errors] [-from-file <manifest>] [-from-doc <file.html|file.md>] [-sample <n>] [-seed <n>] [-retries <n>] [-file-timeout <duration>] [-hash <algorithm>] [-phash] [-raw WxH:MODEL:DEPTH] [-offset <bytes>] [-min-ratio <x>] [-max-ratio <x>] [-histogram] [-extract-xmp <file>] [-exit-on-warning] [-warn-avg-ratio <x>] [-sidecar] [-output-dir <dir>] [-fields <names>] [-budget <file.csv>] [-detect-grayscale] [-count-colors] [-cpuprofile <file>] [-memprofile <file>] [-explain] [-diff] <image-file|archive>...")
+		fmt.Println("Supported formats: PNG, JPEG, HEIF/HEIC (and .heics sequences), AVIF (and .avis/.avifs sequences), WebP, ICO, OpenEXR, Radiance HDR, DDS textures, JPEG 2000, GIF, TIFF, SVG (dimensions only)")
+		fmt.Println("Archives (.zip, .tar) are scanned and every image entry is analyzed")
+		fmt.Println("\nFlags:")
+		fmt.Println("  -json    Output in JSON format")
+		fmt.Println("  -json-compact  Output single-line JSON; archives emit one object per line")
+		fmt.Println("  -json-array  Stream results, failures and a final summary as one valid JSON array")
+		fmt.Println("  -scales  Comma-separated target widths (e.g. 320,640,1280) to estimate downscaled sizes")
+		fmt.Println("  -all-images  Sum all embedded images in multi-image files (ICO) into the decoded size")
+		fmt.Println("  -mipmaps Include the mipmap chain of DDS textures in the decoded size")
+		fmt.Println("  -all-frames  Count every frame of HEIF/AVIF image sequences and animated GIFs in the decoded size")
+		fmt.Println("  -color   Colorize output: auto (default, honors NO_COLOR and TTY), always, never")
+		fmt.Println("  -archive-size  Original size for archive entries: uncompressed (default) or compressed")
+		fmt.Println("  -estimate-model  Decoded size model: go (default, Go's image types), rgba (4 bytes per pixel, like a browser canvas) or tight (minimal packed layout)")
+		fmt.Println("  -compare-to  Re-encode each decodable image as webp or avif and report the resulting size and projected savings (slow)")
+		fmt.Println("  -quality  Encoder quality for -compare-to, 0-100 (default 80)")
+		fmt.Println("  -gpu  Report the GPU texture memory, with width and height padded to the next power of two")
+		fmt.Println("  -gpu-mipmaps  Add a full mipmap chain (about 1.33x) to the GPU texture memory (implies -gpu)")
+		fmt.Println("  -decode-time  Fully decode each image and report the decode duration (slow; archives also print a total)")
+		fmt.Println("  -strict  Fully decode each image and treat decode errors (e.g. truncated pixel data) as failures")
+		fmt.Println("  -from-file  Also analyze the paths listed in this file (one per line, # comments allowed)")
+		fmt.Println("  -from-doc  Also analyze the local images referenced by <img src> or ![](path) in this HTML or Markdown file")
+		fmt.Println("  -file-timeout  Abandon a file whose analysis exceeds this duration (e.g. 10s) and report it as an error")
+		fmt.Println("  -sample  Analyze a random sample of N files and extrapolate size totals to the full file count")
+		fmt.Println("  -seed  Random seed for -sample, to repeat a sample (default: time-based; the seed used is reported)")
+		fmt.Println("  -retries  Retry a file up to N times on transient I/O errors (format errors are not retried)")
+		fmt.Println("  -hash    Include a content hash of each file (md5, sha1 or sha256)")
+		fmt.Println("  -phash   Fully decode each image and report a 64-bit perceptual hash; identical hashes are grouped")
+		fmt.Println("  -histogram  Print megapixel, bit depth and format histograms of all analyzed images to stderr (a JSON object with -json)")
+		fmt.Println("  -warn-avg-ratio  Warn and exit with code 5 when the average compression ratio of all analyzed images is below this value")
+		fmt.Println("  -min-ratio / -max-ratio  Only list images whose compression ratio is within this range; summaries still cover every image")
+		fmt.Println("  -offset  Skip this many leading bytes and analyze the image that starts there (image files only)")
+		fmt.Println("  -raw     Treat inputs as headerless pixel dumps, e.g. 1920x1080:RGB:8 (models RGB, RGBA, GRAY, GRAYA; depths 8, 16, 32)")
+		fmt.Println("  -extract-xmp  Write the raw XMP packet of each image to a file (\"-\" for stderr)")
+		fmt.Println("  -exit-on-warning  Exit with code 5 when any image reports a warning (truncation, zero dimensions, ...)")
+		fmt.Println("  -sidecar Write each image's JSON to <image>.json next to it (archive entries are skipped)")
+		fmt.Println("  -output-dir  Write sidecars to <dir>/<relative path>.json instead, keeping the source tree read-only (implies -sidecar)")
+		fmt.Println("  -fields  Comma-separated JSON field names to keep (e.g. filename,width,height,decoded_size_bytes)")
+		fmt.Println("  -budget  CSV of format,max_decoded_bytes; images over budget get a warning and are counted")
+		fmt.Println("  -detect-grayscale  Fully decode color images and flag those whose pixels are all gray")
+		fmt.Println("  -count-colors  Fully decode indexed (palette) images and report how many distinct colors are used")
+		fmt.Println("  -cpuprofile / -memprofile  Write CPU / heap profiles (runtime/pprof) for the whole run")
+		fmt.Println("  -explain Trace how one image was analyzed: matched magic bytes, chunks/boxes found and the rule behind each value")
+		fmt.Println("  -diff    Compare two images side by side and highlight differing fields")
+		fmt.Println("  -quiet   Print nothing on success; errors still go to stderr (JSON output is kept)")
+		fmt.Println("  -errors-only  Print only failures (as JSON objects with -json); successful files and summaries are suppressed")
+		fmt.Println("  -compact-errors  Print one line per distinct error message with a count and up to 3 example files")
+		fmt.Println("  -server  Listen on a Unix socket; each request is a 4-byte big-endian length plus image bytes, each reply a length-prefixed JSON object")
+		fmt.Println("\nExit Codes:")
+		fmt.Println("  0 - Success")
+		fmt.Println("  1 - Usage error")
+		fmt.Println("  2 - File not found")
+		fmt.Println("  3 - Invalid or unsupported format")
+		fmt.Println("  4 - Processing error")
+		fmt.Println("  5 - Warning reported (only with -exit-on-warning)")
+		exit(ExitUsageError)
+	}
+
+	opts := Options{
+		JSONOutput:            *jsonOutput,
+		CompactJSON:           *jsonCompact,
+		Fields:                fields,
+		Quiet:                 *quiet,
+		UseColor:              useColor,
+		Scales:                scales,
+		AllImages:             *allImages,
+		AllFrames:             *allFrames,
+		Mipmaps:               *mipmaps,
+		CompressedArchiveSize: *archiveSize == "compressed",
+		DecodeTime:            *decodeTime,
+		Strict:                *strict,
+		HashAlgorithm:         *hashAlgorithm,
+		PerceptualHash:        *perceptualHash,
+		DetectGrayscale:       *detectGrayscale,
+		CountColors:           *countColors,
+		Budgets:               budgets,
+		Offset:                *offset,
+		MinRatio:              *minRatio,
+		MaxRatio:              *maxRatio,
+		EstimateModel:         *estimateModel,
+		CompareTo:             *compareTo,
+		Quality:               *quality,
+		GPU:                   *gpu,
+		GPUMipmaps:            *gpuMipmaps,
+		Raw:                   rawSpec,
+		JSONArray:             *jsonArray,
+		ErrorsOnly:            *errorsOnly,
+		CompactErrors:         *compactErrors,
+		Histogram:             *histogram,
+		Summary:               *runSummary,
+		SummaryJSON:           *summaryJSON,
+		Sidecar:               *sidecar,
+		OutputDir:             *outputDir,
+		XMPWriter:             xmpWriter,
+		FileTimeout:           *fileTimeout,
+		Retries:               *retries,
+		Sample:                *sample,
+		Seed:                  *seed,
+		ExitOnWarning:         *exitOnWarning,
+		WarnAvgRatio:          *warnAvgRatio,
+	}
+
+	if *serverSocket != "" {
+		if err := runServer(*serverSocket, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(categorizeError(err))
 		}
+		return
+	}
 
-		length := int(binary.BigEndian.Uint16(buf)) - 2
-		_, _ = r.Seek(int64(length), 1)
+	if *explainFlag {
+		if len(files) != 1 {
+			fmt.Fprintf(os.Stderr, "Error: -explain requires exactly one file, got %d\n", len(files))
+			exit(ExitUsageError)
+		}
+
+		if _, err := explainImage(files[0], opts, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(categorizeError(err))
+		}
+		return
+	}
+
+	if *diff {
+		if len(files) != 2 {
+			fmt.Fprintf(os.Stderr, "Error: -diff requires exactly two files, got %d\n", len(files))
+			exit(ExitUsageError)
+		}
+
+		if _, err := diffImages(files[0], files[1], opts); err != nil {
+			exitCode := categorizeError(err)
+			if *jsonOutput {
+				errJSON, _ := json.Marshal(map[string]interface{}{
+					"error":     err.Error(),
+					"exit_code": exitCode,
+				})
+				fmt.Println(string(errJSON))
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+			exit(exitCode)
+		}
+		return
 	}
 
-	return "Unknown"
+	if code := runFiles(files, opts); code != ExitSuccess {
+		exit(code)
+	}
 }
 
-func is12BitJPEG(r io.ReadSeeker) bool {
-	_, _ = r.Seek(0, 0)
+func runFiles(files []string, opts Options) int {
+	jsonOutput := opts.JSONOutput && !opts.SummaryJSON
+	if opts.ErrorsOnly || opts.SummaryJSON {
+		opts.JSONOutput = false
+		opts.Quiet = true
+	}
 
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return false
+	var sampled *SampleSummary
+	if opts.Sample > 0 && opts.Sample < len(files) {
+		sampled = &SampleSummary{Seed: opts.Seed, TotalFiles: len(files)}
+		files = sampleFiles(files, opts.Sample, opts.Seed)
 	}
 
-	if buf[0] != 0xFF || buf[1] != 0xD8 {
-		return false
+	var array *jsonArrayWriter
+	if opts.JSONArray {
+		opts.JSONOutput = false
+		opts.Quiet = true
+		var err error
+		array, err = newJSONArrayWriter(os.Stdout, opts.CompactJSON)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return ExitProcessingError
+		}
 	}
 
-	for {
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return false
+	analyzeTarget := func(filename string) ([]*ImageInfo, error) {
+		if opts.Raw == nil && isArchive(filename) {
+			return analyzeArchive(filename, opts)
 		}
 
-		if buf[0] != 0xFF {
-			return false
+		var info *ImageInfo
+		var err error
+		if opts.Raw != nil {
+			info, err = analyzeRawSize(filename, opts.Raw, opts)
+		} else {
+			info, err = analyzeDecodedSize(filename, opts)
+		}
+		if err != nil {
+			return nil, err
 		}
+		return []*ImageInfo{info}, nil
+	}
 
-		marker := buf[1]
+	emitTarget := func(filename string, analyzed []*ImageInfo) error {
+		if opts.Raw == nil && isArchive(filename) {
+			return printArchiveResults(analyzed, opts)
+		}
 
-		if marker == 0xC0 || marker == 0xC1 || marker == 0xC2 {
-			if _, err := io.ReadFull(r, buf); err != nil {
-				return false
+		for _, info := range analyzed {
+			if err := printResult(info, opts); err != nil {
+				return err
 			}
-
-			length := int(binary.BigEndian.Uint16(buf))
-			sofData := make([]byte, length-2)
-			if _, err := io.ReadFull(r, sofData); err != nil {
-				return false
+			if opts.Sidecar {
+				if err := writeSidecar(info, opts.CompactJSON, opts.Fields, opts.OutputDir); err != nil {
+					return err
+				}
 			}
+			if opts.XMPWriter != nil && info.HasXMP {
+				if err := extractXMP(filename, opts.XMPWriter); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
 
-			if len(sofData) > 0 {
-				precision := sofData[0]
-				return precision == 12
+	printed := false
+	var results []*ImageInfo
+	analyzedFiles := 0
+	failures := processFiles(files, func(filename string) error {
+		if printed && !opts.JSONOutput && !opts.Quiet {
+			fmt.Println()
+			printed = false
+		}
+
+		analyzed, err := withFileTimeout(opts.FileTimeout, func() ([]*ImageInfo, error) {
+			var analyzed []*ImageInfo
+			err := withRetries(opts.Retries, retryBackoff, func() error {
+				var err error
+				analyzed, err = analyzeTarget(filename)
+				return err
+			})
+			return analyzed, err
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			if emitErr := emitTarget(filename, analyzed); emitErr != nil && err == nil {
+				err = emitErr
+			}
+			results = append(results, analyzed...)
+			if len(analyzed) > 0 {
+				analyzedFiles++
+			}
+			for _, info := range analyzed {
+				printed = printed || opts.showsRatio(info.CompressionRatio)
+				if array != nil && !opts.ErrorsOnly && opts.showsRatio(info.CompressionRatio) {
+					if writeErr := array.writeImage(info, opts.Fields); writeErr != nil && err == nil {
+						err = writeErr
+					}
+				}
+			}
+		}
+		if array != nil && err != nil {
+			for _, failure := range processErrors(filename, err) {
+				_ = array.writeFailure(failure, len(files) > 1 || isArchive(filename))
 			}
 		}
+		return err
+	})
 
-		if marker == 0xD9 {
-			break
+	if opts.PerceptualHash && len(results) > 1 && !opts.JSONOutput && !opts.Quiet {
+		printPerceptualHashGroups(results)
+	}
+
+	if opts.Budgets != nil && !opts.JSONOutput && !opts.Quiet {
+		exceeded := 0
+		for _, info := range results {
+			if info.BudgetExceeded {
+				exceeded++
+			}
 		}
+		fmt.Printf("\nBudget exceeded: %d of %d images\n", exceeded, len(results))
+	}
 
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return false
+	if opts.HashAlgorithm != "" && len(results) > 1 && !opts.JSONOutput && !opts.Quiet {
+		var total int64
+		for _, info := range results {
+			total += info.DecodedSize
 		}
+		unique, duplicates := uniqueDecodedSize(results)
+		fmt.Printf("\nTotal decoded size: %d bytes (%.2f MB)\n", total, float64(total)/(1024*1024))
+		fmt.Printf("Unique decoded size: %d bytes (%.2f MB), %d duplicates\n", unique, float64(unique)/(1024*1024), duplicates)
+	}
 
-		length := int(binary.BigEndian.Uint16(buf)) - 2
-		_, _ = r.Seek(int64(length), 1)
+	if sampled != nil {
+		*sampled = summarizeSample(results, len(files), analyzedFiles, sampled.TotalFiles, sampled.Seed)
+		if array == nil && opts.JSONOutput {
+			_ = writeJSON(os.Stderr, map[string]SampleSummary{"sample": *sampled}, opts.CompactJSON)
+		} else if array == nil && !opts.Quiet {
+			fmt.Println()
+			printSampleSummary(os.Stdout, *sampled)
+		}
 	}
 
-	return false
-}
+	if array != nil || opts.SummaryJSON {
+		summary := summarizeRun(results, len(failures))
+		summary.Sample = sampled
+		if opts.Histogram {
+			h := buildHistogram(results)
+			summary.Histogram = &h
+		}
+		var err error
+		if array != nil {
+			err = array.close(summary)
+		} else {
+			err = writeJSON(os.Stdout, map[string]RunSummary{"summary": summary}, opts.CompactJSON)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return ExitProcessingError
+		}
+	} else if opts.Histogram {
+		if jsonOutput {
+			_ = writeJSON(os.Stderr, map[string]Histogram{"histogram": buildHistogram(results)}, opts.CompactJSON)
+		} else {
+			fmt.Fprintln(os.Stderr)
+			printHistogram(os.Stderr, buildHistogram(results), len(results))
+		}
+	}
 
-func detectPNGBitDepth(r io.ReadSeeker) int {
-	_, _ = r.Seek(8, 0)
+	if array == nil && opts.Summary && !opts.SummaryJSON {
+		summary := summarizeRun(results, len(failures))
+		if jsonOutput {
+			_ = writeJSON(os.Stderr, map[string]RunSummary{"summary": summary}, opts.CompactJSON)
+		} else {
+			fmt.Fprintln(os.Stderr)
+			printRunSummary(os.Stderr, summary)
+		}
+	}
 
-	buf := make([]byte, 8)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return 8
+	if array == nil && opts.CompactErrors {
+		reportGroupedFailures(failures, jsonOutput)
+	} else if array == nil {
+		reportFailures(failures, len(files) > 1 || isArchive(files[0]), jsonOutput)
 	}
 
-	length := binary.BigEndian.Uint32(buf[:4])
-	chunkType := string(buf[4:8])
+	if len(failures) > 0 {
+		return categorizeError(failures[0].Err)
+	}
 
-	if chunkType != "IHDR" || length != 13 {
-		return 8
+	if opts.ExitOnWarning && hasWarnings(results) {
+		return ExitWarning
 	}
 
-	ihdr := make([]byte, 13)
-	if _, err := io.ReadFull(r, ihdr); err != nil {
-		return 8
+	if opts.WarnAvgRatio > 0 {
+		if average, ok := averageCompressionRatio(results); ok && average < opts.WarnAvgRatio {
+			fmt.Fprintf(os.Stderr, "Warning: average compression ratio %.1fx is below %.1fx\n", average, opts.WarnAvgRatio)
+			return ExitWarning
+		}
 	}
 
-	bitDepth := int(ihdr[8])
-	return bitDepth
+	return ExitSuccess
 }
 
-func main() {
-	jsonOutput := flag.Bool("json", false, "Output in JSON format")
-	flag.Parse()
-
-	if flag.NArg() < 1 {
-		fmt.Println("Usage: decoded-imagesize [-json] <image-file>")
-		fmt.Println("Supported formats: PNG, JPEG, HEIF/HEIC, AVIF, WebP")
-		fmt.Println("\nFlags:")
-		fmt.Println("  -json    Output in JSON format")
-		fmt.Println("\nExit Codes:")
-		fmt.Println("  0 - Success")
-		fmt.Println("  1 - Usage error")
-		fmt.Println("  2 - File not found")
-		fmt.Println("  3 - Invalid or unsupported format")
-		fmt.Println("  4 - Processing error")
-		os.Exit(ExitUsageError)
+func averageCompressionRatio(results []*ImageInfo) (float64, bool) {
+	var total float64
+	count := 0
+	for _, info := range results {
+		if info.CompressionRatio > 0 {
+			total += info.CompressionRatio
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
 	}
+	return total / float64(count), true
+}
 
-	filename := flag.Arg(0)
+func hasWarnings(results []*ImageInfo) bool {
+	for _, info := range results {
+		if info.Warning != "" {
+			return true
+		}
+	}
+	return false
+}
 
-	_, err := estimateDecodedSize(filename, *jsonOutput)
-	if err != nil {
-		exitCode := categorizeError(err)
-		if *jsonOutput {
-			errJSON, _ := json.Marshal(map[string]interface{}{
-				"error":     err.Error(),
-				"exit_code": exitCode,
-			})
-			fmt.Println(string(errJSON))
-		} else {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+func startProfiling(cpuPath, memPath string) (func(), error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		file, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(file); err != nil {
+			_ = file.Close()
+			return nil, err
 		}
-		os.Exit(exitCode)
+		cpuFile = file
 	}
+
+	stopped := false
+	return func() {
+		if stopped {
+			return
+		}
+		stopped = true
+
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			_ = cpuFile.Close()
+		}
+
+		if memPath != "" {
+			file, err := os.Create(memPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return
+			}
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(file); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+			_ = file.Close()
+		}
+	}, nil
 }
 
 func categorizeError(err error) int {
@@ -1,17 +1,36 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"io/fs"
+	"math"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/chai2010/webp"
 	"github.com/strukturag/libheif/go/heif"
@@ -159,7 +178,7 @@ func TestPNGRGBAEstimation(t *testing.T) {
 				t.Fatalf("Failed to encode PNG: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -209,7 +228,7 @@ func TestPNGGrayscaleEstimation(t *testing.T) {
 				t.Fatalf("Failed to encode PNG: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -259,7 +278,7 @@ func TestPNGGray16Estimation(t *testing.T) {
 				t.Fatalf("Failed to encode PNG: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -309,7 +328,7 @@ func TestJPEGEstimation(t *testing.T) {
 				t.Fatalf("Failed to encode JPEG: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -383,7 +402,7 @@ func TestAccuracyAcrossAllFormats(t *testing.T) {
 				t.Fatalf("Failed to encode image: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -425,7 +444,7 @@ func TestWebPEstimation(t *testing.T) {
 				t.Fatalf("Failed to encode WebP: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -478,7 +497,7 @@ func TestHEIFEstimation(t *testing.T) {
 				t.Fatalf("Failed to write HEIF file: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -531,7 +550,7 @@ func TestAVIFEstimation(t *testing.T) {
 				t.Fatalf("Failed to write AVIF file: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -584,7 +603,7 @@ func TestWebPLosslessEstimation(t *testing.T) {
 			t.Fatalf("Failed to encode WebP: %v", err)
 		}
 
-		info, err := estimateDecodedSize(filename, false)
+		info, err := estimateDecodedSize(filename, Options{})
 		if err != nil {
 			t.Fatalf("estimateDecodedSize failed: %v", err)
 		}
@@ -711,7 +730,7 @@ func TestMultipleColorModels(t *testing.T) {
 				t.Fatalf("Failed to encode: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -769,7 +788,7 @@ func TestPNGPalettedEstimation(t *testing.T) {
 				t.Fatalf("Failed to encode PNG: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -819,7 +838,7 @@ func TestPNGRGBA64Estimation(t *testing.T) {
 				t.Fatalf("Failed to encode PNG: %v", err)
 			}
 
-			info, err := estimateDecodedSize(filename, false)
+			info, err := estimateDecodedSize(filename, Options{})
 			estimated := info.DecodedSize
 			if err != nil {
 				t.Fatalf("estimateDecodedSize failed: %v", err)
@@ -883,7 +902,7 @@ func TestBitDepthDetection(t *testing.T) {
 				t.Fatalf("Failed to open file: %v", err)
 			}
 			defer func() { _ = f.Close() }()
-			bitDepth := detectPNGBitDepth(f)
+			bitDepth := scanPNGChunks(f).BitDepth
 
 			if bitDepth != tc.expected {
 				t.Errorf("%s: bit depth mismatch: got=%d, want=%d", tc.name, bitDepth, tc.expected)
@@ -917,7 +936,7 @@ func TestYCbCrSubsamplingDetection(t *testing.T) {
 	}
 	defer func() { _ = f.Close() }()
 
-	subsampling := detectJPEGSubsampling(f)
+	subsampling := scanJPEGMarkers(f).Subsampling
 	t.Logf("Detected YCbCr subsampling: %s", subsampling)
 
 	if subsampling == "Unknown" {
@@ -1039,8 +1058,8 @@ func TestImageInfoPNG(t *testing.T) {
 				t.Errorf("CompressionType mismatch: got=%s, want=%s", info.CompressionType, tc.expectedComp)
 			}
 
-			if info.ColorSpace != ColorSpaceSRGB {
-				t.Errorf("ColorSpace mismatch: got=%s, want=sRGB", info.ColorSpace)
+			if info.ColorSpace != ColorSpaceUntagged {
+				t.Errorf("ColorSpace mismatch: got=%s, want=Untagged", info.ColorSpace)
 			}
 		})
 	}
@@ -1292,6 +1311,7 @@ func TestStringMethods(t *testing.T) {
 			{ColorModelYCbCr, "YCbCr"},
 			{ColorModelGrayscale, "Grayscale"},
 			{ColorModelIndexed, "Indexed"},
+			{ColorModelCMYK, "CMYK"},
 			{ColorModelUnknown, "Unknown"},
 			{ColorModel(999), "Unknown"},
 		}
@@ -1313,6 +1333,8 @@ func TestStringMethods(t *testing.T) {
 			{ColorSpaceBT709, "BT.709"},
 			{ColorSpaceBT2020, "BT.2020"},
 			{ColorSpaceDisplayP3, "Display P3"},
+			{ColorSpaceUntagged, "Untagged"},
+			{ColorSpaceGray, "Gray"},
 			{ColorSpaceUnknown, "Unknown"},
 			{ColorSpace(999), "Unknown"},
 		}
@@ -1333,6 +1355,7 @@ func TestStringMethods(t *testing.T) {
 			{HDRPQ, "PQ (SMPTE ST 2084)"},
 			{HDRHLG, "HLG (ARIB STD-B67)"},
 			{HDRLimited, "Limited"},
+			{HDRLinear, "Linear (scene-referred)"},
 			{HDRType(999), "Unknown"},
 		}
 
@@ -1343,6 +1366,28 @@ func TestStringMethods(t *testing.T) {
 		}
 	})
 
+	t.Run("HDRTypeJSONRoundTrip", func(t *testing.T) {
+		for _, hdr := range []HDRType{HDRNone, HDRPQ, HDRHLG, HDRLimited, HDRLinear} {
+			data, err := json.Marshal(hdr)
+			if err != nil {
+				t.Fatalf("Marshal(%s) failed: %v", hdr, err)
+			}
+
+			var got HDRType
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal(%s) failed: %v", data, err)
+			}
+			if got != hdr {
+				t.Errorf("Round trip mismatch: got=%s, want=%s", got, hdr)
+			}
+		}
+
+		var got HDRType
+		if err := json.Unmarshal([]byte(`"Dolby Vision"`), &got); err == nil {
+			t.Error("Expected error for unknown HDR type string")
+		}
+	})
+
 	t.Run("ChromaSubsampling", func(t *testing.T) {
 		tests := []struct {
 			chroma   ChromaSubsampling
@@ -1351,6 +1396,8 @@ func TestStringMethods(t *testing.T) {
 			{ChromaSubsampling444, "4:4:4"},
 			{ChromaSubsampling422, "4:2:2"},
 			{ChromaSubsampling420, "4:2:0"},
+			{ChromaSubsampling411, "4:1:1"},
+			{ChromaSubsampling440, "4:4:0"},
 			{ChromaSubsamplingNA, "N/A"},
 			{ChromaSubsamplingUnknown, "Unknown"},
 			{ChromaSubsampling(999), "Unknown"},
@@ -1363,6 +1410,37 @@ func TestStringMethods(t *testing.T) {
 		}
 	})
 
+	t.Run("ChromaSubsamplingJSONRoundTrip", func(t *testing.T) {
+		for _, chroma := range []ChromaSubsampling{ChromaSubsamplingNA, ChromaSubsampling444, ChromaSubsampling422, ChromaSubsampling420, ChromaSubsampling411, ChromaSubsampling440, ChromaSubsamplingUnknown} {
+			data, err := json.Marshal(chroma)
+			if err != nil {
+				t.Fatalf("Marshal(%s) failed: %v", chroma, err)
+			}
+
+			var got ChromaSubsampling
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal(%s) failed: %v", data, err)
+			}
+			if got != chroma {
+				t.Errorf("Round trip mismatch: got=%s, want=%s", got, chroma)
+			}
+		}
+
+		var got ChromaSubsampling
+		if err := json.Unmarshal([]byte(`"4:2:1"`), &got); err == nil {
+			t.Error("Expected error for unknown chroma subsampling string")
+		}
+	})
+
+	t.Run("ChromaSubsamplingBytesPerPixel", func(t *testing.T) {
+		for _, chroma := range []ChromaSubsampling{ChromaSubsampling411, ChromaSubsampling440} {
+			info := &ImageInfo{ColorModel: ColorModelYCbCr, BitDepth: 8, ChromaSubsampling: chroma}
+			if bpp := calculateBytesPerPixel(info); bpp != 3 {
+				t.Errorf("%s: expected 3 bytes per pixel, got %d", chroma, bpp)
+			}
+		}
+	})
+
 	t.Run("CompressionType", func(t *testing.T) {
 		tests := []struct {
 			comp     CompressionType
@@ -1371,6 +1449,7 @@ func TestStringMethods(t *testing.T) {
 			{CompressionLossless, "Lossless"},
 			{CompressionLossy, "Lossy"},
 			{CompressionHybrid, "Lossy/Lossless"},
+			{CompressionNotApplicable, "N/A"},
 			{CompressionUnknown, "Unknown"},
 			{CompressionType(999), "Unknown"},
 		}
@@ -1422,7 +1501,7 @@ func TestErrorHandling(t *testing.T) {
 	})
 
 	t.Run("EstimateDecodedSize_NonExistent", func(t *testing.T) {
-		_, err := estimateDecodedSize("/nonexistent/file.png", false)
+		_, err := estimateDecodedSize("/nonexistent/file.png", Options{})
 		if err == nil {
 			t.Error("Expected error for nonexistent file, got nil")
 		}
@@ -1437,7 +1516,7 @@ func TestErrorHandling(t *testing.T) {
 			t.Fatalf("Failed to create test file: %v", err)
 		}
 
-		_, err = estimateDecodedSize(filename, false)
+		_, err = estimateDecodedSize(filename, Options{})
 		if err == nil {
 			t.Error("Expected error for invalid image file, got nil")
 		}
@@ -1455,6 +1534,7 @@ func TestParseColorSpace(t *testing.T) {
 		{"BT.709", ColorSpaceBT709},
 		{"BT.2020", ColorSpaceBT2020},
 		{"Display P3", ColorSpaceDisplayP3},
+		{"Untagged", ColorSpaceUntagged},
 		{"Unknown Profile", ColorSpaceSRGB},
 		{"", ColorSpaceSRGB},
 	}
@@ -1517,6 +1597,16 @@ func TestDetectColorSpaceFromICC(t *testing.T) {
 			data:     append(make([]byte, 128), []byte("Some other profile")...),
 			expected: "sRGB (ICC)",
 		},
+		{
+			name:     "GrayDataColorSpace",
+			data:     append(append(make([]byte, 16), []byte("GRAYXYZ ")...), append(make([]byte, 104), []byte("Dot Gain 20%")...)...),
+			expected: "Gray",
+		},
+		{
+			name:     "RGBDataColorSpace",
+			data:     append(append(make([]byte, 16), []byte("RGB XYZ ")...), append(make([]byte, 104), []byte("Display P3")...)...),
+			expected: "Display P3",
+		},
 	}
 
 	for _, tc := range tests {
@@ -1762,7 +1852,7 @@ func TestJPEGSubsamplingDetection(t *testing.T) {
 			jpegData := createMinimalJPEGData(100, 100, tc.yH, tc.yV, tc.cbH, tc.cbV, 8)
 			reader := bytes.NewReader(jpegData)
 
-			result := detectJPEGSubsampling(reader)
+			result := scanJPEGMarkers(reader).Subsampling
 			if result != tc.expectedSubsample {
 				t.Errorf("Subsampling mismatch: got=%s, want=%s", result, tc.expectedSubsample)
 			}
@@ -1785,7 +1875,7 @@ func Test12BitJPEGDetection(t *testing.T) {
 			jpegData := createMinimalJPEGData(100, 100, 2, 2, 1, 1, tc.precision)
 			reader := bytes.NewReader(jpegData)
 
-			result := is12BitJPEG(reader)
+			result := scanJPEGMarkers(reader).Precision == 12
 			if result != tc.expected12 {
 				t.Errorf("12-bit detection mismatch: got=%v, want=%v", result, tc.expected12)
 			}
@@ -1878,7 +1968,8 @@ func TestWebPFormatDetection(t *testing.T) {
 		webpData := createWebPData("VP8X")
 		reader := bytes.NewReader(webpData)
 
-		isLossless, chroma := detectWebPFormat(reader)
+		features := detectWebPFormat(reader)
+		isLossless, chroma := features.Lossless, features.ChromaSubsampling
 		if isLossless {
 			t.Error("VP8X should not be detected as lossless")
 		}
@@ -1891,7 +1982,8 @@ func TestWebPFormatDetection(t *testing.T) {
 		webpData := createWebPData("VP8L")
 		reader := bytes.NewReader(webpData)
 
-		isLossless, chroma := detectWebPFormat(reader)
+		features := detectWebPFormat(reader)
+		isLossless, chroma := features.Lossless, features.ChromaSubsampling
 		if !isLossless {
 			t.Error("VP8L should be detected as lossless")
 		}
@@ -1904,7 +1996,8 @@ func TestWebPFormatDetection(t *testing.T) {
 		webpData := createWebPData("VP8 ")
 		reader := bytes.NewReader(webpData)
 
-		isLossless, chroma := detectWebPFormat(reader)
+		features := detectWebPFormat(reader)
+		isLossless, chroma := features.Lossless, features.ChromaSubsampling
 		if isLossless {
 			t.Error("VP8 should not be detected as lossless")
 		}
@@ -1917,7 +2010,8 @@ func TestWebPFormatDetection(t *testing.T) {
 		webpData := []byte("RIFF")
 		reader := bytes.NewReader(webpData)
 
-		isLossless, chroma := detectWebPFormat(reader)
+		features := detectWebPFormat(reader)
+		isLossless, chroma := features.Lossless, features.ChromaSubsampling
 		if isLossless {
 			t.Error("Truncated file should not be lossless")
 		}
@@ -1930,7 +2024,8 @@ func TestWebPFormatDetection(t *testing.T) {
 		webpData := []byte("JUNK____WEBP____")
 		reader := bytes.NewReader(webpData)
 
-		isLossless, chroma := detectWebPFormat(reader)
+		features := detectWebPFormat(reader)
+		isLossless, chroma := features.Lossless, features.ChromaSubsampling
 		if isLossless {
 			t.Error("Invalid RIFF should not be lossless")
 		}
@@ -1943,7 +2038,8 @@ func TestWebPFormatDetection(t *testing.T) {
 		webpData := []byte("RIFF____JUNK____")
 		reader := bytes.NewReader(webpData)
 
-		isLossless, chroma := detectWebPFormat(reader)
+		features := detectWebPFormat(reader)
+		isLossless, chroma := features.Lossless, features.ChromaSubsampling
 		if isLossless {
 			t.Error("Invalid WEBP should not be lossless")
 		}
@@ -1956,7 +2052,8 @@ func TestWebPFormatDetection(t *testing.T) {
 		webpData := []byte("RIFF\x00\x00\x00\x00WEBP")
 		reader := bytes.NewReader(webpData)
 
-		isLossless, chroma := detectWebPFormat(reader)
+		features := detectWebPFormat(reader)
+		isLossless, chroma := features.Lossless, features.ChromaSubsampling
 		if isLossless {
 			t.Error("Truncated chunk should not be lossless")
 		}
@@ -2000,7 +2097,7 @@ func createMinimalHEIFMetadata(colorPrimaries, transferChar uint16, bitDepth uin
 	var ipcoData bytes.Buffer
 
 	var pixiData bytes.Buffer
-	pixiData.WriteByte(0)
+	pixiData.Write([]byte{0, 0, 0, 0})
 	pixiData.WriteByte(3)
 	pixiData.WriteByte(bitDepth)
 	pixiData.WriteByte(bitDepth)
@@ -2302,7 +2399,7 @@ func TestAnalyzeJPEG_GrayscaleAndUnknown(t *testing.T) {
 		jpegData := createGrayscaleJPEG(100, 100, 8)
 		reader := bytes.NewReader(jpegData)
 
-		subsampling := detectJPEGSubsampling(reader)
+		subsampling := scanJPEGMarkers(reader).Subsampling
 		if subsampling != "Grayscale" {
 			t.Errorf("Subsampling: got=%s, want=Grayscale", subsampling)
 		}
@@ -2312,8 +2409,8 @@ func TestAnalyzeJPEG_GrayscaleAndUnknown(t *testing.T) {
 		jpegData := createCustomSubsamplingJPEG(100, 100, 3, 3, 1, 1, 8)
 		reader := bytes.NewReader(jpegData)
 
-		subsampling := detectJPEGSubsampling(reader)
-		expected := "Custom (3x3:1x1)"
+		subsampling := scanJPEGMarkers(reader).Subsampling
+		expected := "Custom (3x3:1x1:1x1)"
 		if subsampling != expected {
 			t.Errorf("Subsampling: got=%s, want=%s", subsampling, expected)
 		}
@@ -2323,7 +2420,8 @@ func TestAnalyzeJPEG_GrayscaleAndUnknown(t *testing.T) {
 		jpegData := createMinimalJPEGData(100, 100, 2, 2, 1, 1, 8)
 		reader := bytes.NewReader(jpegData)
 
-		iccData, colorSpace := detectJPEGICCProfile(reader)
+		markers := scanJPEGMarkers(reader)
+		iccData, colorSpace := markers.ICCProfile, markers.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data")
 		}
@@ -2338,7 +2436,7 @@ func TestJPEGSubsampling_AllMarkers(t *testing.T) {
 		jpegData := createJPEGWithSOFMarker(0xC2, 8, 3, 100, 100, 2, 2, 1, 1)
 		reader := bytes.NewReader(jpegData)
 
-		result := detectJPEGSubsampling(reader)
+		result := scanJPEGMarkers(reader).Subsampling
 		if result != "4:2:0" {
 			t.Errorf("SOF2 subsampling: got=%s, want=4:2:0", result)
 		}
@@ -2348,7 +2446,7 @@ func TestJPEGSubsampling_AllMarkers(t *testing.T) {
 		jpegData := createGrayscaleJPEG(100, 100, 8)
 		reader := bytes.NewReader(jpegData)
 
-		result := detectJPEGSubsampling(reader)
+		result := scanJPEGMarkers(reader).Subsampling
 		if result != "Grayscale" {
 			t.Errorf("Grayscale subsampling: got=%s, want=Grayscale", result)
 		}
@@ -2358,9 +2456,9 @@ func TestJPEGSubsampling_AllMarkers(t *testing.T) {
 		jpegData := createCustomSubsamplingJPEG(100, 100, 3, 3, 1, 1, 8)
 		reader := bytes.NewReader(jpegData)
 
-		result := detectJPEGSubsampling(reader)
-		if result != "Custom (3x3:1x1)" {
-			t.Errorf("Custom subsampling: got=%s, want=Custom (3x3:1x1)", result)
+		result := scanJPEGMarkers(reader).Subsampling
+		if result != "Custom (3x3:1x1:1x1)" {
+			t.Errorf("Custom subsampling: got=%s, want=Custom (3x3:1x1:1x1)", result)
 		}
 	})
 
@@ -2370,7 +2468,7 @@ func TestJPEGSubsampling_AllMarkers(t *testing.T) {
 		buf.Write([]byte{0xFF, 0xD9})
 		reader := bytes.NewReader(buf.Bytes())
 
-		result := detectJPEGSubsampling(reader)
+		result := scanJPEGMarkers(reader).Subsampling
 		if result != "Unknown" {
 			t.Errorf("EOI without SOF: got=%s, want=Unknown", result)
 		}
@@ -2384,7 +2482,7 @@ func TestJPEGSubsampling_AllMarkers(t *testing.T) {
 		buf.Write([]byte{8, 0, 100, 0, 100})
 		reader := bytes.NewReader(buf.Bytes())
 
-		result := detectJPEGSubsampling(reader)
+		result := scanJPEGMarkers(reader).Subsampling
 		if result != "Unknown" {
 			t.Errorf("Truncated SOF: got=%s, want=Unknown", result)
 		}
@@ -2402,7 +2500,7 @@ func TestJPEGSubsampling_AllMarkers(t *testing.T) {
 		buf.Write(make([]byte, 5))
 		reader := bytes.NewReader(buf.Bytes())
 
-		result := detectJPEGSubsampling(reader)
+		result := scanJPEGMarkers(reader).Subsampling
 		if result != "Unknown" {
 			t.Errorf("Invalid components: got=%s, want=Unknown", result)
 		}
@@ -2416,7 +2514,8 @@ func TestJPEGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte{0xFF, 0xD9})
 		reader := bytes.NewReader(buf.Bytes())
 
-		iccData, colorSpace := detectJPEGICCProfile(reader)
+		markers := scanJPEGMarkers(reader)
+		iccData, colorSpace := markers.ICCProfile, markers.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data")
 		}
@@ -2435,7 +2534,8 @@ func TestJPEGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte{0xFF, 0xD9})
 		reader := bytes.NewReader(buf.Bytes())
 
-		iccData, colorSpace := detectJPEGICCProfile(reader)
+		markers := scanJPEGMarkers(reader)
+		iccData, colorSpace := markers.ICCProfile, markers.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data for non-ICC APP2")
 		}
@@ -2455,7 +2555,7 @@ func TestJPEGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte{0xFF, 0xD9})
 		reader := bytes.NewReader(buf.Bytes())
 
-		_, colorSpace := detectJPEGICCProfile(reader)
+		colorSpace := scanJPEGMarkers(reader).ColorSpace
 		if colorSpace != "sRGB" {
 			t.Errorf("ColorSpace: got=%s, want=sRGB", colorSpace)
 		}
@@ -2464,7 +2564,8 @@ func TestJPEGICCProfile_EdgeCases(t *testing.T) {
 	t.Run("InvalidJPEGHeader", func(t *testing.T) {
 		buf := bytes.NewReader([]byte{0x00, 0x00})
 
-		iccData, colorSpace := detectJPEGICCProfile(buf)
+		markers := scanJPEGMarkers(buf)
+		iccData, colorSpace := markers.ICCProfile, markers.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data for invalid header")
 		}
@@ -2479,7 +2580,8 @@ func TestJPEGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte{0xFF, 0xE1})
 		reader := bytes.NewReader(buf.Bytes())
 
-		iccData, colorSpace := detectJPEGICCProfile(reader)
+		markers := scanJPEGMarkers(reader)
+		iccData, colorSpace := markers.ICCProfile, markers.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data for truncated marker")
 		}
@@ -2494,7 +2596,7 @@ func Test12BitJPEG_AllSOFMarkers(t *testing.T) {
 		jpegData := createJPEGWithSOFMarker(0xC2, 8, 3, 100, 100, 2, 2, 1, 1)
 		reader := bytes.NewReader(jpegData)
 
-		result := is12BitJPEG(reader)
+		result := scanJPEGMarkers(reader).Precision == 12
 		if result {
 			t.Error("Expected false for 8-bit progressive JPEG")
 		}
@@ -2504,7 +2606,7 @@ func Test12BitJPEG_AllSOFMarkers(t *testing.T) {
 		jpegData := createJPEGWithSOFMarker(0xC2, 12, 3, 100, 100, 2, 2, 1, 1)
 		reader := bytes.NewReader(jpegData)
 
-		result := is12BitJPEG(reader)
+		result := scanJPEGMarkers(reader).Precision == 12
 		if !result {
 			t.Error("Expected true for 12-bit progressive JPEG")
 		}
@@ -2517,7 +2619,7 @@ func Test12BitJPEG_AllSOFMarkers(t *testing.T) {
 		_ = binary.Write(&buf, binary.BigEndian, uint16(2))
 		reader := bytes.NewReader(buf.Bytes())
 
-		result := is12BitJPEG(reader)
+		result := scanJPEGMarkers(reader).Precision == 12
 		if result {
 			t.Error("Expected false for empty SOF data")
 		}
@@ -2529,7 +2631,7 @@ func Test12BitJPEG_AllSOFMarkers(t *testing.T) {
 		buf.Write([]byte{0xFF, 0xD9})
 		reader := bytes.NewReader(buf.Bytes())
 
-		result := is12BitJPEG(reader)
+		result := scanJPEGMarkers(reader).Precision == 12
 		if result {
 			t.Error("Expected false when reaching EOI without SOF")
 		}
@@ -2538,7 +2640,7 @@ func Test12BitJPEG_AllSOFMarkers(t *testing.T) {
 	t.Run("InvalidJPEGHeader", func(t *testing.T) {
 		buf := bytes.NewReader([]byte{0x00, 0x00})
 
-		result := is12BitJPEG(buf)
+		result := scanJPEGMarkers(buf).Precision == 12
 		if result {
 			t.Error("Expected false for invalid JPEG header")
 		}
@@ -2550,7 +2652,7 @@ func Test12BitJPEG_AllSOFMarkers(t *testing.T) {
 		buf.Write([]byte{0xFF, 0xC0})
 		reader := bytes.NewReader(buf.Bytes())
 
-		result := is12BitJPEG(reader)
+		result := scanJPEGMarkers(reader).Precision == 12
 		if result {
 			t.Error("Expected false for truncated SOF")
 		}
@@ -2609,7 +2711,7 @@ func TestDetectPNGBitDepth_EdgeCases(t *testing.T) {
 		buf.Write([]byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A})
 		reader := bytes.NewReader(buf.Bytes())
 
-		bitDepth := detectPNGBitDepth(reader)
+		bitDepth := scanPNGChunks(reader).BitDepth
 		if bitDepth != 8 {
 			t.Errorf("Expected default 8, got %d", bitDepth)
 		}
@@ -2622,7 +2724,7 @@ func TestDetectPNGBitDepth_EdgeCases(t *testing.T) {
 		buf.Write([]byte("IXXX"))
 		reader := bytes.NewReader(buf.Bytes())
 
-		bitDepth := detectPNGBitDepth(reader)
+		bitDepth := scanPNGChunks(reader).BitDepth
 		if bitDepth != 8 {
 			t.Errorf("Expected default 8, got %d", bitDepth)
 		}
@@ -2635,7 +2737,7 @@ func TestDetectPNGBitDepth_EdgeCases(t *testing.T) {
 		buf.Write([]byte("IHDR"))
 		reader := bytes.NewReader(buf.Bytes())
 
-		bitDepth := detectPNGBitDepth(reader)
+		bitDepth := scanPNGChunks(reader).BitDepth
 		if bitDepth != 8 {
 			t.Errorf("Expected default 8, got %d", bitDepth)
 		}
@@ -2649,7 +2751,7 @@ func TestDetectPNGBitDepth_EdgeCases(t *testing.T) {
 		buf.Write([]byte{0, 0, 0, 100})
 		reader := bytes.NewReader(buf.Bytes())
 
-		bitDepth := detectPNGBitDepth(reader)
+		bitDepth := scanPNGChunks(reader).BitDepth
 		if bitDepth != 8 {
 			t.Errorf("Expected default 8, got %d", bitDepth)
 		}
@@ -2669,7 +2771,7 @@ func TestDetectPNGBitDepth_EdgeCases(t *testing.T) {
 		buf.WriteByte(0)
 
 		reader := bytes.NewReader(buf.Bytes())
-		bitDepth := detectPNGBitDepth(reader)
+		bitDepth := scanPNGChunks(reader).BitDepth
 		if bitDepth != 16 {
 			t.Errorf("Expected 16, got %d", bitDepth)
 		}
@@ -2689,7 +2791,7 @@ func TestDetectPNGBitDepth_EdgeCases(t *testing.T) {
 		buf.WriteByte(0)
 
 		reader := bytes.NewReader(buf.Bytes())
-		bitDepth := detectPNGBitDepth(reader)
+		bitDepth := scanPNGChunks(reader).BitDepth
 		if bitDepth != 4 {
 			t.Errorf("Expected 4, got %d", bitDepth)
 		}
@@ -2702,12 +2804,13 @@ func TestDetectPNGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A})
 		reader := bytes.NewReader(buf.Bytes())
 
-		iccData, colorSpace := detectPNGICCProfile(reader)
+		chunks := scanPNGChunks(reader)
+		iccData, colorSpace := chunks.ICCProfile, chunks.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data")
 		}
-		if colorSpace != "sRGB" {
-			t.Errorf("Expected sRGB, got %s", colorSpace)
+		if colorSpace != "Untagged" {
+			t.Errorf("Expected Untagged, got %s", colorSpace)
 		}
 	})
 
@@ -2728,12 +2831,13 @@ func TestDetectPNGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte("IEND"))
 
 		reader := bytes.NewReader(buf.Bytes())
-		iccData, colorSpace := detectPNGICCProfile(reader)
+		chunks := scanPNGChunks(reader)
+		iccData, colorSpace := chunks.ICCProfile, chunks.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data")
 		}
-		if colorSpace != "sRGB" {
-			t.Errorf("Expected sRGB, got %s", colorSpace)
+		if colorSpace != "Untagged" {
+			t.Errorf("Expected Untagged, got %s", colorSpace)
 		}
 	})
 
@@ -2748,7 +2852,8 @@ func TestDetectPNGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte("IEND"))
 
 		reader := bytes.NewReader(buf.Bytes())
-		iccData, colorSpace := detectPNGICCProfile(reader)
+		chunks := scanPNGChunks(reader)
+		iccData, colorSpace := chunks.ICCProfile, chunks.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data")
 		}
@@ -2765,12 +2870,13 @@ func TestDetectPNGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write([]byte("profile\x00"))
 
 		reader := bytes.NewReader(buf.Bytes())
-		iccData, colorSpace := detectPNGICCProfile(reader)
+		chunks := scanPNGChunks(reader)
+		iccData, colorSpace := chunks.ICCProfile, chunks.ColorSpace
 		if iccData != nil {
 			t.Error("Expected nil ICC data on truncated iCCP")
 		}
-		if colorSpace != "sRGB" {
-			t.Errorf("Expected sRGB, got %s", colorSpace)
+		if colorSpace != "Untagged" {
+			t.Errorf("Expected Untagged, got %s", colorSpace)
 		}
 	})
 
@@ -2784,7 +2890,8 @@ func TestDetectPNGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write(iccProfile)
 
 		reader := bytes.NewReader(buf.Bytes())
-		iccData, colorSpace := detectPNGICCProfile(reader)
+		chunks := scanPNGChunks(reader)
+		iccData, colorSpace := chunks.ICCProfile, chunks.ColorSpace
 		if iccData == nil {
 			t.Error("Expected ICC data")
 		}
@@ -2822,7 +2929,7 @@ func TestDetectPNGICCProfile_EdgeCases(t *testing.T) {
 		buf.Write(iccProfile)
 
 		reader := bytes.NewReader(buf.Bytes())
-		iccData, _ := detectPNGICCProfile(reader)
+		iccData := scanPNGChunks(reader).ICCProfile
 		if iccData == nil {
 			t.Error("Expected ICC data after skipping other chunks")
 		}
@@ -2904,7 +3011,7 @@ func TestParseHEIFMetadata_PixiBox(t *testing.T) {
 		buf.Write([]byte("ftyp"))
 		buf.Write([]byte("heicheic"))
 
-		pixiData := []byte{0, 1, 8}
+		pixiData := []byte{0, 0, 0, 0, 1, 8}
 		_ = binary.Write(&buf, binary.BigEndian, uint32(8+len(pixiData)))
 		buf.Write([]byte("pixi"))
 		buf.Write(pixiData)
@@ -2923,7 +3030,7 @@ func TestParseHEIFMetadata_PixiBox(t *testing.T) {
 		buf.Write([]byte("ftyp"))
 		buf.Write([]byte("heicheic"))
 
-		pixiData := []byte{0, 1, 10}
+		pixiData := []byte{0, 0, 0, 0, 1, 10}
 		_ = binary.Write(&buf, binary.BigEndian, uint32(8+len(pixiData)))
 		buf.Write([]byte("pixi"))
 		buf.Write(pixiData)
@@ -2942,7 +3049,7 @@ func TestParseHEIFMetadata_PixiBox(t *testing.T) {
 		buf.Write([]byte("ftyp"))
 		buf.Write([]byte("heicheic"))
 
-		pixiData := []byte{0, 1, 12}
+		pixiData := []byte{0, 0, 0, 0, 1, 12}
 		_ = binary.Write(&buf, binary.BigEndian, uint32(8+len(pixiData)))
 		buf.Write([]byte("pixi"))
 		buf.Write(pixiData)
@@ -2961,9 +3068,9 @@ func TestParseHEIFMetadata_PixiBox(t *testing.T) {
 		buf.Write([]byte("ftyp"))
 		buf.Write([]byte("heicheic"))
 
-		_ = binary.Write(&buf, binary.BigEndian, uint32(10))
+		_ = binary.Write(&buf, binary.BigEndian, uint32(13))
 		buf.Write([]byte("pixi"))
-		buf.Write([]byte{0, 1})
+		buf.Write([]byte{0, 0, 0, 0, 1})
 
 		reader := bytes.NewReader(buf.Bytes())
 		meta := parseHEIFMetadata(reader)
@@ -3162,6 +3269,40 @@ func TestParseHEIFMetadata_AuxCBox(t *testing.T) {
 			t.Error("Expected HasAlpha to be false")
 		}
 	})
+
+	t.Run("AuxC_GainMap", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 0, 16})
+		buf.Write([]byte("ftyp"))
+		buf.Write([]byte("heicheic"))
+
+		auxcData := []byte("\x00\x00\x00\x00urn:com:apple:photo:2020:aux:hdrgainmap\x00")
+		_ = binary.Write(&buf, binary.BigEndian, uint32(8+len(auxcData)))
+		buf.Write([]byte("auxC"))
+		buf.Write(auxcData)
+
+		meta := parseHEIFMetadata(bytes.NewReader(buf.Bytes()))
+		if !meta.HasGainMap {
+			t.Error("Expected HasGainMap to be true")
+		}
+		if meta.HasAlpha {
+			t.Error("Gain map auxiliary image should not be reported as alpha")
+		}
+
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(buf.Bytes()), image.Config{}, info)
+		if !info.HasGainMap {
+			t.Error("Expected ImageInfo.HasGainMap to be true")
+		}
+	})
+
+	t.Run("AuxC_GainMapInIpco", func(t *testing.T) {
+		meta := &heifMetadata{}
+		parseIpcoBox(heifBox("auxC", []byte{0, 0, 0, 0}, []byte("urn:com:apple:photo:2020:aux:hdrgainmap\x00")), meta)
+		if !meta.HasGainMap {
+			t.Error("Expected HasGainMap from ipco auxC property")
+		}
+	})
 }
 
 func TestAnalyzeJPEG_WithICCProfile(t *testing.T) {
@@ -3313,7 +3454,7 @@ func TestParseIprpBox_EdgeCases(t *testing.T) {
 		var buf bytes.Buffer
 
 		var ipcoBuf bytes.Buffer
-		pixiData := []byte{0, 1, 10}
+		pixiData := []byte{0, 0, 0, 0, 1, 10}
 		_ = binary.Write(&ipcoBuf, binary.BigEndian, uint32(8+len(pixiData)))
 		ipcoBuf.Write([]byte("pixi"))
 		ipcoBuf.Write(pixiData)
@@ -3324,6 +3465,7 @@ func TestParseIprpBox_EdgeCases(t *testing.T) {
 
 		meta := &heifMetadata{BitDepth: 8}
 		parseIprpBox(buf.Bytes(), meta)
+		applyHEIFItemProperties(meta)
 
 		if meta.BitDepth != 10 {
 			t.Errorf("Expected BitDepth 10, got %d", meta.BitDepth)
@@ -3339,6 +3481,7 @@ func TestParseIpcoBox_EdgeCases(t *testing.T) {
 
 		meta := &heifMetadata{BitDepth: 8}
 		parseIpcoBox(buf.Bytes(), meta)
+		applyHEIFItemProperties(meta)
 
 		if meta.BitDepth != 8 {
 			t.Error("Metadata should remain unchanged with invalid box")
@@ -3352,6 +3495,7 @@ func TestParseIpcoBox_EdgeCases(t *testing.T) {
 
 		meta := &heifMetadata{BitDepth: 8}
 		parseIpcoBox(buf.Bytes(), meta)
+		applyHEIFItemProperties(meta)
 
 		if meta.BitDepth != 8 {
 			t.Error("Metadata should remain unchanged with overflow box")
@@ -3360,13 +3504,14 @@ func TestParseIpcoBox_EdgeCases(t *testing.T) {
 
 	t.Run("PixiBox_ZeroChannels", func(t *testing.T) {
 		var buf bytes.Buffer
-		pixiData := []byte{0, 0, 10}
+		pixiData := []byte{0, 0, 0, 0, 0, 10}
 		_ = binary.Write(&buf, binary.BigEndian, uint32(8+len(pixiData)))
 		buf.Write([]byte("pixi"))
 		buf.Write(pixiData)
 
 		meta := &heifMetadata{BitDepth: 8}
 		parseIpcoBox(buf.Bytes(), meta)
+		applyHEIFItemProperties(meta)
 
 		if meta.BitDepth != 8 {
 			t.Error("BitDepth should remain 8 with zero channels")
@@ -3375,13 +3520,14 @@ func TestParseIpcoBox_EdgeCases(t *testing.T) {
 
 	t.Run("PixiBox_InsufficientData", func(t *testing.T) {
 		var buf bytes.Buffer
-		pixiData := []byte{0, 3}
+		pixiData := []byte{0, 0, 0, 0, 3}
 		_ = binary.Write(&buf, binary.BigEndian, uint32(8+len(pixiData)))
 		buf.Write([]byte("pixi"))
 		buf.Write(pixiData)
 
 		meta := &heifMetadata{BitDepth: 8}
 		parseIpcoBox(buf.Bytes(), meta)
+		applyHEIFItemProperties(meta)
 
 		if meta.BitDepth != 8 {
 			t.Error("BitDepth should remain 8 with insufficient data")
@@ -3396,6 +3542,7 @@ func TestParseIpcoBox_EdgeCases(t *testing.T) {
 
 		meta := &heifMetadata{BitDepth: 8}
 		parseIpcoBox(buf.Bytes(), meta)
+		applyHEIFItemProperties(meta)
 
 		if meta.BitDepth != 8 {
 			t.Error("Metadata should remain unchanged with unknown box")
@@ -3461,7 +3608,7 @@ func TestEstimateDecodedSize_WithICCProfile(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		info, err := estimateDecodedSize(tmpfile.Name(), false)
+		info, err := estimateDecodedSize(tmpfile.Name(), Options{})
 		if err != nil {
 			t.Fatalf("Failed to estimate decoded size: %v", err)
 		}
@@ -3516,3 +3663,5575 @@ func TestParseIprpBox_MalformedData(t *testing.T) {
 		t.Logf("Parsed iprp box successfully")
 	})
 }
+
+func TestDerivedPixelMetrics(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	filename := filepath.Join(tmpDir, "rgba.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	err = png.Encode(file, generateRGBAImage(2000, 1500))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+
+	if info.BitsPerPixel != 32 {
+		t.Errorf("Expected 32 bits per pixel for 8-bit RGBA, got %d", info.BitsPerPixel)
+	}
+
+	if info.Megapixels != 3.0 {
+		t.Errorf("Expected 3.0 megapixels, got %f", info.Megapixels)
+	}
+
+	t.Run("BitsPerPixelStored", func(t *testing.T) {
+		known := &ImageInfo{Width: 1000, Height: 500, ColorModel: ColorModelRGB, BitDepth: 8}
+		applySizeEstimate(known, 125000, nil, sizeScope{}, "")
+
+		if known.BitsPerPixelStored != 2.0 {
+			t.Errorf("Expected 2.0 stored bits per pixel, got %f", known.BitsPerPixelStored)
+		}
+
+		empty := &ImageInfo{ColorModel: ColorModelRGB, BitDepth: 8}
+		applySizeEstimate(empty, 100, nil, sizeScope{}, "")
+		if empty.BitsPerPixelStored != 0 {
+			t.Errorf("Expected 0 stored bits per pixel for zero dimensions, got %f", empty.BitsPerPixelStored)
+		}
+	})
+}
+
+func insertPNGChunk(pngData []byte, chunkType string, data []byte) []byte {
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(pngData[8:12]))
+
+	var chunk bytes.Buffer
+	_ = binary.Write(&chunk, binary.BigEndian, uint32(len(data)))
+	chunk.WriteString(chunkType)
+	chunk.Write(data)
+	_ = binary.Write(&chunk, binary.BigEndian, crc32PNG(append([]byte(chunkType), data...)))
+
+	var out bytes.Buffer
+	out.Write(pngData[:ihdrEnd])
+	out.Write(chunk.Bytes())
+	out.Write(pngData[ihdrEnd:])
+	return out.Bytes()
+}
+
+func TestPNGColorSpaceChunks(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(50, 50)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	plain := buf.Bytes()
+
+	gamma := make([]byte, 4)
+	binary.BigEndian.PutUint32(gamma, 45455)
+	linearGamma := make([]byte, 4)
+	binary.BigEndian.PutUint32(linearGamma, 100000)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected ColorSpace
+	}{
+		{"NoChunks", plain, ColorSpaceUntagged},
+		{"SRGBChunk", insertPNGChunk(plain, "sRGB", []byte{0}), ColorSpaceSRGB},
+		{"SRGBGamma", insertPNGChunk(plain, "gAMA", gamma), ColorSpaceSRGB},
+		{"LinearGamma", insertPNGChunk(plain, "gAMA", linearGamma), ColorSpaceUntagged},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, _, err := image.DecodeConfig(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatalf("DecodeConfig failed: %v", err)
+			}
+
+			info := &ImageInfo{}
+			analyzePNG(bytes.NewReader(tc.data), config, info)
+
+			if info.ColorSpace != tc.expected {
+				t.Errorf("ColorSpace mismatch: got=%s, want=%s", info.ColorSpace, tc.expected)
+			}
+			if info.HasICCProfile {
+				t.Error("Expected no ICC profile")
+			}
+		})
+	}
+}
+
+func TestScaledSizes(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	filename := filepath.Join(tmpDir, "rgba.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	err = png.Encode(file, generateRGBAImage(2000, 1500))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Scales: []int{320, 640, 4000}})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+
+	expected := map[int]int64{
+		320:  320 * 240 * 4,
+		640:  640 * 480 * 4,
+		4000: 2000 * 1500 * 4,
+	}
+
+	for width, size := range expected {
+		if got := info.ScaledSizes[width]; got != size {
+			t.Errorf("ScaledSizes[%d] = %d, want %d", width, got, size)
+		}
+	}
+}
+
+func TestParseScales(t *testing.T) {
+	scales, err := parseScales("320, 640,1280")
+	if err != nil {
+		t.Fatalf("parseScales failed: %v", err)
+	}
+	if len(scales) != 3 || scales[0] != 320 || scales[1] != 640 || scales[2] != 1280 {
+		t.Errorf("Unexpected scales: %v", scales)
+	}
+
+	for _, input := range []string{"abc", "320,,640", "-10", "0"} {
+		if _, err := parseScales(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func createICOData(entries [][3]int) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(0))
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(1))
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(len(entries)))
+
+	offset := uint32(6 + 16*len(entries))
+	for _, entry := range entries {
+		buf.WriteByte(uint8(entry[0]))
+		buf.WriteByte(uint8(entry[1]))
+		buf.WriteByte(0)
+		buf.WriteByte(0)
+		_ = binary.Write(&buf, binary.LittleEndian, uint16(1))
+		_ = binary.Write(&buf, binary.LittleEndian, uint16(entry[2]))
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(64))
+		_ = binary.Write(&buf, binary.LittleEndian, offset)
+		offset += 64
+	}
+	buf.Write(make([]byte, 64*len(entries)))
+	return buf.Bytes()
+}
+
+func TestICOAnalysis(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	filename := filepath.Join(tmpDir, "icon.ico")
+	data := createICOData([][3]int{{16, 16, 8}, {0, 0, 32}})
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Failed to write ICO: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+
+	if info.Format != "ico" {
+		t.Errorf("Format mismatch: got=%s, want=ico", info.Format)
+	}
+	if info.Width != 256 || info.Height != 256 {
+		t.Errorf("Expected largest entry 256x256, got %dx%d", info.Width, info.Height)
+	}
+	if info.DecodedSize != 256*256*4 {
+		t.Errorf("Expected decoded size %d, got %d", 256*256*4, info.DecodedSize)
+	}
+
+	if len(info.EmbeddedImages) != 2 {
+		t.Fatalf("Expected 2 embedded images, got %d", len(info.EmbeddedImages))
+	}
+	if first := info.EmbeddedImages[0]; first.Width != 16 || first.ColorModel != ColorModelIndexed || first.BitDepth != 8 {
+		t.Errorf("Unexpected first entry: %dx%d %s %d-bit", first.Width, first.Height, first.ColorModel, first.BitDepth)
+	}
+	if second := info.EmbeddedImages[1]; second.Width != 256 || !second.HasAlpha {
+		t.Errorf("Unexpected second entry: %dx%d alpha=%v", second.Width, second.Height, second.HasAlpha)
+	}
+
+	info, err = estimateDecodedSize(filename, Options{AllImages: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if expected := int64(16*16*1 + 256*256*4); info.DecodedSize != expected {
+		t.Errorf("Expected summed decoded size %d, got %d", expected, info.DecodedSize)
+	}
+
+	t.Run("PNGEntry", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			dirSize   int
+			pngSize   int
+			wantWidth int
+		}{
+			{"256", 0, 256, 256},
+			{"512", 0, 512, 512},
+			{"DirectoryMismatch", 32, 256, 256},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				data := createICOData([][3]int{{48, 48, 32}, {tt.dirSize, tt.dirSize, 32}})
+				png := make([]byte, 0, 33)
+				png = append(png, "\x89PNG\r\n\x1a\n"...)
+				png = binary.BigEndian.AppendUint32(png, 13)
+				png = append(png, "IHDR"...)
+				png = binary.BigEndian.AppendUint32(png, uint32(tt.pngSize))
+				png = binary.BigEndian.AppendUint32(png, uint32(tt.pngSize))
+				png = append(png, 8, 2, 0, 0, 0)
+				copy(data[6+16*2+64:], png)
+
+				info, err := analyzeReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("analyzeReader failed: %v", err)
+				}
+				if len(info.EmbeddedImages) != 2 {
+					t.Fatalf("Expected 2 embedded images, got %d", len(info.EmbeddedImages))
+				}
+				if first := info.EmbeddedImages[0]; first.DecodedSize != 48*48*4 {
+					t.Errorf("BMP entry DecodedSize: got=%d, want=%d", first.DecodedSize, 48*48*4)
+				}
+				second := info.EmbeddedImages[1]
+				if second.Width != tt.wantWidth || second.Height != tt.wantWidth {
+					t.Errorf("PNG entry: got %dx%d, want %dx%d", second.Width, second.Height, tt.wantWidth, tt.wantWidth)
+				}
+				if second.ColorModel != ColorModelRGB || second.HasAlpha {
+					t.Errorf("PNG entry: got %s alpha=%v, want opaque rgb", second.ColorModel, second.HasAlpha)
+				}
+				if want := int64(tt.wantWidth * tt.wantWidth * 3); second.DecodedSize != want {
+					t.Errorf("PNG entry DecodedSize: got=%d, want=%d", second.DecodedSize, want)
+				}
+			})
+		}
+	})
+}
+
+func TestParseICODirectory_Invalid(t *testing.T) {
+	tests := map[string][]byte{
+		"Truncated":  {0, 0, 1},
+		"WrongType":  {0, 0, 2, 0, 1, 0},
+		"NoEntries":  {0, 0, 1, 0, 0, 0},
+		"ShortEntry": {0, 0, 1, 0, 1, 0, 16, 16},
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseICODirectory(bytes.NewReader(data)); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func heifBox(boxType string, payloads ...[]byte) []byte {
+	var body bytes.Buffer
+	for _, payload := range payloads {
+		body.Write(payload)
+	}
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(body.Len()+8))
+	buf.WriteString(boxType)
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func heifInfe(itemID uint16, itemType string) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{2, 0, 0, 0})
+	_ = binary.Write(&buf, binary.BigEndian, itemID)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(0))
+	buf.WriteString(itemType)
+	buf.WriteByte(0)
+	return heifBox("infe", buf.Bytes())
+}
+
+func heifIspe(width, height uint32) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0})
+	_ = binary.Write(&buf, binary.BigEndian, width)
+	_ = binary.Write(&buf, binary.BigEndian, height)
+	return heifBox("ispe", buf.Bytes())
+}
+
+func createGridHEIFData(brand string, tileWidth, tileHeight uint32, tiles []uint16, gridRecord []byte) []byte {
+	var ftyp bytes.Buffer
+	ftyp.WriteString(brand)
+	_ = binary.Write(&ftyp, binary.BigEndian, uint32(0))
+	ftyp.WriteString("mif1")
+
+	var pitm bytes.Buffer
+	pitm.Write([]byte{0, 0, 0, 0})
+	_ = binary.Write(&pitm, binary.BigEndian, uint16(1))
+
+	var iinf bytes.Buffer
+	iinf.Write([]byte{0, 0, 0, 0})
+	_ = binary.Write(&iinf, binary.BigEndian, uint16(len(tiles)+1))
+	iinf.Write(heifInfe(1, "grid"))
+	for _, tile := range tiles {
+		iinf.Write(heifInfe(tile, "av01"))
+	}
+
+	var dimg bytes.Buffer
+	_ = binary.Write(&dimg, binary.BigEndian, uint16(1))
+	_ = binary.Write(&dimg, binary.BigEndian, uint16(len(tiles)))
+	for _, tile := range tiles {
+		_ = binary.Write(&dimg, binary.BigEndian, tile)
+	}
+
+	var ipma bytes.Buffer
+	ipma.Write([]byte{0, 0, 0, 0})
+	_ = binary.Write(&ipma, binary.BigEndian, uint32(len(tiles)))
+	for _, tile := range tiles {
+		_ = binary.Write(&ipma, binary.BigEndian, tile)
+		ipma.Write([]byte{1, 0x81})
+	}
+
+	metaChildren := [][]byte{
+		{0, 0, 0, 0},
+		heifBox("pitm", pitm.Bytes()),
+		heifBox("iinf", iinf.Bytes()),
+		heifBox("iref", []byte{0, 0, 0, 0}, heifBox("dimg", dimg.Bytes())),
+		heifBox("iprp", heifBox("ipco", heifIspe(tileWidth, tileHeight)), heifBox("ipma", ipma.Bytes())),
+	}
+
+	if gridRecord != nil {
+		var iloc bytes.Buffer
+		iloc.Write([]byte{1, 0, 0, 0, 0x44, 0x00})
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(1))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(1))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(1))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(0))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(1))
+		_ = binary.Write(&iloc, binary.BigEndian, uint32(0))
+		_ = binary.Write(&iloc, binary.BigEndian, uint32(len(gridRecord)))
+
+		metaChildren = append(metaChildren, heifBox("iloc", iloc.Bytes()), heifBox("idat", gridRecord))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(heifBox("ftyp", ftyp.Bytes()))
+	buf.Write(heifBox("meta", metaChildren...))
+	return buf.Bytes()
+}
+
+func TestHEIFGridCanvas(t *testing.T) {
+	t.Run("GridRecordOutputSize", func(t *testing.T) {
+		data := createGridHEIFData("avif", 512, 512, []uint16{2, 3}, []byte{0, 0, 0, 1, 0x03, 0xE8, 0x01, 0xF4})
+
+		meta := parseHEIFMetadata(bytes.NewReader(data))
+		if meta.Width != 1000 || meta.Height != 500 {
+			t.Errorf("Expected canvas 1000x500, got %dx%d", meta.Width, meta.Height)
+		}
+	})
+
+	t.Run("TileLayoutFallback", func(t *testing.T) {
+		data := createGridHEIFData("avif", 512, 512, []uint16{2, 3}, nil)
+
+		meta := parseHEIFMetadata(bytes.NewReader(data))
+		if meta.Width != 1024 || meta.Height != 512 {
+			t.Errorf("Expected canvas 1024x512, got %dx%d", meta.Width, meta.Height)
+		}
+	})
+
+	t.Run("AnalyzeAVIFOverridesTileSize", func(t *testing.T) {
+		data := createGridHEIFData("avif", 512, 512, []uint16{2, 3}, []byte{0, 0, 0, 1, 0x04, 0x00, 0x02, 0x00})
+
+		info := &ImageInfo{Width: 512, Height: 512}
+		analyzeISOBMFF(bytes.NewReader(data), image.Config{Width: 512, Height: 512}, info)
+		if info.Width != 1024 || info.Height != 512 {
+			t.Errorf("Expected canvas 1024x512, got %dx%d", info.Width, info.Height)
+		}
+	})
+
+	t.Run("NoGridKeepsDefaults", func(t *testing.T) {
+		meta := parseHEIFMetadata(bytes.NewReader(createMinimalHEIFMetadata(1, 1, 8, false)))
+		if meta.Width != 0 || meta.Height != 0 {
+			t.Errorf("Expected no canvas override, got %dx%d", meta.Width, meta.Height)
+		}
+	})
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+
+	original := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = original }()
+
+	done := make(chan []byte)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(reader)
+		done <- buf.Bytes()
+	}()
+
+	fn()
+
+	_ = writer.Close()
+	return string(<-done)
+}
+
+func TestColorOutput(t *testing.T) {
+	t.Run("ResolveColorMode", func(t *testing.T) {
+		tests := []struct {
+			mode     string
+			noColor  bool
+			tty      bool
+			expected bool
+		}{
+			{"auto", false, true, true},
+			{"auto", false, false, false},
+			{"auto", true, true, false},
+			{"always", true, false, true},
+			{"never", false, true, false},
+		}
+
+		for _, tc := range tests {
+			got, err := resolveColorMode(tc.mode, tc.noColor, tc.tty)
+			if err != nil {
+				t.Fatalf("resolveColorMode(%q) failed: %v", tc.mode, err)
+			}
+			if got != tc.expected {
+				t.Errorf("resolveColorMode(%q, noColor=%v, tty=%v) = %v, want %v",
+					tc.mode, tc.noColor, tc.tty, got, tc.expected)
+			}
+		}
+
+		if _, err := resolveColorMode("rainbow", false, true); err == nil {
+			t.Error("Expected error for invalid mode")
+		}
+	})
+
+	t.Run("NoColorWhenNotTTY", func(t *testing.T) {
+		file, err := os.CreateTemp(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = file.Close() }()
+
+		if isTerminal(file) {
+			t.Fatal("Expected regular file not to be a terminal")
+		}
+
+		useColor, _ := resolveColorMode("auto", false, isTerminal(file))
+		info := &ImageInfo{Format: "png", Width: 10, Height: 10, CompressionRatio: 50}
+		output := captureStdout(t, func() { printImageInfo(info, nil, useColor) })
+
+		if strings.Contains(output, "\x1b[") {
+			t.Errorf("Expected no ANSI escapes, got %q", output)
+		}
+	})
+
+	t.Run("AlwaysColors", func(t *testing.T) {
+		info := &ImageInfo{Format: "png", Width: 10, Height: 10, CompressionRatio: 50}
+		output := captureStdout(t, func() { printImageInfo(info, nil, true) })
+
+		if !strings.Contains(output, ansiBold+"Format:"+ansiReset) {
+			t.Errorf("Expected bold label, got %q", output)
+		}
+		if !strings.Contains(output, ansiGreen+"50.0x"+ansiReset) {
+			t.Errorf("Expected green compression ratio, got %q", output)
+		}
+	})
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fourCC)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func createWebPFile(chunks ...[]byte) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		body.Write(chunk)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func vp8lPayload(width, height int, alpha bool) []byte {
+	bits := uint32(width-1) | uint32(height-1)<<14
+	if alpha {
+		bits |= 1 << 28
+	}
+	payload := []byte{0x2F, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(payload[1:5], bits)
+	return payload
+}
+
+func TestWebPChunkDetection(t *testing.T) {
+	iccProfile := make([]byte, 200)
+	copy(iccProfile, "fake ICC profile")
+
+	tests := []struct {
+		name           string
+		data           []byte
+		expectLossless bool
+		expectAlpha    bool
+		expectICCSize  int
+		expectChroma   ChromaSubsampling
+	}{
+		{
+			name:         "LossyNoAlpha",
+			data:         createWebPFile(webpChunk("VP8 ", make([]byte, 10))),
+			expectChroma: ChromaSubsampling420,
+		},
+		{
+			name: "LossyWithALPH",
+			data: createWebPFile(
+				webpChunk("VP8X", []byte{0x10, 0, 0, 0, 99, 0, 0, 99, 0, 0}),
+				webpChunk("ALPH", make([]byte, 7)),
+				webpChunk("VP8 ", make([]byte, 10)),
+			),
+			expectAlpha:  true,
+			expectChroma: ChromaSubsampling420,
+		},
+		{
+			name: "LossyALPHWithoutFlag",
+			data: createWebPFile(
+				webpChunk("VP8X", make([]byte, 10)),
+				webpChunk("ALPH", make([]byte, 7)),
+				webpChunk("VP8 ", make([]byte, 10)),
+			),
+			expectAlpha:  true,
+			expectChroma: ChromaSubsampling420,
+		},
+		{
+			name: "LosslessWithICCAndAlpha",
+			data: createWebPFile(
+				webpChunk("VP8X", []byte{0x30, 0, 0, 0, 99, 0, 0, 99, 0, 0}),
+				webpChunk("ICCP", iccProfile),
+				webpChunk("VP8L", vp8lPayload(100, 100, true)),
+			),
+			expectLossless: true,
+			expectAlpha:    true,
+			expectICCSize:  200,
+			expectChroma:   ChromaSubsamplingNA,
+		},
+		{
+			name:           "LosslessNoAlpha",
+			data:           createWebPFile(webpChunk("VP8L", vp8lPayload(100, 100, false))),
+			expectLossless: true,
+			expectChroma:   ChromaSubsamplingNA,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			features := detectWebPFormat(bytes.NewReader(tc.data))
+
+			if features.Lossless != tc.expectLossless {
+				t.Errorf("Lossless mismatch: got=%v, want=%v", features.Lossless, tc.expectLossless)
+			}
+			if features.HasAlpha != tc.expectAlpha {
+				t.Errorf("HasAlpha mismatch: got=%v, want=%v", features.HasAlpha, tc.expectAlpha)
+			}
+			if len(features.ICCProfile) != tc.expectICCSize {
+				t.Errorf("ICC size mismatch: got=%d, want=%d", len(features.ICCProfile), tc.expectICCSize)
+			}
+			if features.ChromaSubsampling != tc.expectChroma {
+				t.Errorf("Chroma mismatch: got=%s, want=%s", features.ChromaSubsampling, tc.expectChroma)
+			}
+
+			info := &ImageInfo{}
+			analyzeWebP(bytes.NewReader(tc.data), image.Config{ColorModel: color.YCbCrModel}, info)
+			if info.HasAlpha != tc.expectAlpha {
+				t.Errorf("ImageInfo.HasAlpha mismatch: got=%v, want=%v", info.HasAlpha, tc.expectAlpha)
+			}
+			if info.HasICCProfile != (tc.expectICCSize > 0) || info.ICCProfileSize != tc.expectICCSize {
+				t.Errorf("ImageInfo ICC mismatch: has=%v size=%d", info.HasICCProfile, info.ICCProfileSize)
+			}
+		})
+	}
+}
+
+func createJPEGWithExifThumbnail(order binary.ByteOrder, thumbnailLength uint32) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	_ = binary.Write(&tiff, order, uint16(42))
+	_ = binary.Write(&tiff, order, uint32(8))
+
+	_ = binary.Write(&tiff, order, uint16(0))
+	_ = binary.Write(&tiff, order, uint32(14))
+
+	_ = binary.Write(&tiff, order, uint16(2))
+	_ = binary.Write(&tiff, order, uint16(0x0201))
+	_ = binary.Write(&tiff, order, uint16(4))
+	_ = binary.Write(&tiff, order, uint32(1))
+	_ = binary.Write(&tiff, order, uint32(44))
+	_ = binary.Write(&tiff, order, uint16(0x0202))
+	_ = binary.Write(&tiff, order, uint16(4))
+	_ = binary.Write(&tiff, order, uint32(1))
+	_ = binary.Write(&tiff, order, thumbnailLength)
+	_ = binary.Write(&tiff, order, uint32(0))
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(app1)+2))
+	buf.Write(app1)
+	buf.Write([]byte{0xFF, 0xD9})
+	return buf.Bytes()
+}
+
+func TestJPEGExifThumbnail(t *testing.T) {
+	t.Run("LittleEndian", func(t *testing.T) {
+		data := createJPEGWithExifThumbnail(binary.LittleEndian, 5120)
+		if got := scanJPEGMarkers(bytes.NewReader(data)).ThumbnailBytes; got != 5120 {
+			t.Errorf("Expected thumbnail length 5120, got %d", got)
+		}
+	})
+
+	t.Run("BigEndian", func(t *testing.T) {
+		data := createJPEGWithExifThumbnail(binary.BigEndian, 8000)
+		if got := scanJPEGMarkers(bytes.NewReader(data)).ThumbnailBytes; got != 8000 {
+			t.Errorf("Expected thumbnail length 8000, got %d", got)
+		}
+	})
+
+	t.Run("NoExif", func(t *testing.T) {
+		data := createMinimalJPEGData(100, 100, 2, 2, 1, 1, 8)
+		if got := scanJPEGMarkers(bytes.NewReader(data)).ThumbnailBytes; got != 0 {
+			t.Errorf("Expected no thumbnail, got %d", got)
+		}
+	})
+
+	t.Run("TruncatedTIFF", func(t *testing.T) {
+		data := createJPEGWithExifThumbnail(binary.LittleEndian, 5120)
+		binary.LittleEndian.PutUint32(data[16:20], 4000)
+		if got := scanJPEGMarkers(bytes.NewReader(data)).ThumbnailBytes; got != 0 {
+			t.Errorf("Expected no thumbnail for out-of-range IFD, got %d", got)
+		}
+	})
+
+	t.Run("AnalyzeJPEG", func(t *testing.T) {
+		data := createJPEGWithExifThumbnail(binary.LittleEndian, 4096)
+		info := &ImageInfo{}
+		analyzeJPEG(bytes.NewReader(data), image.Config{}, info)
+		if info.EmbeddedThumbnailBytes != 4096 {
+			t.Errorf("Expected EmbeddedThumbnailBytes 4096, got %d", info.EmbeddedThumbnailBytes)
+		}
+	})
+}
+
+func TestArchiveAnalysis(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var first, second bytes.Buffer
+	if err := png.Encode(&first, generateRGBAImage(100, 50)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	if err := png.Encode(&second, generateGrayImage(40, 30)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	t.Run("Zip", func(t *testing.T) {
+		filename := filepath.Join(tmpDir, "images.zip")
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create zip: %v", err)
+		}
+
+		writer := zip.NewWriter(file)
+		for name, data := range map[string][]byte{
+			"a/first.png":  first.Bytes(),
+			"b/second.png": second.Bytes(),
+			"readme.txt":   []byte("not an image"),
+		} {
+			w, err := writer.Create(name)
+			if err != nil {
+				t.Fatalf("Failed to add %s: %v", name, err)
+			}
+			_, _ = w.Write(data)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close zip writer: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to close zip: %v", err)
+		}
+
+		results, err := estimateArchive(filename, Options{})
+		if err != nil {
+			t.Fatalf("estimateArchive failed: %v", err)
+		}
+		if len(results) != 2 {
+			t.Fatalf("Expected 2 images, got %d", len(results))
+		}
+
+		byName := map[string]*ImageInfo{}
+		for _, info := range results {
+			byName[info.Filename] = info
+		}
+
+		if info := byName["a/first.png"]; info == nil || info.DecodedSize != 100*50*4 || info.OriginalSize != int64(first.Len()) {
+			t.Errorf("Unexpected result for a/first.png: %+v", info)
+		}
+		if info := byName["b/second.png"]; info == nil || info.DecodedSize != 40*30 || info.OriginalSize != int64(second.Len()) {
+			t.Errorf("Unexpected result for b/second.png: %+v", info)
+		}
+
+		compressed, err := estimateArchive(filename, Options{CompressedArchiveSize: true})
+		if err != nil {
+			t.Fatalf("estimateArchive failed: %v", err)
+		}
+
+		archive, err := zip.OpenReader(filename)
+		if err != nil {
+			t.Fatalf("Failed to reopen zip: %v", err)
+		}
+		defer func() { _ = archive.Close() }()
+
+		sizes := map[string]int64{}
+		for _, entry := range archive.File {
+			sizes[entry.Name] = int64(entry.CompressedSize64)
+		}
+		for _, info := range compressed {
+			if info.OriginalSize != sizes[info.Filename] {
+				t.Errorf("%s: expected compressed size %d, got %d", info.Filename, sizes[info.Filename], info.OriginalSize)
+			}
+		}
+	})
+
+	t.Run("Tar", func(t *testing.T) {
+		filename := filepath.Join(tmpDir, "images.tar")
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create tar: %v", err)
+		}
+
+		writer := tar.NewWriter(file)
+		_ = writer.WriteHeader(&tar.Header{Name: "first.png", Mode: 0644, Size: int64(first.Len())})
+		_, _ = writer.Write(first.Bytes())
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close tar writer: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to close tar: %v", err)
+		}
+
+		results, err := estimateArchive(filename, Options{})
+		if err != nil {
+			t.Fatalf("estimateArchive failed: %v", err)
+		}
+		if len(results) != 1 || results[0].Filename != "first.png" || results[0].Width != 100 {
+			t.Errorf("Unexpected tar results: %+v", results)
+		}
+	})
+
+	t.Run("EntryFailure", func(t *testing.T) {
+		filename := filepath.Join(tmpDir, "partial.tar")
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create tar: %v", err)
+		}
+
+		broken := []byte("\x89PNG\r\n\x1a\nnot really a png")
+		writer := tar.NewWriter(file)
+		_ = writer.WriteHeader(&tar.Header{Name: "broken.png", Mode: 0644, Size: int64(len(broken))})
+		_, _ = writer.Write(broken)
+		_ = writer.WriteHeader(&tar.Header{Name: "first.png", Mode: 0644, Size: int64(first.Len())})
+		_, _ = writer.Write(first.Bytes())
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close tar writer: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to close tar: %v", err)
+		}
+
+		results, err := estimateArchive(filename, Options{Quiet: true})
+		if len(results) != 1 || results[0].Filename != "first.png" {
+			t.Errorf("Expected the entry after the broken one to be analyzed, got %+v", results)
+		}
+
+		failures := processErrors(filename, err)
+		if len(failures) != 1 || failures[0].Filename != filename+"!broken.png" {
+			t.Fatalf("Expected one failure for %s!broken.png, got %v", filename, failures)
+		}
+		if strings.Contains(failures[0].Err.Error(), "broken.png") {
+			t.Errorf("Expected the entry name only in the failure's filename, got %q", failures[0].Err)
+		}
+	})
+
+	t.Run("IsArchive", func(t *testing.T) {
+		for name, expected := range map[string]bool{
+			"pack.zip":  true,
+			"PACK.ZIP":  true,
+			"pack.tar":  true,
+			"image.png": false,
+		} {
+			if got := isArchive(name); got != expected {
+				t.Errorf("isArchive(%q) = %v, want %v", name, got, expected)
+			}
+		}
+	})
+}
+
+func TestQuietOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	filename := filepath.Join(tmpDir, "quiet.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = png.Encode(file, generateRGBAImage(20, 20))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	t.Run("HumanSuppressed", func(t *testing.T) {
+		output := captureStdout(t, func() {
+			if _, err := estimateDecodedSize(filename, Options{Quiet: true}); err != nil {
+				t.Errorf("estimateDecodedSize failed: %v", err)
+			}
+		})
+		if output != "" {
+			t.Errorf("Expected empty stdout, got %q", output)
+		}
+	})
+
+	t.Run("JSONKept", func(t *testing.T) {
+		output := captureStdout(t, func() {
+			if _, err := estimateDecodedSize(filename, Options{JSONOutput: true, Quiet: true}); err != nil {
+				t.Errorf("estimateDecodedSize failed: %v", err)
+			}
+		})
+		if !strings.Contains(output, `"format": "png"`) {
+			t.Errorf("Expected JSON output in quiet mode, got %q", output)
+		}
+	})
+
+	t.Run("ErrorStillReturned", func(t *testing.T) {
+		output := captureStdout(t, func() {
+			if _, err := estimateDecodedSize(filepath.Join(tmpDir, "missing.png"), Options{Quiet: true}); err == nil {
+				t.Error("Expected error for missing file")
+			}
+		})
+		if output != "" {
+			t.Errorf("Expected empty stdout, got %q", output)
+		}
+	})
+}
+
+func TestJPEGRestartInterval(t *testing.T) {
+	withDRI := func(interval uint16) []byte {
+		base := createMinimalJPEGData(100, 100, 2, 2, 1, 1, 8)
+
+		var buf bytes.Buffer
+		buf.Write(base[:2])
+		buf.Write([]byte{0xFF, 0xDD, 0x00, 0x04})
+		_ = binary.Write(&buf, binary.BigEndian, interval)
+		buf.Write(base[2:])
+		return buf.Bytes()
+	}
+
+	t.Run("WithDRI", func(t *testing.T) {
+		if got := scanJPEGMarkers(bytes.NewReader(withDRI(64))).RestartInterval; got != 64 {
+			t.Errorf("Expected restart interval 64, got %d", got)
+		}
+	})
+
+	t.Run("WithoutDRI", func(t *testing.T) {
+		data := createMinimalJPEGData(100, 100, 2, 2, 1, 1, 8)
+		if got := scanJPEGMarkers(bytes.NewReader(data)).RestartInterval; got != 0 {
+			t.Errorf("Expected no restart interval, got %d", got)
+		}
+	})
+
+	t.Run("NotJPEG", func(t *testing.T) {
+		if got := scanJPEGMarkers(bytes.NewReader([]byte("not a jpeg"))).RestartInterval; got != 0 {
+			t.Errorf("Expected 0 for non-JPEG, got %d", got)
+		}
+	})
+
+	t.Run("SingleWalk", func(t *testing.T) {
+		base := createMinimalJPEGData(100, 100, 2, 2, 1, 1, 12)
+
+		var buf bytes.Buffer
+		buf.Write(base[:2])
+		buf.Write([]byte{0xFF, 0xE0, 0x00, 0x10})
+		buf.WriteString("JFIF\x00")
+		buf.Write([]byte{1, 2, 1, 0x01, 0x2C, 0x01, 0x2C, 0, 0})
+		buf.Write([]byte{0xFF, 0xDD, 0x00, 0x04, 0x00, 0x20})
+		buf.Write(base[2:])
+
+		markers := scanJPEGMarkers(bytes.NewReader(buf.Bytes()))
+		if markers.RestartInterval != 32 {
+			t.Errorf("RestartInterval: got=%d, want=32", markers.RestartInterval)
+		}
+		if markers.DPIX != 300 || markers.DPIY != 300 || markers.DensityUnit != "dpi" {
+			t.Errorf("Density: got=%dx%d %s, want=300x300 dpi", markers.DPIX, markers.DPIY, markers.DensityUnit)
+		}
+		if markers.FrameMarker != 0xC1 || markers.Precision != 12 {
+			t.Errorf("Frame: got=SOF%d precision %d, want=SOF1 precision 12", markers.FrameMarker-0xC0, markers.Precision)
+		}
+		if markers.Subsampling != "4:2:0" {
+			t.Errorf("Subsampling: got=%s, want=4:2:0", markers.Subsampling)
+		}
+	})
+
+	t.Run("AnalyzeJPEG", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeJPEG(bytes.NewReader(withDRI(8)), image.Config{}, info)
+		if info.RestartInterval != 8 {
+			t.Errorf("Expected RestartInterval 8, got %d", info.RestartInterval)
+		}
+	})
+}
+
+func exrAttribute(name, typ string, value []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	buf.WriteString(typ)
+	buf.WriteByte(0)
+	_ = binary.Write(&buf, binary.LittleEndian, int32(len(value)))
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+func createEXRData(width, height int, channels []string, pixelType int32) []byte {
+	var chlist bytes.Buffer
+	for _, name := range channels {
+		chlist.WriteString(name)
+		chlist.WriteByte(0)
+		_ = binary.Write(&chlist, binary.LittleEndian, pixelType)
+		chlist.Write([]byte{0, 0, 0, 0})
+		_ = binary.Write(&chlist, binary.LittleEndian, int32(1))
+		_ = binary.Write(&chlist, binary.LittleEndian, int32(1))
+	}
+	chlist.WriteByte(0)
+
+	var window bytes.Buffer
+	_ = binary.Write(&window, binary.LittleEndian, []int32{0, 0, int32(width - 1), int32(height - 1)})
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0x76, 0x2f, 0x31, 0x01, 0x02, 0x00, 0x00, 0x00})
+	buf.Write(exrAttribute("channels", "chlist", chlist.Bytes()))
+	buf.Write(exrAttribute("compression", "compression", []byte{0}))
+	buf.Write(exrAttribute("dataWindow", "box2i", window.Bytes()))
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+func TestEXRAnalysis(t *testing.T) {
+	tests := []struct {
+		name         string
+		channels     []string
+		pixelType    int32
+		wantModel    ColorModel
+		wantBitDepth int
+		wantAlpha    bool
+		wantBytesPP  int
+	}{
+		{"HALF_RGBA", []string{"A", "B", "G", "R"}, 1, ColorModelRGB, 16, true, 8},
+		{"FLOAT_RGB", []string{"B", "G", "R"}, 2, ColorModelRGB, 32, false, 12},
+		{"HALF_Y", []string{"Y"}, 1, ColorModelGrayscale, 16, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := createEXRData(640, 480, tt.channels, tt.pixelType)
+
+			info, err := analyzeReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("analyzeReader failed: %v", err)
+			}
+
+			if info.Format != "exr" {
+				t.Errorf("Format mismatch: got=%s, want=exr", info.Format)
+			}
+			if info.Width != 640 || info.Height != 480 {
+				t.Errorf("Dimensions mismatch: got=%dx%d, want=640x480", info.Width, info.Height)
+			}
+			if info.ColorModel != tt.wantModel {
+				t.Errorf("ColorModel mismatch: got=%s, want=%s", info.ColorModel, tt.wantModel)
+			}
+			if info.BitDepth != tt.wantBitDepth {
+				t.Errorf("BitDepth mismatch: got=%d, want=%d", info.BitDepth, tt.wantBitDepth)
+			}
+			if info.HasAlpha != tt.wantAlpha {
+				t.Errorf("HasAlpha mismatch: got=%v, want=%v", info.HasAlpha, tt.wantAlpha)
+			}
+			if info.HDRType != HDRLinear {
+				t.Errorf("HDRType mismatch: got=%s, want=%s", info.HDRType, HDRLinear)
+			}
+			if info.ChannelCount != len(tt.channels) {
+				t.Errorf("ChannelCount mismatch: got=%d, want=%d", info.ChannelCount, len(tt.channels))
+			}
+			if bpp := calculateBytesPerPixel(info); bpp != tt.wantBytesPP {
+				t.Errorf("Bytes per pixel mismatch: got=%d, want=%d", bpp, tt.wantBytesPP)
+			}
+		})
+	}
+}
+
+func TestParseEXRHeader_Invalid(t *testing.T) {
+	t.Run("BadMagic", func(t *testing.T) {
+		if _, err := parseEXRHeader(bytes.NewReader([]byte("not an exr file"))); err == nil {
+			t.Error("Expected error for bad magic")
+		}
+	})
+
+	t.Run("MissingDataWindow", func(t *testing.T) {
+		data := []byte{0x76, 0x2f, 0x31, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00}
+		if _, err := parseEXRHeader(bytes.NewReader(data)); err == nil {
+			t.Error("Expected error for missing dataWindow")
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		data := createEXRData(8, 8, []string{"R"}, 1)
+		if _, err := parseEXRHeader(bytes.NewReader(data[:20])); err == nil {
+			t.Error("Expected error for truncated header")
+		}
+	})
+}
+
+func TestRadianceAnalysis(t *testing.T) {
+	t.Run("RADIANCE", func(t *testing.T) {
+		data := []byte("#?RADIANCE\n# made by test\nFORMAT=32-bit_rle_rgbe\nEXPOSURE=1.0\n\n-Y 480 +X 640\n")
+		data = append(data, make([]byte, 16)...)
+
+		info, err := analyzeReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+
+		if info.Format != "hdr" {
+			t.Errorf("Format mismatch: got=%s, want=hdr", info.Format)
+		}
+		if info.Width != 640 || info.Height != 480 {
+			t.Errorf("Dimensions mismatch: got=%dx%d, want=640x480", info.Width, info.Height)
+		}
+		if info.ColorModel != ColorModelRGB {
+			t.Errorf("ColorModel mismatch: got=%s, want=RGB", info.ColorModel)
+		}
+		if info.BitDepth != 32 {
+			t.Errorf("BitDepth mismatch: got=%d, want=32", info.BitDepth)
+		}
+		if info.HDRType != HDRLinear {
+			t.Errorf("HDRType mismatch: got=%s, want=%s", info.HDRType, HDRLinear)
+		}
+		if bpp := calculateBytesPerPixel(info); bpp != 12 {
+			t.Errorf("Bytes per pixel mismatch: got=%d, want=12", bpp)
+		}
+	})
+
+	t.Run("RGBESignature", func(t *testing.T) {
+		data := []byte("#?RGBE\n\n+X 32 +Y 16\n")
+		width, height, err := parseRadianceHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("parseRadianceHeader failed: %v", err)
+		}
+		if width != 32 || height != 16 {
+			t.Errorf("Dimensions mismatch: got=%dx%d, want=32x16", width, height)
+		}
+	})
+
+	invalid := map[string]string{
+		"UnsupportedFormat": "#?RADIANCE\nFORMAT=16-bit_raw\n\n-Y 4 +X 4\n",
+		"MissingResolution": "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n",
+		"BadResolution":     "#?RADIANCE\n\n-Y four +X 4\n",
+		"BadSignature":      "#?OTHER\n\n-Y 4 +X 4\n",
+	}
+	for name, header := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := parseRadianceHeader(strings.NewReader(header)); err == nil {
+				t.Error("Expected error for invalid header")
+			}
+		})
+	}
+}
+
+func TestDecodeTime(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	filename := filepath.Join(tmpDir, "decode.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = png.Encode(file, generateRGBAImage(256, 256))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Quiet: true, DecodeTime: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.DecodeDurationMs <= 0 {
+		t.Errorf("Expected positive DecodeDurationMs, got %f", info.DecodeDurationMs)
+	}
+
+	info, err = estimateDecodedSize(filename, Options{Quiet: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.DecodeDurationMs != 0 {
+		t.Errorf("Expected DecodeDurationMs to stay unset without -decode-time, got %f", info.DecodeDurationMs)
+	}
+
+	t.Run("UnsupportedDecoder", func(t *testing.T) {
+		icoFile := filepath.Join(tmpDir, "icon.ico")
+		if err := os.WriteFile(icoFile, createICOData([][3]int{{16, 16, 32}}), 0644); err != nil {
+			t.Fatalf("Failed to write ICO: %v", err)
+		}
+
+		info, err := estimateDecodedSize(icoFile, Options{Quiet: true, DecodeTime: true})
+		if err != nil {
+			t.Fatalf("Expected header-only format to be analyzed without decode timing, got %v", err)
+		}
+		if info.DecodeDurationMs != 0 {
+			t.Errorf("Expected no decode time for header-only format, got %f", info.DecodeDurationMs)
+		}
+	})
+}
+
+func TestStrictDecode(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(64, 64)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	data := buf.Bytes()
+
+	iend := bytes.Index(data, []byte("IEND"))
+	if iend < 0 {
+		t.Fatal("Encoded PNG has no IEND chunk")
+	}
+	truncated := data[:iend-40]
+
+	filename := filepath.Join(tmpDir, "truncated.png")
+	if err := os.WriteFile(filename, truncated, 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+
+	t.Run("HeaderOnlyPasses", func(t *testing.T) {
+		if _, err := estimateDecodedSize(filename, Options{Quiet: true}); err != nil {
+			t.Errorf("Expected header-only analysis to succeed, got %v", err)
+		}
+	})
+
+	t.Run("StrictFails", func(t *testing.T) {
+		_, err := estimateDecodedSize(filename, Options{Quiet: true, Strict: true})
+		if err == nil {
+			t.Fatal("Expected strict decode of truncated IDAT to fail")
+		}
+		if !strings.HasPrefix(err.Error(), "decode: ") {
+			t.Errorf("Expected descriptive decode error, got %q", err)
+		}
+		if code := categorizeError(err); code != ExitInvalidFormat {
+			t.Errorf("Expected exit code %d, got %d", ExitInvalidFormat, code)
+		}
+	})
+
+	t.Run("StrictPassesValidFile", func(t *testing.T) {
+		valid := filepath.Join(tmpDir, "valid.png")
+		if err := os.WriteFile(valid, data, 0644); err != nil {
+			t.Fatalf("Failed to write PNG: %v", err)
+		}
+		if _, err := estimateDecodedSize(valid, Options{Quiet: true, Strict: true}); err != nil {
+			t.Errorf("Expected strict decode of valid PNG to succeed, got %v", err)
+		}
+	})
+}
+
+func TestManifestProcessing(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	for _, name := range []string{"one.png", "two.png"} {
+		file, err := os.Create(filepath.Join(tmpDir, name))
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		err = png.Encode(file, generateRGBAImage(10, 10))
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+	}
+
+	manifest := filepath.Join(tmpDir, "manifest.txt")
+	content := "# audit list\n" +
+		filepath.Join(tmpDir, "one.png") + "\n\n" +
+		"  " + filepath.Join(tmpDir, "missing.png") + "  \n" +
+		filepath.Join(tmpDir, "two.png") + "\n"
+	if err := os.WriteFile(manifest, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	files, err := readManifest(manifest)
+	if err != nil {
+		t.Fatalf("readManifest failed: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 manifest entries, got %d: %v", len(files), files)
+	}
+	if files[1] != filepath.Join(tmpDir, "missing.png") {
+		t.Errorf("Expected surrounding whitespace trimmed, got %q", files[1])
+	}
+
+	var analyzed []*ImageInfo
+	failures := processFiles(files, func(filename string) error {
+		info, err := estimateDecodedSize(filename, Options{Quiet: true})
+		if err == nil {
+			analyzed = append(analyzed, info)
+		}
+		return err
+	})
+
+	if len(analyzed) != 2 {
+		t.Errorf("Expected both existing files to be analyzed, got %d", len(analyzed))
+	}
+	if len(failures) != 1 {
+		t.Fatalf("Expected 1 failure, got %d", len(failures))
+	}
+	if failures[0].Filename != files[1] {
+		t.Errorf("Failure filename mismatch: got=%s, want=%s", failures[0].Filename, files[1])
+	}
+	if code := categorizeError(failures[0]); code != ExitFileNotFound {
+		t.Errorf("Expected exit code %d for missing file, got %d", ExitFileNotFound, code)
+	}
+	if !strings.HasPrefix(failures[0].Error(), files[1]+": ") {
+		t.Errorf("Expected error to be prefixed with the filename, got %q", failures[0].Error())
+	}
+
+	if _, err := readManifest(filepath.Join(tmpDir, "nope.txt")); err == nil {
+		t.Error("Expected error for missing manifest")
+	}
+}
+
+func TestHEIFCodecDetection(t *testing.T) {
+	ftypOnly := func(major string, compatible ...string) []byte {
+		var ftyp bytes.Buffer
+		ftyp.WriteString(major)
+		_ = binary.Write(&ftyp, binary.BigEndian, uint32(0))
+		for _, brand := range compatible {
+			ftyp.WriteString(brand)
+		}
+		return append(heifBox("ftyp", ftyp.Bytes()), heifBox("free", make([]byte, 8))...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"HeicBrand", createMinimalHEIFMetadata(1, 1, 8, false), "HEVC"},
+		{"AvifBrand", ftypOnly("avif", "mif1", "miaf"), "AV1"},
+		{"CompatibleBrand", ftypOnly("mif1", "miaf", "heic"), "HEVC"},
+		{"GridTileItemType", createGridHEIFData("mif1", 512, 512, []uint16{2, 3}, nil), "AV1"},
+		{"ItemTypeOverridesBrand", createGridHEIFData("heic", 512, 512, []uint16{2}, nil), "AV1"},
+		{"Unknown", ftypOnly("mif1", "miaf"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := parseHEIFMetadata(bytes.NewReader(tt.data))
+			if meta.Codec != tt.want {
+				t.Errorf("Codec mismatch: got=%q, want=%q", meta.Codec, tt.want)
+			}
+		})
+	}
+
+	t.Run("AnalyzeAVIF", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(ftypOnly("avif", "mif1")), image.Config{}, info)
+		if info.Codec != "AV1" {
+			t.Errorf("Expected ImageInfo.Codec AV1, got %q", info.Codec)
+		}
+	})
+}
+
+func TestDiffImages(t *testing.T) {
+	tmpDir := t.TempDir()
+	img := generateRGBAImage(40, 30)
+
+	pngFile := filepath.Join(tmpDir, "a.png")
+	jpegFile := filepath.Join(tmpDir, "b.jpg")
+	for filename, encode := range map[string]func(*os.File) error{
+		pngFile:  func(f *os.File) error { return png.Encode(f, img) },
+		jpegFile: func(f *os.File) error { return jpeg.Encode(f, img, &jpeg.Options{Quality: 80}) },
+	} {
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		err = encode(file)
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", filename, err)
+		}
+	}
+
+	t.Run("Human", func(t *testing.T) {
+		var differences []FieldDifference
+		output := captureStdout(t, func() {
+			var err error
+			differences, err = diffImages(pngFile, jpegFile, Options{})
+			if err != nil {
+				t.Errorf("diffImages failed: %v", err)
+			}
+		})
+
+		differing := make(map[string]bool)
+		for _, difference := range differences {
+			differing[difference.Field] = true
+		}
+		for _, field := range []string{"Format", "Color Model", "Compression Type", "Estimated decoded size"} {
+			if !differing[field] {
+				t.Errorf("Expected %s to differ between PNG and JPEG", field)
+			}
+		}
+		if differing["Dimensions"] {
+			t.Error("Expected dimensions to match for a re-encode")
+		}
+
+		if !strings.Contains(output, "* Format:") {
+			t.Errorf("Expected differing rows to be marked, got:\n%s", output)
+		}
+		if !strings.Contains(output, "  Dimensions:") || !strings.Contains(output, "40x30") {
+			t.Errorf("Expected matching dimensions row, got:\n%s", output)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		output := captureStdout(t, func() {
+			if _, err := diffImages(pngFile, jpegFile, Options{JSONOutput: true}); err != nil {
+				t.Errorf("diffImages failed: %v", err)
+			}
+		})
+
+		var result struct {
+			A           map[string]interface{} `json:"a"`
+			B           map[string]interface{} `json:"b"`
+			Differences []FieldDifference      `json:"differences"`
+		}
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("Invalid JSON output: %v\n%s", err, output)
+		}
+		if result.A["format"] != "png" || result.B["format"] != "jpeg" {
+			t.Errorf("Unexpected formats: a=%v, b=%v", result.A["format"], result.B["format"])
+		}
+		if len(result.Differences) == 0 || result.Differences[0].Field != "Format" {
+			t.Errorf("Expected Format as first difference, got %+v", result.Differences)
+		}
+	})
+
+	t.Run("Identical", func(t *testing.T) {
+		info, err := analyzeFile(pngFile, Options{})
+		if err != nil {
+			t.Fatalf("analyzeFile failed: %v", err)
+		}
+		if differences := diffImageInfo(info, info); len(differences) != 0 {
+			t.Errorf("Expected no differences, got %+v", differences)
+		}
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := diffImages(pngFile, filepath.Join(tmpDir, "missing.png"), Options{})
+		if err == nil {
+			t.Fatal("Expected error for missing file")
+		}
+		if categorizeError(err) != ExitFileNotFound {
+			t.Errorf("Expected file-not-found exit code, got %d", categorizeError(err))
+		}
+	})
+}
+
+func TestHEIFPixelAspectRatio(t *testing.T) {
+	pasp := func(hSpacing, vSpacing uint32) []byte {
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.BigEndian, hSpacing)
+		_ = binary.Write(&buf, binary.BigEndian, vSpacing)
+		return heifBox("pasp", buf.Bytes())
+	}
+
+	var ftyp bytes.Buffer
+	ftyp.WriteString("heic")
+	_ = binary.Write(&ftyp, binary.BigEndian, uint32(0))
+	ftyp.WriteString("mif1")
+
+	withPasp := func(box []byte) []byte {
+		var buf bytes.Buffer
+		buf.Write(heifBox("ftyp", ftyp.Bytes()))
+		buf.Write(heifBox("meta", []byte{0, 0, 0, 0},
+			heifBox("iprp", heifBox("ipco", heifIspe(640, 480), box))))
+		return buf.Bytes()
+	}
+
+	t.Run("TwoToOne", func(t *testing.T) {
+		info := &ImageInfo{Width: 640, Height: 480}
+		analyzeISOBMFF(bytes.NewReader(withPasp(pasp(2, 1))), image.Config{}, info)
+
+		if info.PixelAspectRatio != 2 {
+			t.Errorf("Expected PixelAspectRatio 2, got %f", info.PixelAspectRatio)
+		}
+		if info.DisplayWidth != 1280 || info.DisplayHeight != 480 {
+			t.Errorf("Expected display dimensions 1280x480, got %dx%d", info.DisplayWidth, info.DisplayHeight)
+		}
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		info := &ImageInfo{Width: 640, Height: 480}
+		analyzeISOBMFF(bytes.NewReader(withPasp(heifBox("free"))), image.Config{}, info)
+
+		if info.PixelAspectRatio != 1 {
+			t.Errorf("Expected default PixelAspectRatio 1, got %f", info.PixelAspectRatio)
+		}
+		if info.DisplayWidth != 0 || info.DisplayHeight != 0 {
+			t.Errorf("Expected no display dimensions for square pixels, got %dx%d", info.DisplayWidth, info.DisplayHeight)
+		}
+	})
+
+	t.Run("ZeroSpacingIgnored", func(t *testing.T) {
+		meta := parseHEIFMetadata(bytes.NewReader(withPasp(pasp(0, 1))))
+		if meta.PixelAspectRatio != 1 {
+			t.Errorf("Expected zero spacing to be ignored, got %f", meta.PixelAspectRatio)
+		}
+	})
+}
+
+func TestRegisterAnalyzer(t *testing.T) {
+	saved := customAnalyzers
+	t.Cleanup(func() { customAnalyzers = saved })
+
+	invoked := 0
+	RegisterAnalyzer(".FAKE", []byte("FAKEIMG1"), func(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+		invoked++
+
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		info.Width = int(binary.BigEndian.Uint32(header[8:12]))
+		info.Height = int(binary.BigEndian.Uint32(header[12:16]))
+		info.ColorModel = ColorModelGrayscale
+		info.BitDepth = 8
+		info.CompressionType = CompressionLossless
+	})
+
+	var data bytes.Buffer
+	data.WriteString("FAKEIMG1")
+	_ = binary.Write(&data, binary.BigEndian, uint32(320))
+	_ = binary.Write(&data, binary.BigEndian, uint32(200))
+
+	t.Run("MagicMatch", func(t *testing.T) {
+		info, err := analyzeReader(bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+		if invoked != 1 {
+			t.Errorf("Expected custom analyzer to be invoked once, got %d", invoked)
+		}
+		if info.Format != "fake" {
+			t.Errorf("Format mismatch: got=%s, want=fake", info.Format)
+		}
+		if info.Width != 320 || info.Height != 200 {
+			t.Errorf("Dimensions mismatch: got=%dx%d, want=320x200", info.Width, info.Height)
+		}
+		if bpp := calculateBytesPerPixel(info); bpp != 1 {
+			t.Errorf("Expected 1 byte per pixel, got %d", bpp)
+		}
+	})
+
+	t.Run("BuiltInFormatsFirst", func(t *testing.T) {
+		RegisterAnalyzer("png", []byte("\x89PNG"), func(r io.ReadSeeker, config image.Config, info *ImageInfo) {
+			t.Error("Custom analyzer should not override a built-in format")
+		})
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(4, 4)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		info, err := analyzeReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+		if info.ColorModel != ColorModelRGB {
+			t.Errorf("Expected built-in PNG analysis, got color model %s", info.ColorModel)
+		}
+	})
+
+	t.Run("NoMatch", func(t *testing.T) {
+		_, err := analyzeReader(bytes.NewReader([]byte("SOMETHING ELSE ENTIRELY")))
+		if !errors.Is(err, image.ErrFormat) {
+			t.Errorf("Expected image.ErrFormat for unknown data, got %v", err)
+		}
+	})
+}
+
+func TestJPEGPrecision(t *testing.T) {
+	tests := []struct {
+		name      string
+		marker    uint8
+		precision uint8
+	}{
+		{"SOF0_8bit", 0xC0, 8},
+		{"SOF1_12bit", 0xC1, 12},
+		{"SOF3_Lossless_16bit", 0xC3, 16},
+		{"SOF3_Lossless_12bit", 0xC3, 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := createJPEGWithSOFMarker(tt.marker, tt.precision, 3, 64, 64, 1, 1, 1, 1)
+
+			if got := scanJPEGMarkers(bytes.NewReader(data)).Precision; got != int(tt.precision) {
+				t.Errorf("Precision mismatch: got=%d, want=%d", got, tt.precision)
+			}
+
+			info := &ImageInfo{}
+			analyzeJPEG(bytes.NewReader(data), image.Config{}, info)
+			if info.BitDepth != int(tt.precision) {
+				t.Errorf("BitDepth mismatch: got=%d, want=%d", info.BitDepth, tt.precision)
+			}
+
+			wantCompression := CompressionLossy
+			if tt.marker == 0xC3 {
+				wantCompression = CompressionLossless
+			}
+			if info.CompressionType != wantCompression {
+				t.Errorf("CompressionType mismatch: got=%s, want=%s", info.CompressionType, wantCompression)
+			}
+		})
+	}
+
+	t.Run("SOF3_16bit_BytesPerPixel", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeJPEG(bytes.NewReader(createJPEGWithSOFMarker(0xC3, 16, 3, 64, 64, 1, 1, 1, 1)), image.Config{}, info)
+		if bpp := calculateBytesPerPixel(info); bpp != 6 {
+			t.Errorf("Expected 6 bytes per pixel for 16-bit lossless YCbCr, got %d", bpp)
+		}
+	})
+
+	t.Run("NoFrame", func(t *testing.T) {
+		if got := scanJPEGMarkers(bytes.NewReader([]byte{0xFF, 0xD8, 0xFF, 0xD9})).Precision; got != 0 {
+			t.Errorf("Expected 0 without a frame header, got %d", got)
+		}
+	})
+}
+
+func TestHEIFMetaAfterLargeMdat(t *testing.T) {
+	base := createMinimalHEIFMetadata(9, 16, 10, true)
+	ftypSize := int(binary.BigEndian.Uint32(base[0:4]))
+	ftyp, meta := base[:ftypSize], base[ftypSize:]
+
+	mdatPayload := make([]byte, 64*1024)
+
+	t.Run("32BitMdat", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Write(ftyp)
+		buf.Write(heifBox("mdat", mdatPayload))
+		buf.Write(meta)
+
+		got := parseHEIFMetadata(bytes.NewReader(buf.Bytes()))
+		if got.BitDepth != 10 || got.HDRType != HDRPQ || got.ColorSpace != ColorSpaceBT2020 || !got.HasAlpha {
+			t.Errorf("Expected meta after mdat to be parsed, got BitDepth=%d HDR=%s ColorSpace=%s Alpha=%v",
+				got.BitDepth, got.HDRType, got.ColorSpace, got.HasAlpha)
+		}
+	})
+
+	t.Run("64BitMdat", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Write(ftyp)
+		_ = binary.Write(&buf, binary.BigEndian, uint32(1))
+		buf.WriteString("mdat")
+		_ = binary.Write(&buf, binary.BigEndian, uint64(16+len(mdatPayload)))
+		buf.Write(mdatPayload)
+		buf.Write(meta)
+
+		got := parseHEIFMetadata(bytes.NewReader(buf.Bytes()))
+		if got.BitDepth != 10 || got.HDRType != HDRPQ || !got.HasAlpha {
+			t.Errorf("Expected meta after 64-bit mdat to be parsed, got BitDepth=%d HDR=%s Alpha=%v",
+				got.BitDepth, got.HDRType, got.HasAlpha)
+		}
+	})
+
+	t.Run("InvalidLargeSize", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Write(ftyp)
+		_ = binary.Write(&buf, binary.BigEndian, uint32(1))
+		buf.WriteString("mdat")
+		_ = binary.Write(&buf, binary.BigEndian, uint64(4))
+		buf.Write(meta)
+
+		got := parseHEIFMetadata(bytes.NewReader(buf.Bytes()))
+		if got.BitDepth != 8 {
+			t.Errorf("Expected defaults after an invalid largesize, got BitDepth=%d", got.BitDepth)
+		}
+	})
+}
+
+func TestCompactJSON(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, generateRGBAImage(12, 8)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	filename := filepath.Join(tmpDir, "compact.png")
+	if err := os.WriteFile(filename, encoded.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+
+	t.Run("SingleFile", func(t *testing.T) {
+		output := captureStdout(t, func() {
+			if _, err := estimateDecodedSize(filename, Options{JSONOutput: true, CompactJSON: true}); err != nil {
+				t.Errorf("estimateDecodedSize failed: %v", err)
+			}
+		})
+
+		if strings.Count(output, "\n") != 1 || !strings.HasSuffix(output, "\n") {
+			t.Errorf("Expected a single line of JSON, got:\n%s", output)
+		}
+
+		var info map[string]interface{}
+		if err := json.Unmarshal([]byte(output), &info); err != nil {
+			t.Fatalf("Invalid JSON output: %v", err)
+		}
+		if info["width"] != 12.0 || info["height"] != 8.0 {
+			t.Errorf("Dimensions mismatch: got=%vx%v, want=12x8", info["width"], info["height"])
+		}
+	})
+
+	t.Run("PrettyByDefault", func(t *testing.T) {
+		output := captureStdout(t, func() {
+			if _, err := estimateDecodedSize(filename, Options{JSONOutput: true}); err != nil {
+				t.Errorf("estimateDecodedSize failed: %v", err)
+			}
+		})
+
+		if strings.Count(output, "\n") <= 1 {
+			t.Errorf("Expected indented multi-line JSON, got:\n%s", output)
+		}
+	})
+
+	t.Run("ArchiveOneObjectPerLine", func(t *testing.T) {
+		archivePath := filepath.Join(tmpDir, "images.tar")
+		file, err := os.Create(archivePath)
+		if err != nil {
+			t.Fatalf("Failed to create tar: %v", err)
+		}
+		writer := tar.NewWriter(file)
+		for _, name := range []string{"a.png", "b.png"} {
+			_ = writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(encoded.Len()), Typeflag: tar.TypeReg})
+			_, _ = writer.Write(encoded.Bytes())
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close tar writer: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to close tar: %v", err)
+		}
+
+		output := captureStdout(t, func() {
+			if _, err := estimateArchive(archivePath, Options{JSONOutput: true, CompactJSON: true}); err != nil {
+				t.Errorf("estimateArchive failed: %v", err)
+			}
+		})
+
+		lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("Expected 2 lines, got %d:\n%s", len(lines), output)
+		}
+		for i, line := range lines {
+			var info map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &info); err != nil {
+				t.Errorf("Line %d is not a JSON object: %v", i, err)
+			}
+		}
+	})
+}
+
+func TestPNGPaletteSize(t *testing.T) {
+	t.Run("SuggestedPaletteOnTruecolor", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		data := insertPNGChunk(buf.Bytes(), "PLTE", make([]byte, 16*3))
+
+		info, err := analyzeReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+		if info.PaletteSize != 16 {
+			t.Errorf("Expected PaletteSize 16, got %d", info.PaletteSize)
+		}
+		if info.ColorModel != ColorModelRGB {
+			t.Errorf("Expected truecolor model to be kept, got %s", info.ColorModel)
+		}
+	})
+
+	t.Run("IndexedImage", func(t *testing.T) {
+		palette := make(color.Palette, 16)
+		for i := range palette {
+			palette[i] = color.RGBA{uint8(i * 16), 0, 0, 255}
+		}
+		img := image.NewPaletted(image.Rect(0, 0, 8, 8), palette)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+
+		info, err := analyzeReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+		if info.ColorModel != ColorModelIndexed {
+			t.Errorf("Expected Indexed color model, got %s", info.ColorModel)
+		}
+		if info.PaletteSize != 16 {
+			t.Errorf("Expected PaletteSize 16, got %d", info.PaletteSize)
+		}
+	})
+
+	t.Run("NoPalette", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		if got := scanPNGChunks(bytes.NewReader(buf.Bytes())).PaletteSize; got != 0 {
+			t.Errorf("Expected no palette, got %d", got)
+		}
+	})
+
+	t.Run("InvalidLength", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		data := insertPNGChunk(buf.Bytes(), "PLTE", make([]byte, 10))
+		if got := scanPNGChunks(bytes.NewReader(data)).PaletteSize; got != 0 {
+			t.Errorf("Expected 0 for a PLTE length that is not a multiple of 3, got %d", got)
+		}
+	})
+}
+
+type flakySource struct {
+	data     []byte
+	failures int
+	attempts int
+}
+
+func (f *flakySource) Open() (io.Reader, error) {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return nil, &fs.PathError{Op: "read", Path: "flaky.png", Err: syscall.EIO}
+	}
+	return bytes.NewReader(f.data), nil
+}
+
+func TestRetries(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, generateRGBAImage(6, 4)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	analyzeFlaky := func(f *flakySource, info **ImageInfo) func() error {
+		return func() error {
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			*info, err = analyzeReader(bytes.NewReader(data))
+			return err
+		}
+	}
+
+	t.Run("RecoversAfterTransientFailure", func(t *testing.T) {
+		flaky := &flakySource{data: encoded.Bytes(), failures: 1}
+		var info *ImageInfo
+
+		if err := withRetries(2, 0, analyzeFlaky(flaky, &info)); err != nil {
+			t.Fatalf("Expected success after retry, got %v", err)
+		}
+		if flaky.attempts != 2 {
+			t.Errorf("Expected 2 attempts, got %d", flaky.attempts)
+		}
+		if info == nil || info.Width != 6 {
+			t.Errorf("Expected analyzed image after retry, got %+v", info)
+		}
+	})
+
+	t.Run("NoRetriesByDefault", func(t *testing.T) {
+		flaky := &flakySource{data: encoded.Bytes(), failures: 1}
+		var info *ImageInfo
+
+		if err := withRetries(0, 0, analyzeFlaky(flaky, &info)); err == nil {
+			t.Error("Expected transient failure without retries")
+		}
+		if flaky.attempts != 1 {
+			t.Errorf("Expected 1 attempt, got %d", flaky.attempts)
+		}
+	})
+
+	t.Run("FormatErrorsNotRetried", func(t *testing.T) {
+		flaky := &flakySource{data: []byte("not an image at all")}
+		var info *ImageInfo
+
+		err := withRetries(3, 0, analyzeFlaky(flaky, &info))
+		if !errors.Is(err, image.ErrFormat) {
+			t.Errorf("Expected image.ErrFormat, got %v", err)
+		}
+		if flaky.attempts != 1 {
+			t.Errorf("Expected format error not to be retried, got %d attempts", flaky.attempts)
+		}
+	})
+
+	t.Run("MissingFileNotRetried", func(t *testing.T) {
+		attempts := 0
+		err := withRetries(3, 0, func() error {
+			attempts++
+			_, err := analyzeImage(filepath.Join(t.TempDir(), "missing.png"))
+			return err
+		})
+		if err == nil || attempts != 1 {
+			t.Errorf("Expected a single failed attempt for a missing file, got %d attempts (err=%v)", attempts, err)
+		}
+	})
+
+	t.Run("RetriedAnalysisPrintsNothing", func(t *testing.T) {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "image.png")
+		if err := os.WriteFile(filename, encoded.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write PNG: %v", err)
+		}
+		archiveName := filepath.Join(dir, "images.tar")
+		file, err := os.Create(archiveName)
+		if err != nil {
+			t.Fatalf("Failed to create tar: %v", err)
+		}
+		writer := tar.NewWriter(file)
+		_ = writer.WriteHeader(&tar.Header{Name: "image.png", Mode: 0644, Size: int64(encoded.Len())})
+		_, _ = writer.Write(encoded.Bytes())
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close tar writer: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to close tar: %v", err)
+		}
+
+		opts := Options{JSONOutput: true}
+		output := captureStdout(t, func() {
+			_ = withRetries(2, 0, func() error {
+				if _, err := analyzeDecodedSize(filename, opts); err != nil {
+					return err
+				}
+				if _, err := analyzeArchive(archiveName, opts); err != nil {
+					return err
+				}
+				return &fs.PathError{Op: "write", Path: filename, Err: syscall.ENOSPC}
+			})
+		})
+		if output != "" {
+			t.Errorf("Expected retried analysis to print nothing, got %q", output)
+		}
+	})
+}
+
+func TestSVGAnalysis(t *testing.T) {
+	tests := []struct {
+		name       string
+		svg        string
+		wantWidth  int
+		wantHeight int
+	}{
+		{"WidthHeight", `<svg xmlns="http://www.w3.org/2000/svg" width="640" height="480"></svg>`, 640, 480},
+		{"PixelUnits", `<?xml version="1.0" encoding="UTF-8"?>
+<!-- exported -->
+<svg xmlns="http://www.w3.org/2000/svg" width="300px" height="150px"/>`, 300, 150},
+		{"ViewBoxOnly", `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 1024 768"><rect/></svg>`, 1024, 768},
+		{"ViewBoxCommas", `<svg viewBox="0,0,200.5,100" width="50%"/>`, 201, 100},
+		{"InchUnits", `<svg width="2in" height="1in"/>`, 192, 96},
+		{"Latin1Declaration", `<?xml version="1.0" encoding="ISO-8859-1"?><svg width="10" height="20"/>`, 10, 20},
+		{"ByteOrderMark", "\xef\xbb\xbf<?xml version=\"1.0\"?>\n<svg width=\"32\" height=\"16\"/>", 32, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := analyzeReader(strings.NewReader(tt.svg))
+			if err != nil {
+				t.Fatalf("analyzeReader failed: %v", err)
+			}
+
+			if info.Format != "svg" {
+				t.Errorf("Format mismatch: got=%s, want=svg", info.Format)
+			}
+			if info.Width != tt.wantWidth || info.Height != tt.wantHeight {
+				t.Errorf("Dimensions mismatch: got=%dx%d, want=%dx%d", info.Width, info.Height, tt.wantWidth, tt.wantHeight)
+			}
+			if info.ColorModel != ColorModelUnknown {
+				t.Errorf("Expected unknown color model for vector, got %s", info.ColorModel)
+			}
+			if info.CompressionType != CompressionNotApplicable {
+				t.Errorf("Expected N/A compression, got %s", info.CompressionType)
+			}
+
+			applySizeEstimate(info, int64(len(tt.svg)), []int{100}, sizeScope{}, "")
+			if info.DecodedSize != 0 || info.ScaledSizes[100] != 0 {
+				t.Errorf("Expected no decoded size for vector, got %d (scaled %d)", info.DecodedSize, info.ScaledSizes[100])
+			}
+		})
+	}
+
+	t.Run("NonSVGXML", func(t *testing.T) {
+		for _, doc := range []string{
+			`<?xml version="1.0"?><html></html>`,
+			`<?xml version="1.0"?><rss version="2.0"><channel><title>feed</title></channel></rss>`,
+			`<?xml version="1.0"?><doc><note>mentions <svg width="1" height="1"/> inline</note></doc>`,
+		} {
+			if _, _, err := image.DecodeConfig(strings.NewReader(doc)); !errors.Is(err, image.ErrFormat) {
+				t.Errorf("image.DecodeConfig(%q): expected image.ErrFormat, got %v", doc, err)
+			}
+			if _, err := analyzeReader(strings.NewReader(doc)); !errors.Is(err, image.ErrFormat) {
+				t.Errorf("analyzeReader(%q): expected image.ErrFormat, got %v", doc, err)
+			}
+		}
+	})
+
+	t.Run("NoDimensions", func(t *testing.T) {
+		if _, _, err := parseSVGDimensions(strings.NewReader(`<svg width="100"/>`)); err == nil {
+			t.Error("Expected error without height or viewBox")
+		}
+	})
+}
+
+func TestJPEGDensity(t *testing.T) {
+	withJFIF := func(units uint8, x, y uint16) []byte {
+		base := createMinimalJPEGData(100, 100, 2, 2, 1, 1, 8)
+
+		var app0 bytes.Buffer
+		app0.WriteString("JFIF\x00")
+		app0.Write([]byte{1, 2, units})
+		_ = binary.Write(&app0, binary.BigEndian, x)
+		_ = binary.Write(&app0, binary.BigEndian, y)
+		app0.Write([]byte{0, 0})
+
+		var buf bytes.Buffer
+		buf.Write(base[:2])
+		buf.Write([]byte{0xFF, 0xE0})
+		_ = binary.Write(&buf, binary.BigEndian, uint16(app0.Len()+2))
+		buf.Write(app0.Bytes())
+		buf.Write(base[2:])
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantX    int
+		wantY    int
+		wantUnit string
+	}{
+		{"300DPI", withJFIF(1, 300, 300), 300, 300, "dpi"},
+		{"DotsPerCm", withJFIF(2, 118, 118), 300, 300, "dpcm"},
+		{"AspectRatioOnly", withJFIF(0, 1, 1), 0, 0, "aspect ratio 1:1"},
+		{"NoJFIF", createMinimalJPEGData(100, 100, 2, 2, 1, 1, 8), 0, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &ImageInfo{}
+			analyzeJPEG(bytes.NewReader(tt.data), image.Config{}, info)
+
+			if info.DPIX != tt.wantX || info.DPIY != tt.wantY {
+				t.Errorf("DPI mismatch: got=%dx%d, want=%dx%d", info.DPIX, info.DPIY, tt.wantX, tt.wantY)
+			}
+			if info.DensityUnit != tt.wantUnit {
+				t.Errorf("DensityUnit mismatch: got=%q, want=%q", info.DensityUnit, tt.wantUnit)
+			}
+		})
+	}
+}
+
+func TestPNGDensity(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, generateRGBAImage(8, 8)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	phys := func(x, y uint32, unit byte) []byte {
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.BigEndian, x)
+		_ = binary.Write(&buf, binary.BigEndian, y)
+		buf.WriteByte(unit)
+		return insertPNGChunk(encoded.Bytes(), "pHYs", buf.Bytes())
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantX    int
+		wantY    int
+		wantUnit string
+	}{
+		{"300DPI", phys(11811, 11811, 1), 300, 300, "ppm"},
+		{"Anisotropic", phys(11811, 5906, 1), 300, 150, "ppm"},
+		{"UnknownUnit", phys(2, 1, 0), 0, 0, "aspect ratio 2:1"},
+		{"NoPHYs", encoded.Bytes(), 0, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := analyzeReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("analyzeReader failed: %v", err)
+			}
+
+			if info.DPIX != tt.wantX || info.DPIY != tt.wantY {
+				t.Errorf("DPI mismatch: got=%dx%d, want=%dx%d", info.DPIX, info.DPIY, tt.wantX, tt.wantY)
+			}
+			if info.DensityUnit != tt.wantUnit {
+				t.Errorf("DensityUnit mismatch: got=%q, want=%q", info.DensityUnit, tt.wantUnit)
+			}
+		})
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	filename := filepath.Join(tmpDir, "hash.png")
+	if err := os.WriteFile(filename, encoded.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+
+	t.Run("KnownContent", func(t *testing.T) {
+		got, err := computeContentHash(strings.NewReader("hello world"), "sha256")
+		if err != nil {
+			t.Fatalf("computeContentHash failed: %v", err)
+		}
+		want := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+		if got != want {
+			t.Errorf("sha256 mismatch: got=%s, want=%s", got, want)
+		}
+
+		md5sum, _ := computeContentHash(strings.NewReader("hello world"), "md5")
+		if md5sum != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+			t.Errorf("md5 mismatch: got=%s", md5sum)
+		}
+	})
+
+	t.Run("FileHash", func(t *testing.T) {
+		info, err := estimateDecodedSize(filename, Options{Quiet: true, HashAlgorithm: "sha256"})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+
+		sum := sha256.Sum256(encoded.Bytes())
+		if want := hex.EncodeToString(sum[:]); info.ContentHash != want {
+			t.Errorf("ContentHash mismatch: got=%s, want=%s", info.ContentHash, want)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		info, err := estimateDecodedSize(filename, Options{Quiet: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		if info.ContentHash != "" {
+			t.Errorf("Expected no hash when disabled, got %s", info.ContentHash)
+		}
+	})
+
+	t.Run("InvalidAlgorithm", func(t *testing.T) {
+		if _, err := newHasher("crc32"); err == nil {
+			t.Error("Expected error for unsupported hash algorithm")
+		}
+	})
+}
+
+func TestPerceptualHash(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	scene := func(width, height int) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+				v := uint8(255 * fx * fy)
+				if fx > 0.3 && fx < 0.6 && fy > 0.2 && fy < 0.5 {
+					v = 255 - v
+				}
+				img.Set(x, y, color.RGBA{R: v, G: uint8(255 * fx), B: v / 2, A: 255})
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	large, err := computePerceptualHash(bytes.NewReader(scene(320, 240)))
+	if err != nil {
+		t.Fatalf("computePerceptualHash failed: %v", err)
+	}
+	small, err := computePerceptualHash(bytes.NewReader(scene(97, 73)))
+	if err != nil {
+		t.Fatalf("computePerceptualHash failed: %v", err)
+	}
+	if len(large) != 16 {
+		t.Errorf("Expected 16 hex digits, got %q", large)
+	}
+
+	distance, err := perceptualHashDistance(large, small)
+	if err != nil {
+		t.Fatalf("perceptualHashDistance failed: %v", err)
+	}
+	if distance > 6 {
+		t.Errorf("Resized copies should hash closely: %s vs %s (distance %d)", large, small, distance)
+	}
+
+	inverted := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			inverted.SetGray(x, y, color.Gray{Y: uint8(255 - x*4)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, inverted); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	other, err := computePerceptualHash(&buf)
+	if err != nil {
+		t.Fatalf("computePerceptualHash failed: %v", err)
+	}
+	if d, _ := perceptualHashDistance(large, other); d <= distance {
+		t.Errorf("Unrelated image should be further away than a resized copy: %d <= %d", d, distance)
+	}
+
+	t.Run("EstimateDecodedSize", func(t *testing.T) {
+		filename := filepath.Join(tmpDir, "scene.png")
+		if err := os.WriteFile(filename, scene(64, 48), 0644); err != nil {
+			t.Fatalf("Failed to write PNG: %v", err)
+		}
+		info, err := estimateDecodedSize(filename, Options{Quiet: true, PerceptualHash: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		if info.PerceptualHash == "" {
+			t.Error("Expected perceptual hash to be reported")
+		}
+	})
+
+	t.Run("HeaderOnlyFormat", func(t *testing.T) {
+		filename := filepath.Join(tmpDir, "shape.svg")
+		if err := os.WriteFile(filename, []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"/>`), 0644); err != nil {
+			t.Fatalf("Failed to write SVG: %v", err)
+		}
+		info, err := estimateDecodedSize(filename, Options{Quiet: true, PerceptualHash: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		if info.PerceptualHash != "" {
+			t.Errorf("Expected no perceptual hash for header-only format, got %s", info.PerceptualHash)
+		}
+	})
+}
+
+func TestRawBuffers(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		name        string
+		spec        string
+		size        int
+		wantModel   ColorModel
+		wantAlpha   bool
+		wantBPP     int
+		wantDecoded int64
+	}{
+		{"RGB", "16x8:RGB:8", 16 * 8 * 3, ColorModelRGB, false, 24, 16 * 8 * 3},
+		{"RGBA", "16x8:rgba:8", 16 * 8 * 4, ColorModelRGB, true, 32, 16 * 8 * 4},
+		{"Gray16", "10X10:GRAY:16", 10 * 10 * 2, ColorModelGrayscale, false, 16, 10 * 10 * 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseRawSpec(tt.spec)
+			if err != nil {
+				t.Fatalf("parseRawSpec(%q) failed: %v", tt.spec, err)
+			}
+
+			filename := filepath.Join(tmpDir, tt.name+".raw")
+			if err := os.WriteFile(filename, make([]byte, tt.size), 0644); err != nil {
+				t.Fatalf("Failed to write raw file: %v", err)
+			}
+
+			info, err := analyzeRaw(filename, spec, nil)
+			if err != nil {
+				t.Fatalf("analyzeRaw failed: %v", err)
+			}
+			if info.Format != "raw" || info.ColorModel != tt.wantModel || info.HasAlpha != tt.wantAlpha {
+				t.Errorf("Unexpected info: format=%s model=%v alpha=%v", info.Format, info.ColorModel, info.HasAlpha)
+			}
+			if info.BitsPerPixel != tt.wantBPP {
+				t.Errorf("BitsPerPixel: got=%d, want=%d", info.BitsPerPixel, tt.wantBPP)
+			}
+			if info.DecodedSize != tt.wantDecoded {
+				t.Errorf("DecodedSize: got=%d, want=%d", info.DecodedSize, tt.wantDecoded)
+			}
+			if info.CompressionRatio != 1.0 {
+				t.Errorf("CompressionRatio: got=%f, want=1.0", info.CompressionRatio)
+			}
+		})
+	}
+
+	t.Run("SizeMismatch", func(t *testing.T) {
+		spec, _ := parseRawSpec("4x4:RGB:8")
+		filename := filepath.Join(tmpDir, "short.raw")
+		if err := os.WriteFile(filename, make([]byte, 10), 0644); err != nil {
+			t.Fatalf("Failed to write raw file: %v", err)
+		}
+
+		info, err := analyzeRaw(filename, spec, nil)
+		if err != nil {
+			t.Fatalf("analyzeRaw failed: %v", err)
+		}
+		if info.OriginalSize != 10 || info.DecodedSize != 48 {
+			t.Errorf("Unexpected sizes: original=%d decoded=%d", info.OriginalSize, info.DecodedSize)
+		}
+		if !strings.Contains(info.Warning, "needs 48 bytes") {
+			t.Errorf("Expected size mismatch warning, got %q", info.Warning)
+		}
+	})
+
+	t.Run("InvalidSpecs", func(t *testing.T) {
+		for _, spec := range []string{"", "1920x1080", "1920x1080:RGB", "0x10:RGB:8", "axb:RGB:8", "10x10:CMYK:8", "10x10:RGB:12"} {
+			if _, err := parseRawSpec(spec); err == nil {
+				t.Errorf("Expected error for raw spec %q", spec)
+			}
+		}
+	})
+}
+
+func TestHEIFChannelBitDepths(t *testing.T) {
+	pixi := func(depths ...byte) []byte {
+		return heifBox("pixi", append([]byte{0, 0, 0, 0, byte(len(depths))}, depths...))
+	}
+
+	t.Run("Mixed", func(t *testing.T) {
+		meta := &heifMetadata{BitDepth: 8}
+		parseIpcoBox(pixi(8, 8, 10), meta)
+		applyHEIFItemProperties(meta)
+
+		if meta.BitDepth != 10 {
+			t.Errorf("BitDepth should be the widest channel: got=%d, want=10", meta.BitDepth)
+		}
+		if fmt.Sprint(meta.ChannelBitDepths) != "[8 8 10]" {
+			t.Errorf("ChannelBitDepths: got=%v, want=[8 8 10]", meta.ChannelBitDepths)
+		}
+		if uniformBitDepth(meta.ChannelBitDepths) {
+			t.Error("Expected mixed channel depths to be non-uniform")
+		}
+
+		info := &ImageInfo{Width: 10, Height: 10, ColorModel: ColorModelRGB, BitDepth: meta.BitDepth}
+		if got := calculateBytesPerPixel(info); got != 6 {
+			t.Errorf("Expected conservative 16-bit storage per channel: got=%d bytes, want=6", got)
+		}
+	})
+
+	t.Run("Uniform", func(t *testing.T) {
+		meta := &heifMetadata{BitDepth: 8}
+		parseIpcoBox(pixi(10, 10, 10), meta)
+		applyHEIFItemProperties(meta)
+
+		if meta.BitDepth != 10 || !uniformBitDepth(meta.ChannelBitDepths) {
+			t.Errorf("Unexpected result: depth=%d channels=%v", meta.BitDepth, meta.ChannelBitDepths)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		meta := &heifMetadata{BitDepth: 8}
+		parseIpcoBox(heifBox("pixi", []byte{0, 0, 0, 0, 3, 10}), meta)
+		applyHEIFItemProperties(meta)
+
+		if meta.BitDepth != 8 || meta.ChannelBitDepths != nil {
+			t.Errorf("Truncated pixi should be ignored: depth=%d channels=%v", meta.BitDepth, meta.ChannelBitDepths)
+		}
+	})
+
+	t.Run("PrimaryItemAssociation", func(t *testing.T) {
+		ipma := []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 1, 0x81, 0, 2, 1, 0x82}
+		metaBox := append([]byte{0, 0, 0, 0}, heifBox("pitm", []byte{0, 0, 0, 0, 0, 1})...)
+		metaBox = append(metaBox, heifBox("iprp", heifBox("ipco", pixi(10, 10, 10), pixi(8)), heifBox("ipma", ipma))...)
+
+		meta := &heifMetadata{BitDepth: 8}
+		parseMetaBox(metaBox, meta)
+
+		if meta.BitDepth != 10 || fmt.Sprint(meta.ChannelBitDepths) != "[10 10 10]" {
+			t.Errorf("Expected the primary item's pixi, got depth=%d channels=%v", meta.BitDepth, meta.ChannelBitDepths)
+		}
+	})
+
+	t.Run("AnalyzeHEIF", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(createMinimalHEIFMetadata(1, 1, 8, false)), image.Config{}, info)
+		if !info.UniformBitDepth || len(info.ChannelBitDepths) != 3 {
+			t.Errorf("Expected uniform 3-channel depths, got uniform=%v channels=%v", info.UniformBitDepth, info.ChannelBitDepths)
+		}
+	})
+}
+
+func TestXMPDetection(t *testing.T) {
+	packet := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"/></x:xmpmeta>`)
+
+	t.Run("JPEG", func(t *testing.T) {
+		base := createMinimalJPEGData(64, 64, 2, 2, 1, 1, 8)
+
+		var app1 bytes.Buffer
+		app1.Write([]byte{0xFF, 0xE1})
+		_ = binary.Write(&app1, binary.BigEndian, uint16(2+len(jpegXMPHeader)+len(packet)))
+		app1.WriteString(jpegXMPHeader)
+		app1.Write(packet)
+
+		data := append(append(append([]byte{}, base[:2]...), app1.Bytes()...), base[2:]...)
+
+		if got := scanJPEGMarkers(bytes.NewReader(data)).XMP; !bytes.Equal(got, packet) {
+			t.Errorf("scanJPEGMarkers XMP: got %q", got)
+		}
+
+		info := &ImageInfo{}
+		analyzeJPEG(bytes.NewReader(data), image.Config{}, info)
+		if !info.HasXMP || info.XMPSize != len(packet) {
+			t.Errorf("Expected XMP of %d bytes, got HasXMP=%v size=%d", len(packet), info.HasXMP, info.XMPSize)
+		}
+
+		if got := scanJPEGMarkers(bytes.NewReader(base)).XMP; got != nil {
+			t.Errorf("Expected no XMP in plain JPEG, got %q", got)
+		}
+	})
+
+	t.Run("JPEGExifIsNotXMP", func(t *testing.T) {
+		base := createMinimalJPEGData(64, 64, 2, 2, 1, 1, 8)
+		exif := []byte{0xFF, 0xE1, 0x00, 0x08, 'E', 'x', 'i', 'f', 0, 0}
+		data := append(append(append([]byte{}, base[:2]...), exif...), base[2:]...)
+
+		if got := scanJPEGMarkers(bytes.NewReader(data)).XMP; got != nil {
+			t.Errorf("Exif APP1 should not be reported as XMP, got %q", got)
+		}
+	})
+
+	t.Run("PNG", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+
+		itxt := append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), packet...)
+		data := insertPNGChunk(buf.Bytes(), "iTXt", itxt)
+		if got := scanPNGChunks(bytes.NewReader(data)).XMP; !bytes.Equal(got, packet) {
+			t.Errorf("scanPNGChunks XMP: got %q", got)
+		}
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		_, _ = zw.Write(packet)
+		_ = zw.Close()
+		itxt = append([]byte(pngXMPKeyword+"\x00\x01\x00en\x00\x00"), compressed.Bytes()...)
+		data = insertPNGChunk(buf.Bytes(), "iTXt", itxt)
+		if got := scanPNGChunks(bytes.NewReader(data)).XMP; !bytes.Equal(got, packet) {
+			t.Errorf("scanPNGChunks XMP (compressed): got %q", got)
+		}
+
+		other := insertPNGChunk(buf.Bytes(), "iTXt", []byte("Comment\x00\x00\x00\x00\x00hello"))
+		if got := scanPNGChunks(bytes.NewReader(other)).XMP; got != nil {
+			t.Errorf("Expected no XMP for unrelated iTXt, got %q", got)
+		}
+	})
+
+	t.Run("HEIF", func(t *testing.T) {
+		var ftyp bytes.Buffer
+		ftyp.WriteString("heic")
+		_ = binary.Write(&ftyp, binary.BigEndian, uint32(0))
+		ftyp.WriteString("mif1")
+
+		var infe bytes.Buffer
+		infe.Write([]byte{2, 0, 0, 0})
+		_ = binary.Write(&infe, binary.BigEndian, uint16(2))
+		_ = binary.Write(&infe, binary.BigEndian, uint16(0))
+		infe.WriteString("mime\x00application/rdf+xml\x00")
+
+		var iinf bytes.Buffer
+		iinf.Write([]byte{0, 0, 0, 0})
+		_ = binary.Write(&iinf, binary.BigEndian, uint16(2))
+		iinf.Write(heifInfe(1, "hvc1"))
+		iinf.Write(heifBox("infe", infe.Bytes()))
+
+		var iloc bytes.Buffer
+		iloc.Write([]byte{1, 0, 0, 0, 0x44, 0x00})
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(1))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(2))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(1))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(0))
+		_ = binary.Write(&iloc, binary.BigEndian, uint16(1))
+		_ = binary.Write(&iloc, binary.BigEndian, uint32(0))
+		_ = binary.Write(&iloc, binary.BigEndian, uint32(len(packet)))
+
+		var data bytes.Buffer
+		data.Write(heifBox("ftyp", ftyp.Bytes()))
+		data.Write(heifBox("meta", []byte{0, 0, 0, 0}, heifBox("iinf", iinf.Bytes()), heifBox("iloc", iloc.Bytes()), heifBox("idat", packet)))
+
+		meta := parseHEIFMetadata(bytes.NewReader(data.Bytes()))
+		if !bytes.Equal(meta.XMP, packet) {
+			t.Errorf("Expected HEIF XMP item payload, got %q", meta.XMP)
+		}
+		if got := readXMP(bytes.NewReader(data.Bytes())); !bytes.Equal(got, packet) {
+			t.Errorf("readXMP: got %q", got)
+		}
+	})
+
+	t.Run("Extract", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		filename := filepath.Join(t.TempDir(), "xmp.png")
+		data := insertPNGChunk(buf.Bytes(), "iTXt", append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), packet...))
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatalf("Failed to write PNG: %v", err)
+		}
+
+		info, err := estimateDecodedSize(filename, Options{Quiet: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		if !info.HasXMP || info.XMPSize != len(packet) {
+			t.Errorf("Expected XMP of %d bytes, got HasXMP=%v size=%d", len(packet), info.HasXMP, info.XMPSize)
+		}
+
+		var out bytes.Buffer
+		if err := extractXMP(filename, &out); err != nil {
+			t.Fatalf("extractXMP failed: %v", err)
+		}
+		if !bytes.Equal(bytes.TrimSuffix(out.Bytes(), []byte("\n")), packet) {
+			t.Errorf("Extracted XMP mismatch: %q", out.String())
+		}
+	})
+}
+
+func TestTruncatedFiles(t *testing.T) {
+	t.Run("WebPShortRIFF", func(t *testing.T) {
+		data := append(createWebPData("VP8L"), make([]byte, 20)...)
+		binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8+500))
+
+		info := &ImageInfo{}
+		analyzeWebP(bytes.NewReader(data), image.Config{}, info)
+		if !info.Truncated || info.MissingBytes != 500 {
+			t.Errorf("Expected 500 missing bytes, got Truncated=%v MissingBytes=%d", info.Truncated, info.MissingBytes)
+		}
+	})
+
+	t.Run("WebPComplete", func(t *testing.T) {
+		data := append(createWebPData("VP8L"), make([]byte, 20)...)
+		binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+
+		if missing := detectWebPMissingBytes(bytes.NewReader(data)); missing != 0 {
+			t.Errorf("Expected complete WebP, got %d missing bytes", missing)
+		}
+	})
+
+	t.Run("HEIFShortMdat", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Write(createMinimalHEIFMetadata(1, 1, 8, false))
+		_ = binary.Write(&buf, binary.BigEndian, uint32(8+4096))
+		buf.WriteString("mdat")
+		buf.Write(make([]byte, 1000))
+
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(buf.Bytes()), image.Config{}, info)
+		if !info.Truncated || info.MissingBytes != 3096 {
+			t.Errorf("Expected 3096 missing bytes, got Truncated=%v MissingBytes=%d", info.Truncated, info.MissingBytes)
+		}
+	})
+
+	t.Run("HEIFComplete", func(t *testing.T) {
+		meta := parseHEIFMetadata(bytes.NewReader(createMinimalHEIFMetadata(1, 1, 8, false)))
+		if meta.MissingBytes != 0 {
+			t.Errorf("Expected complete HEIF, got %d missing bytes", meta.MissingBytes)
+		}
+	})
+}
+
+func TestZeroDimensionImages(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		originalSize  int64
+	}{
+		{"ZeroByZero", 0, 0, 0},
+		{"ZeroWidth", 0, 16, 128},
+		{"ZeroHeight", 16, 0, 128},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &ImageInfo{Format: "ico", Width: tt.width, Height: tt.height, ColorModel: ColorModelRGB, BitDepth: 8}
+			applySizeEstimate(info, tt.originalSize, []int{320}, sizeScope{}, "")
+
+			if info.DecodedSize != 0 || info.CompressionRatio != 0 || info.BitsPerPixelStored != 0 {
+				t.Errorf("Expected zero sizes, got decoded=%d ratio=%f stored=%f", info.DecodedSize, info.CompressionRatio, info.BitsPerPixelStored)
+			}
+			if !strings.Contains(info.Warning, "zero-dimension") {
+				t.Errorf("Expected zero-dimension warning, got %q", info.Warning)
+			}
+			if _, err := json.Marshal(info); err != nil {
+				t.Errorf("Zero-dimension info should marshal to JSON: %v", err)
+			}
+		})
+	}
+
+	t.Run("MultipleWarnings", func(t *testing.T) {
+		info := &ImageInfo{}
+		addWarning(info, "first")
+		addWarning(info, "second")
+		if info.Warning != "first; second" {
+			t.Errorf("Unexpected warning: %q", info.Warning)
+		}
+	})
+}
+
+func TestExitOnWarning(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	data := append(createWebPData("VP8L"), make([]byte, 20)...)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8+64))
+	truncated := &ImageInfo{}
+	analyzeWebP(bytes.NewReader(data), image.Config{}, truncated)
+	if !strings.Contains(truncated.Warning, "truncated (64 bytes missing)") {
+		t.Errorf("Expected truncation warning, got %q", truncated.Warning)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	filename := filepath.Join(tmpDir, "clean.png")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+	clean, err := estimateDecodedSize(filename, Options{Quiet: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+
+	if hasWarnings([]*ImageInfo{clean}) {
+		t.Errorf("Clean PNG should not carry a warning, got %q", clean.Warning)
+	}
+	if !hasWarnings([]*ImageInfo{clean, truncated}) {
+		t.Error("Expected warnings to be detected when any image carries one")
+	}
+	if hasWarnings(nil) {
+		t.Error("No results should mean no warnings")
+	}
+}
+
+func TestRunFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	filename := filepath.Join(tmpDir, "image.png")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+
+	t.Run("Sidecar", func(t *testing.T) {
+		var code int
+		output := captureStdout(t, func() {
+			code = runFiles([]string{filename}, Options{Quiet: true, Sidecar: true})
+		})
+		if code != ExitSuccess {
+			t.Fatalf("Expected exit code %d, got %d", ExitSuccess, code)
+		}
+		if output != "" {
+			t.Errorf("Expected no stdout with -quiet, got %q", output)
+		}
+		data, err := os.ReadFile(filename + ".json")
+		if err != nil {
+			t.Fatalf("Expected sidecar file: %v", err)
+		}
+		var info map[string]interface{}
+		if err := json.Unmarshal(data, &info); err != nil {
+			t.Fatalf("Invalid sidecar JSON: %v", err)
+		}
+		if info["width"] != float64(8) || info["height"] != float64(8) {
+			t.Errorf("Expected 8x8 in sidecar, got %vx%v", info["width"], info["height"])
+		}
+	})
+
+	t.Run("WarnAvgRatio", func(t *testing.T) {
+		var code int
+		captureStdout(t, func() {
+			code = runFiles([]string{filename}, Options{Quiet: true, WarnAvgRatio: 1000})
+		})
+		if code != ExitWarning {
+			t.Errorf("Expected exit code %d, got %d", ExitWarning, code)
+		}
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		var code int
+		captureStdout(t, func() {
+			code = runFiles([]string{filepath.Join(tmpDir, "missing.png")}, Options{Quiet: true})
+		})
+		if code == ExitSuccess {
+			t.Error("Expected a failing exit code for a missing file")
+		}
+	})
+
+	t.Run("SummaryJSON", func(t *testing.T) {
+		var code int
+		output := captureStdout(t, func() {
+			code = runFiles([]string{filename, filepath.Join(tmpDir, "missing.png")}, Options{JSONOutput: true, SummaryJSON: true})
+		})
+		if code != ExitFileNotFound {
+			t.Errorf("Expected exit code %d for the missing file, got %d", ExitFileNotFound, code)
+		}
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(output), &doc); err != nil {
+			t.Fatalf("Expected a single JSON object, got %q (%v)", output, err)
+		}
+		if _, ok := doc["images"]; ok {
+			t.Errorf("Expected no per-image results, got %s", output)
+		}
+		var summary RunSummary
+		if err := json.Unmarshal(doc["summary"], &summary); err != nil {
+			t.Fatalf("Expected a summary key, got %s (%v)", output, err)
+		}
+		if summary.Images != 1 || summary.Failures != 1 || summary.ByFormat["png"].Count != 1 {
+			t.Errorf("Unexpected summary: %+v", summary)
+		}
+		if strings.Contains(output, "image.png") {
+			t.Errorf("Expected no per-image output, got %s", output)
+		}
+	})
+
+	t.Run("JSONArray", func(t *testing.T) {
+		var code int
+		output := captureStdout(t, func() {
+			code = runFiles([]string{filename}, Options{JSONArray: true, CompactJSON: true, Histogram: true})
+		})
+		if code != ExitSuccess {
+			t.Fatalf("Expected exit code %d, got %d", ExitSuccess, code)
+		}
+		var elements []map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(output), &elements); err != nil {
+			t.Fatalf("Invalid JSON array output: %v\n%s", err, output)
+		}
+		if len(elements) != 2 {
+			t.Fatalf("Expected an image and a summary element, got %d", len(elements))
+		}
+		if _, ok := elements[0]["filename"]; !ok {
+			t.Errorf("Expected the first element to be the image, got %v", elements[0])
+		}
+		if !strings.Contains(string(elements[1]["summary"]), `"histogram"`) {
+			t.Errorf("Expected histogram in summary, got %s", elements[1]["summary"])
+		}
+	})
+}
+
+func createHEIFSequenceData(brand, handler string, width, height, frames uint32) []byte {
+	var ftyp bytes.Buffer
+	ftyp.WriteString(brand)
+	_ = binary.Write(&ftyp, binary.BigEndian, uint32(0))
+	ftyp.WriteString("msf1")
+	ftyp.WriteString("iso8")
+
+	var tkhd bytes.Buffer
+	tkhd.Write(make([]byte, 76))
+	_ = binary.Write(&tkhd, binary.BigEndian, width<<16)
+	_ = binary.Write(&tkhd, binary.BigEndian, height<<16)
+
+	var hdlr bytes.Buffer
+	hdlr.Write(make([]byte, 8))
+	hdlr.WriteString(handler)
+	hdlr.Write(make([]byte, 13))
+
+	var stsz bytes.Buffer
+	stsz.Write(make([]byte, 8))
+	_ = binary.Write(&stsz, binary.BigEndian, frames)
+
+	trak := heifBox("trak",
+		heifBox("tkhd", tkhd.Bytes()),
+		heifBox("mdia", heifBox("hdlr", hdlr.Bytes()), heifBox("minf", heifBox("stbl", heifBox("stsz", stsz.Bytes())))),
+	)
+
+	var buf bytes.Buffer
+	buf.Write(heifBox("ftyp", ftyp.Bytes()))
+	buf.Write(heifBox("moov", heifBox("mvhd", make([]byte, 100)), trak))
+	buf.Write(heifBox("mdat", make([]byte, 256)))
+	return buf.Bytes()
+}
+
+func TestHEIFSequences(t *testing.T) {
+	t.Run("AVIS", func(t *testing.T) {
+		data := createHEIFSequenceData("avis", "pict", 640, 480, 24)
+
+		meta := parseHEIFMetadata(bytes.NewReader(data))
+		if meta.FrameCount != 24 {
+			t.Errorf("FrameCount: got=%d, want=24", meta.FrameCount)
+		}
+		if meta.Width != 640 || meta.Height != 480 {
+			t.Errorf("Dimensions: got=%dx%d, want=640x480", meta.Width, meta.Height)
+		}
+		if meta.Codec != "AV1" {
+			t.Errorf("Codec: got=%q, want=AV1", meta.Codec)
+		}
+
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("DecodeConfig failed: %v", err)
+		}
+		if format != "avif" || config.Width != 640 || config.Height != 480 {
+			t.Errorf("DecodeConfig: got %s %dx%d", format, config.Width, config.Height)
+		}
+	})
+
+	t.Run("MSF1", func(t *testing.T) {
+		data := createHEIFSequenceData("msf1", "vide", 320, 240, 5)
+
+		_, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("DecodeConfig failed: %v", err)
+		}
+		if format != "heif" {
+			t.Errorf("Format: got=%s, want=heif", format)
+		}
+		if meta := parseHEIFMetadata(bytes.NewReader(data)); meta.FrameCount != 5 {
+			t.Errorf("FrameCount: got=%d, want=5", meta.FrameCount)
+		}
+	})
+
+	t.Run("NonVisualTrackIgnored", func(t *testing.T) {
+		data := createHEIFSequenceData("avis", "soun", 0, 0, 100)
+		if meta := parseHEIFMetadata(bytes.NewReader(data)); meta.FrameCount != 0 {
+			t.Errorf("Audio track should not set FrameCount, got %d", meta.FrameCount)
+		}
+	})
+
+	t.Run("AllFrames", func(t *testing.T) {
+		data := createHEIFSequenceData("avis", "pict", 64, 32, 10)
+
+		single := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(data), image.Config{}, single)
+		applySizeEstimate(single, int64(len(data)), nil, sizeScope{}, "")
+
+		all := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(data), image.Config{}, all)
+		applySizeEstimate(all, int64(len(data)), nil, sizeScope{allFrames: true}, "")
+
+		if single.FrameCount != 10 || single.DecodedSize == 0 {
+			t.Fatalf("Unexpected single-frame info: frames=%d decoded=%d", single.FrameCount, single.DecodedSize)
+		}
+		if all.DecodedSize != 10*single.DecodedSize {
+			t.Errorf("Expected all-frames size to be 10x single frame: got=%d, single=%d", all.DecodedSize, single.DecodedSize)
+		}
+	})
+}
+
+func TestSidecar(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(12, 10)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	filename := filepath.Join(tmpDir, "image.png")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Quiet: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if err := writeSidecar(info, false, nil, ""); err != nil {
+		t.Fatalf("writeSidecar failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filename + ".json")
+	if err != nil {
+		t.Fatalf("Expected sidecar next to image: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Sidecar is not valid JSON: %v", err)
+	}
+	if decoded["filename"] != filename || decoded["width"] != float64(12) {
+		t.Errorf("Unexpected sidecar content: %s", data)
+	}
+
+	t.Run("WriteError", func(t *testing.T) {
+		missing := &ImageInfo{Filename: filepath.Join(tmpDir, "missing-dir", "image.png")}
+		err := writeSidecar(missing, false, nil, "")
+		if err == nil || !strings.Contains(err.Error(), "sidecar") {
+			t.Errorf("Expected sidecar write error, got %v", err)
+		}
+	})
+}
+
+func TestNamedPipeInput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("named pipes are not supported on Windows")
+	}
+	mkfifo, err := exec.LookPath("mkfifo")
+	if err != nil {
+		t.Skip("mkfifo not available")
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(20, 10)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	fifo := filepath.Join(t.TempDir(), "stream.png")
+	if out, err := exec.Command(mkfifo, fifo).CombinedOutput(); err != nil {
+		t.Skipf("mkfifo failed: %v (%s)", err, out)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- os.WriteFile(fifo, buf.Bytes(), 0644)
+	}()
+
+	info, err := estimateDecodedSize(fifo, Options{Quiet: true, DecodeTime: true, HashAlgorithm: "sha256"})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed on FIFO: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("Failed to write to FIFO: %v", err)
+	}
+
+	if info.Width != 20 || info.Height != 10 {
+		t.Errorf("Dimensions: got=%dx%d, want=20x10", info.Width, info.Height)
+	}
+	if info.OriginalSize != int64(buf.Len()) {
+		t.Errorf("OriginalSize: got=%d, want=%d", info.OriginalSize, buf.Len())
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if want := hex.EncodeToString(sum[:]); info.ContentHash != want {
+		t.Errorf("ContentHash should cover the buffered stream: got=%s, want=%s", info.ContentHash, want)
+	}
+	if info.DecodeDurationMs <= 0 {
+		t.Error("Expected decode time to be measured from the buffered stream")
+	}
+}
+
+func TestCICPValues(t *testing.T) {
+	t.Run("HEIF_BT2020_PQ", func(t *testing.T) {
+		var nclx bytes.Buffer
+		nclx.WriteString("nclx")
+		_ = binary.Write(&nclx, binary.BigEndian, uint16(9))
+		_ = binary.Write(&nclx, binary.BigEndian, uint16(16))
+		_ = binary.Write(&nclx, binary.BigEndian, uint16(9))
+		nclx.WriteByte(0x80)
+
+		meta := &heifMetadata{}
+		parseIpcoBox(heifBox("colr", nclx.Bytes()), meta)
+		applyHEIFItemProperties(meta)
+
+		want := CICPValues{ColorPrimaries: 9, TransferCharacteristics: 16, MatrixCoefficients: 9, FullRange: true}
+		if meta.CICP == nil || *meta.CICP != want {
+			t.Fatalf("CICP: got=%+v, want=%+v", meta.CICP, want)
+		}
+		if meta.ColorSpace != ColorSpaceBT2020 || meta.HDRType != HDRPQ {
+			t.Errorf("Friendly mapping should be unchanged: %s / %s", meta.ColorSpace, meta.HDRType)
+		}
+	})
+
+	t.Run("HEIF_PreservesUnmappedCodes", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(createMinimalHEIFMetadata(22, 14, 8, false)), image.Config{}, info)
+
+		if info.CICP == nil || info.CICP.ColorPrimaries != 22 || info.CICP.TransferCharacteristics != 14 || info.CICP.MatrixCoefficients != 1 {
+			t.Errorf("Expected raw codes 22/14/1, got %+v", info.CICP)
+		}
+		if info.CICP != nil && info.CICP.FullRange {
+			t.Error("Expected limited range")
+		}
+	})
+
+	t.Run("PNG_cICP", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(4, 4)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		data := insertPNGChunk(buf.Bytes(), "cICP", []byte{9, 16, 0, 1})
+
+		want := CICPValues{ColorPrimaries: 9, TransferCharacteristics: 16, MatrixCoefficients: 0, FullRange: true}
+		if got := scanPNGChunks(bytes.NewReader(data)).CICP; got == nil || *got != want {
+			t.Errorf("PNG cICP: got=%+v, want=%+v", got, want)
+		}
+		if got := scanPNGChunks(bytes.NewReader(buf.Bytes())).CICP; got != nil {
+			t.Errorf("Expected no CICP without cICP chunk, got %+v", got)
+		}
+	})
+}
+
+func TestFieldSelection(t *testing.T) {
+	fields, err := parseFields("filename, width,height,decoded_size_bytes")
+	if err != nil {
+		t.Fatalf("parseFields failed: %v", err)
+	}
+
+	info := &ImageInfo{Filename: "a.png", Format: "png", Width: 640, Height: 480, DecodedSize: 1228800, HasAlpha: true}
+
+	var buf bytes.Buffer
+	if err := writeSelectedJSON(&buf, info, fields, true); err != nil {
+		t.Fatalf("writeSelectedJSON failed: %v", err)
+	}
+	want := `{"filename":"a.png","width":640,"height":480,"decoded_size_bytes":1228800}`
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Errorf("Selected JSON:\n got=%s\nwant=%s", got, want)
+	}
+
+	buf.Reset()
+	if err := writeSelectedJSON(&buf, info, fields, false); err != nil {
+		t.Fatalf("writeSelectedJSON failed: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Indented selection is not valid JSON: %v", err)
+	}
+	if len(decoded) != 4 || decoded["width"] != float64(640) {
+		t.Errorf("Unexpected indented selection: %v", decoded)
+	}
+
+	t.Run("AllFieldsWhenEmpty", func(t *testing.T) {
+		selected, err := selectFields(info, nil)
+		if err != nil || selected != info {
+			t.Errorf("Expected the full ImageInfo without a selection, got %v (%v)", selected, err)
+		}
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		if _, err := parseFields("filename,bogus"); err == nil || !strings.Contains(err.Error(), "bogus") {
+			t.Errorf("Expected unknown field error, got %v", err)
+		}
+	})
+
+	t.Run("Archive", func(t *testing.T) {
+		var pngData bytes.Buffer
+		if err := png.Encode(&pngData, generateRGBAImage(8, 4)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		var zipData bytes.Buffer
+		zw := zip.NewWriter(&zipData)
+		w, _ := zw.Create("a.png")
+		_, _ = w.Write(pngData.Bytes())
+		_ = zw.Close()
+
+		archive := filepath.Join(t.TempDir(), "images.zip")
+		if err := os.WriteFile(archive, zipData.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write archive: %v", err)
+		}
+
+		output := captureStdout(t, func() {
+			if _, err := estimateArchive(archive, Options{JSONOutput: true, Fields: []string{"width"}}); err != nil {
+				t.Fatalf("estimateArchive failed: %v", err)
+			}
+		})
+
+		var entries []map[string]interface{}
+		if err := json.Unmarshal([]byte(output), &entries); err != nil {
+			t.Fatalf("Invalid JSON output: %v\n%s", err, output)
+		}
+		if len(entries) != 1 || len(entries[0]) != 1 || entries[0]["width"] != float64(8) {
+			t.Errorf("Unexpected archive selection: %v", entries)
+		}
+	})
+}
+
+func TestWebPCanvasSize(t *testing.T) {
+	canvas := func(flags byte, width, height int) []byte {
+		w, h := width-1, height-1
+		return webpChunk("VP8X", []byte{flags, 0, 0, 0, byte(w), byte(w >> 8), byte(w >> 16), byte(h), byte(h >> 8), byte(h >> 16)})
+	}
+
+	frame := make([]byte, 16)
+	frame = append(frame, webpChunk("VP8L", vp8lPayload(100, 80, false))...)
+
+	data := createWebPFile(
+		canvas(0x02, 4000, 300),
+		webpChunk("ANIM", make([]byte, 6)),
+		webpChunk("ANMF", frame),
+	)
+
+	features := detectWebPFormat(bytes.NewReader(data))
+	if features.CanvasWidth != 4000 || features.CanvasHeight != 300 {
+		t.Errorf("Canvas: got=%dx%d, want=4000x300", features.CanvasWidth, features.CanvasHeight)
+	}
+
+	info := &ImageInfo{Width: 100, Height: 80}
+	analyzeWebP(bytes.NewReader(data), image.Config{Width: 100, Height: 80, ColorModel: color.NRGBAModel}, info)
+	if info.Width != 4000 || info.Height != 300 {
+		t.Errorf("Expected canvas to override first frame size, got %dx%d", info.Width, info.Height)
+	}
+
+	t.Run("SimpleFormatKeepsFrameSize", func(t *testing.T) {
+		simple := createWebPFile(webpChunk("VP8L", vp8lPayload(100, 80, false)))
+		info := &ImageInfo{Width: 100, Height: 80}
+		analyzeWebP(bytes.NewReader(simple), image.Config{Width: 100, Height: 80, ColorModel: color.NRGBAModel}, info)
+		if info.Width != 100 || info.Height != 80 {
+			t.Errorf("Expected frame size without VP8X, got %dx%d", info.Width, info.Height)
+		}
+	})
+}
+
+func TestProfiling(t *testing.T) {
+	tmpDir := t.TempDir()
+	cpuPath := filepath.Join(tmpDir, "cpu.prof")
+	memPath := filepath.Join(tmpDir, "mem.prof")
+
+	stop, err := startProfiling(cpuPath, memPath)
+	if err != nil {
+		t.Fatalf("startProfiling failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(64, 64)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	if _, err := analyzeReader(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("analyzeReader failed: %v", err)
+	}
+
+	stop()
+	stop()
+
+	for _, path := range []string{cpuPath, memPath} {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Expected profile %s: %v", path, err)
+		}
+		if stat.Size() == 0 {
+			t.Errorf("Profile %s is empty", path)
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		stop, err := startProfiling("", "")
+		if err != nil {
+			t.Fatalf("startProfiling failed: %v", err)
+		}
+		stop()
+	})
+
+	t.Run("BadPath", func(t *testing.T) {
+		if _, err := startProfiling(filepath.Join(tmpDir, "missing", "cpu.prof"), ""); err == nil {
+			t.Error("Expected error for unwritable CPU profile path")
+		}
+	})
+}
+
+func TestBudgets(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	budgetPath := filepath.Join(tmpDir, "budget.csv")
+	csvData := "format,max_decoded_bytes\n# lossless formats\npng, 4096\nJPEG,1000000\n"
+	if err := os.WriteFile(budgetPath, []byte(csvData), 0644); err != nil {
+		t.Fatalf("Failed to write budget CSV: %v", err)
+	}
+
+	budgets, err := readBudgets(budgetPath)
+	if err != nil {
+		t.Fatalf("readBudgets failed: %v", err)
+	}
+	if budgets["png"] != 4096 || budgets["jpeg"] != 1000000 || len(budgets) != 2 {
+		t.Fatalf("Unexpected budgets: %v", budgets)
+	}
+
+	writePNG := func(name string, width, height int) string {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, generateRGBAImage(width, height)); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		filename := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write PNG: %v", err)
+		}
+		return filename
+	}
+
+	small, err := estimateDecodedSize(writePNG("small.png", 16, 16), Options{Quiet: true, Budgets: budgets})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if small.BudgetExceeded || small.Warning != "" {
+		t.Errorf("1 KiB image should be within budget: exceeded=%v warning=%q", small.BudgetExceeded, small.Warning)
+	}
+
+	large, err := estimateDecodedSize(writePNG("large.png", 64, 64), Options{Quiet: true, Budgets: budgets})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if !large.BudgetExceeded || !strings.Contains(large.Warning, "png budget of 4096 bytes") {
+		t.Errorf("16 KiB image should exceed budget: exceeded=%v warning=%q", large.BudgetExceeded, large.Warning)
+	}
+
+	t.Run("InvalidLimit", func(t *testing.T) {
+		path := filepath.Join(tmpDir, "bad.csv")
+		if err := os.WriteFile(path, []byte("png,100\nwebp,lots\n"), 0644); err != nil {
+			t.Fatalf("Failed to write CSV: %v", err)
+		}
+		if _, err := readBudgets(path); err == nil {
+			t.Error("Expected error for non-numeric limit")
+		}
+	})
+}
+
+func TestEffectivelyGrayscale(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	writePNG := func(name string, img image.Image) string {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		filename := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write PNG: %v", err)
+		}
+		return filename
+	}
+
+	grayRamp := func() *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				v := uint8(x * 8)
+				img.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+			}
+		}
+		return img
+	}
+
+	tinted := grayRamp()
+	tinted.Set(31, 31, color.RGBA{R: 200, G: 201, B: 200, A: 255})
+
+	tests := []struct {
+		name string
+		img  image.Image
+		want bool
+	}{
+		{"EqualChannels", grayRamp(), true},
+		{"SinglePixelTint", tinted, false},
+		{"Colorful", generateRGBAImage(32, 32), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writePNG(tt.name+".png", tt.img)
+			info, err := estimateDecodedSize(filename, Options{Quiet: true, DetectGrayscale: true})
+			if err != nil {
+				t.Fatalf("estimateDecodedSize failed: %v", err)
+			}
+			if info.ColorModel != ColorModelRGB {
+				t.Fatalf("Expected RGB storage, got %s", info.ColorModel)
+			}
+			if info.EffectivelyGrayscale != tt.want {
+				t.Errorf("EffectivelyGrayscale: got=%v, want=%v", info.EffectivelyGrayscale, tt.want)
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		info, err := estimateDecodedSize(writePNG("off.png", grayRamp()), Options{Quiet: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		if info.EffectivelyGrayscale {
+			t.Error("Expected no grayscale detection without the flag")
+		}
+	})
+}
+
+func TestErrorsOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	valid := filepath.Join(tmpDir, "valid.png")
+	file, err := os.Create(valid)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = png.Encode(file, generateRGBAImage(10, 10))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	corrupt := filepath.Join(tmpDir, "corrupt.png")
+	if err := os.WriteFile(corrupt, []byte("\x89PNG\r\n\x1a\nnot really a png"), 0644); err != nil {
+		t.Fatalf("Failed to write corrupt file: %v", err)
+	}
+
+	files := []string{valid, corrupt}
+	output := captureStdout(t, func() {
+		failures := processFiles(files, func(filename string) error {
+			_, err := estimateDecodedSize(filename, Options{Quiet: true})
+			return err
+		})
+		if len(failures) != 1 {
+			t.Errorf("Expected 1 failure, got %d", len(failures))
+		}
+		reportFailures(failures, len(files) > 1, true)
+	})
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected exactly one output line, got %d: %q", len(lines), output)
+	}
+	if strings.Contains(output, "valid.png") {
+		t.Errorf("Expected successful file to be suppressed, got %q", output)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Expected a JSON error object, got %q: %v", lines[0], err)
+	}
+	if message, _ := entry["error"].(string); !strings.HasPrefix(message, corrupt+": ") {
+		t.Errorf("Expected error prefixed with the corrupt filename, got %q", message)
+	}
+	if code, _ := entry["exit_code"].(float64); int(code) != ExitProcessingError {
+		t.Errorf("Unexpected exit code %v", entry["exit_code"])
+	}
+}
+
+func TestCountColors(t *testing.T) {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{R: uint8(i), G: uint8(255 - i), B: 0, A: 255}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetColorIndex(x, y, uint8((x/6)*100))
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "three.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = png.Encode(file, img)
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Quiet: true, CountColors: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.ColorModel != ColorModelIndexed {
+		t.Fatalf("Expected indexed color model, got %s", info.ColorModel)
+	}
+	if info.DistinctColors != 3 {
+		t.Errorf("DistinctColors: got=%d, want=3", info.DistinctColors)
+	}
+
+	info, err = estimateDecodedSize(filename, Options{Quiet: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.DistinctColors != 0 {
+		t.Errorf("Expected no color count without the flag, got %d", info.DistinctColors)
+	}
+}
+
+func TestDetectionConfidence(t *testing.T) {
+	var ftyp bytes.Buffer
+	ftyp.WriteString("heic")
+	_ = binary.Write(&ftyp, binary.BigEndian, uint32(0))
+	ftyp.WriteString("mif1")
+	defaultPath := heifBox("ftyp", ftyp.Bytes())
+
+	tests := []struct {
+		name string
+		data []byte
+		want map[string]string
+	}{
+		{
+			name: "DefaultPath",
+			data: defaultPath,
+			want: map[string]string{
+				"color_space":        ConfidenceDefault,
+				"bit_depth":          ConfidenceDefault,
+				"chroma_subsampling": ConfidenceDefault,
+				"hdr_type":           ConfidenceDefault,
+			},
+		},
+		{
+			name: "TaggedNCLXAndPixi",
+			data: createMinimalHEIFMetadata(9, 16, 10, false),
+			want: map[string]string{
+				"color_space":        ConfidenceAuthoritative,
+				"bit_depth":          ConfidenceAuthoritative,
+				"chroma_subsampling": ConfidenceDefault,
+				"hdr_type":           ConfidenceAuthoritative,
+			},
+		},
+		{
+			name: "UnknownPrimaries",
+			data: createMinimalHEIFMetadata(5, 1, 8, false),
+			want: map[string]string{
+				"color_space": ConfidenceDefault,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &ImageInfo{}
+			analyzeISOBMFF(bytes.NewReader(tt.data), image.Config{}, info)
+			for field, want := range tt.want {
+				if got := info.Confidence[field]; got != want {
+					t.Errorf("Confidence[%s]: got=%q, want=%q", field, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(defaultPath), image.Config{}, info)
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if !bytes.Contains(data, []byte(`"confidence":{`)) || !bytes.Contains(data, []byte(`"color_space":"default"`)) {
+			t.Errorf("Expected confidence map in JSON, got %s", data)
+		}
+	})
+}
+
+func TestExtensionMismatch(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, generateRGBAImage(8, 8)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		filename    string
+		data        []byte
+		wantFormat  string
+		wantWarning string
+	}{
+		{"AVIFNamedHEIC", "clip.heic", createHEIFSequenceData("avis", "pict", 64, 48, 3), "avif", "extension .heic but brand avif"},
+		{"HEIFNamedAVIF", "clip.avif", createHEIFSequenceData("msf1", "vide", 64, 48, 3), "heif", "extension .avif but brand heif"},
+		{"PNGNamedJPG", "photo.JPG", pngData.Bytes(), "png", "extension .jpg but content png"},
+		{"Matching", "clip.avifs", createHEIFSequenceData("avis", "pict", 64, 48, 3), "avif", ""},
+		{"MatchingAVIS", "clip.avis", createHEIFSequenceData("avis", "pict", 64, 48, 3), "avif", ""},
+		{"HEIFNamedAVIS", "clip.avis", createHEIFSequenceData("msf1", "vide", 64, 48, 3), "heif", "extension .avis but brand heif"},
+		{"UnknownExtension", "image.bin", pngData.Bytes(), "png", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(tmpDir, tt.filename)
+			if err := os.WriteFile(filename, tt.data, 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			info, err := analyzeFile(filename, Options{})
+			if err != nil {
+				t.Fatalf("analyzeFile failed: %v", err)
+			}
+			if info.Format != tt.wantFormat {
+				t.Errorf("Format: got=%s, want=%s", info.Format, tt.wantFormat)
+			}
+			if info.Warning != tt.wantWarning {
+				t.Errorf("Warning: got=%q, want=%q", info.Warning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, generateRGBA64Image(16, 16)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	profile := append([]byte("ICC\x00\x00"), make([]byte, 128)...)
+	profile = append(profile, []byte("Display P3 profile description")...)
+
+	filename := filepath.Join(t.TempDir(), "p3.png")
+	if err := os.WriteFile(filename, insertPNGChunk(pngData.Bytes(), "iCCP", profile), 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+
+	var buf bytes.Buffer
+	info, err := explainImage(filename, Options{}, &buf)
+	if err != nil {
+		t.Fatalf("explainImage failed: %v", err)
+	}
+	output := buf.String()
+
+	for _, want := range []string{
+		"How " + filename + " was analyzed:",
+		`1. format png from magic bytes "\x89PNG\r\n\x1a\n"`,
+		"dimensions 16x16 from the png header",
+		"bit depth 16 from PNG IHDR offset 24",
+		"color space Display P3 from iCCP substring match",
+		"decoded size 2048 bytes from 16x16 pixels at 8 bytes per pixel",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected explanation to contain %q, got:\n%s", want, output)
+		}
+	}
+
+	if len(info.Explanation) == 0 {
+		t.Fatal("Expected explanation steps on the result")
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if bytes.Contains(data, []byte("iCCP substring")) {
+		t.Error("Expected the explanation to stay out of JSON output")
+	}
+
+	if _, err := explainImage(filepath.Join(t.TempDir(), "missing.png"), Options{}, &buf); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func createDDSData(width, height, mipmaps, pixelFlags uint32, fourCC string, rgbBitCount uint32, dxgiFormat uint32) []byte {
+	header := make([]byte, 128)
+	copy(header[0:4], "DDS ")
+	binary.LittleEndian.PutUint32(header[4:8], 124)
+	binary.LittleEndian.PutUint32(header[8:12], 0x1|0x2|0x4|0x1000|0x20000)
+	binary.LittleEndian.PutUint32(header[12:16], height)
+	binary.LittleEndian.PutUint32(header[16:20], width)
+	binary.LittleEndian.PutUint32(header[28:32], mipmaps)
+	binary.LittleEndian.PutUint32(header[76:80], 32)
+	binary.LittleEndian.PutUint32(header[80:84], pixelFlags)
+	copy(header[84:88], fourCC)
+	binary.LittleEndian.PutUint32(header[88:92], rgbBitCount)
+
+	if fourCC == "DX10" {
+		dx10 := make([]byte, 20)
+		binary.LittleEndian.PutUint32(dx10[0:4], dxgiFormat)
+		binary.LittleEndian.PutUint32(dx10[4:8], 3)
+		header = append(header, dx10...)
+	}
+	return append(header, make([]byte, 64)...)
+}
+
+func TestDDSTextures(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            []byte
+		wantCodec       string
+		wantCompression CompressionType
+		wantAlpha       bool
+		wantMipmaps     int
+	}{
+		{"DXT1", createDDSData(256, 128, 9, 0x4, "DXT1", 0, 0), "DXT1", CompressionLossy, false, 9},
+		{"DXT5", createDDSData(256, 128, 1, 0x4, "DXT5", 0, 0), "DXT5", CompressionLossy, true, 1},
+		{"BC7ViaDX10", createDDSData(256, 128, 0, 0x4, "DX10", 0, 98), "BC7", CompressionLossy, true, 1},
+		{"Uncompressed", createDDSData(256, 128, 1, 0x40|0x1, "", 32, 0), "uncompressed 32-bit", CompressionLossless, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := analyzeReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("analyzeReader failed: %v", err)
+			}
+			if info.Format != "dds" {
+				t.Errorf("Format: got=%s, want=dds", info.Format)
+			}
+			if info.Width != 256 || info.Height != 128 {
+				t.Errorf("Dimensions: got=%dx%d, want=256x128", info.Width, info.Height)
+			}
+			if info.Codec != tt.wantCodec {
+				t.Errorf("Codec: got=%q, want=%q", info.Codec, tt.wantCodec)
+			}
+			if info.CompressionType != tt.wantCompression {
+				t.Errorf("CompressionType: got=%s, want=%s", info.CompressionType, tt.wantCompression)
+			}
+			if info.HasAlpha != tt.wantAlpha {
+				t.Errorf("HasAlpha: got=%v, want=%v", info.HasAlpha, tt.wantAlpha)
+			}
+			if info.MipmapCount != tt.wantMipmaps {
+				t.Errorf("MipmapCount: got=%d, want=%d", info.MipmapCount, tt.wantMipmaps)
+			}
+
+			applySizeEstimate(info, int64(len(tt.data)), nil, sizeScope{}, "")
+			if info.DecodedSize != 256*128*4 {
+				t.Errorf("DecodedSize: got=%d, want=%d", info.DecodedSize, 256*128*4)
+			}
+		})
+	}
+
+	t.Run("MipmapChain", func(t *testing.T) {
+		info, err := analyzeReader(bytes.NewReader(createDDSData(256, 128, 9, 0x4, "DXT1", 0, 0)))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+		applySizeEstimate(info, 0, nil, sizeScope{mipmaps: true}, "")
+		const want = (32768 + 8192 + 2048 + 512 + 128 + 32 + 8 + 2 + 1) * 4
+		if info.DecodedSize != want {
+			t.Errorf("DecodedSize with mipmaps: got=%d, want=%d", info.DecodedSize, want)
+		}
+
+		applySizeEstimate(info, 0, nil, sizeScope{allImages: true, allFrames: true}, "")
+		if info.DecodedSize != 256*128*4 {
+			t.Errorf("DecodedSize without -mipmaps: got=%d, want=%d", info.DecodedSize, 256*128*4)
+		}
+	})
+
+	t.Run("InvalidHeaderSize", func(t *testing.T) {
+		data := createDDSData(16, 16, 1, 0x4, "DXT1", 0, 0)
+		binary.LittleEndian.PutUint32(data[4:8], 100)
+		if _, err := analyzeReader(bytes.NewReader(data)); err == nil {
+			t.Error("Expected error for invalid DDS header size")
+		}
+	})
+}
+
+func TestFileTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	slowAnalyzer := func() ([]*ImageInfo, error) {
+		<-release
+		return []*ImageInfo{{Filename: "slow.png"}}, nil
+	}
+
+	failures := processFiles([]string{"slow.png", "fast.png"}, func(filename string) error {
+		infos, err := withFileTimeout(20*time.Millisecond, func() ([]*ImageInfo, error) {
+			if filename == "slow.png" {
+				return slowAnalyzer()
+			}
+			return []*ImageInfo{{Filename: filename}}, nil
+		})
+		if err == nil && len(infos) != 1 {
+			t.Errorf("Expected the fast result to be returned, got %d infos", len(infos))
+		}
+		if err != nil && infos != nil {
+			t.Errorf("Expected no result from the abandoned analysis, got %d infos", len(infos))
+		}
+		return err
+	})
+
+	if len(failures) != 1 {
+		t.Fatalf("Expected 1 failure, got %d", len(failures))
+	}
+	if failures[0].Filename != "slow.png" {
+		t.Errorf("Failure filename: got=%s, want=slow.png", failures[0].Filename)
+	}
+	if !errors.Is(failures[0], context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", failures[0].Err)
+	}
+	if !strings.Contains(failures[0].Error(), "timed out after 20ms") {
+		t.Errorf("Expected timeout message, got %q", failures[0].Error())
+	}
+	if code := categorizeError(failures[0]); code != ExitProcessingError {
+		t.Errorf("Expected exit code %d, got %d", ExitProcessingError, code)
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		want := errors.New("boom")
+		if _, err := withFileTimeout(0, func() ([]*ImageInfo, error) { return nil, want }); err != want {
+			t.Errorf("Expected the analysis error to pass through, got %v", err)
+		}
+	})
+}
+
+func createPackedGrayPNG(width, height int, depth uint8) []byte {
+	writeChunk := func(buf *bytes.Buffer, chunkType string, data []byte) {
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(data)))
+		buf.WriteString(chunkType)
+		buf.Write(data)
+		_ = binary.Write(buf, binary.BigEndian, crc32PNG(append([]byte(chunkType), data...)))
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = depth
+
+	rowBytes := (width*int(depth) + 7) / 8
+	var raw bytes.Buffer
+	for y := 0; y < height; y++ {
+		raw.WriteByte(0)
+		for x := 0; x < rowBytes; x++ {
+			raw.WriteByte(byte(x*37 + y*11))
+		}
+	}
+	var compressed bytes.Buffer
+	zlibWriter := zlib.NewWriter(&compressed)
+	_, _ = zlibWriter.Write(raw.Bytes())
+	_ = zlibWriter.Close()
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	writeChunk(&buf, "IHDR", ihdr)
+	writeChunk(&buf, "IDAT", compressed.Bytes())
+	writeChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+func TestSubBytePNGEstimates(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	paletted := func(colors int) []byte {
+		palette := make(color.Palette, colors)
+		for i := range palette {
+			palette[i] = color.RGBA{R: uint8(i * 16), G: uint8(255 - i*16), B: 128, A: 255}
+		}
+		img := image.NewPaletted(image.Rect(0, 0, 37, 19), palette)
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i % colors)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantModel ColorModel
+		wantDepth int
+	}{
+		{"Gray1", createPackedGrayPNG(37, 19, 1), ColorModelGrayscale, 1},
+		{"Gray2", createPackedGrayPNG(37, 19, 2), ColorModelGrayscale, 2},
+		{"Gray4", createPackedGrayPNG(37, 19, 4), ColorModelGrayscale, 4},
+		{"Indexed1", paletted(2), ColorModelIndexed, 1},
+		{"Indexed2", paletted(4), ColorModelIndexed, 2},
+		{"Indexed4", paletted(16), ColorModelIndexed, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(tmpDir, tt.name+".png")
+			if err := os.WriteFile(filename, tt.data, 0644); err != nil {
+				t.Fatalf("Failed to write PNG: %v", err)
+			}
+
+			info, err := analyzeFile(filename, Options{})
+			if err != nil {
+				t.Fatalf("analyzeFile failed: %v", err)
+			}
+			if info.ColorModel != tt.wantModel {
+				t.Errorf("ColorModel: got=%s, want=%s", info.ColorModel, tt.wantModel)
+			}
+			if info.BitDepth != tt.wantDepth {
+				t.Errorf("BitDepth: got=%d, want=%d", info.BitDepth, tt.wantDepth)
+			}
+
+			actual, err := getActualDecodedSize(filename)
+			if err != nil {
+				t.Fatalf("getActualDecodedSize failed: %v", err)
+			}
+			if info.DecodedSize != actual {
+				t.Errorf("DecodedSize: estimated=%d, actual=%d", info.DecodedSize, actual)
+			}
+			if info.DecodedSize != 37*19 {
+				t.Errorf("Expected one byte per unpacked pixel, got %d bytes for %d pixels", info.DecodedSize, 37*19)
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "options.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = png.Encode(file, generateRGBAImage(16, 16))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	t.Run("AnalysisOptions", func(t *testing.T) {
+		opts := Options{
+			Quiet:         true,
+			Scales:        []int{8},
+			HashAlgorithm: "sha256",
+			Budgets:       map[string]int64{"png": 100},
+		}
+		info, err := estimateDecodedSize(filename, opts)
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		if info.ScaledSizes[8] != 8*8*4 {
+			t.Errorf("ScaledSizes[8]: got=%d, want=%d", info.ScaledSizes[8], 8*8*4)
+		}
+		if len(info.ContentHash) != 64 {
+			t.Errorf("Expected a sha256 content hash, got %q", info.ContentHash)
+		}
+		if !info.BudgetExceeded {
+			t.Error("Expected the budget to be exceeded")
+		}
+	})
+
+	t.Run("OutputOptions", func(t *testing.T) {
+		opts := Options{JSONOutput: true, CompactJSON: true, Fields: []string{"width", "height"}}
+		output := captureStdout(t, func() {
+			if _, err := estimateDecodedSize(filename, opts); err != nil {
+				t.Errorf("estimateDecodedSize failed: %v", err)
+			}
+		})
+		if output != "{\"width\":16,\"height\":16}\n" {
+			t.Errorf("Unexpected output: %q", output)
+		}
+	})
+
+	t.Run("Quiet", func(t *testing.T) {
+		output := captureStdout(t, func() {
+			if _, err := estimateDecodedSize(filename, Options{Quiet: true}); err != nil {
+				t.Errorf("estimateDecodedSize failed: %v", err)
+			}
+		})
+		if output != "" {
+			t.Errorf("Expected no output in quiet mode, got %q", output)
+		}
+	})
+}
+
+func TestHEIFTiling(t *testing.T) {
+	t.Run("Grid2x2", func(t *testing.T) {
+		data := createGridHEIFData("avif", 256, 256, []uint16{2, 3, 4, 5}, []byte{0, 0, 1, 1, 0x02, 0x00, 0x02, 0x00})
+
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(data), image.Config{}, info)
+		if !info.Tiled {
+			t.Error("Expected a grid image to be reported as tiled")
+		}
+		if info.TileCount != 4 {
+			t.Errorf("TileCount: got=%d, want=4", info.TileCount)
+		}
+		if info.Width != 512 || info.Height != 512 {
+			t.Errorf("Expected canvas 512x512, got %dx%d", info.Width, info.Height)
+		}
+	})
+
+	t.Run("SingleImage", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeISOBMFF(bytes.NewReader(createMinimalHEIFMetadata(1, 1, 8, false)), image.Config{}, info)
+		if info.Tiled || info.TileCount != 0 {
+			t.Errorf("Expected single-image coding, got Tiled=%v TileCount=%d", info.Tiled, info.TileCount)
+		}
+	})
+}
+
+func TestJPEGExtensionVariants(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, generateRGBAImage(8, 8), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, generateRGBAImage(8, 8)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	for _, name := range []string{"photo.JPE", "photo.jfif", "photo.JIF", "photo.Jpg"} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(tmpDir, name)
+			if err := os.WriteFile(filename, jpegData.Bytes(), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			info, err := analyzeFile(filename, Options{})
+			if err != nil {
+				t.Fatalf("analyzeFile failed: %v", err)
+			}
+			if info.Format != "jpeg" {
+				t.Errorf("Format: got=%s, want=jpeg", info.Format)
+			}
+			if info.Warning != "" {
+				t.Errorf("Expected no extension warning, got %q", info.Warning)
+			}
+		})
+	}
+
+	t.Run("PNGNamedJPE", func(t *testing.T) {
+		filename := filepath.Join(tmpDir, "mislabeled.JPE")
+		if err := os.WriteFile(filename, pngData.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		info, err := analyzeFile(filename, Options{})
+		if err != nil {
+			t.Fatalf("analyzeFile failed: %v", err)
+		}
+		if info.Warning != "extension .jpe but content png" {
+			t.Errorf("Warning: got=%q", info.Warning)
+		}
+	})
+}
+
+func TestUniqueDecodedSize(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	write := func(name string, img image.Image) string {
+		filename := filepath.Join(tmpDir, name)
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		err = png.Encode(file, img)
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		return filename
+	}
+
+	files := []string{
+		write("a.png", generateRGBAImage(16, 16)),
+		write("a-copy.png", generateRGBAImage(16, 16)),
+		write("b.png", generateRGBAImage(32, 8)),
+	}
+
+	var results []*ImageInfo
+	for _, filename := range files {
+		info, err := estimateDecodedSize(filename, Options{Quiet: true, HashAlgorithm: "sha256"})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		results = append(results, info)
+	}
+
+	unique, duplicates := uniqueDecodedSize(results)
+	if unique != 16*16*4+32*8*4 {
+		t.Errorf("Unique decoded size: got=%d, want=%d", unique, 16*16*4+32*8*4)
+	}
+	if duplicates != 1 {
+		t.Errorf("Duplicates: got=%d, want=1", duplicates)
+	}
+
+	for _, info := range results {
+		info.ContentHash = ""
+	}
+	if unique, duplicates := uniqueDecodedSize(results); unique != 3*16*16*4 || duplicates != 0 {
+		t.Errorf("Expected files without hashes to count individually, got %d bytes and %d duplicates", unique, duplicates)
+	}
+}
+
+func TestImageAtOffset(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, generateRGBAImage(20, 10)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	profile := append([]byte("ICC\x00\x00"), make([]byte, 128)...)
+	embedded := insertPNGChunk(pngData.Bytes(), "iCCP", append(profile, []byte("Display P3")...))
+
+	atlas := append(bytes.Repeat([]byte{0xAB}, 100), embedded...)
+	filename := filepath.Join(t.TempDir(), "atlas.bin")
+	if err := os.WriteFile(filename, atlas, 0644); err != nil {
+		t.Fatalf("Failed to write atlas: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Quiet: true, Offset: 100})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.Format != "png" || info.Width != 20 || info.Height != 10 {
+		t.Errorf("Expected a 20x10 png, got %s %dx%d", info.Format, info.Width, info.Height)
+	}
+	if !info.HasICCProfile || info.ColorSpace != ColorSpaceDisplayP3 {
+		t.Errorf("Expected the iCCP chunk to be found relative to the offset, got HasICCProfile=%v ColorSpace=%s", info.HasICCProfile, info.ColorSpace)
+	}
+	if info.OriginalSize != int64(len(embedded)) {
+		t.Errorf("OriginalSize: got=%d, want=%d", info.OriginalSize, len(embedded))
+	}
+
+	if _, err := estimateDecodedSize(filename, Options{Quiet: true}); err == nil {
+		t.Error("Expected the atlas to fail detection without an offset")
+	}
+	if _, err := estimateDecodedSize(filename, Options{Quiet: true, Offset: int64(len(atlas))}); err == nil {
+		t.Error("Expected error for an offset past the end of the file")
+	}
+}
+
+func TestRatioFilter(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	solid := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range solid.Pix {
+		solid.Pix[i] = 0x80
+	}
+	noise := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	seed := uint32(1)
+	for i := range noise.Pix {
+		seed = seed*1664525 + 1013904223
+		noise.Pix[i] = uint8(seed >> 24)
+	}
+
+	var files []string
+	for name, img := range map[string]image.Image{"solid.png": solid, "noise.png": noise} {
+		filename := filepath.Join(tmpDir, name)
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		err = png.Encode(file, img)
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		files = append(files, filename)
+	}
+
+	list := func(opts Options) string {
+		return captureStdout(t, func() {
+			for _, filename := range files {
+				if _, err := estimateDecodedSize(filename, opts); err != nil {
+					t.Errorf("estimateDecodedSize failed: %v", err)
+				}
+			}
+		})
+	}
+
+	output := list(Options{JSONOutput: true, CompactJSON: true, Fields: []string{"filename"}, MinRatio: 10})
+	if !strings.Contains(output, "solid.png") || strings.Contains(output, "noise.png") {
+		t.Errorf("Expected only the well-compressed image above ratio 10, got %q", output)
+	}
+
+	output = list(Options{JSONOutput: true, CompactJSON: true, Fields: []string{"filename"}, MaxRatio: 10})
+	if strings.Contains(output, "solid.png") || !strings.Contains(output, "noise.png") {
+		t.Errorf("Expected only the poorly compressed image below ratio 10, got %q", output)
+	}
+
+	output = list(Options{JSONOutput: true, CompactJSON: true, Fields: []string{"filename"}})
+	if strings.Count(output, "\n") != 2 {
+		t.Errorf("Expected both images without a filter, got %q", output)
+	}
+
+	info, err := estimateDecodedSize(files[0], Options{Quiet: true, MinRatio: 1e9})
+	if err != nil || info == nil {
+		t.Errorf("Expected filtered images to still be analyzed, got %v", err)
+	}
+}
+
+func createJ2KCodestream(width, height uint32, depths ...uint8) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0x4F, 0xFF, 0x51})
+	_ = binary.Write(&buf, binary.BigEndian, uint16(38+3*len(depths)))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(0))
+	for _, value := range []uint32{width + 4, height + 2, 4, 2, width, height, 0, 0} {
+		_ = binary.Write(&buf, binary.BigEndian, value)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(depths)))
+	for _, depth := range depths {
+		buf.Write([]byte{depth - 1, 1, 1})
+	}
+	buf.Write([]byte{0xFF, 0x52, 0x00, 0x0C})
+	buf.Write(make([]byte, 10))
+	buf.Write([]byte{0xFF, 0xD9})
+	return buf.Bytes()
+}
+
+func createJP2Data(width, height uint32, components uint16, depth uint8, enumCS uint32) []byte {
+	ihdr := make([]byte, 14)
+	binary.BigEndian.PutUint32(ihdr[0:4], height)
+	binary.BigEndian.PutUint32(ihdr[4:8], width)
+	binary.BigEndian.PutUint16(ihdr[8:10], components)
+	ihdr[10] = depth - 1
+	ihdr[11] = 7
+
+	colr := []byte{1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(colr[3:7], enumCS)
+
+	var ftyp bytes.Buffer
+	ftyp.WriteString("jp2 ")
+	_ = binary.Write(&ftyp, binary.BigEndian, uint32(0))
+	ftyp.WriteString("jp2 ")
+
+	depths := make([]uint8, components)
+	for i := range depths {
+		depths[i] = depth
+	}
+
+	var buf bytes.Buffer
+	buf.Write(heifBox("jP  ", []byte{0x0D, 0x0A, 0x87, 0x0A}))
+	buf.Write(heifBox("ftyp", ftyp.Bytes()))
+	buf.Write(heifBox("jp2h", heifBox("ihdr", ihdr), heifBox("colr", colr)))
+	buf.Write(heifBox("jp2c", createJ2KCodestream(width, height, depths...)))
+	return buf.Bytes()
+}
+
+func TestJPEG2000(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           []byte
+		wantWidth      int
+		wantHeight     int
+		wantComponents int
+		wantDepth      int
+		wantModel      ColorModel
+		wantSpace      ColorSpace
+		wantDecoded    int64
+	}{
+		{"ContainerRGB", createJP2Data(640, 480, 3, 8, 16), 640, 480, 3, 8, ColorModelRGB, ColorSpaceSRGB, 640 * 480 * 3},
+		{"ContainerGray16", createJP2Data(300, 200, 1, 16, 17), 300, 200, 1, 16, ColorModelGrayscale, ColorSpaceSRGB, 300 * 200 * 2},
+		{"ContainerSYCC", createJP2Data(64, 64, 3, 8, 18), 64, 64, 3, 8, ColorModelYCbCr, ColorSpaceSRGB, 64 * 64 * 3},
+		{"CodestreamRGBA", createJ2KCodestream(1024, 768, 8, 8, 8, 8), 1024, 768, 4, 8, ColorModelRGB, ColorSpaceUntagged, 1024 * 768 * 4},
+		{"CodestreamGray12", createJ2KCodestream(100, 50, 12), 100, 50, 1, 12, ColorModelGrayscale, ColorSpaceUntagged, 100 * 50 * 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := analyzeReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("analyzeReader failed: %v", err)
+			}
+			applySizeEstimate(info, int64(len(tt.data)), nil, sizeScope{}, "")
+
+			if info.Format != "jp2" {
+				t.Errorf("Format: got=%s, want=jp2", info.Format)
+			}
+			if info.Width != tt.wantWidth || info.Height != tt.wantHeight {
+				t.Errorf("Dimensions: got=%dx%d, want=%dx%d", info.Width, info.Height, tt.wantWidth, tt.wantHeight)
+			}
+			if info.ChannelCount != tt.wantComponents {
+				t.Errorf("ChannelCount: got=%d, want=%d", info.ChannelCount, tt.wantComponents)
+			}
+			if info.BitDepth != tt.wantDepth {
+				t.Errorf("BitDepth: got=%d, want=%d", info.BitDepth, tt.wantDepth)
+			}
+			if info.ColorModel != tt.wantModel {
+				t.Errorf("ColorModel: got=%s, want=%s", info.ColorModel, tt.wantModel)
+			}
+			if info.ColorSpace != tt.wantSpace {
+				t.Errorf("ColorSpace: got=%s, want=%s", info.ColorSpace, tt.wantSpace)
+			}
+			if info.CompressionType != CompressionHybrid {
+				t.Errorf("CompressionType: got=%s, want=%s", info.CompressionType, CompressionHybrid)
+			}
+			if info.DecodedSize != tt.wantDecoded {
+				t.Errorf("DecodedSize: got=%d, want=%d", info.DecodedSize, tt.wantDecoded)
+			}
+		})
+	}
+
+	t.Run("TruncatedSIZ", func(t *testing.T) {
+		if _, err := analyzeReader(bytes.NewReader(createJ2KCodestream(10, 10, 8)[:20])); err == nil {
+			t.Error("Expected error for truncated SIZ segment")
+		}
+	})
+}
+
+func TestHistogram(t *testing.T) {
+	results := []*ImageInfo{
+		{Format: "png", BitDepth: 8, Megapixels: 0.25},
+		{Format: "png", BitDepth: 8, Megapixels: 0.99},
+		{Format: "jpeg", BitDepth: 8, Megapixels: 2},
+		{Format: "heif", BitDepth: 10, Megapixels: 12},
+		{Format: "avif", BitDepth: 12, Megapixels: 20},
+		{Format: "tiff", BitDepth: 16, Megapixels: 61},
+	}
+
+	histogram := buildHistogram(results)
+
+	wantMegapixels := []HistogramBucket{
+		{"< 1 MP", 2}, {"1-4 MP", 1}, {"4-12 MP", 0}, {"12-24 MP", 2}, {"24-50 MP", 0}, {">= 50 MP", 1},
+	}
+	if !reflect.DeepEqual(histogram.Megapixels, wantMegapixels) {
+		t.Errorf("Megapixels = %v, want %v", histogram.Megapixels, wantMegapixels)
+	}
+
+	wantDepths := []HistogramBucket{{"8-bit", 3}, {"10-bit", 1}, {"12-bit", 1}, {"16-bit", 1}}
+	if !reflect.DeepEqual(histogram.BitDepths, wantDepths) {
+		t.Errorf("BitDepths = %v, want %v", histogram.BitDepths, wantDepths)
+	}
+
+	wantFormats := []HistogramBucket{{"avif", 1}, {"heif", 1}, {"jpeg", 1}, {"png", 2}, {"tiff", 1}}
+	if !reflect.DeepEqual(histogram.Formats, wantFormats) {
+		t.Errorf("Formats = %v, want %v", histogram.Formats, wantFormats)
+	}
+
+	var buf bytes.Buffer
+	printHistogram(&buf, histogram, len(results))
+	output := buf.String()
+	for _, want := range []string{"Megapixels:", "< 1 MP", "Bit depths:", "10-bit", "Formats:", "png"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Histogram output missing %q:\n%s", want, output)
+		}
+	}
+
+	data, err := json.Marshal(map[string]Histogram{"histogram": histogram})
+	if err != nil {
+		t.Fatalf("Failed to marshal histogram: %v", err)
+	}
+	if !strings.Contains(string(data), `"bit_depths":[{"label":"8-bit","count":3}`) {
+		t.Errorf("Unexpected histogram JSON: %s", data)
+	}
+}
+
+func TestPNGTrailingBytes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(32, 32)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	pngSize := int64(buf.Len())
+	buf.Write(bytes.Repeat([]byte{0xAB}, 1024))
+
+	filename := filepath.Join(t.TempDir(), "trailing.png")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Quiet: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+
+	if info.TrailingBytes != 1024 {
+		t.Errorf("TrailingBytes = %d, want 1024", info.TrailingBytes)
+	}
+	if info.OriginalSize != pngSize+1024 {
+		t.Errorf("OriginalSize = %d, want %d", info.OriginalSize, pngSize+1024)
+	}
+	if info.EffectiveOriginalSize != pngSize {
+		t.Errorf("EffectiveOriginalSize = %d, want %d", info.EffectiveOriginalSize, pngSize)
+	}
+	wantRatio := float64(info.DecodedSize) / float64(pngSize)
+	if info.CompressionRatio != wantRatio {
+		t.Errorf("CompressionRatio = %f, want %f", info.CompressionRatio, wantRatio)
+	}
+	if !strings.Contains(info.Warning, "trailing data after IEND") {
+		t.Errorf("Expected trailing data warning, got %q", info.Warning)
+	}
+
+	clean, err := analyzeReader(bytes.NewReader(buf.Bytes()[:pngSize]))
+	if err != nil {
+		t.Fatalf("analyzeReader failed: %v", err)
+	}
+	if clean.TrailingBytes != 0 {
+		t.Errorf("Expected no trailing bytes for a clean PNG, got %d", clean.TrailingBytes)
+	}
+
+	t.Run("SingleWalk", func(t *testing.T) {
+		data := buf.Bytes()[:pngSize]
+		data = insertPNGChunk(data, "cICP", []byte{9, 16, 0, 1})
+		data = insertPNGChunk(data, "pHYs", []byte{0, 0, 0x0B, 0x13, 0, 0, 0x0B, 0x13, 1})
+		data = insertPNGChunk(data, "sRGB", []byte{0})
+		data = append(data, 0, 0, 0, 0)
+
+		chunks := scanPNGChunks(bytes.NewReader(data))
+		if chunks.BitDepth != 8 || chunks.Header.Width != 32 {
+			t.Errorf("Header: got %d-bit width %d, want 8-bit width 32", chunks.BitDepth, chunks.Header.Width)
+		}
+		if chunks.ColorSpace != "sRGB" {
+			t.Errorf("ColorSpace: got=%s, want=sRGB", chunks.ColorSpace)
+		}
+		if chunks.DPIX != 72 || chunks.DensityUnit != "ppm" {
+			t.Errorf("Density: got=%d %s, want=72 ppm", chunks.DPIX, chunks.DensityUnit)
+		}
+		if chunks.CICP == nil || chunks.CICP.TransferCharacteristics != 16 {
+			t.Errorf("CICP: got %+v, want transfer 16", chunks.CICP)
+		}
+		if chunks.TrailingBytes != 4 {
+			t.Errorf("TrailingBytes: got=%d, want=4", chunks.TrailingBytes)
+		}
+	})
+}
+
+func TestAverageCompressionRatio(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var results []*ImageInfo
+	for i, size := range []int{16, 24, 32} {
+		filename := filepath.Join(tmpDir, fmt.Sprintf("noise%d.png", i))
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		noise := image.NewRGBA(image.Rect(0, 0, size, size))
+		state := uint32(i + 1)
+		for p := range noise.Pix {
+			state = state*1664525 + 1013904223
+			noise.Pix[p] = uint8(state >> 24)
+		}
+		err = png.Encode(file, noise)
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+
+		info, err := estimateDecodedSize(filename, Options{Quiet: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		results = append(results, info)
+	}
+
+	average, ok := averageCompressionRatio(results)
+	if !ok {
+		t.Fatal("Expected an average for analyzed images")
+	}
+	want := (results[0].CompressionRatio + results[1].CompressionRatio + results[2].CompressionRatio) / 3
+	if math.Abs(average-want) > 1e-9 {
+		t.Errorf("average = %f, want %f", average, want)
+	}
+	if average >= 1.5 {
+		t.Errorf("Expected a low average ratio for noisy PNGs, got %.1fx", average)
+	}
+
+	results = append(results, &ImageInfo{IsVector: true})
+	if withVector, _ := averageCompressionRatio(results); math.Abs(withVector-want) > 1e-9 {
+		t.Errorf("Expected zero-ratio images to be ignored, got %f", withVector)
+	}
+
+	if _, ok := averageCompressionRatio(nil); ok {
+		t.Error("Expected no average for an empty result set")
+	}
+}
+
+func TestDocumentImages(t *testing.T) {
+	tmpDir := t.TempDir()
+	docsDir := filepath.Join(tmpDir, "docs")
+	if err := os.MkdirAll(filepath.Join(docsDir, "img"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+
+	write := func(filename string, width, height int) {
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		err = png.Encode(file, generateRGBAImage(width, height))
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+	}
+	write(filepath.Join(docsDir, "img", "diagram.png"), 40, 20)
+	write(filepath.Join(tmpDir, "logo.png"), 16, 16)
+
+	markdown := strings.Join([]string{
+		"# Guide",
+		"![Diagram](img/diagram.png \"Architecture\")",
+		"Inline <img src='../logo.png?v=2' alt=\"logo\"> and again ![logo](../logo.png#top).",
+		"![Remote](https://example.com/banner.png)",
+		"![Inline](data:image/png;base64,AAAA)",
+	}, "\n")
+	doc := filepath.Join(docsDir, "guide.md")
+	if err := os.WriteFile(doc, []byte(markdown), 0644); err != nil {
+		t.Fatalf("Failed to write markdown: %v", err)
+	}
+
+	files, err := readDocumentImages(doc)
+	if err != nil {
+		t.Fatalf("readDocumentImages failed: %v", err)
+	}
+	want := []string{filepath.Join(docsDir, "img", "diagram.png"), filepath.Join(tmpDir, "logo.png")}
+	sort.Strings(files)
+	sort.Strings(want)
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("files = %v, want %v", files, want)
+	}
+
+	sizes := make(map[string]int64)
+	for _, filename := range files {
+		info, err := estimateDecodedSize(filename, Options{Quiet: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize(%s) failed: %v", filename, err)
+		}
+		sizes[filepath.Base(filename)] = info.DecodedSize
+	}
+	if sizes["diagram.png"] != 40*20*4 || sizes["logo.png"] != 16*16*4 {
+		t.Errorf("Unexpected decoded sizes: %v", sizes)
+	}
+
+	html := filepath.Join(tmpDir, "index.html")
+	if err := os.WriteFile(html, []byte(`<p><IMG class="hero" SRC="docs/img/diagram%2Epng"></p>`), 0644); err != nil {
+		t.Fatalf("Failed to write HTML: %v", err)
+	}
+	files, err = readDocumentImages(html)
+	if err != nil {
+		t.Fatalf("readDocumentImages failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join(docsDir, "img", "diagram.png") {
+		t.Errorf("Unexpected HTML references: %v", files)
+	}
+
+	if _, err := readDocumentImages(filepath.Join(tmpDir, "missing.md")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not-exist error for a missing document, got %v", err)
+	}
+}
+
+func TestPremultipliedAlpha(t *testing.T) {
+	opaque := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	translucent := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := range opaque.Pix {
+		opaque.Pix[i] = 255
+		translucent.Pix[i] = uint8(i)
+	}
+
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		return buf.Bytes()
+	}
+	opaqueData := encode(opaque)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantExplain string
+	}{
+		{"OpaqueRGB", opaqueData, ""},
+		{"RGBWithTRNS", insertPNGChunk(opaqueData, "tRNS", []byte{0, 255, 0, 255, 0, 255}), "straight alpha because the PNG decodes to image.NRGBA"},
+		{"NRGBA", encode(translucent), "straight alpha because the PNG decodes to image.NRGBA"},
+		{"Gray", createPackedGrayPNG(8, 8, 8), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := png.Decode(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Failed to decode PNG: %v", err)
+			}
+			if got := pngDecodedModel(scanPNGChunks(bytes.NewReader(tt.data)), nil); got != decoded.ColorModel() {
+				t.Errorf("pngDecodedModel = %s, but png.Decode returned %T", imageTypeName(got), decoded)
+			}
+
+			info, err := analyzeReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("analyzeReader failed: %v", err)
+			}
+			if info.PremultipliedAlpha {
+				t.Errorf("PremultipliedAlpha = true, but png.Decode returned %T", decoded)
+			}
+
+			explanation := strings.Join(info.Explanation, "\n")
+			if tt.wantExplain == "" && strings.Contains(explanation, "alpha because") {
+				t.Errorf("Unexpected alpha explanation: %s", explanation)
+			}
+			if tt.wantExplain != "" && !strings.Contains(explanation, tt.wantExplain) {
+				t.Errorf("Explanation missing %q: %s", tt.wantExplain, explanation)
+			}
+		})
+	}
+
+	t.Run("Transparency", func(t *testing.T) {
+		tests := []struct {
+			name string
+			data []byte
+			want bool
+		}{
+			{"Opaque", createTransparencyPNG(2, false), false},
+			{"TRNS", createTransparencyPNG(2, true), true},
+			{"GrayAlpha", createTransparencyPNG(4, false), true},
+			{"RGBA", createTransparencyPNG(6, false), true},
+		}
+		for _, tt := range tests {
+			if got := scanPNGChunks(bytes.NewReader(tt.data)).Transparency; got != tt.want {
+				t.Errorf("%s: Transparency = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	})
+}
+
+func createTransparencyPNG(colorType uint8, withTRNS bool) []byte {
+	writeChunk := func(buf *bytes.Buffer, chunkType string, data []byte) {
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(data)))
+		buf.WriteString(chunkType)
+		buf.Write(data)
+		_ = binary.Write(buf, binary.BigEndian, crc32PNG(append([]byte(chunkType), data...)))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], 1)
+	binary.BigEndian.PutUint32(ihdr[4:8], 1)
+	ihdr[8] = 8
+	ihdr[9] = colorType
+	writeChunk(&buf, "IHDR", ihdr)
+	if withTRNS {
+		writeChunk(&buf, "tRNS", []byte{0, 0, 0, 0, 0, 0})
+	}
+	writeChunk(&buf, "IDAT", nil)
+	writeChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+func TestCompactErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var files []string
+	for i := 0; i < 10; i++ {
+		filename := filepath.Join(tmpDir, fmt.Sprintf("junk%d.bin", i))
+		if err := os.WriteFile(filename, []byte("not an image at all"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		files = append(files, filename)
+	}
+	missing := filepath.Join(tmpDir, "missing.png")
+	files = append(files, missing)
+
+	failures := processFiles(files, func(filename string) error {
+		_, err := estimateDecodedSize(filename, Options{Quiet: true})
+		return err
+	})
+	if len(failures) != 11 {
+		t.Fatalf("Expected 11 failures, got %d", len(failures))
+	}
+
+	groups := groupFailures(failures)
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d: %+v", len(groups), groups)
+	}
+	if groups[0].Count != 10 || len(groups[0].Examples) != maxFailureExamples || groups[0].Examples[0] != files[0] {
+		t.Errorf("Unexpected unknown format group: %+v", groups[0])
+	}
+	if groups[0].ExitCode != ExitInvalidFormat {
+		t.Errorf("Expected exit code %d for unknown formats, got %d", ExitInvalidFormat, groups[0].ExitCode)
+	}
+	if groups[1].Count != 1 || groups[1].Examples[0] != missing || strings.Contains(groups[1].Message, missing) {
+		t.Errorf("Unexpected missing file group: %+v", groups[1])
+	}
+
+	output := captureStdout(t, func() {
+		reportGroupedFailures(failures, true)
+	})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 grouped lines, got %d: %q", len(lines), output)
+	}
+	var group FailureGroup
+	if err := json.Unmarshal([]byte(lines[0]), &group); err != nil {
+		t.Fatalf("Expected a JSON group object, got %q: %v", lines[0], err)
+	}
+	if group.Count != 10 || len(group.Examples) != maxFailureExamples {
+		t.Errorf("Unexpected grouped JSON: %q", lines[0])
+	}
+}
+
+func TestHEIFColorConflict(t *testing.T) {
+	nclx := func(primaries uint16) []byte {
+		var buf bytes.Buffer
+		buf.WriteString("nclx")
+		_ = binary.Write(&buf, binary.BigEndian, primaries)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(13))
+		_ = binary.Write(&buf, binary.BigEndian, uint16(1))
+		buf.WriteByte(0x80)
+		return buf.Bytes()
+	}
+	prof := func(description string) []byte {
+		profile := make([]byte, 256)
+		copy(profile[128:], description)
+		return append([]byte("prof"), profile...)
+	}
+	heif := func(colrs ...[]byte) []byte {
+		var ipco [][]byte
+		for _, colr := range colrs {
+			ipco = append(ipco, heifBox("colr", colr))
+		}
+		return append(
+			heifBox("ftyp", []byte("heic"), make([]byte, 4), []byte("mif1heic")),
+			heifBox("meta", make([]byte, 4), heifBox("iprp", heifBox("ipco", ipco...)))...)
+	}
+
+	tests := []struct {
+		name           string
+		data           []byte
+		wantColorSpace ColorSpace
+		wantWarning    string
+	}{
+		{"P3ProfileWithBT709Nclx", heif(nclx(1), prof("Display P3")), ColorSpaceBT709, "ICC profile (Display P3) conflicts with nclx (BT.709)"},
+		{"SRGBProfileWithBT709Nclx", heif(prof("sRGB IEC61966-2.1"), nclx(1)), ColorSpaceBT709, ""},
+		{"MatchingP3", heif(nclx(12), prof("Display P3")), ColorSpaceDisplayP3, ""},
+		{"ProfileOnly", heif(prof("Display P3")), ColorSpaceDisplayP3, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &ImageInfo{}
+			analyzeISOBMFF(bytes.NewReader(tt.data), image.Config{}, info)
+
+			if info.ColorSpace != tt.wantColorSpace {
+				t.Errorf("ColorSpace = %s, want %s", info.ColorSpace, tt.wantColorSpace)
+			}
+			if info.Warning != tt.wantWarning {
+				t.Errorf("Warning = %q, want %q", info.Warning, tt.wantWarning)
+			}
+			if !info.HasICCProfile || info.ICCProfileSize != 256 {
+				t.Errorf("Expected a 256-byte ICC profile, got HasICCProfile=%v size=%d", info.HasICCProfile, info.ICCProfileSize)
+			}
+		})
+	}
+}
+
+func TestWebPICCColorSpace(t *testing.T) {
+	chunk := func(fourCC string, payload []byte) []byte {
+		var buf bytes.Buffer
+		buf.WriteString(fourCC)
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(payload)))
+		buf.Write(payload)
+		if len(payload)%2 == 1 {
+			buf.WriteByte(0)
+		}
+		return buf.Bytes()
+	}
+	webp := func(chunks ...[]byte) []byte {
+		body := bytes.Join(append([][]byte{[]byte("WEBP")}, chunks...), nil)
+		var buf bytes.Buffer
+		buf.WriteString("RIFF")
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(body)))
+		buf.Write(body)
+		return buf.Bytes()
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x20
+	profile := make([]byte, 200)
+	copy(profile[128:], "Display P3")
+	vp8l := []byte{0x2F, 0, 0, 0, 0}
+
+	t.Run("DisplayP3", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeWebP(bytes.NewReader(webp(chunk("VP8X", vp8x), chunk("ICCP", profile), chunk("VP8L", vp8l))), image.Config{}, info)
+
+		if info.CompressionType != CompressionLossless {
+			t.Errorf("Expected lossless, got %s", info.CompressionType)
+		}
+		if !info.HasICCProfile || info.ICCProfileSize != len(profile) {
+			t.Errorf("Expected a %d-byte ICC profile, got HasICCProfile=%v size=%d", len(profile), info.HasICCProfile, info.ICCProfileSize)
+		}
+		if info.ColorSpace != ColorSpaceDisplayP3 {
+			t.Errorf("ColorSpace = %s, want Display P3", info.ColorSpace)
+		}
+		if info.Confidence["color_space"] != ConfidenceHeuristic {
+			t.Errorf("Expected heuristic color space confidence, got %q", info.Confidence["color_space"])
+		}
+	})
+
+	t.Run("NoICCP", func(t *testing.T) {
+		info := &ImageInfo{}
+		analyzeWebP(bytes.NewReader(webp(chunk("VP8L", vp8l))), image.Config{}, info)
+
+		if info.HasICCProfile || info.ColorSpace != ColorSpaceSRGB {
+			t.Errorf("Expected untagged WebP to stay sRGB, got HasICCProfile=%v ColorSpace=%s", info.HasICCProfile, info.ColorSpace)
+		}
+	})
+
+	t.Run("OversizedICCP", func(t *testing.T) {
+		var data bytes.Buffer
+		data.Write(webp(chunk("VP8X", vp8x)))
+		data.WriteString("ICCP")
+		_ = binary.Write(&data, binary.LittleEndian, uint32(0xFFFFFFF0))
+		data.Write(make([]byte, 16))
+
+		meta := detectWebPFormat(bytes.NewReader(data.Bytes()))
+		if meta.ICCProfile != nil {
+			t.Errorf("Expected an oversized ICCP chunk to be skipped, got %d bytes", len(meta.ICCProfile))
+		}
+
+		data.Reset()
+		data.Write(webp(chunk("VP8X", vp8x)))
+		data.WriteString("ICCP")
+		_ = binary.Write(&data, binary.LittleEndian, uint32(1000))
+		data.Write(make([]byte, 16))
+
+		meta = detectWebPFormat(bytes.NewReader(data.Bytes()))
+		if meta.ICCProfile != nil {
+			t.Errorf("Expected a truncated ICCP chunk to be ignored, got %d bytes", len(meta.ICCProfile))
+		}
+	})
+}
+
+func TestEstimateModels(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "photo.jpg")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = jpeg.Encode(file, generateRGBAImage(64, 48), &jpeg.Options{Quality: 90})
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+
+	tests := []struct {
+		model       string
+		wantBits    int
+		wantDecoded int64
+		wantScaled  int64
+	}{
+		{"", 24, 64 * 48 * 3, 32 * 24 * 3},
+		{EstimateModelGo, 24, 64 * 48 * 3, 32 * 24 * 3},
+		{EstimateModelRGBA, 32, 64 * 48 * 4, 32 * 24 * 4},
+		{EstimateModelTight, 12, 64 * 48 * 3 / 2, 32 * 24 * 3 / 2},
+	}
+
+	for _, tt := range tests {
+		t.Run("model="+tt.model, func(t *testing.T) {
+			info, err := estimateDecodedSize(filename, Options{Quiet: true, Scales: []int{32}, EstimateModel: tt.model})
+			if err != nil {
+				t.Fatalf("estimateDecodedSize failed: %v", err)
+			}
+			if info.ColorModel != ColorModelYCbCr || info.ChromaSubsampling != ChromaSubsampling420 {
+				t.Fatalf("Expected a 4:2:0 YCbCr JPEG, got %s %s", info.ColorModel, info.ChromaSubsampling)
+			}
+			if info.BitsPerPixel != tt.wantBits {
+				t.Errorf("BitsPerPixel = %d, want %d", info.BitsPerPixel, tt.wantBits)
+			}
+			if info.DecodedSize != tt.wantDecoded {
+				t.Errorf("DecodedSize = %d, want %d", info.DecodedSize, tt.wantDecoded)
+			}
+			if info.ScaledSizes[32] != tt.wantScaled {
+				t.Errorf("ScaledSizes[32] = %d, want %d", info.ScaledSizes[32], tt.wantScaled)
+			}
+		})
+	}
+
+	tight := []struct {
+		name string
+		info ImageInfo
+		want int
+	}{
+		{"YCbCr444", ImageInfo{ColorModel: ColorModelYCbCr, BitDepth: 8, ChromaSubsampling: ChromaSubsampling444}, 24},
+		{"YCbCr422", ImageInfo{ColorModel: ColorModelYCbCr, BitDepth: 8, ChromaSubsampling: ChromaSubsampling422}, 16},
+		{"YCbCr420_10bit", ImageInfo{ColorModel: ColorModelYCbCr, BitDepth: 10, ChromaSubsampling: ChromaSubsampling420}, 15},
+		{"Gray1", ImageInfo{ColorModel: ColorModelGrayscale, BitDepth: 1}, 1},
+		{"Indexed4", ImageInfo{ColorModel: ColorModelIndexed, BitDepth: 4}, 4},
+		{"RGBA16", ImageInfo{ColorModel: ColorModelRGB, BitDepth: 16, HasAlpha: true}, 64},
+	}
+	for _, tt := range tight {
+		if got := tightBitsPerPixel(&tt.info); got != tt.want {
+			t.Errorf("%s: tightBitsPerPixel = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	info := &ImageInfo{ColorModel: ColorModelGrayscale, BitDepth: 1, Width: 9, Height: 1}
+	applySizeEstimate(info, 10, nil, sizeScope{}, EstimateModelTight)
+	if info.DecodedSize != 2 {
+		t.Errorf("Expected a 9-pixel 1-bit row to round up to 2 bytes, got %d", info.DecodedSize)
+	}
+}
+
+func TestServerProtocol(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skipf("socketpair unavailable: %v", err)
+	}
+	newConn := func(fd int, name string) net.Conn {
+		file := os.NewFile(uintptr(fd), name)
+		defer func() { _ = file.Close() }()
+		conn, err := net.FileConn(file)
+		if err != nil {
+			t.Fatalf("FileConn failed: %v", err)
+		}
+		return conn
+	}
+	server := newConn(fds[0], "server")
+	client := newConn(fds[1], "client")
+	defer func() { _ = client.Close() }()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { _ = server.Close() }()
+		done <- serveConn(server, Options{HashAlgorithm: "sha256"})
+	}()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(20, 10)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	if err := writeFrame(client, buf.Bytes()); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+	response, err := readFrame(client)
+	if err != nil {
+		t.Fatalf("readFrame failed: %v", err)
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal(response, &info); err != nil {
+		t.Fatalf("Expected a JSON ImageInfo, got %q: %v", response, err)
+	}
+	if info["format"] != "png" || info["width"] != float64(20) || info["decoded_size_bytes"] != float64(20*10*4) {
+		t.Errorf("Unexpected response: %s", response)
+	}
+	if hash, _ := info["content_hash"].(string); len(hash) != 64 {
+		t.Errorf("Expected a sha256 content hash, got %q", hash)
+	}
+
+	if err := writeFrame(client, []byte("not an image")); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+	response, err = readFrame(client)
+	if err != nil {
+		t.Fatalf("readFrame failed: %v", err)
+	}
+	if !strings.Contains(string(response), `"error":"image: unknown format"`) {
+		t.Errorf("Expected an error reply, got %s", response)
+	}
+
+	if err := client.(*net.UnixConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveConn returned %v after a clean close", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveConn did not return after the client closed")
+	}
+
+	if _, err := readFrame(bytes.NewReader([]byte{0, 0, 0, 10, 1, 2})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ErrUnexpectedEOF for a short frame, got %v", err)
+	}
+	if _, err := readFrame(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF})); err == nil {
+		t.Error("Expected an error for an oversized frame")
+	}
+}
+
+func TestWideGamut(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaries     uint16
+		transfer      uint16
+		wantWideGamut bool
+		wantHDR       HDRType
+	}{
+		{"BT2020_Linear", 9, 8, true, HDRNone},
+		{"BT2020_sRGB", 9, 13, true, HDRNone},
+		{"BT2020_PQ", 9, 16, true, HDRPQ},
+		{"DisplayP3_sRGB", 12, 13, true, HDRNone},
+		{"BT709_sRGB", 1, 13, false, HDRNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &ImageInfo{}
+			analyzeISOBMFF(bytes.NewReader(createMinimalHEIFMetadata(tt.primaries, tt.transfer, 10, false)), image.Config{}, info)
+
+			if info.BitDepth != 10 {
+				t.Errorf("BitDepth = %d, want 10", info.BitDepth)
+			}
+			if info.WideGamut != tt.wantWideGamut {
+				t.Errorf("WideGamut = %v, want %v", info.WideGamut, tt.wantWideGamut)
+			}
+			if info.HDRType != tt.wantHDR {
+				t.Errorf("HDRType = %s, want %s", info.HDRType, tt.wantHDR)
+			}
+		})
+	}
+}
+
+func TestSidecarOutputDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Chdir(tmpDir)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateRGBAImage(8, 8)); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	files := []string{
+		filepath.Join("photos", "2024", "a.png"),
+		filepath.Join("photos", "b.png"),
+		"c.png",
+	}
+	for _, filename := range files {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write PNG: %v", err)
+		}
+	}
+
+	outputDir := filepath.Join(tmpDir, "catalog")
+	for _, filename := range files {
+		info, err := estimateDecodedSize(filename, Options{Quiet: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+		if err := writeSidecar(info, true, nil, outputDir); err != nil {
+			t.Fatalf("writeSidecar failed: %v", err)
+		}
+	}
+
+	for _, filename := range files {
+		data, err := os.ReadFile(filepath.Join(outputDir, filename+".json"))
+		if err != nil {
+			t.Errorf("Expected mirrored sidecar for %s: %v", filename, err)
+			continue
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil || decoded["filename"] != filename {
+			t.Errorf("Unexpected sidecar content for %s: %s", filename, data)
+		}
+		if _, err := os.Stat(filename + ".json"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected no sidecar next to %s in the source tree", filename)
+		}
+	}
+
+	outside := &ImageInfo{Filename: filepath.Join("..", "elsewhere.png")}
+	if err := writeSidecar(outside, true, nil, outputDir); err == nil || !strings.Contains(err.Error(), "outside the current directory") {
+		t.Errorf("Expected an error for a path outside the current directory, got %v", err)
+	}
+}
+
+func TestGIFLoopCountAndTransparency(t *testing.T) {
+	palette := color.Palette{color.RGBA{0, 0, 0, 0}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	frame := func(index uint8) *image.Paletted {
+		img := image.NewPaletted(image.Rect(0, 0, 16, 12), palette)
+		for i := range img.Pix {
+			img.Pix[i] = index
+		}
+		return img
+	}
+
+	encode := func(t *testing.T, anim *gif.GIF) []byte {
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, anim); err != nil {
+			t.Fatalf("Failed to encode GIF: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("LoopCount3", func(t *testing.T) {
+		data := encode(t, &gif.GIF{
+			Image:     []*image.Paletted{frame(0), frame(1), frame(2)},
+			Delay:     []int{10, 10, 10},
+			LoopCount: 3,
+		})
+
+		filename := filepath.Join(t.TempDir(), "anim.gif")
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatalf("Failed to write GIF: %v", err)
+		}
+		info, err := estimateDecodedSize(filename, Options{Quiet: true, AllFrames: true})
+		if err != nil {
+			t.Fatalf("estimateDecodedSize failed: %v", err)
+		}
+
+		if info.Format != "gif" || info.ColorModel != ColorModelIndexed {
+			t.Errorf("Expected indexed gif, got %s %s", info.Format, info.ColorModel)
+		}
+		if info.LoopCount == nil || *info.LoopCount != 3 {
+			t.Errorf("Expected loop count 3, got %v", info.LoopCount)
+		}
+		if !info.HasAlpha {
+			t.Error("Expected HasAlpha from the transparent color index")
+		}
+		if info.FrameCount != 3 {
+			t.Errorf("FrameCount = %d, want 3", info.FrameCount)
+		}
+		if info.DecodedSize != 16*12*3 {
+			t.Errorf("DecodedSize = %d, want %d", info.DecodedSize, 16*12*3)
+		}
+		if info.Warning != "" {
+			t.Errorf("Unexpected warning: %s", info.Warning)
+		}
+	})
+
+	t.Run("Infinite", func(t *testing.T) {
+		info, err := analyzeReader(bytes.NewReader(encode(t, &gif.GIF{
+			Image: []*image.Paletted{frame(1), frame(2)},
+			Delay: []int{5, 5},
+		})))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+		if info.LoopCount == nil || *info.LoopCount != 0 {
+			t.Errorf("Expected loop count 0 (infinite), got %v", info.LoopCount)
+		}
+	})
+
+	t.Run("StillOpaque", func(t *testing.T) {
+		opaque := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+		var buf bytes.Buffer
+		if err := gif.Encode(&buf, opaque, nil); err != nil {
+			t.Fatalf("Failed to encode GIF: %v", err)
+		}
+		info, err := analyzeReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("analyzeReader failed: %v", err)
+		}
+		if info.LoopCount != nil || info.HasAlpha || info.FrameCount != 0 {
+			t.Errorf("Expected a plain still GIF, got LoopCount=%v HasAlpha=%v FrameCount=%d", info.LoopCount, info.HasAlpha, info.FrameCount)
+		}
+	})
+}
+
+func TestStableJSONOutput(t *testing.T) {
+	info := &ImageInfo{
+		Filename:    "image.png",
+		Format:      "png",
+		Width:       4000,
+		Height:      3000,
+		Confidence:  map[string]string{},
+		ScaledSizes: map[int]int64{},
+	}
+	for _, field := range []string{"hdr_type", "color_space", "bit_depth", "chroma_subsampling"} {
+		info.Confidence[field] = ConfidenceHeuristic
+	}
+	for _, width := range []int{3840, 160, 1280, 320, 2560, 640, 1920, 480} {
+		info.ScaledSizes[width] = int64(width) * 3
+	}
+
+	for _, fields := range [][]string{nil, {"scaled_sizes", "filename", "confidence"}} {
+		var first string
+		for run := 0; run < 50; run++ {
+			var buf bytes.Buffer
+			if err := writeSelectedJSON(&buf, info, fields, true); err != nil {
+				t.Fatalf("writeSelectedJSON failed: %v", err)
+			}
+			if run == 0 {
+				first = buf.String()
+				continue
+			}
+			if buf.String() != first {
+				t.Fatalf("Serialization changed between runs (fields %v):\n%s\n%s", fields, first, buf.String())
+			}
+		}
+
+		confidence := `"confidence":{"bit_depth":"heuristic","chroma_subsampling":"heuristic","color_space":"heuristic","hdr_type":"heuristic"}`
+		if !strings.Contains(first, confidence) {
+			t.Errorf("Expected sorted confidence keys, got %s", first)
+		}
+		if !strings.Contains(first, `"scaled_sizes":{"1280":3840,"160":480,"1920":5760,"2560":7680,"320":960,"3840":11520,"480":1440,"640":1920}`) {
+			t.Errorf("Expected sorted scaled_sizes keys, got %s", first)
+		}
+	}
+}
+
+func TestJPEGChromaNotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		yH, yV   uint8
+		want     string
+		wantEnum ChromaSubsampling
+	}{
+		{"4:1:1", 4, 1, "4:1:1", ChromaSubsampling411},
+		{"4:4:0", 1, 2, "4:4:0", ChromaSubsampling440},
+		{"4:2:0", 2, 2, "4:2:0", ChromaSubsampling420},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := createMinimalJPEGData(64, 64, tt.yH, tt.yV, 1, 1, 8)
+			if got := scanJPEGMarkers(bytes.NewReader(data)).Subsampling; got != tt.want {
+				t.Errorf("Subsampling = %s, want %s", got, tt.want)
+			}
+
+			info := &ImageInfo{}
+			analyzeJPEG(bytes.NewReader(data), image.Config{ColorModel: color.YCbCrModel}, info)
+			if info.ChromaSubsampling != tt.wantEnum || info.ChromaSubsampling.String() != tt.want {
+				t.Errorf("ChromaSubsampling = %s, want %s", info.ChromaSubsampling, tt.want)
+			}
+			if info.Confidence["chroma_subsampling"] != ConfidenceAuthoritative {
+				t.Errorf("Expected authoritative chroma confidence, got %q", info.Confidence["chroma_subsampling"])
+			}
+			if bpp := calculateBytesPerPixel(info); bpp != 3 {
+				t.Errorf("Expected 3 decoded bytes per pixel, got %d", bpp)
+			}
+		})
+	}
+
+	notations := []struct {
+		factors [6]uint8
+		want    string
+	}{
+		{[6]uint8{2, 2, 2, 2, 2, 2}, "4:4:4"},
+		{[6]uint8{4, 2, 2, 2, 2, 2}, "4:2:2"},
+		{[6]uint8{2, 2, 1, 1, 2, 1}, "Custom (2x2:1x1:2x1)"},
+		{[6]uint8{3, 1, 2, 1, 2, 1}, "Custom (3x1:2x1:2x1)"},
+		{[6]uint8{4, 2, 1, 1, 1, 1}, "Custom (4x2:1x1:1x1)"},
+	}
+	for _, tt := range notations {
+		f := tt.factors
+		if got := chromaNotation(f[0], f[1], f[2], f[3], f[4], f[5]); got != tt.want {
+			t.Errorf("chromaNotation(%v) = %s, want %s", f, got, tt.want)
+		}
+	}
+}
+
+func TestReencodeSavings(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "photo.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = png.Encode(file, generateRGBAImage(64, 64))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Quiet: true, CompareTo: CompareToWebP, Quality: 80})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.ReencodedFormat != CompareToWebP {
+		t.Errorf("ReencodedFormat: got=%q, want=%q", info.ReencodedFormat, CompareToWebP)
+	}
+	if info.ReencodedSize <= 0 {
+		t.Fatalf("Expected a re-encoded size, got %d", info.ReencodedSize)
+	}
+	want := 1 - float64(info.ReencodedSize)/float64(info.OriginalSize)
+	if math.Abs(info.ProjectedSavings-want) > 1e-9 {
+		t.Errorf("ProjectedSavings: got=%f, want=%f", info.ProjectedSavings, want)
+	}
+
+	info, err = estimateDecodedSize(filename, Options{Quiet: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.ReencodedSize != 0 || info.ProjectedSavings != 0 {
+		t.Errorf("Expected no re-encode without the flag, got %d bytes", info.ReencodedSize)
+	}
+
+	pngData, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read PNG: %v", err)
+	}
+	archiveName := filepath.Join(t.TempDir(), "photos.zip")
+	archiveFile, err := os.Create(archiveName)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	writer := zip.NewWriter(archiveFile)
+	w, err := writer.Create("photo.png")
+	if err != nil {
+		t.Fatalf("Failed to add photo.png: %v", err)
+	}
+	_, _ = w.Write(pngData)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close zip writer: %v", err)
+	}
+	if err := archiveFile.Close(); err != nil {
+		t.Fatalf("Failed to close zip: %v", err)
+	}
+
+	entries, err := estimateArchive(archiveName, Options{Quiet: true, CompareTo: CompareToWebP, Quality: 80})
+	if err != nil {
+		t.Fatalf("estimateArchive failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].ReencodedSize <= 0 {
+		t.Errorf("Expected archive entries to be re-encoded, got %+v", entries)
+	}
+}
+
+func TestGPUTextureBytes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "texture.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	err = png.Encode(file, image.NewRGBA(image.Rect(0, 0, 1000, 1000)))
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	info, err := estimateDecodedSize(filename, Options{Quiet: true, GPU: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if info.DecodedSize != 1000*1000*4 {
+		t.Errorf("DecodedSize: got=%d, want=%d", info.DecodedSize, 1000*1000*4)
+	}
+	if want := int64(1024 * 1024 * 4); info.GPUTextureBytes != want {
+		t.Errorf("GPUTextureBytes: got=%d, want=%d", info.GPUTextureBytes, want)
+	}
+
+	info, err = estimateDecodedSize(filename, Options{Quiet: true, GPU: true, GPUMipmaps: true})
+	if err != nil {
+		t.Fatalf("estimateDecodedSize failed: %v", err)
+	}
+	if want := int64(5592404); info.GPUTextureBytes != want {
+		t.Errorf("GPUTextureBytes with mipmaps: got=%d, want=%d", info.GPUTextureBytes, want)
+	}
+
+	tests := []struct {
+		width, height int
+		want          int64
+	}{
+		{1024, 1024, 1024 * 1024 * 4},
+		{1025, 1, 2048 * 1 * 4},
+		{300, 200, 512 * 256 * 4},
+		{0, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := gpuTextureBytes(tt.width, tt.height, 32, false); got != tt.want {
+			t.Errorf("gpuTextureBytes(%d, %d) = %d, want %d", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func createTIFFData(order binary.ByteOrder, width, height int, photometric uint16, bitsPerSample []uint16, extraSamples []uint16) []byte {
+	type entry struct {
+		tag, fieldType uint16
+		values         []uint16
+	}
+	entries := []entry{
+		{256, 3, []uint16{uint16(width)}},
+		{257, 3, []uint16{uint16(height)}},
+		{258, 3, bitsPerSample},
+		{259, 3, []uint16{1}},
+		{262, 3, []uint16{photometric}},
+		{277, 3, []uint16{uint16(len(bitsPerSample))}},
+	}
+	if len(extraSamples) > 0 {
+		entries = append(entries, entry{338, 3, extraSamples})
+	}
+
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	_ = binary.Write(&buf, order, uint16(42))
+	_ = binary.Write(&buf, order, uint32(8))
+
+	dataOffset := 8 + 2 + len(entries)*12 + 4
+	var data bytes.Buffer
+	_ = binary.Write(&buf, order, uint16(len(entries)))
+	for _, e := range entries {
+		_ = binary.Write(&buf, order, e.tag)
+		_ = binary.Write(&buf, order, e.fieldType)
+		_ = binary.Write(&buf, order, uint32(len(e.values)))
+		if len(e.values) <= 2 {
+			value := make([]uint16, 2)
+			copy(value, e.values)
+			_ = binary.Write(&buf, order, value)
+			continue
+		}
+		_ = binary.Write(&buf, order, uint32(dataOffset+data.Len()))
+		_ = binary.Write(&data, order, e.values)
+	}
+	_ = binary.Write(&buf, order, uint32(0))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func TestTIFFChannelCount(t *testing.T) {
+	tests := []struct {
+		name        string
+		order       binary.ByteOrder
+		photometric uint16
+		bits        []uint16
+		extra       []uint16
+		model       ColorModel
+		alpha       bool
+		bitDepth    int
+		bytesPerPx  int
+	}{
+		{"CMYK plus spot color", binary.LittleEndian, 5, []uint16{8, 8, 8, 8, 8}, []uint16{0}, ColorModelCMYK, false, 8, 5},
+		{"16-bit CMYK plus two inks", binary.BigEndian, 5, []uint16{16, 16, 16, 16, 16, 16}, []uint16{0, 0}, ColorModelCMYK, false, 16, 12},
+		{"RGB with alpha", binary.BigEndian, 2, []uint16{8, 8, 8, 8}, []uint16{2}, ColorModelRGB, true, 8, 4},
+		{"grayscale", binary.LittleEndian, 1, []uint16{8}, nil, ColorModelGrayscale, false, 8, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := createTIFFData(tt.order, 300, 200, tt.photometric, tt.bits, tt.extra)
+			info, err := analyzeReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("analyzeReader failed: %v", err)
+			}
+			if info.Format != "tiff" {
+				t.Fatalf("Format: got=%s, want=tiff", info.Format)
+			}
+			if info.Width != 300 || info.Height != 200 {
+				t.Errorf("Dimensions: got=%dx%d, want=300x200", info.Width, info.Height)
+			}
+			if info.ChannelCount != len(tt.bits) {
+				t.Errorf("ChannelCount: got=%d, want=%d", info.ChannelCount, len(tt.bits))
+			}
+			if info.ColorModel != tt.model {
+				t.Errorf("ColorModel: got=%s, want=%s", info.ColorModel, tt.model)
+			}
+			if info.HasAlpha != tt.alpha {
+				t.Errorf("HasAlpha: got=%v, want=%v", info.HasAlpha, tt.alpha)
+			}
+			if info.BitDepth != tt.bitDepth {
+				t.Errorf("BitDepth: got=%d, want=%d", info.BitDepth, tt.bitDepth)
+			}
+
+			applySizeEstimate(info, int64(len(data)), nil, sizeScope{}, "")
+			if want := int64(300 * 200 * tt.bytesPerPx); info.DecodedSize != want {
+				t.Errorf("DecodedSize: got=%d, want=%d", info.DecodedSize, want)
+			}
+		})
+	}
+
+	if _, err := analyzeReader(bytes.NewReader([]byte("II*\x00\x04\x00\x00\x00"))); err == nil {
+		t.Error("Expected an error for an invalid IFD offset")
+	}
+}
+
+func TestJSONArrayStreaming(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		var buf bytes.Buffer
+		array, err := newJSONArrayWriter(&buf, compact)
+		if err != nil {
+			t.Fatalf("newJSONArrayWriter failed: %v", err)
+		}
+
+		results := []*ImageInfo{
+			{Filename: "a.png", Format: "png", Width: 10, Height: 10, DecodedSize: 400},
+			{Filename: "b.jpg", Format: "jpeg", Width: 20, Height: 10, DecodedSize: 600},
+		}
+		if err := array.writeImage(results[0], nil); err != nil {
+			t.Fatalf("writeImage failed: %v", err)
+		}
+		if !strings.Contains(buf.String(), `"a.png"`) {
+			t.Errorf("Expected the first image to be written before the array is closed, got %q", buf.String())
+		}
+		if err := array.writeImage(results[1], []string{"filename", "decoded_size_bytes"}); err != nil {
+			t.Fatalf("writeImage failed: %v", err)
+		}
+		failure := &ProcessError{Filename: "c.png", Err: &os.PathError{Op: "open", Path: "c.png", Err: os.ErrNotExist}}
+		if err := array.writeFailure(failure, true); err != nil {
+			t.Fatalf("writeFailure failed: %v", err)
+		}
+		if err := array.close(summarizeRun(results, 1)); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+
+		var elements []map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &elements); err != nil {
+			t.Fatalf("Output is not a JSON array (compact=%v): %v\n%s", compact, err, buf.String())
+		}
+		if len(elements) != 4 {
+			t.Fatalf("Expected 4 elements, got %d", len(elements))
+		}
+		if elements[0]["filename"] != "a.png" || elements[1]["filename"] != "b.jpg" {
+			t.Errorf("Unexpected image elements: %v, %v", elements[0], elements[1])
+		}
+		if _, ok := elements[1]["width"]; ok {
+			t.Errorf("Expected -fields to limit the second element, got %v", elements[1])
+		}
+		if elements[2]["exit_code"] != float64(ExitFileNotFound) {
+			t.Errorf("Unexpected failure element: %v", elements[2])
+		}
+		summary, ok := elements[3]["summary"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("Expected a summary element last, got %v", elements[3])
+		}
+		if summary["images"] != float64(2) || summary["failures"] != float64(1) || summary["total_decoded_size_bytes"] != float64(1000) {
+			t.Errorf("Unexpected summary: %v", summary)
+		}
+	}
+
+	var buf bytes.Buffer
+	array, err := newJSONArrayWriter(&buf, true)
+	if err != nil {
+		t.Fatalf("newJSONArrayWriter failed: %v", err)
+	}
+	if err := array.close(RunSummary{}); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	var elements []interface{}
+	if err := json.Unmarshal(buf.Bytes(), &elements); err != nil || len(elements) != 1 {
+		t.Errorf("Expected an array holding only the summary, got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestRunSummaryByFormat(t *testing.T) {
+	results := []*ImageInfo{
+		{Filename: "a.png", Format: "png", OriginalSize: 100, DecodedSize: 1000, CompressionRatio: 10},
+		{Filename: "b.png", Format: "png", OriginalSize: 300, DecodedSize: 1200, CompressionRatio: 4},
+		{Filename: "c.jpg", Format: "jpeg", OriginalSize: 200, DecodedSize: 3000, CompressionRatio: 15},
+		{Filename: "d.webp", Format: "webp", OriginalSize: 50, DecodedSize: 400, CompressionRatio: 8},
+	}
+
+	summary := summarizeRun(results, 1)
+	want := map[string]FormatStats{
+		"png":  {Count: 2, OriginalSize: 400, DecodedSize: 2200, AverageRatio: 7},
+		"jpeg": {Count: 1, OriginalSize: 200, DecodedSize: 3000, AverageRatio: 15},
+		"webp": {Count: 1, OriginalSize: 50, DecodedSize: 400, AverageRatio: 8},
+	}
+	if !reflect.DeepEqual(summary.ByFormat, want) {
+		t.Errorf("ByFormat = %+v, want %+v", summary.ByFormat, want)
+	}
+	if summary.TotalDecodedSize != 5600 {
+		t.Errorf("Expected a total decoded size of 5600, got %d", summary.TotalDecodedSize)
+	}
+
+	var buf bytes.Buffer
+	printRunSummary(&buf, summary)
+	output := buf.String()
+	if !strings.Contains(output, "Images: 4, failures: 1") {
+		t.Errorf("Expected image and failure counts, got %q", output)
+	}
+	jpegLine := strings.Index(output, "  jpeg ")
+	pngLine := strings.Index(output, "  png ")
+	webpLine := strings.Index(output, "  webp ")
+	if jpegLine < 0 || pngLine < jpegLine || webpLine < pngLine {
+		t.Errorf("Expected formats listed in sorted order, got %q", output)
+	}
+	if !strings.Contains(output, "2 images") || !strings.Contains(output, "average ratio 7.0x") {
+		t.Errorf("Expected the png breakdown, got %q", output)
+	}
+
+	if empty := summarizeRun(nil, 0); empty.ByFormat != nil {
+		t.Errorf("Expected no format breakdown for an empty run, got %v", empty.ByFormat)
+	}
+
+	t.Run("JSONArray", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		img := generateRGBAImage(16, 16)
+		var pngData, jpegData bytes.Buffer
+		if err := png.Encode(&pngData, img); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		if err := jpeg.Encode(&jpegData, img, nil); err != nil {
+			t.Fatalf("Failed to encode JPEG: %v", err)
+		}
+		files := []string{filepath.Join(tmpDir, "a.png"), filepath.Join(tmpDir, "b.jpg")}
+		for i, data := range [][]byte{pngData.Bytes(), jpegData.Bytes()} {
+			if err := os.WriteFile(files[i], data, 0644); err != nil {
+				t.Fatalf("Failed to write image: %v", err)
+			}
+		}
+
+		output := captureStdout(t, func() {
+			runFiles(files, Options{JSONArray: true, CompactJSON: true})
+		})
+		var elements []map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(output), &elements); err != nil || len(elements) != 3 {
+			t.Fatalf("Expected two images and a summary, got %q (%v)", output, err)
+		}
+		var doc RunSummary
+		if err := json.Unmarshal(elements[2]["summary"], &doc); err != nil {
+			t.Fatalf("Invalid summary: %v", err)
+		}
+		if doc.ByFormat["png"].Count != 1 || doc.ByFormat["jpeg"].Count != 1 {
+			t.Errorf("Expected one png and one jpeg, got %+v", doc.ByFormat)
+		}
+		if doc.ByFormat["png"].OriginalSize != int64(pngData.Len()) || doc.ByFormat["jpeg"].DecodedSize != 16*16*3 {
+			t.Errorf("Unexpected per-format sizes: %+v", doc.ByFormat)
+		}
+	})
+}
+
+func TestRunSummaryHDR(t *testing.T) {
+	results := []*ImageInfo{
+		{Filename: "pq.avif", Format: "avif", HDRType: HDRPQ},
+		{Filename: "hlg.heic", Format: "heif", HDRType: HDRHLG},
+		{Filename: "pq2.avif", Format: "avif", HDRType: HDRPQ},
+		{Filename: "sdr.jpg", Format: "jpeg", HDRType: HDRNone},
+		{Filename: "sdr.png", Format: "png", HDRType: HDRNone},
+	}
+
+	summary := summarizeRun(results, 0)
+	if summary.HDRCount != 3 || summary.SDRCount != 2 {
+		t.Errorf("Expected 3 HDR and 2 SDR images, got %d and %d", summary.HDRCount, summary.SDRCount)
+	}
+	want := map[string]int{HDRPQ.String(): 2, HDRHLG.String(): 1, HDRNone.String(): 2}
+	if !reflect.DeepEqual(summary.ByHDRType, want) {
+		t.Errorf("ByHDRType = %v, want %v", summary.ByHDRType, want)
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, key := range []string{`"hdr_count":3`, `"sdr_count":2`, `"PQ (SMPTE ST 2084)":2`} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("Expected %s in %s", key, data)
+		}
+	}
+
+	var buf bytes.Buffer
+	printRunSummary(&buf, summary)
+	output := buf.String()
+	if !strings.Contains(output, "HDR: 3, SDR: 2") {
+		t.Errorf("Expected HDR/SDR counts, got %q", output)
+	}
+	for _, hdrType := range []string{"HLG (ARIB STD-B67)", "None", "PQ (SMPTE ST 2084)"} {
+		if !strings.Contains(output, "  "+hdrType+" ") {
+			t.Errorf("Expected a line for %s, got %q", hdrType, output)
+		}
+	}
+}
+
+func TestSampleFiles(t *testing.T) {
+	files := make([]string, 100)
+	for i := range files {
+		files[i] = fmt.Sprintf("image%03d.png", i)
+	}
+
+	first := sampleFiles(files, 10, 42)
+	second := sampleFiles(files, 10, 42)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same sample for the same seed, got %v and %v", first, second)
+	}
+	if len(first) != 10 {
+		t.Fatalf("Expected 10 sampled files, got %d", len(first))
+	}
+	if !sort.StringsAreSorted(first) {
+		t.Errorf("Expected the sample to keep the input order, got %v", first)
+	}
+	seen := make(map[string]bool)
+	for _, name := range first {
+		if seen[name] {
+			t.Errorf("File %s sampled twice", name)
+		}
+		seen[name] = true
+	}
+	if reflect.DeepEqual(first, sampleFiles(files, 10, 43)) {
+		t.Errorf("Expected a different sample for a different seed")
+	}
+
+	if got := sampleFiles(files, 200, 42); len(got) != len(files) {
+		t.Errorf("Expected all files when N exceeds the file count, got %d", len(got))
+	}
+
+	results := []*ImageInfo{
+		{OriginalSize: 100, DecodedSize: 1000},
+		{OriginalSize: 300, DecodedSize: 3000},
+	}
+	summary := summarizeSample(results, 2, 2, 10, 42)
+	if summary.SampledDecodedSize != 4000 || summary.ExtrapolatedDecodedSize != 20000 {
+		t.Errorf("Decoded size: sampled=%d extrapolated=%d, want 4000 and 20000", summary.SampledDecodedSize, summary.ExtrapolatedDecodedSize)
+	}
+	if summary.SampledOriginalSize != 400 || summary.ExtrapolatedOriginalSize != 2000 {
+		t.Errorf("Original size: sampled=%d extrapolated=%d, want 400 and 2000", summary.SampledOriginalSize, summary.ExtrapolatedOriginalSize)
+	}
+	if summary.Seed != 42 || summary.SampledFiles != 2 || summary.TotalFiles != 10 || summary.FailedFiles != 0 {
+		t.Errorf("Unexpected sample bookkeeping: %+v", summary)
+	}
+
+	t.Run("FailedSamples", func(t *testing.T) {
+		summary := summarizeSample(results, 4, 2, 10, 42)
+		if summary.FailedFiles != 2 || summary.AnalyzedFiles != 2 {
+			t.Errorf("Expected 2 failed and 2 analyzed samples, got %+v", summary)
+		}
+		if summary.ExtrapolatedDecodedSize != 20000 || summary.ExtrapolatedOriginalSize != 2000 {
+			t.Errorf("Failed samples should not bias the extrapolation: decoded=%d original=%d, want 20000 and 2000",
+				summary.ExtrapolatedDecodedSize, summary.ExtrapolatedOriginalSize)
+		}
+
+		var buf bytes.Buffer
+		printSampleSummary(&buf, summary)
+		if !strings.Contains(buf.String(), "Failed samples: 2") {
+			t.Errorf("Expected failed samples in the summary, got %q", buf.String())
+		}
+	})
+
+	t.Run("AllFailed", func(t *testing.T) {
+		summary := summarizeSample(nil, 3, 0, 10, 42)
+		if summary.FailedFiles != 3 || summary.ExtrapolatedDecodedSize != 0 {
+			t.Errorf("Unexpected summary when every sample failed: %+v", summary)
+		}
+	})
+}